@@ -39,6 +39,34 @@ spec:
               value: {{ .Values.config.redis.username | quote }}
             - name: REDIS_DB
               value: {{ .Values.config.redis.db | quote }}
+            - name: REDIS_MODE
+              value: {{ .Values.config.redis.mode | quote }}
+            {{- if .Values.config.redis.addrs }}
+            - name: REDIS_ADDRS
+              value: {{ join "," .Values.config.redis.addrs | quote }}
+            {{- end }}
+            {{- if .Values.config.redis.sentinelMaster }}
+            - name: REDIS_SENTINEL_MASTER
+              value: {{ .Values.config.redis.sentinelMaster | quote }}
+            {{- end }}
+            - name: STREAM_GLOBAL_SHARDS
+              value: {{ .Values.config.streams.globalShards | quote }}
+            - name: SSE_HEARTBEAT_INTERVAL
+              value: {{ .Values.beacon.sseHeartbeatInterval | quote }}
+            - name: WS_PING_INTERVAL
+              value: {{ .Values.beacon.ws.pingInterval | quote }}
+            - name: WS_WRITE_TIMEOUT
+              value: {{ .Values.beacon.ws.writeTimeout | quote }}
+            - name: WS_SEND_QUEUE
+              value: {{ .Values.beacon.ws.sendQueue | quote }}
+            - name: WS_MAX_UNACKED
+              value: {{ .Values.beacon.ws.maxUnacked | quote }}
+            - name: WS_MAX_SUBSCRIPTIONS
+              value: {{ .Values.beacon.ws.maxSubscriptions | quote }}
+            {{- if .Values.beacon.ws.originPatterns }}
+            - name: WS_ORIGIN_PATTERNS
+              value: {{ join "," .Values.beacon.ws.originPatterns | quote }}
+            {{- end }}
             - name: PG_CONN
               valueFrom:
                 secretKeyRef:
@@ -39,8 +39,31 @@ spec:
               value: {{ .Values.config.redis.username | quote }}
             - name: REDIS_DB
               value: {{ .Values.config.redis.db | quote }}
+            - name: REDIS_MODE
+              value: {{ .Values.config.redis.mode | quote }}
+            {{- if .Values.config.redis.addrs }}
+            - name: REDIS_ADDRS
+              value: {{ join "," .Values.config.redis.addrs | quote }}
+            {{- end }}
+            {{- if .Values.config.redis.sentinelMaster }}
+            - name: REDIS_SENTINEL_MASTER
+              value: {{ .Values.config.redis.sentinelMaster | quote }}
+            {{- end }}
+            - name: STREAM_GLOBAL_SHARDS
+              value: {{ .Values.config.streams.globalShards | quote }}
             - name: STREAM_TRIM_MAXLEN
               value: {{ .Values.config.streams.trimMaxLen | quote }}
+            - name: DEDUPE_TTL
+              value: {{ .Values.config.streams.dedupeTTL | quote }}
+            - name: DEDUPE_WINDOW
+              value: {{ .Values.config.streams.dedupeWindow | quote }}
+            - name: STREAM_ENTRY_FORMAT
+              value: {{ .Values.config.streams.entryFormat | quote }}
+            - name: PG_CONN
+              valueFrom:
+                secretKeyRef:
+                  name: {{ include "eventide.secretsName" . }}
+                  key: PG_CONN
             - name: REDIS_PASSWORD
               valueFrom:
                 secretKeyRef:
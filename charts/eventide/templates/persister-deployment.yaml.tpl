@@ -33,6 +33,18 @@ spec:
               value: {{ .Values.config.redis.username | quote }}
             - name: REDIS_DB
               value: {{ .Values.config.redis.db | quote }}
+            - name: REDIS_MODE
+              value: {{ .Values.config.redis.mode | quote }}
+            {{- if .Values.config.redis.addrs }}
+            - name: REDIS_ADDRS
+              value: {{ join "," .Values.config.redis.addrs | quote }}
+            {{- end }}
+            {{- if .Values.config.redis.sentinelMaster }}
+            - name: REDIS_SENTINEL_MASTER
+              value: {{ .Values.config.redis.sentinelMaster | quote }}
+            {{- end }}
+            - name: STREAM_GLOBAL_SHARDS
+              value: {{ .Values.config.streams.globalShards | quote }}
             - name: REDIS_PASSWORD
               valueFrom:
                 secretKeyRef:
@@ -57,6 +69,24 @@ spec:
               value: {{ .Values.persister.dlqStream | quote }}
             - name: PERSISTER_MAX_RETRIES
               value: {{ .Values.persister.maxRetries | quote }}
+            - name: PERSISTER_BATCH_SIZE
+              value: {{ .Values.persister.batchSize | quote }}
+            - name: PERSISTER_BATCH_MAX_LATENCY
+              value: {{ .Values.persister.batchMaxLatency | quote }}
+            - name: PERSISTER_TRIM_INTERVAL
+              value: {{ .Values.persister.trimInterval | quote }}
+            - name: PERSISTER_TRIM_MARGIN
+              value: {{ .Values.persister.trimMargin | quote }}
+            - name: PERSISTER_RECONCILE_INTERVAL
+              value: {{ .Values.persister.reconcileInterval | quote }}
+            - name: PERSISTER_RECONCILE_AGE
+              value: {{ .Values.persister.reconcileAge | quote }}
+            {{- if .Values.persister.shards }}
+            - name: PERSISTER_SHARDS
+              value: {{ .Values.persister.shards | quote }}
+            {{- end }}
+            - name: PERSISTER_LEASE_TTL
+              value: {{ .Values.persister.leaseTTL | quote }}
           resources:
             {{- toYaml .Values.persister.resources | nindent 12 }}
 {{- end }}
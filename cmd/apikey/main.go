@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	_ "github.com/joho/godotenv/autoload"
+	"github.com/warjiang/eventide/internal/auth"
+	"github.com/warjiang/eventide/internal/config"
+	"github.com/warjiang/eventide/internal/logx"
+	"github.com/warjiang/eventide/internal/pgstore"
+)
+
+const usage = `usage:
+  apikey create -tenant <tenant_id> [-name <name>]
+  apikey revoke <key_id>
+  apikey list [-tenant <tenant_id>]
+
+Running gateways and beacons cache keys; a revoked key is refused within
+about 5 seconds.`
+
+func main() {
+	logx.Setup()
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	cfg, err := config.FromEnv()
+	if err != nil {
+		log.Fatalf("config: %v", err)
+	}
+
+	ctx := context.Background()
+	store, err := pgstore.New(ctx, cfg.Postgres.ConnString)
+	if err != nil {
+		log.Fatalf("pg: %v", err)
+	}
+	defer store.Close()
+
+	cmd, args := os.Args[1], os.Args[2:]
+	switch cmd {
+	case "create":
+		fs := flag.NewFlagSet("create", flag.ExitOnError)
+		tenant := fs.String("tenant", "", "tenant the key belongs to")
+		name := fs.String("name", "", "human-readable label")
+		_ = fs.Parse(args)
+		if *tenant == "" {
+			log.Fatalf("-tenant is required")
+		}
+		keyID, key, hash, err := auth.NewAPIKey()
+		if err != nil {
+			log.Fatalf("generate: %v", err)
+		}
+		if err := store.InsertAPIKey(ctx, keyID, *tenant, *name, hash); err != nil {
+			log.Fatalf("insert: %v", err)
+		}
+		fmt.Printf("key_id: %s\ntenant: %s\napi_key: %s\n", keyID, *tenant, key)
+		fmt.Fprintln(os.Stderr, "store the api_key now; it cannot be shown again")
+	case "revoke":
+		if len(args) != 1 {
+			fmt.Fprintln(os.Stderr, usage)
+			os.Exit(2)
+		}
+		ok, err := store.RevokeAPIKey(ctx, args[0])
+		if err != nil {
+			log.Fatalf("revoke: %v", err)
+		}
+		if !ok {
+			log.Fatalf("key %s not found or already revoked", args[0])
+		}
+		fmt.Printf("revoked %s\n", args[0])
+		fmt.Fprintln(os.Stderr, "running services may accept the key for a few more seconds")
+	case "list":
+		fs := flag.NewFlagSet("list", flag.ExitOnError)
+		tenant := fs.String("tenant", "", "only list keys of this tenant")
+		_ = fs.Parse(args)
+		keys, err := store.ListAPIKeys(ctx, *tenant)
+		if err != nil {
+			log.Fatalf("list: %v", err)
+		}
+		for _, k := range keys {
+			status := "active"
+			if k.RevokedAt != nil {
+				status = "revoked " + k.RevokedAt.UTC().Format(time.RFC3339)
+			}
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\n", k.KeyID, k.TenantID, k.Name, k.CreatedAt.UTC().Format(time.RFC3339), status)
+		}
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
@@ -17,6 +17,7 @@ import (
 	"github.com/warjiang/eventide/internal/config"
 	"github.com/warjiang/eventide/internal/id"
 	"github.com/warjiang/eventide/internal/logx"
+	"github.com/warjiang/eventide/internal/metrics"
 	"github.com/warjiang/eventide/internal/pgstore"
 	"github.com/warjiang/eventide/internal/s3store"
 )
@@ -38,6 +39,9 @@ func main() {
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
+	// log.Fatalf skips deferred calls, so only successful runs are reported.
+	defer reportMetrics()
+
 	store, err := pgstore.New(ctx, cfg.Postgres.ConnString)
 	if err != nil {
 		log.Fatalf("pg: %v", err)
@@ -121,6 +125,8 @@ func main() {
 		log.Fatalf("insert archive: %v", err)
 	}
 
+	metrics.ArchivedEvents.Add(float64(len(result.Events)))
+	metrics.ArchivedBytes.Add(float64(len(buf)))
 	log.Printf("archived %d events (seq %d~%d) to s3://%s/%s", len(result.Events), result.MinSeq, result.MaxSeq, cfg.S3.Bucket, objectKey)
 }
 
@@ -143,6 +149,13 @@ func encodeJSONLGzip(events []json.RawMessage) ([]byte, error) {
 	return b.Bytes(), nil
 }
 
+func getenvDefault(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
 func getenvInt64Default(key string, def int64) int64 {
 	v := strings.TrimSpace(os.Getenv(key))
 	if v == "" {
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/warjiang/eventide/internal/metrics"
+)
+
+// reportMetrics publishes the metrics of a successful run. The archiver exits
+// when done, so instead of being scraped it pushes to a Pushgateway
+// (METRICS_PUSHGATEWAY_URL) and/or writes a node_exporter textfile
+// (METRICS_TEXTFILE).
+func reportMetrics() {
+	metrics.ArchiveLastSuccess.Set(float64(time.Now().Unix()))
+	if url := os.Getenv("METRICS_PUSHGATEWAY_URL"); url != "" {
+		job := getenvDefault("METRICS_PUSHGATEWAY_JOB", "eventide_archiver")
+		if err := push.New(url, job).Gatherer(prometheus.DefaultGatherer).Push(); err != nil {
+			log.Printf("metrics push: %v", err)
+		}
+	}
+	if path := os.Getenv("METRICS_TEXTFILE"); path != "" {
+		if err := prometheus.WriteToTextfile(path, prometheus.DefaultGatherer); err != nil {
+			log.Printf("metrics textfile: %v", err)
+		}
+	}
+}
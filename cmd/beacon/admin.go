@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/warjiang/eventide/internal/dlq"
+	"github.com/warjiang/eventide/internal/redisstreams"
+)
+
+// defaultHealthScanLimit bounds how many unacknowledged entries the pipeline
+// report reads per global stream shard to find the oldest unpersisted event
+// per thread.
+const defaultHealthScanLimit = 1000
+
+type pipelineResponse struct {
+	CheckedAt time.Time       `json:"checked_at"`
+	Streams   []streamHealth  `json:"streams"`
+	DLQ       dlqHealth       `json:"dlq"`
+	Group     string          `json:"persister_group"`
+	Threads   []threadBacklog `json:"threads"`
+	Truncated bool            `json:"threads_truncated,omitempty"`
+}
+
+type streamHealth struct {
+	Name   string        `json:"name"`
+	Length int64         `json:"length"`
+	Groups []groupHealth `json:"groups"`
+}
+
+type groupHealth struct {
+	Name            string           `json:"name"`
+	Pending         int64            `json:"pending"`
+	LastDeliveredID string           `json:"last_delivered_id"`
+	LagEvents       *int64           `json:"lag_events"`
+	LagSeconds      float64          `json:"lag_seconds"`
+	OldestPendingID string           `json:"oldest_pending_id,omitempty"`
+	Consumers       []consumerHealth `json:"consumers"`
+}
+
+type consumerHealth struct {
+	Name            string  `json:"name"`
+	Pending         int64   `json:"pending"`
+	IdleSeconds     float64 `json:"idle_seconds"`
+	InactiveSeconds float64 `json:"inactive_seconds"`
+}
+
+type dlqHealth struct {
+	Name   string `json:"name"`
+	Length int64  `json:"length"`
+}
+
+type threadBacklog struct {
+	ThreadID   string  `json:"thread_id"`
+	TenantID   string  `json:"tenant_id,omitempty"`
+	OldestID   string  `json:"oldest_stream_id"`
+	AgeSeconds float64 `json:"age_seconds"`
+	Events     int64   `json:"events"`
+}
+
+// pipelineHealth reports how far the persister is behind the global stream
+// shards.
+type pipelineHealth struct {
+	rdb       *redisstreams.Client
+	dlqStream string
+	group     string
+}
+
+func newPipelineHealth(rdb *redisstreams.Client) *pipelineHealth {
+	return &pipelineHealth{
+		rdb:       rdb,
+		dlqStream: getenvDefault("PERSISTER_DLQ_STREAM", redisstreams.DLQStreamKey()),
+		group:     getenvDefault("PERSISTER_GROUP", "persist"),
+	}
+}
+
+// mountAdmin registers the operator routes on r. The caller applies the
+// admin middleware.
+func mountAdmin(r chi.Router, health *pipelineHealth, dead *dlq.Queue) {
+	r.Get("/admin/pipeline", health.handle)
+	mountDLQ(r, dead)
+}
+
+func (h *pipelineHealth) handle(w http.ResponseWriter, req *http.Request) {
+	group := h.group
+	if v := req.URL.Query().Get("group"); v != "" {
+		group = v
+	}
+	limit := defaultHealthScanLimit
+	if v := req.URL.Query().Get("limit"); v != "" {
+		parsed, err := strconv.Atoi(v)
+		if err != nil || parsed <= 0 || parsed > 10000 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+	resp, err := h.report(req.Context(), group, int64(limit))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (h *pipelineHealth) report(ctx context.Context, group string, limit int64) (pipelineResponse, error) {
+	now := time.Now().UTC()
+	resp := pipelineResponse{
+		CheckedAt: now,
+		Streams:   []streamHealth{},
+		DLQ:       dlqHealth{Name: h.dlqStream},
+		Group:     group,
+		Threads:   []threadBacklog{},
+	}
+	var err error
+	if resp.DLQ.Length, err = h.rdb.XLen(ctx, h.dlqStream); err != nil {
+		return resp, err
+	}
+	streams := h.rdb.GlobalStreams()
+	if h.rdb.Sharded() {
+		streams = append(streams, redisstreams.GlobalStreamKey())
+	}
+	for _, stream := range streams {
+		sh := streamHealth{Name: stream, Groups: []groupHealth{}}
+		if sh.Length, err = h.rdb.XLen(ctx, stream); err != nil {
+			return resp, err
+		}
+		if sh.Length == 0 && stream == redisstreams.GlobalStreamKey() && h.rdb.Sharded() {
+			continue // drained since sharding was enabled
+		}
+		groups, err := h.rdb.XInfoGroups(ctx, stream)
+		if err != nil {
+			return resp, err
+		}
+		for _, g := range groups {
+			gh, err := h.groupHealth(ctx, stream, g, now)
+			if err != nil {
+				return resp, err
+			}
+			sh.Groups = append(sh.Groups, gh)
+			if g.Name == group {
+				threads, truncated, err := h.threadBacklog(ctx, stream, g, now, limit)
+				if err != nil {
+					return resp, err
+				}
+				resp.Threads = append(resp.Threads, threads...)
+				resp.Truncated = resp.Truncated || truncated
+			}
+		}
+		resp.Streams = append(resp.Streams, sh)
+	}
+	// A thread lives on a single shard, so merging only needs reordering.
+	sort.SliceStable(resp.Threads, func(i, j int) bool {
+		return resp.Threads[i].AgeSeconds > resp.Threads[j].AgeSeconds
+	})
+	return resp, nil
+}
+
+// groupHealth estimates the lag of a group in seconds from the ID of the
+// oldest entry it has not acknowledged, whether pending or not yet delivered.
+func (h *pipelineHealth) groupHealth(ctx context.Context, stream string, g redisstreams.GroupInfo, now time.Time) (groupHealth, error) {
+	gh := groupHealth{
+		Name:            g.Name,
+		Pending:         g.Pending,
+		LastDeliveredID: g.LastDeliveredID,
+		Consumers:       []consumerHealth{},
+	}
+	if g.Lag >= 0 {
+		lag := g.Lag
+		gh.LagEvents = &lag
+	}
+	consumers, err := h.rdb.XInfoConsumers(ctx, stream, g.Name)
+	if err != nil {
+		return gh, err
+	}
+	for _, c := range consumers {
+		gh.Consumers = append(gh.Consumers, consumerHealth{
+			Name:            c.Name,
+			Pending:         c.Pending,
+			IdleSeconds:     c.Idle.Seconds(),
+			InactiveSeconds: c.Inactive.Seconds(),
+		})
+	}
+	oldest := ""
+	pending, err := h.rdb.XPendingExt(ctx, stream, g.Name, "-", "+", 1)
+	if err != nil {
+		return gh, err
+	}
+	if len(pending) > 0 {
+		gh.OldestPendingID = pending[0].ID
+		oldest = pending[0].ID
+	}
+	next, err := h.rdb.XRange(ctx, stream, "("+g.LastDeliveredID, "+", 1)
+	if err != nil {
+		return gh, err
+	}
+	if len(next) > 0 && (oldest == "" || redisstreams.CompareStreamIDs(next[0].ID, oldest) < 0) {
+		oldest = next[0].ID
+	}
+	if ts, ok := redisstreams.StreamIDTime(oldest); ok {
+		gh.LagSeconds = now.Sub(ts).Seconds()
+	}
+	return gh, nil
+}
+
+// threadBacklog groups the entries group has not acknowledged by thread,
+// oldest first. It reads at most limit pending IDs and limit entries, and
+// reports truncated when either bound was reached.
+func (h *pipelineHealth) threadBacklog(ctx context.Context, stream string, g redisstreams.GroupInfo, now time.Time, limit int64) ([]threadBacklog, bool, error) {
+	pending, err := h.rdb.XPendingExt(ctx, stream, g.Name, "-", "+", limit)
+	if err != nil {
+		return nil, false, err
+	}
+	truncated := int64(len(pending)) == limit
+	unacked := make(map[string]struct{}, len(pending))
+	start := "(" + g.LastDeliveredID
+	for i, p := range pending {
+		unacked[p.ID] = struct{}{}
+		if i == 0 {
+			start = p.ID
+		}
+	}
+	entries, err := h.rdb.XRange(ctx, stream, start, "+", limit)
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(entries)) == limit {
+		truncated = true
+	}
+
+	byThread := make(map[string]*threadBacklog)
+	var order []string
+	for _, m := range entries {
+		if _, ok := unacked[m.ID]; !ok && redisstreams.CompareStreamIDs(m.ID, g.LastDeliveredID) <= 0 {
+			continue // delivered and already acknowledged
+		}
+		threadID, _ := m.Values["thread_id"].(string)
+		if threadID == "" {
+			continue
+		}
+		tb, ok := byThread[threadID]
+		if !ok {
+			tenantID, _ := m.Values["tenant_id"].(string)
+			tb = &threadBacklog{ThreadID: threadID, TenantID: tenantID, OldestID: m.ID}
+			if ts, ok := redisstreams.StreamIDTime(m.ID); ok {
+				tb.AgeSeconds = now.Sub(ts).Seconds()
+			}
+			byThread[threadID] = tb
+			order = append(order, threadID)
+		}
+		tb.Events++
+	}
+	out := make([]threadBacklog, 0, len(order))
+	for _, threadID := range order {
+		out = append(out, *byThread[threadID])
+	}
+	return out, truncated, nil
+}
+
+func getenvDefault(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func getenvDurationDefault(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return def
+	}
+	return d
+}
+
+func getenvIntDefault(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return def
+	}
+	return n
+}
+
+// getenvList splits a comma-separated variable, dropping empty items.
+func getenvList(key string) []string {
+	var out []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/warjiang/eventide/internal/auth"
+	"github.com/warjiang/eventide/internal/pgstore"
+	"github.com/warjiang/eventide/sdk/go/eventide"
+)
+
+// defaultStreamTokenTTL is used when the caller does not ask for a TTL.
+const defaultStreamTokenTTL = 60 * time.Second
+
+type streamTokenRequest struct {
+	ThreadID   string `json:"thread_id"`
+	TTLSeconds int    `json:"ttl_seconds,omitempty"`
+}
+
+type streamTokenResponse struct {
+	Token     string    `json:"token"`
+	ThreadID  string    `json:"thread_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// authorizeThread writes 404 and returns false when the caller may not read
+// threadID. Threads owned by another tenant are reported as missing so that
+// thread IDs cannot be probed across tenants. Threads not yet persisted pass;
+// the SSE route filters their stream entries by tenant instead.
+func authorizeThread(w http.ResponseWriter, req *http.Request, store *pgstore.Store, threadID string) bool {
+	ok, err := canAccessThread(req.Context(), store, auth.FromContext(req.Context()), threadID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// canAccessThread is authorizeThread for callers without an HTTP response
+// to write to, such as WebSocket subscriptions.
+func canAccessThread(ctx context.Context, store *pgstore.Store, p auth.Principal, threadID string) (bool, error) {
+	if !p.CanAccessThread(threadID) {
+		return false, nil
+	}
+	if p.Method == auth.MethodAnonymous {
+		return true, nil
+	}
+	th, ok, err := store.GetThread(ctx, threadID)
+	if err != nil {
+		return false, err
+	}
+	return !ok || p.CanAccessTenant(th.TenantID), nil
+}
+
+// streamTenant returns the tenant of a stream entry holding e. Entries
+// written before authentication existed carry no tenant and belong to
+// defaultTenant.
+func streamTenant(values map[string]any, e eventide.Event, defaultTenant string) string {
+	if tenantID, _ := values["tenant_id"].(string); tenantID != "" {
+		return tenantID
+	}
+	if e.TenantID != "" {
+		return e.TenantID
+	}
+	return defaultTenant
+}
+
+func handleStreamToken(authn *auth.Authenticator, store *pgstore.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		tokens := authn.StreamTokens()
+		if tokens == nil {
+			http.Error(w, "stream tokens not configured", http.StatusNotImplemented)
+			return
+		}
+		var in streamTokenRequest
+		dec := json.NewDecoder(req.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&in); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		in.ThreadID = strings.TrimSpace(in.ThreadID)
+		if in.ThreadID == "" {
+			http.Error(w, "thread_id is required", http.StatusBadRequest)
+			return
+		}
+		ttl := defaultStreamTokenTTL
+		if in.TTLSeconds != 0 {
+			ttl = time.Duration(in.TTLSeconds) * time.Second
+			if ttl < 0 || ttl > auth.MaxStreamTokenTTL {
+				http.Error(w, "invalid ttl_seconds", http.StatusBadRequest)
+				return
+			}
+		}
+		if !authorizeThread(w, req, store, in.ThreadID) {
+			return
+		}
+		token, exp, err := tokens.Issue(auth.FromContext(req.Context()), in.ThreadID, ttl)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		_ = json.NewEncoder(w).Encode(streamTokenResponse{Token: token, ThreadID: in.ThreadID, ExpiresAt: exp})
+	}
+}
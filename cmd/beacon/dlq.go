@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/warjiang/eventide/internal/dlq"
+	"github.com/warjiang/eventide/sdk/go/eventide"
+)
+
+type dlqListResponse struct {
+	Stream  string      `json:"stream"`
+	Length  int64       `json:"length"`
+	Entries []dlq.Entry `json:"entries"`
+}
+
+type dlqReplayRequest struct {
+	IDs []string `json:"ids,omitempty"`
+	All bool     `json:"all,omitempty"`
+}
+
+type dlqReplayEditRequest struct {
+	Event *eventide.Event `json:"event,omitempty"`
+}
+
+type dlqReplayed struct {
+	ID       string `json:"id"`
+	StreamID string `json:"stream_id"`
+}
+
+type dlqReplayResponse struct {
+	Replayed []dlqReplayed `json:"replayed,omitempty"`
+	Count    int           `json:"count"`
+	Missing  []string      `json:"missing,omitempty"`
+}
+
+type dlqSkipRequest struct {
+	IDs []string `json:"ids"`
+}
+
+type dlqPurgeRequest struct {
+	Before *time.Time `json:"before,omitempty"`
+}
+
+type dlqCountResponse struct {
+	Count int64 `json:"count"`
+}
+
+// mountDLQ registers the dead-letter routes of the admin API.
+func mountDLQ(r chi.Router, dead *dlq.Queue) {
+	r.Get("/admin/dlq", func(w http.ResponseWriter, req *http.Request) {
+		limit := 100
+		if v := req.URL.Query().Get("limit"); v != "" {
+			parsed, err := strconv.Atoi(v)
+			if err != nil || parsed <= 0 || parsed > 1000 {
+				http.Error(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+			limit = parsed
+		}
+		entries, err := dead.List(req.Context(), req.URL.Query().Get("after"), int64(limit))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		n, err := dead.Len(req.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, dlqListResponse{Stream: dead.Stream(), Length: n, Entries: entries})
+	})
+
+	r.Get("/admin/dlq/{id}", func(w http.ResponseWriter, req *http.Request) {
+		entry, err := dead.Get(req.Context(), chi.URLParam(req, "id"))
+		if err != nil {
+			writeDLQError(w, err)
+			return
+		}
+		writeJSON(w, entry)
+	})
+
+	// Replays the listed entries, or all of them, into the global stream.
+	r.Post("/admin/dlq:replay", func(w http.ResponseWriter, req *http.Request) {
+		var in dlqReplayRequest
+		if !decodeJSON(w, req, &in) {
+			return
+		}
+		if in.All == (len(in.IDs) > 0) {
+			http.Error(w, "set either ids or all", http.StatusBadRequest)
+			return
+		}
+		if in.All {
+			n, err := dead.ReplayAll(req.Context())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, dlqReplayResponse{Count: n})
+			return
+		}
+		var resp dlqReplayResponse
+		for _, id := range in.IDs {
+			streamID, err := dead.Replay(req.Context(), id)
+			if errors.Is(err, dlq.ErrNotFound) {
+				resp.Missing = append(resp.Missing, id)
+				continue
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			resp.Replayed = append(resp.Replayed, dlqReplayed{ID: id, StreamID: streamID})
+		}
+		resp.Count = len(resp.Replayed)
+		writeJSON(w, resp)
+	})
+
+	// Replays one entry, optionally with a corrected event.
+	r.Post("/admin/dlq/{id}:replay", func(w http.ResponseWriter, req *http.Request) {
+		id := chi.URLParam(req, "id")
+		var in dlqReplayEditRequest
+		if req.ContentLength != 0 && !decodeJSON(w, req, &in) {
+			return
+		}
+		var (
+			streamID string
+			err      error
+		)
+		if in.Event != nil {
+			streamID, err = dead.ReplayEdited(req.Context(), id, *in.Event)
+		} else {
+			streamID, err = dead.Replay(req.Context(), id)
+		}
+		if err != nil {
+			writeDLQError(w, err)
+			return
+		}
+		writeJSON(w, dlqReplayResponse{Replayed: []dlqReplayed{{ID: id, StreamID: streamID}}, Count: 1})
+	})
+
+	r.Delete("/admin/dlq/{id}", func(w http.ResponseWriter, req *http.Request) {
+		n, err := dead.Skip(req.Context(), chi.URLParam(req, "id"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n == 0 {
+			http.Error(w, dlq.ErrNotFound.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	r.Post("/admin/dlq:skip", func(w http.ResponseWriter, req *http.Request) {
+		var in dlqSkipRequest
+		if !decodeJSON(w, req, &in) {
+			return
+		}
+		n, err := dead.Skip(req.Context(), in.IDs...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, dlqCountResponse{Count: n})
+	})
+
+	r.Post("/admin/dlq:purge", func(w http.ResponseWriter, req *http.Request) {
+		var in dlqPurgeRequest
+		if req.ContentLength != 0 && !decodeJSON(w, req, &in) {
+			return
+		}
+		var before time.Time
+		if in.Before != nil {
+			before = *in.Before
+		}
+		n, err := dead.Purge(req.Context(), before)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, dlqCountResponse{Count: n})
+	})
+}
+
+func writeDLQError(w http.ResponseWriter, err error) {
+	if errors.Is(err, dlq.ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	var invalid *dlq.InvalidEventError
+	if errors.As(err, &invalid) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+func decodeJSON(w http.ResponseWriter, req *http.Request, v any) bool {
+	dec := json.NewDecoder(req.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
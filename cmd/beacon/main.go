@@ -1,11 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"os"
 	"os/signal"
 	"strconv"
 	"strings"
@@ -14,9 +17,13 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	_ "github.com/joho/godotenv/autoload"
+	"github.com/warjiang/eventide/internal/auth"
 	"github.com/warjiang/eventide/internal/config"
+	"github.com/warjiang/eventide/internal/dlq"
+	"github.com/warjiang/eventide/internal/eventfilter"
 	"github.com/warjiang/eventide/internal/httpx"
 	"github.com/warjiang/eventide/internal/logx"
+	"github.com/warjiang/eventide/internal/metrics"
 	"github.com/warjiang/eventide/internal/pgstore"
 	"github.com/warjiang/eventide/internal/redisstreams"
 	"github.com/warjiang/eventide/internal/s3store"
@@ -31,10 +38,14 @@ type threadResponse struct {
 	Status             string `json:"status"`
 	IdleTimeoutSeconds int    `json:"idle_timeout_seconds"`
 	LastSeq            int64  `json:"last_seq"`
+	ConflictCount      int64  `json:"conflict_count"`
 }
 
 type eventsResponse struct {
 	Events []json.RawMessage `json:"events"`
+	// NextFromSeq is set when a filtered read stopped before the end of the
+	// thread; reading on from it continues where this response ended.
+	NextFromSeq int64 `json:"next_from_seq,omitempty"`
 }
 
 type archiveResponse struct {
@@ -52,6 +63,22 @@ type archivesResponse struct {
 	Archives []archiveResponse `json:"archives"`
 }
 
+type conflictResponse struct {
+	ConflictID      int64           `json:"conflict_id"`
+	ThreadID        string          `json:"thread_id"`
+	Seq             int64           `json:"seq"`
+	Reason          string          `json:"reason"`
+	ExistingEventID string          `json:"existing_event_id,omitempty"`
+	EventID         string          `json:"event_id"`
+	Event           json.RawMessage `json:"event"`
+	DetectedAt      time.Time       `json:"detected_at"`
+}
+
+type conflictsResponse struct {
+	Count     int64              `json:"count"`
+	Conflicts []conflictResponse `json:"conflicts"`
+}
+
 func main() {
 	logx.Setup()
 	cfg, err := config.FromEnv()
@@ -75,24 +102,59 @@ func main() {
 	}
 
 	// ── Redis (for SSE streaming) ───────────────────────────────────────
-	rdb := redisstreams.New(cfg.Redis.Addr, cfg.Redis.Username, cfg.Redis.Password, cfg.Redis.DB)
+	rdb := redisstreams.New(cfg.Redis)
+	rdb.SetGlobalShards(cfg.Streams.GlobalShards)
 	defer func() { _ = rdb.Close() }()
 	if err := rdb.Ping(ctx); err != nil {
 		log.Fatalf("redis ping: %v", err)
 	}
 
+	// ── S3 (archives and offloaded payloads) ────────────────────────────
+	s3c, err := s3store.New(ctx, s3store.Config{
+		Endpoint:        cfg.S3.Endpoint,
+		Region:          cfg.S3.Region,
+		Bucket:          cfg.S3.Bucket,
+		AccessKeyID:     cfg.S3.AccessKeyID,
+		SecretAccessKey: cfg.S3.SecretAccessKey,
+		Prefix:          cfg.S3.Prefix,
+		UsePathStyle:    cfg.S3.UsePathStyle,
+	})
+	if err != nil {
+		log.Printf("s3 disabled: %v", err)
+		s3c = nil
+	}
+	payloads := &payloadResolver{s3: s3c}
+	tails := &tailer{rdb: rdb, replay: &replayer{store: store, s3: s3c}, defaultTenant: cfg.Auth.DefaultTenant}
+	heartbeatEvery := getenvDurationDefault("SSE_HEARTBEAT_INTERVAL", 15*time.Second)
+	if heartbeatEvery <= 0 {
+		heartbeatEvery = 15 * time.Second
+	}
+
+	authn, err := auth.New(cfg.Auth, store)
+	if err != nil {
+		log.Fatalf("auth: %v", err)
+	}
+
 	// ── Router ──────────────────────────────────────────────────────────
 	r := chi.NewRouter()
+	r.Use(metrics.Middleware("beacon"))
+	api := r.With(authn.Middleware)
+	// Only the streaming routes accept stream tokens.
+	streams := r.With(authn.StreamMiddleware)
 
 	r.Get("/healthz", func(w http.ResponseWriter, _ *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("ok"))
 	})
+	r.Handle("/metrics", metrics.Handler())
 
 	// ── REST: read-api routes ───────────────────────────────────────────
 
-	r.Get("/threads/{threadID}", func(w http.ResponseWriter, req *http.Request) {
+	api.Get("/threads/{threadID}", func(w http.ResponseWriter, req *http.Request) {
 		threadID := chi.URLParam(req, "threadID")
+		if !authorizeThread(w, req, store, threadID) {
+			return
+		}
 		th, ok, err := store.GetThread(req.Context(), threadID)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -102,6 +164,11 @@ func main() {
 			http.Error(w, "not found", http.StatusNotFound)
 			return
 		}
+		conflicts, err := store.CountConflicts(req.Context(), threadID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 		w.Header().Set("content-type", "application/json")
 		_ = json.NewEncoder(w).Encode(threadResponse{
 			ThreadID:           th.ThreadID,
@@ -109,11 +176,56 @@ func main() {
 			Status:             th.Status,
 			IdleTimeoutSeconds: th.IdleTimeoutSeconds,
 			LastSeq:            th.LastSeq,
+			ConflictCount:      conflicts,
 		})
 	})
 
-	r.Get("/threads/{threadID}/events", func(w http.ResponseWriter, req *http.Request) {
+	api.Get("/threads/{threadID}/conflicts", func(w http.ResponseWriter, req *http.Request) {
+		threadID := chi.URLParam(req, "threadID")
+		if !authorizeThread(w, req, store, threadID) {
+			return
+		}
+		limit := 100
+		if v := req.URL.Query().Get("limit"); v != "" {
+			parsed, err := strconv.Atoi(v)
+			if err != nil || parsed <= 0 || parsed > 1000 {
+				http.Error(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+			limit = parsed
+		}
+		count, err := store.CountConflicts(req.Context(), threadID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		items, err := store.ListConflicts(req.Context(), threadID, int64(limit))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp := conflictsResponse{Count: count, Conflicts: make([]conflictResponse, 0, len(items))}
+		for _, c := range items {
+			resp.Conflicts = append(resp.Conflicts, conflictResponse{
+				ConflictID:      c.ConflictID,
+				ThreadID:        c.ThreadID,
+				Seq:             c.Seq,
+				Reason:          c.Reason,
+				ExistingEventID: c.ExistingEventID,
+				EventID:         c.EventID,
+				Event:           c.Event,
+				DetectedAt:      c.DetectedAt,
+			})
+		}
+		w.Header().Set("content-type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+
+	api.Get("/threads/{threadID}/events", func(w http.ResponseWriter, req *http.Request) {
 		threadID := chi.URLParam(req, "threadID")
+		if !authorizeThread(w, req, store, threadID) {
+			return
+		}
 		fromSeq := int64(0)
 		if v := req.URL.Query().Get("from_seq"); v != "" {
 			parsed, err := strconv.ParseInt(v, 10, 64)
@@ -133,17 +245,63 @@ func main() {
 			limit = parsed
 		}
 
-		events, err := store.ListEvents(req.Context(), threadID, fromSeq, int64(limit))
+		traceID := req.URL.Query().Get("trace_id")
+		if traceID != "" && !eventide.IsValidTraceID(traceID) {
+			http.Error(w, "invalid trace_id", http.StatusBadRequest)
+			return
+		}
+
+		filter, err := eventfilter.Parse(req.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		q := pgstore.EventQuery{ThreadID: threadID, TraceID: traceID, FromSeq: fromSeq, Limit: int64(limit)}
+		filter.Pushdown(&q)
+		events, next, err := queryFiltered(req.Context(), store.QueryEvents, q, filter)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		w.Header().Set("content-type", "application/json")
-		_ = json.NewEncoder(w).Encode(eventsResponse{Events: events})
+		writeEvents(w, req, payloads, eventsResponse{Events: events, NextFromSeq: next})
+	})
+
+	// Events of one distributed trace, across the caller's threads.
+	api.Get("/events", func(w http.ResponseWriter, req *http.Request) {
+		traceID := req.URL.Query().Get("trace_id")
+		if !eventide.IsValidTraceID(traceID) {
+			http.Error(w, "trace_id is required (32 lowercase hex characters)", http.StatusBadRequest)
+			return
+		}
+		limit := 500
+		if v := req.URL.Query().Get("limit"); v != "" {
+			parsed, err := strconv.Atoi(v)
+			if err != nil || parsed <= 0 || parsed > 5000 {
+				http.Error(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+			limit = parsed
+		}
+		q := pgstore.EventQuery{TraceID: traceID, Limit: int64(limit)}
+		p := auth.FromContext(req.Context())
+		if p.Method != auth.MethodAnonymous {
+			q.TenantID = p.TenantID
+		}
+		q.ThreadID = p.ThreadID
+		events, err := store.QueryEvents(req.Context(), q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeEvents(w, req, payloads, eventsResponse{Events: events})
 	})
 
-	r.Get("/threads/{threadID}/archives", func(w http.ResponseWriter, req *http.Request) {
+	api.Get("/threads/{threadID}/archives", func(w http.ResponseWriter, req *http.Request) {
 		threadID := chi.URLParam(req, "threadID")
+		if !authorizeThread(w, req, store, threadID) {
+			return
+		}
 		limit := 100
 		if v := req.URL.Query().Get("limit"); v != "" {
 			parsed, err := strconv.Atoi(v)
@@ -175,8 +333,11 @@ func main() {
 		_ = json.NewEncoder(w).Encode(resp)
 	})
 
-	r.Get("/threads/{threadID}/archives/{archiveID}", func(w http.ResponseWriter, req *http.Request) {
+	api.Get("/threads/{threadID}/archives/{archiveID}", func(w http.ResponseWriter, req *http.Request) {
 		threadID := chi.URLParam(req, "threadID")
+		if !authorizeThread(w, req, store, threadID) {
+			return
+		}
 		archiveID := chi.URLParam(req, "archiveID")
 		arch, ok, err := store.GetArchive(req.Context(), archiveID)
 		if err != nil {
@@ -188,16 +349,7 @@ func main() {
 			return
 		}
 
-		s3c, err := s3store.New(req.Context(), s3store.Config{
-			Endpoint:        cfg.S3.Endpoint,
-			Region:          cfg.S3.Region,
-			Bucket:          cfg.S3.Bucket,
-			AccessKeyID:     cfg.S3.AccessKeyID,
-			SecretAccessKey: cfg.S3.SecretAccessKey,
-			Prefix:          cfg.S3.Prefix,
-			UsePathStyle:    cfg.S3.UsePathStyle,
-		})
-		if err != nil {
+		if s3c == nil {
 			http.Error(w, "s3 not configured", http.StatusInternalServerError)
 			return
 		}
@@ -232,11 +384,16 @@ func main() {
 		_, _ = io.Copy(w, body)
 	})
 
+	api.Post("/auth/stream-token", handleStreamToken(authn, store))
+
 	// ── SSE: realtime route ─────────────────────────────────────────────
 
-	r.Get("/threads/{threadID}/events/stream", func(w http.ResponseWriter, req *http.Request) {
+	streams.Get("/threads/{threadID}/events/stream", func(w http.ResponseWriter, req *http.Request) {
 		threadID := chi.URLParam(req, "threadID")
-		afterSeq, _, err := parseAfterSeq(req)
+		if !authorizeThread(w, req, store, threadID) {
+			return
+		}
+		afterSeq, resume, err := parseAfterSeq(req)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
@@ -265,6 +422,29 @@ func main() {
 			}
 		}
 		filterByTurnID := activeTurns != nil
+		filter, err := eventfilter.Parse(req.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		inline := wantInline(req)
+		eventNames := req.URL.Query().Get("event_names")
+		if eventNames != "" && eventNames != "type" {
+			http.Error(w, "invalid event_names", http.StatusBadRequest)
+			return
+		}
+		// In follow mode the stream stays open across turns: turn ends are
+		// marked with turn_boundary frames instead of [DONE].
+		follow := false
+		switch req.URL.Query().Get("mode") {
+		case "":
+		case "follow":
+			follow = true
+		default:
+			http.Error(w, "invalid mode", http.StatusBadRequest)
+			return
+		}
+		principal := auth.FromContext(req.Context())
 
 		w.Header().Set("content-type", "text/event-stream")
 		w.Header().Set("cache-control", "no-cache")
@@ -276,79 +456,170 @@ func main() {
 			http.Error(w, "streaming not supported", http.StatusInternalServerError)
 			return
 		}
+		w = countingWriter{w}
+		metrics.SSEConnections.Inc()
+		defer metrics.SSEConnections.Dec()
 
-		cursor := "0" // Always start from beginning to support produce-before-consume
-		// _, _ = w.Write([]byte("retry: 2000\n\n"))
-		// flusher.Flush()
-
-		stream := redisstreams.StreamKey(threadID)
 		ctx := req.Context()
-		for {
-			msgs, err := rdb.XRead(ctx, stream, cursor, 30*time.Second, 200)
-			if err != nil {
-				return
+		_, _ = fmt.Fprintf(w, "retry: %d\n\n", sseRetry.Milliseconds())
+		flusher.Flush()
+
+		// send writes one event and reports stop once the requested turns,
+		// or without a turn filter the first turn, have ended. Followers
+		// never stop.
+		send := func(evt eventide.Event) (bool, error) {
+			if evt.TenantID == "" {
+				evt.TenantID = cfg.Auth.DefaultTenant
 			}
-			if len(msgs) == 0 {
-				select {
-				case <-ctx.Done():
-					return
-				default:
-					_, _ = w.Write([]byte(": keepalive\n\n"))
-					flusher.Flush()
-					continue
-				}
+			if !principal.CanAccessTenant(evt.TenantID) {
+				return false, nil
 			}
-			for _, m := range msgs {
-				cursor = m.ID
-				seqVal, ok := m.Values["seq"]
-				if ok {
-					seq, ok2 := toInt64(seqVal)
-					if ok2 && seq <= afterSeq {
-						continue
-					}
-				}
-				evt, ok := eventFromStream(threadID, m.Values)
-				if !ok {
-					continue
+			if filterByTurnID {
+				if _, requested := activeTurns[evt.TurnID]; !requested {
+					return false, nil
 				}
+			}
 
-				if filterByTurnID {
-					if _, requested := activeTurns[evt.TurnID]; !requested {
-						continue
+			// Filtered out events are not written, but the end of their
+			// turn still ends the stream.
+			if filter.Match(evt) {
+				if inline {
+					// The event still goes out, with its reference, after a
+					// frame saying why it could not be inlined.
+					if err := payloads.resolve(ctx, &evt); err != nil {
+						log.Printf("resolve payload %s: %v", evt.EventID, err)
+						b, _ := json.Marshal(payloadError{EventID: evt.EventID, Seq: evt.Seq, Error: err.Error()})
+						if err := writeSSEFrame(w, "", "payload_error", b); err != nil {
+							return false, err
+						}
 					}
 				}
 
 				b, err := json.Marshal(evt)
 				if err != nil {
-					continue
+					return false, nil
 				}
-				if err := writeSSE(w, evt.Seq, "agent_event", b); err != nil {
-					return
+				name := "agent_event"
+				if eventNames == "type" {
+					name = evt.Type
+				}
+				if err := writeSSE(w, evt.Seq, name, b); err != nil {
+					return false, err
 				}
 				flusher.Flush()
+				metrics.SSEEvents.Inc()
+			}
 
-				if evt.Type == eventide.TypeTurnCompleted || evt.Type == eventide.TypeTurnFailed || evt.Type == eventide.TypeTurnCancelled {
-					if filterByTurnID {
-						delete(activeTurns, evt.TurnID)
-						if len(activeTurns) == 0 {
-							if err := writeSSE(w, evt.Seq, "done", []byte("[DONE]")); err != nil {
-								return
-							}
-							flusher.Flush()
-							return // Terminate the connection after all requested turns are done
-						}
-					} else {
-						if err := writeSSE(w, evt.Seq, "done", []byte("[DONE]")); err != nil {
-							return
-						}
-						flusher.Flush()
-						return // Terminate the connection after the turn is done
+			if isTurnEnd(evt.Type) {
+				if follow {
+					b, _ := json.Marshal(turnBoundary{
+						TurnID: evt.TurnID,
+						Status: strings.TrimPrefix(evt.Type, "turn."),
+						Seq:    evt.Seq,
+					})
+					if err := writeSSE(w, evt.Seq, "turn_boundary", b); err != nil {
+						return false, err
+					}
+					flusher.Flush()
+					return false, nil
+				}
+				if filterByTurnID {
+					delete(activeTurns, evt.TurnID)
+					if len(activeTurns) > 0 {
+						return false, nil
 					}
 				}
+				// Terminate the connection after the requested turns are done.
+				if err := writeSSE(w, evt.Seq, "done", []byte("[DONE]")); err != nil {
+					return false, err
+				}
+				flusher.Flush()
+				return true, nil
 			}
+			return false, nil
+		}
+
+		// Followers get heartbeats carrying the thread's head seq, so that
+		// they can tell how far behind they are; other streams get comments.
+		block := 30 * time.Second
+		if follow {
+			block = heartbeatEvery
+		}
+		lastBeat := time.Now()
+		idle := func(lastSeq int64, timedOut bool) error {
+			if !timedOut && (!follow || time.Since(lastBeat) < heartbeatEvery) {
+				return nil
+			}
+			lastBeat = time.Now()
+			if !follow {
+				_, err := w.Write([]byte(": keepalive\n\n"))
+				flusher.Flush()
+				return err
+			}
+			head, err := rdb.LastStreamSeq(ctx, threadID)
+			if err != nil {
+				return err
+			}
+			if head < lastSeq {
+				head = lastSeq
+			}
+			b, _ := json.Marshal(heartbeat{HeadSeq: head})
+			if err := writeSSEFrame(w, "", "heartbeat", b); err != nil {
+				return err
+			}
+			flusher.Flush()
+			return nil
+		}
+
+		if err := tails.follow(ctx, threadID, afterSeq, resume, block, send, idle); err != nil {
+			log.Printf("sse %s: %v", threadID, err)
 		}
 	})
 
+	// ── WebSocket ───────────────────────────────────────────────────────
+	// Subscriptions to several threads over one connection, for clients that
+	// handle WebSockets better than SSE.
+	ws := &wsServer{
+		root:     ctx,
+		store:    store,
+		tails:    tails,
+		payloads: payloads,
+		cfg: wsConfig{
+			PingInterval:     getenvDurationDefault("WS_PING_INTERVAL", defaultWSPingInterval),
+			WriteTimeout:     getenvDurationDefault("WS_WRITE_TIMEOUT", defaultWSWriteTimeout),
+			SendQueue:        getenvIntDefault("WS_SEND_QUEUE", defaultWSSendQueue),
+			MaxUnacked:       getenvIntDefault("WS_MAX_UNACKED", 1000),
+			MaxSubscriptions: getenvIntDefault("WS_MAX_SUBSCRIPTIONS", defaultWSMaxSubscriptions),
+			OriginPatterns:   getenvList("WS_ORIGIN_PATTERNS"),
+		}.withDefaults(),
+	}
+	streams.Get("/ws", ws.handle)
+
+	// ── Admin ───────────────────────────────────────────────────────────
+	// Operator routes live on ADMIN_HTTP_ADDR when set, so that they can be
+	// kept off the public listener; otherwise they share the API port.
+	health := newPipelineHealth(rdb)
+	dead := dlq.New(rdb, redisstreams.GlobalStreamKey(), health.dlqStream)
+	requireAdmin := auth.RequireAdmin(cfg.Auth.AdminToken, cfg.Auth.Enabled)
+	if adminAddr := os.Getenv("ADMIN_HTTP_ADDR"); adminAddr != "" {
+		ar := chi.NewRouter()
+		ar.Use(metrics.Middleware("beacon-admin"))
+		mountAdmin(ar.With(requireAdmin), health, dead)
+		adminSrv := httpx.New(adminAddr, ar)
+		go func() {
+			<-ctx.Done()
+			_ = adminSrv.Shutdown(context.Background())
+		}()
+		go func() {
+			log.Printf("beacon admin listening on %s", adminAddr)
+			if err := adminSrv.ListenAndServe(); err != nil {
+				log.Fatalf("serve admin: %v", err)
+			}
+		}()
+	} else {
+		mountAdmin(r.With(requireAdmin), health, dead)
+	}
+
 	// ── Start server ────────────────────────────────────────────────────
 	srv := httpx.New(addr, r)
 	go func() {
@@ -361,41 +632,81 @@ func main() {
 	}
 }
 
-// ── SSE helpers (from realtime) ─────────────────────────────────────────
-
-func eventFromStream(threadID string, values map[string]any) (eventide.Event, bool) {
-	seqAny, ok := values["seq"]
-	if !ok {
-		return eventide.Event{}, false
+// maxFilterScan bounds the events one filtered read looks at, so that a
+// filter that rarely matches does not scan a whole thread in one request.
+const maxFilterScan = 50000
+
+// queryFiltered runs q, which f was pushed down into, through query and keeps
+// the events that match f. Postgres cannot evaluate every filter, so further
+// pages are read until q.Limit events match, the thread has no more, or
+// maxFilterScan events were read. next is the seq to read on from when the
+// read stopped before the end of the thread, and 0 otherwise.
+func queryFiltered(ctx context.Context, query func(context.Context, pgstore.EventQuery) ([]json.RawMessage, error), q pgstore.EventQuery, f eventfilter.Filter) (out []json.RawMessage, next int64, err error) {
+	if !f.NeedsPostFilter() {
+		out, err = query(ctx, q)
+		return out, 0, err
 	}
-	seq, ok := toInt64(seqAny)
-	if !ok {
-		return eventide.Event{}, false
+	limit := q.Limit
+	q.Limit = 5000
+	scanned := 0
+	for {
+		raws, err := query(ctx, q)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, raw := range raws {
+			var e eventide.Event
+			if err := json.Unmarshal(raw, &e); err != nil {
+				return nil, 0, err
+			}
+			q.FromSeq = e.Seq
+			scanned++
+			if f.Match(e) {
+				out = append(out, raw)
+				if int64(len(out)) == limit {
+					return out, e.Seq, nil
+				}
+			}
+			if scanned == maxFilterScan {
+				return out, e.Seq, nil
+			}
+		}
+		if int64(len(raws)) < q.Limit {
+			return out, 0, nil
+		}
 	}
-	eventID, _ := values["event_id"].(string)
-	turnID, _ := values["turn_id"].(string)
-	tsStr, _ := values["ts"].(string)
-	typeStr, _ := values["type"].(string)
-	levelStr, _ := values["level"].(string)
-	payloadStr, _ := values["payload"].(string)
-	if eventID == "" || turnID == "" || tsStr == "" || typeStr == "" || levelStr == "" || payloadStr == "" {
-		return eventide.Event{}, false
+}
+
+func writeEvents(w http.ResponseWriter, req *http.Request, payloads *payloadResolver, resp eventsResponse) {
+	if wantInline(req) {
+		for i, raw := range resp.Events {
+			resolved, err := payloads.resolveRaw(req.Context(), raw)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			resp.Events[i] = resolved
+		}
 	}
-	ts, err := time.Parse(time.RFC3339Nano, tsStr)
+	w.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// ── SSE helpers (from realtime) ─────────────────────────────────────────
+
+// isTurnEnd reports whether typ ends a turn.
+func isTurnEnd(typ string) bool {
+	return typ == eventide.TypeTurnCompleted || typ == eventide.TypeTurnFailed || typ == eventide.TypeTurnCancelled
+}
+
+// eventFromStream decodes a thread stream entry of any format.
+func eventFromStream(threadID string, values map[string]any) (eventide.Event, bool) {
+	e, err := redisstreams.DecodeEntry(values)
 	if err != nil {
 		return eventide.Event{}, false
 	}
-	return eventide.Event{
-		SpecVersion: eventide.SpecVersion,
-		EventID:     eventID,
-		ThreadID:    threadID,
-		TurnID:      turnID,
-		Seq:         seq,
-		TS:          ts,
-		Type:        typeStr,
-		Level:       eventide.Level(levelStr),
-		Payload:     []byte(payloadStr),
-	}, true
+	e.ThreadID = threadID
+	return e, true
 }
 
 func toInt64(v any) (int64, bool) {
@@ -446,31 +757,66 @@ func (e *requestError) Error() string {
 	return e.msg
 }
 
+// countingWriter feeds the bytes written to an SSE connection into the
+// beacon_sse_bytes_sent_total counter.
+type countingWriter struct {
+	http.ResponseWriter
+}
+
+func (w countingWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	metrics.SSEBytes.Add(float64(n))
+	return n, err
+}
+
+// sseRetry is the reconnection delay suggested to SSE clients.
+const sseRetry = 2 * time.Second
+
+// turnBoundary is the data of a turn_boundary frame, which marks the end of a
+// turn in follow mode.
+type turnBoundary struct {
+	TurnID string `json:"turn_id"`
+	Status string `json:"status"`
+	Seq    int64  `json:"seq"`
+}
+
+// payloadError is the data of a payload_error frame, sent before an event
+// whose offloaded payload could not be inlined.
+type payloadError struct {
+	EventID string `json:"event_id"`
+	Seq     int64  `json:"seq"`
+	Error   string `json:"error"`
+}
+
+// heartbeat is the data of a heartbeat frame in follow mode.
+type heartbeat struct {
+	HeadSeq int64 `json:"head_seq"`
+}
+
+// writeSSE writes one SSE frame. id is the event's seq, which browsers send
+// back as Last-Event-ID when they reconnect.
 func writeSSE(w http.ResponseWriter, id int64, event string, data []byte) error {
-	//if _, err := w.Write([]byte("id: ")); err != nil {
-	//	return err
-	//}
-	//if _, err := w.Write([]byte(strconv.FormatInt(id, 10))); err != nil {
-	//	return err
-	//}
-	//if _, err := w.Write([]byte("\n")); err != nil {
-	//	return err
-	//}
-	//if _, err := w.Write([]byte("event: ")); err != nil {
-	//	return err
-	//}
-	//if _, err := w.Write([]byte(event)); err != nil {
-	//	return err
-	//}
-	//if _, err := w.Write([]byte("\n")); err != nil {
-	//	return err
-	//}
-	if _, err := w.Write([]byte("data: ")); err != nil {
-		return err
+	return writeSSEFrame(w, strconv.FormatInt(id, 10), event, data)
+}
+
+// writeSSEFrame writes one SSE frame. Without an id the client keeps the
+// last one it received.
+func writeSSEFrame(w http.ResponseWriter, id, event string, data []byte) error {
+	var b bytes.Buffer
+	if id != "" {
+		b.WriteString("id: ")
+		b.WriteString(id)
+		b.WriteByte('\n')
 	}
-	if _, err := w.Write(data); err != nil {
-		return err
+	b.WriteString("event: ")
+	b.WriteString(event)
+	b.WriteByte('\n')
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		b.WriteString("data: ")
+		b.Write(line)
+		b.WriteByte('\n')
 	}
-	_, err := w.Write([]byte("\n\n"))
+	b.WriteByte('\n')
+	_, err := w.Write(b.Bytes())
 	return err
 }
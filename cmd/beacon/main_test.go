@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/warjiang/eventide/internal/eventfilter"
+	"github.com/warjiang/eventide/internal/pgstore"
+)
+
+// fakeThread serves the events of a thread with seqs 1 to n, like
+// QueryEvents, and counts the events it returned.
+type fakeThread struct {
+	n       int64
+	match   func(seq int64) bool
+	scanned int
+}
+
+func (f *fakeThread) query(_ context.Context, q pgstore.EventQuery) ([]json.RawMessage, error) {
+	var out []json.RawMessage
+	for seq := q.FromSeq + 1; seq <= f.n && int64(len(out)) < q.Limit; seq++ {
+		role := "user"
+		if f.match(seq) {
+			role = "assistant"
+		}
+		out = append(out, json.RawMessage(fmt.Sprintf(`{"seq":%d,"type":"message","payload":{"role":%q}}`, seq, role)))
+	}
+	f.scanned += len(out)
+	return out, nil
+}
+
+func TestQueryFiltered(t *testing.T) {
+	f, err := eventfilter.Spec{Expr: `payload.role == "assistant"`}.Filter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seqs := func(raws []json.RawMessage) []int64 {
+		var out []int64
+		for _, raw := range raws {
+			var e struct{ Seq int64 }
+			_ = json.Unmarshal(raw, &e)
+			out = append(out, e.Seq)
+		}
+		return out
+	}
+	for _, tt := range []struct {
+		name     string
+		n        int64
+		match    func(int64) bool
+		limit    int64
+		want     []int64
+		wantNext int64
+	}{
+		{
+			name:     "limit reached",
+			n:        20,
+			match:    func(seq int64) bool { return seq%5 == 0 },
+			limit:    2,
+			want:     []int64{5, 10},
+			wantNext: 10,
+		},
+		{
+			name:  "end of thread",
+			n:     20,
+			match: func(seq int64) bool { return seq%5 == 0 },
+			limit: 10,
+			want:  []int64{5, 10, 15, 20},
+		},
+		{
+			name:     "scan bound",
+			n:        3 * maxFilterScan,
+			match:    func(seq int64) bool { return seq == 7 || seq == maxFilterScan+1 },
+			limit:    10,
+			want:     []int64{7},
+			wantNext: maxFilterScan,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			th := &fakeThread{n: tt.n, match: tt.match}
+			got, next, err := queryFiltered(context.Background(), th.query, pgstore.EventQuery{ThreadID: "th", Limit: tt.limit}, f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(seqs(got)) != fmt.Sprint(tt.want) || next != tt.wantNext {
+				t.Fatalf("queryFiltered = %v, next %d; want %v, next %d", seqs(got), next, tt.want, tt.wantNext)
+			}
+			if th.scanned > maxFilterScan {
+				t.Fatalf("read %d events", th.scanned)
+			}
+		})
+	}
+
+	// Reading on from next finds what the bounded read did not get to.
+	th := &fakeThread{n: 3 * maxFilterScan, match: func(seq int64) bool { return seq == maxFilterScan+1 }}
+	got, _, err := queryFiltered(context.Background(), th.query, pgstore.EventQuery{ThreadID: "th", FromSeq: maxFilterScan, Limit: 10}, f)
+	if err != nil || fmt.Sprint(seqs(got)) != fmt.Sprint([]int64{maxFilterScan + 1}) {
+		t.Fatalf("continued read = %v, %v", seqs(got), err)
+	}
+}
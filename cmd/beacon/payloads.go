@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/warjiang/eventide/internal/s3store"
+	"github.com/warjiang/eventide/sdk/go/eventide"
+)
+
+// payloadResolver swaps payload references written by the gateway's
+// claim-check offloading for the stored payload.
+type payloadResolver struct {
+	s3 *s3store.Client
+}
+
+func wantInline(req *http.Request) bool {
+	v := req.URL.Query().Get("inline")
+	return v == "1" || v == "true"
+}
+
+func (r *payloadResolver) resolve(ctx context.Context, e *eventide.Event) error {
+	ref, ok := eventide.ParsePayloadRef(e.Payload)
+	if !ok {
+		return nil
+	}
+	if r.s3 == nil {
+		return errors.New("s3 not configured")
+	}
+	// Only follow references to the event's own object, so a producer cannot
+	// point a reader at another thread's data.
+	if ref.ObjectKey != r.s3.Key(s3store.PayloadPath(e.ThreadID, e.EventID)) {
+		return fmt.Errorf("payload ref %s does not belong to event %s", ref.ObjectKey, e.EventID)
+	}
+	body, _, _, err := r.s3.GetObject(ctx, ref.ObjectKey)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = body.Close()
+	}()
+	b, err := io.ReadAll(io.LimitReader(body, ref.Size+1))
+	if err != nil {
+		return err
+	}
+	if err := ref.Verify(b); err != nil {
+		return err
+	}
+	e.Payload = b
+	return nil
+}
+
+func (r *payloadResolver) resolveRaw(ctx context.Context, raw json.RawMessage) (json.RawMessage, error) {
+	if !bytes.Contains(raw, []byte(`"__ref__"`)) {
+		return raw, nil
+	}
+	var e eventide.Event
+	if err := json.Unmarshal(raw, &e); err != nil {
+		return nil, err
+	}
+	if err := r.resolve(ctx, &e); err != nil {
+		return nil, err
+	}
+	return json.Marshal(e)
+}
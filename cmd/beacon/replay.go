@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/warjiang/eventide/internal/metrics"
+	"github.com/warjiang/eventide/internal/pgstore"
+	"github.com/warjiang/eventide/internal/s3store"
+	"github.com/warjiang/eventide/sdk/go/eventide"
+)
+
+// replayBatch is how many events are read from Postgres per query.
+const replayBatch = 500
+
+// maxArchiveLine bounds one event line of an archive object.
+const maxArchiveLine = 16 << 20
+
+// replayer sends the events of a thread that are no longer in its Redis
+// stream: from Postgres, and from S3 archives for ranges Postgres no longer
+// holds.
+type replayer struct {
+	store *pgstore.Store
+	s3    *s3store.Client
+}
+
+// sendFunc writes one event to a subscriber. It returns stop when the
+// subscriber needs no more events.
+type sendFunc func(e eventide.Event) (stop bool, err error)
+
+// backfill sends, in seq order, the events of threadID with
+// afterSeq < seq < untilSeq; an untilSeq of 0 means no upper bound. It
+// returns the last seq sent, or afterSeq when nothing was sent. Seqs found
+// nowhere are skipped.
+func (r *replayer) backfill(ctx context.Context, threadID string, afterSeq, untilSeq int64, send sendFunc) (last int64, stop bool, err error) {
+	last = afterSeq
+	var archives []pgstore.EventArchive
+	archivesLoaded := false
+	for untilSeq == 0 || last+1 < untilSeq {
+		raws, err := r.store.ListEvents(ctx, threadID, last, replayBatch)
+		if err != nil {
+			return last, false, err
+		}
+		events := make([]eventide.Event, 0, len(raws))
+		for _, raw := range raws {
+			e, err := eventide.DecodeEvent(raw)
+			if err != nil {
+				return last, false, fmt.Errorf("decode event: %w", err)
+			}
+			events = append(events, e)
+		}
+
+		if len(events) == 0 || events[0].Seq > last+1 {
+			// Postgres does not hold the next seq; the archives may, up to
+			// the first seq Postgres does hold.
+			bound := untilSeq
+			if len(events) > 0 && (bound == 0 || events[0].Seq < bound) {
+				bound = events[0].Seq
+			}
+			if !archivesLoaded {
+				archives, err = r.store.ListArchives(ctx, threadID, 1000)
+				if err != nil {
+					return last, false, err
+				}
+				archivesLoaded = true
+			}
+			next, stop, err := r.fromArchives(ctx, archives, last, bound, send)
+			if err != nil || stop {
+				return next, stop, err
+			}
+			if next > last {
+				last = next
+				continue
+			}
+			if len(events) == 0 {
+				return last, false, nil
+			}
+		}
+
+		for _, e := range events {
+			if untilSeq > 0 && e.Seq >= untilSeq {
+				return last, false, nil
+			}
+			metrics.SSEReplayedEvents.WithLabelValues("postgres").Inc()
+			stop, err := send(e)
+			if err != nil || stop {
+				return e.Seq, stop, err
+			}
+			last = e.Seq
+		}
+		if len(events) < replayBatch {
+			return last, false, nil
+		}
+	}
+	return last, false, nil
+}
+
+// fromArchives sends the archived events with after < seq < bound, where a
+// bound of 0 means no upper bound, and returns the last seq sent. archives
+// must be ordered by from_seq.
+func (r *replayer) fromArchives(ctx context.Context, archives []pgstore.EventArchive, after, bound int64, send sendFunc) (last int64, stop bool, err error) {
+	last = after
+	if r.s3 == nil {
+		return last, false, nil
+	}
+	for _, a := range archives {
+		if a.ToSeq <= last {
+			continue
+		}
+		if bound > 0 && a.FromSeq >= bound {
+			break
+		}
+		last, stop, err = r.sendArchive(ctx, a, last, bound, send)
+		if err != nil || stop {
+			return last, stop, err
+		}
+	}
+	return last, false, nil
+}
+
+func (r *replayer) sendArchive(ctx context.Context, a pgstore.EventArchive, after, bound int64, send sendFunc) (last int64, stop bool, err error) {
+	last = after
+	body, _, ce, err := r.s3.GetObject(ctx, a.ObjectKey)
+	if err != nil {
+		return last, false, fmt.Errorf("archive %s: %w", a.ArchiveID, err)
+	}
+	defer func() {
+		_ = body.Close()
+	}()
+	var rd io.Reader = body
+	if enc := a.ContentEncoding; enc == "gzip" || (enc == "" && ce == "gzip") {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return last, false, fmt.Errorf("archive %s: %w", a.ArchiveID, err)
+		}
+		defer func() {
+			_ = gz.Close()
+		}()
+		rd = gz
+	}
+
+	sc := bufio.NewScanner(rd)
+	sc.Buffer(make([]byte, 0, 64<<10), maxArchiveLine)
+	for sc.Scan() {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		e, err := eventide.DecodeEvent(sc.Bytes())
+		if err != nil {
+			return last, false, fmt.Errorf("archive %s: decode event: %w", a.ArchiveID, err)
+		}
+		if e.Seq <= last {
+			continue
+		}
+		if bound > 0 && e.Seq >= bound {
+			break
+		}
+		metrics.SSEReplayedEvents.WithLabelValues("archive").Inc()
+		stop, err := send(e)
+		if err != nil || stop {
+			return e.Seq, stop, err
+		}
+		last = e.Seq
+	}
+	if err := sc.Err(); err != nil {
+		return last, false, fmt.Errorf("archive %s: %w", a.ArchiveID, err)
+	}
+	return last, false, nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/warjiang/eventide/internal/redisstreams"
+	"github.com/warjiang/eventide/sdk/go/eventide"
+)
+
+// tailer follows the events of a thread for a subscriber: it replays what the
+// Redis stream no longer holds, then tails the stream. SSE and WebSocket
+// subscriptions share it, so both resume the same way.
+type tailer struct {
+	rdb           *redisstreams.Client
+	replay        *replayer
+	defaultTenant string
+}
+
+// idleFunc is called after every read of the thread stream with the highest
+// seq sent and whether the read timed out without new entries.
+type idleFunc func(lastSeq int64, timedOut bool) error
+
+// reorderWindow is how far, in seqs, an entry may land in a thread stream
+// behind entries with higher seqs and still be sent. Appends that race or are
+// retried can reorder entries slightly; a seq missing further behind the
+// highest seq sent is given up on.
+const reorderWindow = 1024
+
+// follow sends the events of threadID with seqs above afterSeq until send
+// stops, ctx ends or an error occurs, each at most once. Events follow the
+// order of the Redis stream, which is seq order unless appends landed out of
+// order. Reads of the stream block for at most block. It returns nil when
+// send stops or ctx ends.
+//
+// Only a subscriber that resumes, having passed afterSeq explicitly, gets the
+// events Redis no longer holds replayed. Any other subscriber reads the Redis
+// stream from its start, so that events produced just before it connected
+// are not missed, but never older history.
+func (t *tailer) follow(ctx context.Context, threadID string, afterSeq int64, resume bool, block time.Duration, send sendFunc, idle idleFunc) error {
+	sent := newSeqWindow(afterSeq)
+	deliver := func(e eventide.Event) (bool, error) {
+		if sent.has(e.Seq) {
+			return false, nil
+		}
+		sent.add(e.Seq)
+		return send(e)
+	}
+	cursor := "0"
+	checkGap := resume
+	if resume {
+		// Entries older than the Redis stream's oldest were trimmed or
+		// expired; they are replayed from Postgres and the archives before
+		// tailing.
+		oldest, err := t.rdb.OldestStreamSeq(ctx, threadID)
+		if err != nil {
+			return fmt.Errorf("oldest seq: %w", err)
+		}
+		if oldest == 0 {
+			_, stop, err := t.replay.backfill(ctx, threadID, afterSeq, 0, deliver)
+			if err != nil || stop {
+				return replayErr(err)
+			}
+		}
+
+		// Start right before the resume point instead of rescanning the
+		// stream; entries already sent are still skipped.
+		if afterSeq > 0 {
+			cursor, err = t.rdb.SeekStreamSeq(ctx, threadID, afterSeq)
+			if err != nil {
+				return fmt.Errorf("seek: %w", err)
+			}
+		}
+	}
+
+	stream := redisstreams.StreamKey(threadID)
+	for {
+		msgs, err := t.rdb.XRead(ctx, stream, cursor, block, 200)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(msgs) == 0 {
+			if err := idle(sent.max, true); err != nil {
+				return err
+			}
+			continue
+		}
+		if checkGap {
+			// The lowest unsent seq of the first read shows whether Redis
+			// still holds everything the subscriber has not seen. Taking
+			// the lowest, not the first, keeps reordered entries from
+			// being mistaken for a gap.
+			if low := lowestUnsent(msgs, sent); low > 0 {
+				checkGap = false
+				if low > sent.floor+1 {
+					_, stop, err := t.replay.backfill(ctx, threadID, sent.floor, low, deliver)
+					if err != nil || stop {
+						return replayErr(err)
+					}
+				}
+			}
+		}
+		for _, m := range msgs {
+			cursor = m.ID
+			seq, ok := toInt64(m.Values["seq"])
+			if !ok || sent.has(seq) {
+				continue
+			}
+			evt, ok := eventFromStream(threadID, m.Values)
+			if !ok {
+				continue
+			}
+			evt.TenantID = streamTenant(m.Values, evt, t.defaultTenant)
+			if stop, err := deliver(evt); err != nil || stop {
+				return err
+			}
+		}
+		if err := idle(sent.max, false); err != nil {
+			return err
+		}
+	}
+}
+
+// lowestUnsent returns the lowest seq in msgs not sent yet, or 0 if all were.
+func lowestUnsent(msgs []redisstreams.StreamMessage, sent *seqWindow) int64 {
+	var low int64
+	for _, m := range msgs {
+		seq, ok := toInt64(m.Values["seq"])
+		if ok && !sent.has(seq) && (low == 0 || seq < low) {
+			low = seq
+		}
+	}
+	return low
+}
+
+// seqWindow records the seqs sent to a subscriber: every seq up to floor,
+// and the seqs above it in above.
+type seqWindow struct {
+	floor int64
+	above map[int64]struct{}
+	// max is the highest seq sent, or the initial floor.
+	max int64
+}
+
+func newSeqWindow(floor int64) *seqWindow {
+	return &seqWindow{floor: floor, above: make(map[int64]struct{}), max: floor}
+}
+
+func (w *seqWindow) has(seq int64) bool {
+	if seq <= w.floor {
+		return true
+	}
+	_, ok := w.above[seq]
+	return ok
+}
+
+func (w *seqWindow) add(seq int64) {
+	if w.has(seq) {
+		return
+	}
+	w.above[seq] = struct{}{}
+	if seq > w.max {
+		w.max = seq
+	}
+	if w.max-w.floor > reorderWindow {
+		// Give up on the missing seqs furthest behind, by half the
+		// window at once so that this does not run on every add.
+		w.floor = w.max - reorderWindow/2
+		for s := range w.above {
+			if s <= w.floor {
+				delete(w.above, s)
+			}
+		}
+	}
+	for {
+		if _, ok := w.above[w.floor+1]; !ok {
+			return
+		}
+		delete(w.above, w.floor+1)
+		w.floor++
+	}
+}
+
+func replayErr(err error) error {
+	if err != nil {
+		return fmt.Errorf("replay: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/warjiang/eventide/internal/config"
+	"github.com/warjiang/eventide/internal/redisstreams"
+	"github.com/warjiang/eventide/sdk/go/eventide"
+)
+
+// addSeqs appends events with the given seqs to the thread stream, in that
+// order.
+func addSeqs(t *testing.T, rdb *redisstreams.Client, threadID string, seqs ...int64) {
+	t.Helper()
+	for _, seq := range seqs {
+		addTestEvents(t, rdb, threadID, seq, seq)
+	}
+}
+
+func TestFollowOutOfOrder(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		afterSeq int64
+		resume   bool
+		written  []int64
+		live     []int64
+		want     []int64
+	}{
+		{
+			name:    "from the start",
+			written: []int64{1, 3, 2, 5, 4},
+			live:    []int64{7, 6, 8},
+			want:    []int64{1, 3, 2, 5, 4, 7, 6, 8},
+		},
+		{
+			// 2 follows 3 in the stream; it is neither skipped nor taken
+			// for a gap that Postgres would have to fill.
+			name:     "resumed",
+			afterSeq: 1,
+			resume:   true,
+			written:  []int64{1, 3, 2, 5, 4},
+			live:     []int64{7, 6},
+			want:     []int64{3, 2, 5, 4, 7, 6},
+		},
+		{
+			name:     "resumed within a reordered range",
+			afterSeq: 3,
+			resume:   true,
+			written:  []int64{1, 3, 2, 5, 4, 3},
+			want:     []int64{5, 4},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mr := miniredis.RunT(t)
+			rdb := redisstreams.New(config.RedisConfig{Addr: mr.Addr()})
+			t.Cleanup(func() { _ = rdb.Close() })
+			// A replayer without a store fails the test if follow backfills.
+			tails := &tailer{rdb: rdb, replay: &replayer{}, defaultTenant: "default"}
+			addSeqs(t, rdb, "th1", tt.written...)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			got := make(chan int64, 100)
+			done := make(chan error, 1)
+			go func() {
+				send := func(e eventide.Event) (bool, error) {
+					got <- e.Seq
+					return false, nil
+				}
+				idle := func(int64, bool) error { return nil }
+				done <- tails.follow(ctx, "th1", tt.afterSeq, tt.resume, 20*time.Millisecond, send, idle)
+			}()
+			time.Sleep(50 * time.Millisecond)
+			addSeqs(t, rdb, "th1", tt.live...)
+
+			for i, want := range tt.want {
+				select {
+				case seq := <-got:
+					if seq != want {
+						t.Fatalf("event %d has seq %d, want %d", i, seq, want)
+					}
+				case <-ctx.Done():
+					t.Fatalf("event %d: no event, want seq %d", i, want)
+				}
+			}
+			select {
+			case seq := <-got:
+				t.Fatalf("unexpected seq %d", seq)
+			case <-time.After(100 * time.Millisecond):
+			}
+			cancel()
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestSeqWindow(t *testing.T) {
+	w := newSeqWindow(2)
+	if !w.has(1) || !w.has(2) || w.has(3) {
+		t.Fatal("floor not applied")
+	}
+	for _, seq := range []int64{4, 6, 3} {
+		w.add(seq)
+	}
+	if w.floor != 4 || w.max != 6 || !w.has(6) || w.has(5) {
+		t.Fatalf("window = %+v", w)
+	}
+	w.add(5)
+	if w.floor != 6 || len(w.above) != 0 {
+		t.Fatalf("window = %+v", w)
+	}
+
+	// A seq missing far behind the highest sent is given up on.
+	w.add(8 + reorderWindow)
+	if !w.has(7) || w.floor < 8 || w.has(8+reorderWindow-1) {
+		t.Fatalf("window = floor %d, max %d, %d above", w.floor, w.max, len(w.above))
+	}
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/warjiang/eventide/internal/auth"
+	"github.com/warjiang/eventide/internal/eventfilter"
+	"github.com/warjiang/eventide/internal/metrics"
+	"github.com/warjiang/eventide/internal/pgstore"
+	"github.com/warjiang/eventide/sdk/go/eventide"
+)
+
+// wsReadLimit bounds one client message.
+const wsReadLimit = 64 << 10
+
+// wsConfig holds the per-connection limits of the WebSocket endpoint.
+type wsConfig struct {
+	// PingInterval is how often the server pings; a ping not answered
+	// within WriteTimeout closes the connection.
+	PingInterval time.Duration
+	// WriteTimeout bounds writing one message. A client that reads slower
+	// than that is disconnected.
+	WriteTimeout time.Duration
+	// SendQueue is how many messages may wait to be written before
+	// subscriptions stop reading their threads.
+	SendQueue int
+	// MaxUnacked is how many events may be sent without an ack before
+	// subscriptions pause; 0 disables the limit.
+	MaxUnacked int
+	// MaxSubscriptions bounds the threads one connection subscribes to.
+	MaxSubscriptions int
+	// OriginPatterns are the browser origins allowed besides the server's
+	// own, as host patterns such as "*.example.com".
+	OriginPatterns []string
+}
+
+// Defaults of wsConfig, also used in place of values that are not positive.
+const (
+	defaultWSPingInterval     = 30 * time.Second
+	defaultWSWriteTimeout     = 10 * time.Second
+	defaultWSSendQueue        = 256
+	defaultWSMaxSubscriptions = 16
+)
+
+func (c wsConfig) withDefaults() wsConfig {
+	if c.PingInterval <= 0 {
+		c.PingInterval = defaultWSPingInterval
+	}
+	if c.WriteTimeout <= 0 {
+		c.WriteTimeout = defaultWSWriteTimeout
+	}
+	if c.SendQueue <= 0 {
+		c.SendQueue = defaultWSSendQueue
+	}
+	if c.MaxSubscriptions <= 0 {
+		c.MaxSubscriptions = defaultWSMaxSubscriptions
+	}
+	return c
+}
+
+// wsClientMessage is a message from the client. Type is subscribe,
+// unsubscribe, ack or ping; ID is echoed in the reply.
+type wsClientMessage struct {
+	Type     string            `json:"type"`
+	ID       string            `json:"id,omitempty"`
+	ThreadID string            `json:"thread_id,omitempty"`
+	AfterSeq *int64            `json:"after_seq,omitempty"`
+	Filter   *eventfilter.Spec `json:"filter,omitempty"`
+	Inline   bool              `json:"inline,omitempty"`
+	Seq      int64             `json:"seq,omitempty"`
+}
+
+// wsServerMessage is a message to the client. Type is subscribed,
+// unsubscribed, event, payload_error, turn_boundary, pong or error.
+type wsServerMessage struct {
+	Type     string          `json:"type"`
+	ID       string          `json:"id,omitempty"`
+	ThreadID string          `json:"thread_id,omitempty"`
+	Seq      int64           `json:"seq,omitempty"`
+	TurnID   string          `json:"turn_id,omitempty"`
+	Status   string          `json:"status,omitempty"`
+	Event    json.RawMessage `json:"event,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// wsServer serves /ws. Every subscription of a connection follows its
+// thread like an SSE stream in follow mode.
+type wsServer struct {
+	root     context.Context
+	cfg      wsConfig
+	store    *pgstore.Store
+	tails    *tailer
+	payloads *payloadResolver
+}
+
+func (s *wsServer) handle(w http.ResponseWriter, req *http.Request) {
+	c, err := websocket.Accept(w, req, &websocket.AcceptOptions{OriginPatterns: s.cfg.OriginPatterns})
+	if err != nil {
+		// Accept has written the response.
+		return
+	}
+	defer func() { _ = c.CloseNow() }()
+	c.SetReadLimit(wsReadLimit)
+	metrics.WSConnections.Inc()
+	defer metrics.WSConnections.Dec()
+
+	// Hijacked connections outlive server shutdown unless told otherwise.
+	// Closing the connection ends the read loop and with it the rest.
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	stop := context.AfterFunc(s.root, func() {
+		_ = c.Close(websocket.StatusGoingAway, "server shutting down")
+	})
+	defer stop()
+
+	conn := &wsConn{
+		srv:       s,
+		c:         c,
+		principal: auth.FromContext(req.Context()),
+		out:       make(chan wsOut, s.cfg.SendQueue),
+		subs:      make(map[string]*wsSub),
+		acked:     make(chan struct{}),
+	}
+	go conn.readLoop(ctx, cancel)
+	go conn.pingLoop(ctx, cancel)
+	conn.writeLoop(ctx)
+
+	cancel()
+	conn.closeSubs()
+}
+
+type wsConn struct {
+	srv       *wsServer
+	c         *websocket.Conn
+	principal auth.Principal
+	out       chan wsOut
+
+	mu   sync.Mutex
+	subs map[string]*wsSub
+	// unacked counts the events sent on all subscriptions and not yet
+	// acknowledged. acked is closed and replaced whenever it drops.
+	unacked int
+	acked   chan struct{}
+}
+
+type wsSub struct {
+	threadID string
+	cancel   context.CancelFunc
+	// stopped is set on unsubscribe. Messages of a stopped subscription
+	// still in the send queue are dropped, so that none follow the
+	// unsubscribed reply.
+	stopped atomic.Bool
+	// sent holds the seqs sent and not yet acknowledged, in the order sent.
+	sent []int64
+}
+
+// wsOut is a queued message, with the subscription it belongs to if any.
+type wsOut struct {
+	sub *wsSub
+	b   []byte
+}
+
+func (conn *wsConn) writeLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg := <-conn.out:
+			if msg.sub != nil && msg.sub.stopped.Load() {
+				continue
+			}
+			wctx, cancel := context.WithTimeout(ctx, conn.srv.cfg.WriteTimeout)
+			err := conn.c.Write(wctx, websocket.MessageText, msg.b)
+			cancel()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (conn *wsConn) pingLoop(ctx context.Context, cancel context.CancelFunc) {
+	t := time.NewTicker(conn.srv.cfg.PingInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			pctx, pcancel := context.WithTimeout(ctx, conn.srv.cfg.WriteTimeout)
+			err := conn.c.Ping(pctx)
+			pcancel()
+			if err != nil {
+				cancel()
+				return
+			}
+		}
+	}
+}
+
+func (conn *wsConn) readLoop(ctx context.Context, cancel context.CancelFunc) {
+	defer cancel()
+	for {
+		typ, b, err := conn.c.Read(ctx)
+		if err != nil {
+			return
+		}
+		var m wsClientMessage
+		if typ != websocket.MessageText || json.Unmarshal(b, &m) != nil {
+			conn.reply(ctx, wsServerMessage{Type: "error", Error: "invalid message"})
+			continue
+		}
+		switch m.Type {
+		case "subscribe":
+			conn.subscribe(ctx, m)
+		case "unsubscribe":
+			if !conn.unsubscribe(m.ThreadID) {
+				conn.reply(ctx, wsServerMessage{Type: "error", ID: m.ID, ThreadID: m.ThreadID, Error: "not subscribed"})
+				continue
+			}
+			conn.reply(ctx, wsServerMessage{Type: "unsubscribed", ID: m.ID, ThreadID: m.ThreadID})
+		case "ack":
+			conn.ack(m.ThreadID, m.Seq)
+		case "ping":
+			conn.reply(ctx, wsServerMessage{Type: "pong", ID: m.ID})
+		default:
+			conn.reply(ctx, wsServerMessage{Type: "error", ID: m.ID, Error: "unknown message type"})
+		}
+	}
+}
+
+// reply queues a message that is not an event.
+func (conn *wsConn) reply(ctx context.Context, m wsServerMessage) {
+	b, _ := json.Marshal(m)
+	_ = conn.enqueue(ctx, wsOut{b: b})
+}
+
+// enqueue queues msg for writing, waiting while the send queue is full.
+func (conn *wsConn) enqueue(ctx context.Context, msg wsOut) error {
+	select {
+	case conn.out <- msg:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (conn *wsConn) subscribe(ctx context.Context, m wsClientMessage) {
+	fail := func(msg string) {
+		conn.reply(ctx, wsServerMessage{Type: "error", ID: m.ID, ThreadID: m.ThreadID, Error: msg})
+	}
+	threadID := strings.TrimSpace(m.ThreadID)
+	if threadID == "" {
+		fail("thread_id is required")
+		return
+	}
+	var afterSeq int64
+	if m.AfterSeq != nil {
+		if afterSeq = *m.AfterSeq; afterSeq < 0 {
+			fail("invalid after_seq")
+			return
+		}
+	}
+	var filter eventfilter.Filter
+	if m.Filter != nil {
+		var err error
+		if filter, err = m.Filter.Filter(); err != nil {
+			fail(err.Error())
+			return
+		}
+	}
+	ok, err := canAccessThread(ctx, conn.srv.store, conn.principal, threadID)
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+	if !ok {
+		fail("not found")
+		return
+	}
+
+	conn.mu.Lock()
+	if _, dup := conn.subs[threadID]; dup {
+		conn.mu.Unlock()
+		fail("already subscribed")
+		return
+	}
+	if len(conn.subs) >= conn.srv.cfg.MaxSubscriptions {
+		conn.mu.Unlock()
+		fail("too many subscriptions")
+		return
+	}
+	subCtx, cancel := context.WithCancel(ctx)
+	sub := &wsSub{threadID: threadID, cancel: cancel}
+	conn.subs[threadID] = sub
+	conn.mu.Unlock()
+	metrics.WSSubscriptions.Inc()
+
+	// Queued before the subscription starts, so that it precedes its events.
+	conn.reply(ctx, wsServerMessage{Type: "subscribed", ID: m.ID, ThreadID: threadID, Seq: afterSeq})
+	go func() {
+		defer metrics.WSSubscriptions.Dec()
+		send := conn.sender(subCtx, sub, filter, m.Inline)
+		err := conn.srv.tails.follow(subCtx, threadID, afterSeq, m.AfterSeq != nil, 30*time.Second, send, func(int64, bool) error { return nil })
+		if err == nil || subCtx.Err() != nil {
+			return
+		}
+		log.Printf("ws %s: %v", threadID, err)
+		conn.mu.Lock()
+		conn.drop(sub)
+		conn.mu.Unlock()
+		conn.reply(ctx, wsServerMessage{Type: "error", ThreadID: threadID, Error: "subscription failed"})
+	}()
+}
+
+// sender returns the sendFunc of sub. Events count against the connection's
+// unacked limit until the client acknowledges them.
+func (conn *wsConn) sender(ctx context.Context, sub *wsSub, filter eventfilter.Filter, inline bool) sendFunc {
+	defaultTenant := conn.srv.tails.defaultTenant
+	return func(evt eventide.Event) (bool, error) {
+		if evt.TenantID == "" {
+			evt.TenantID = defaultTenant
+		}
+		if !conn.principal.CanAccessTenant(evt.TenantID) {
+			return false, nil
+		}
+		if filter.Match(evt) {
+			var resolveErr error
+			if inline {
+				if resolveErr = conn.srv.payloads.resolve(ctx, &evt); resolveErr != nil {
+					log.Printf("resolve payload %s: %v", evt.EventID, resolveErr)
+				}
+			}
+			raw, err := json.Marshal(evt)
+			if err != nil {
+				return false, nil
+			}
+			b, _ := json.Marshal(wsServerMessage{Type: "event", ThreadID: sub.threadID, Seq: evt.Seq, Event: raw})
+			if ok, err := conn.acquire(ctx, sub, evt.Seq); err != nil || !ok {
+				return !ok, err
+			}
+			if resolveErr != nil {
+				// As on SSE, the event follows with its reference.
+				pe, _ := json.Marshal(wsServerMessage{Type: "payload_error", ThreadID: sub.threadID, Seq: evt.Seq, Error: resolveErr.Error()})
+				if err := conn.enqueue(ctx, wsOut{sub: sub, b: pe}); err != nil {
+					return false, err
+				}
+			}
+			if err := conn.enqueue(ctx, wsOut{sub: sub, b: b}); err != nil {
+				return false, err
+			}
+			metrics.WSEvents.Inc()
+		}
+		if isTurnEnd(evt.Type) {
+			b, _ := json.Marshal(wsServerMessage{
+				Type:     "turn_boundary",
+				ThreadID: sub.threadID,
+				Seq:      evt.Seq,
+				TurnID:   evt.TurnID,
+				Status:   strings.TrimPrefix(evt.Type, "turn."),
+			})
+			if err := conn.enqueue(ctx, wsOut{sub: sub, b: b}); err != nil {
+				return false, err
+			}
+		}
+		return false, nil
+	}
+}
+
+// acquire waits until the connection may send another unacknowledged event,
+// then records seq as sent on sub. It reports false if sub was dropped, since
+// the events of a dropped subscription are never acknowledged.
+func (conn *wsConn) acquire(ctx context.Context, sub *wsSub, seq int64) (bool, error) {
+	limit := conn.srv.cfg.MaxUnacked
+	for {
+		conn.mu.Lock()
+		if conn.subs[sub.threadID] != sub {
+			conn.mu.Unlock()
+			return false, nil
+		}
+		if limit <= 0 || conn.unacked < limit {
+			conn.unacked++
+			sub.sent = append(sub.sent, seq)
+			conn.mu.Unlock()
+			return true, nil
+		}
+		acked := conn.acked
+		conn.mu.Unlock()
+		select {
+		case <-acked:
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+}
+
+// ack acknowledges the events of threadID up to seq.
+func (conn *wsConn) ack(threadID string, seq int64) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	sub, ok := conn.subs[threadID]
+	if !ok {
+		return
+	}
+	// Events can go out slightly out of seq order, so the acknowledged ones
+	// are not necessarily a prefix of sent.
+	kept := sub.sent[:0]
+	for _, s := range sub.sent {
+		if s > seq {
+			kept = append(kept, s)
+		}
+	}
+	n := len(sub.sent) - len(kept)
+	if n == 0 {
+		return
+	}
+	sub.sent = kept
+	conn.release(n)
+}
+
+// release drops n events from the unacked count and wakes waiting
+// subscriptions. conn.mu must be held.
+func (conn *wsConn) release(n int) {
+	conn.unacked -= n
+	close(conn.acked)
+	conn.acked = make(chan struct{})
+}
+
+// drop forgets sub and its unacknowledged events. conn.mu must be held.
+func (conn *wsConn) drop(sub *wsSub) {
+	if conn.subs[sub.threadID] != sub {
+		return
+	}
+	delete(conn.subs, sub.threadID)
+	if len(sub.sent) > 0 {
+		conn.release(len(sub.sent))
+		sub.sent = nil
+	}
+}
+
+// unsubscribe stops the subscription to threadID. Its tail may still be
+// blocked reading Redis; it exits on its own, without sending anything more.
+func (conn *wsConn) unsubscribe(threadID string) bool {
+	conn.mu.Lock()
+	sub, ok := conn.subs[threadID]
+	if ok {
+		conn.drop(sub)
+	}
+	conn.mu.Unlock()
+	if ok {
+		sub.stop()
+	}
+	return ok
+}
+
+func (conn *wsConn) closeSubs() {
+	conn.mu.Lock()
+	for _, sub := range conn.subs {
+		conn.drop(sub)
+		sub.stop()
+	}
+	conn.mu.Unlock()
+}
+
+func (sub *wsSub) stop() {
+	sub.stopped.Store(true)
+	sub.cancel()
+}
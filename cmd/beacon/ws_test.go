@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/coder/websocket"
+	"github.com/warjiang/eventide/internal/auth"
+	"github.com/warjiang/eventide/internal/config"
+	"github.com/warjiang/eventide/internal/redisstreams"
+	"github.com/warjiang/eventide/sdk/go/eventide"
+)
+
+// wsTestClient is a WebSocket client of a test beacon.
+type wsTestClient struct {
+	t    *testing.T
+	ctx  context.Context
+	c    *websocket.Conn
+	msgs chan wsServerMessage
+}
+
+func newWSTest(t *testing.T, cfg wsConfig) (*redisstreams.Client, *wsTestClient) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb := redisstreams.New(config.RedisConfig{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = rdb.Close() })
+
+	s := &wsServer{
+		root:     context.Background(),
+		cfg:      cfg.withDefaults(),
+		tails:    &tailer{rdb: rdb, replay: &replayer{}, defaultTenant: "default"},
+		payloads: &payloadResolver{},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		p := auth.Principal{TenantID: "default", Method: auth.MethodAnonymous}
+		s.handle(w, req.WithContext(auth.WithPrincipal(req.Context(), p)))
+	}))
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	c, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.CloseNow() })
+	wc := &wsTestClient{t: t, ctx: ctx, c: c, msgs: make(chan wsServerMessage, 100)}
+	go func() {
+		defer close(wc.msgs)
+		for {
+			_, b, err := c.Read(ctx)
+			if err != nil {
+				return
+			}
+			var m wsServerMessage
+			if err := json.Unmarshal(b, &m); err != nil {
+				return
+			}
+			wc.msgs <- m
+		}
+	}()
+	return rdb, wc
+}
+
+func (wc *wsTestClient) send(m wsClientMessage) {
+	wc.t.Helper()
+	b, _ := json.Marshal(m)
+	if err := wc.c.Write(wc.ctx, websocket.MessageText, b); err != nil {
+		wc.t.Fatal(err)
+	}
+}
+
+// expect reads the next message and checks its type, thread and seq.
+func (wc *wsTestClient) expect(typ, threadID string, seq int64) wsServerMessage {
+	wc.t.Helper()
+	select {
+	case m, ok := <-wc.msgs:
+		if !ok {
+			wc.t.Fatal("connection closed")
+		}
+		if m.Type != typ || m.ThreadID != threadID || m.Seq != seq {
+			wc.t.Fatalf("got %+v, want %s %s %d", m, typ, threadID, seq)
+		}
+		return m
+	case <-time.After(2 * time.Second):
+		wc.t.Fatalf("no message, want %s %s %d", typ, threadID, seq)
+	}
+	return wsServerMessage{}
+}
+
+// expectNothing checks that no message arrives for a while.
+func (wc *wsTestClient) expectNothing() {
+	wc.t.Helper()
+	select {
+	case m := <-wc.msgs:
+		wc.t.Fatalf("unexpected message %+v", m)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func addTestEvents(t *testing.T, rdb *redisstreams.Client, threadID string, from, to int64) {
+	t.Helper()
+	for seq := from; seq <= to; seq++ {
+		b, _ := json.Marshal(eventide.Event{
+			SpecVersion: eventide.SpecVersion,
+			EventID:     fmt.Sprintf("%s-%d", threadID, seq),
+			ThreadID:    threadID,
+			TurnID:      "t1",
+			Seq:         seq,
+			TS:          time.Now(),
+			Type:        "message.delta",
+			Level:       eventide.LevelInfo,
+			Payload:     json.RawMessage(`{}`),
+		})
+		values := map[string]any{"seq": seq, "event": string(b), "tenant_id": "default"}
+		if _, err := rdb.XAddEvent(context.Background(), threadID, values); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWSSubscribeAckUnsubscribe(t *testing.T) {
+	rdb, wc := newWSTest(t, wsConfig{MaxUnacked: 2})
+	addTestEvents(t, rdb, "th1", 1, 4)
+	addTestEvents(t, rdb, "th2", 1, 2)
+
+	wc.send(wsClientMessage{Type: "subscribe", ID: "s1", ThreadID: "th1"})
+	if m := wc.expect("subscribed", "th1", 0); m.ID != "s1" {
+		t.Fatalf("subscribed reply has id %q", m.ID)
+	}
+	wc.expect("event", "th1", 1)
+	wc.expect("event", "th1", 2)
+	// The unacked limit holds back seq 3 until the client acknowledges.
+	wc.expectNothing()
+	wc.send(wsClientMessage{Type: "ack", ThreadID: "th1", Seq: 1})
+	wc.expect("event", "th1", 3)
+	wc.expectNothing()
+
+	wc.send(wsClientMessage{Type: "subscribe", ThreadID: "th1"})
+	wc.expect("error", "th1", 0)
+
+	// Unsubscribing releases the unacked events of th1, including the one
+	// its subscription was waiting to send, so th2 gets the whole limit.
+	wc.send(wsClientMessage{Type: "unsubscribe", ID: "u1", ThreadID: "th1"})
+	wc.expect("unsubscribed", "th1", 0)
+	addTestEvents(t, rdb, "th1", 5, 5)
+	wc.send(wsClientMessage{Type: "subscribe", ThreadID: "th2"})
+	wc.expect("subscribed", "th2", 0)
+	wc.expect("event", "th2", 1)
+	wc.expect("event", "th2", 2)
+	wc.expectNothing()
+
+	wc.send(wsClientMessage{Type: "unsubscribe", ThreadID: "th1"})
+	wc.expect("error", "th1", 0)
+}
+
+func TestWSOutOfOrder(t *testing.T) {
+	rdb, wc := newWSTest(t, wsConfig{})
+	addSeqs(t, rdb, "th1", 1, 3, 2)
+
+	// The resume point lies inside the reordered range; 2 is still due.
+	after := int64(1)
+	wc.send(wsClientMessage{Type: "subscribe", ThreadID: "th1", AfterSeq: &after})
+	wc.expect("subscribed", "th1", 1)
+	wc.expect("event", "th1", 3)
+	wc.expect("event", "th1", 2)
+	wc.expectNothing()
+
+	addSeqs(t, rdb, "th1", 5, 4, 5)
+	wc.expect("event", "th1", 5)
+	wc.expect("event", "th1", 4)
+	wc.expectNothing()
+}
+
+func TestWSAckOutOfOrder(t *testing.T) {
+	rdb, wc := newWSTest(t, wsConfig{MaxUnacked: 2})
+	addSeqs(t, rdb, "th1", 2, 1, 3)
+
+	wc.send(wsClientMessage{Type: "subscribe", ThreadID: "th1"})
+	wc.expect("subscribed", "th1", 0)
+	wc.expect("event", "th1", 2)
+	wc.expect("event", "th1", 1)
+	wc.expectNothing()
+	// Acknowledging 1 releases it although 2 was sent before it.
+	wc.send(wsClientMessage{Type: "ack", ThreadID: "th1", Seq: 1})
+	wc.expect("event", "th1", 3)
+}
+
+func TestWSAcquireAfterDrop(t *testing.T) {
+	conn := &wsConn{
+		srv:   &wsServer{cfg: wsConfig{MaxUnacked: 1}},
+		subs:  make(map[string]*wsSub),
+		acked: make(chan struct{}),
+	}
+	ctx := context.Background()
+	sub := &wsSub{threadID: "th1", cancel: func() {}}
+	conn.subs["th1"] = sub
+	if ok, err := conn.acquire(ctx, sub, 1); !ok || err != nil {
+		t.Fatalf("acquire = %v, %v", ok, err)
+	}
+
+	// The second acquire waits for an ack; dropping the subscription wakes
+	// it before its context is canceled.
+	done := make(chan bool)
+	go func() {
+		ok, _ := conn.acquire(ctx, sub, 2)
+		done <- ok
+	}()
+	time.Sleep(20 * time.Millisecond)
+	conn.mu.Lock()
+	conn.drop(sub)
+	conn.mu.Unlock()
+	if <-done {
+		t.Fatal("acquire succeeded on a dropped subscription")
+	}
+	if conn.unacked != 0 || len(sub.sent) != 0 {
+		t.Fatalf("unacked = %d, sent = %v", conn.unacked, sub.sent)
+	}
+	if ok, _ := conn.acquire(ctx, sub, 3); ok {
+		t.Fatal("acquire succeeded on a dropped subscription")
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	_ "github.com/joho/godotenv/autoload"
+	"github.com/warjiang/eventide/internal/config"
+	"github.com/warjiang/eventide/internal/dlq"
+	"github.com/warjiang/eventide/internal/logx"
+	"github.com/warjiang/eventide/internal/redisstreams"
+	"github.com/warjiang/eventide/sdk/go/eventide"
+)
+
+const usage = `usage:
+  dlq list [-after <id>] [-limit <n>]
+  dlq show <id>
+  dlq replay -all | <id>...
+  dlq edit <id> <event.json>
+  dlq skip <id>...
+  dlq purge [-before <RFC3339 time or duration, e.g. 72h>]`
+
+func main() {
+	logx.Setup()
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	cfg, err := config.FromEnv()
+	if err != nil {
+		log.Fatalf("config: %v", err)
+	}
+
+	ctx := context.Background()
+	rdb := redisstreams.New(cfg.Redis)
+	rdb.SetGlobalShards(cfg.Streams.GlobalShards)
+	defer func() { _ = rdb.Close() }()
+	if err := rdb.Ping(ctx); err != nil {
+		log.Fatalf("redis ping: %v", err)
+	}
+	dlqStream := os.Getenv("PERSISTER_DLQ_STREAM")
+	if dlqStream == "" {
+		dlqStream = redisstreams.DLQStreamKey()
+	}
+	dead := dlq.New(rdb, redisstreams.GlobalStreamKey(), dlqStream)
+
+	cmd, args := os.Args[1], os.Args[2:]
+	switch cmd {
+	case "list":
+		fs := flag.NewFlagSet("list", flag.ExitOnError)
+		after := fs.String("after", "", "only list entries after this id")
+		limit := fs.Int64("limit", 100, "maximum entries to list")
+		_ = fs.Parse(args)
+		entries, err := dead.List(ctx, *after, *limit)
+		if err != nil {
+			log.Fatalf("list: %v", err)
+		}
+		for _, e := range entries {
+			movedAt := ""
+			if e.MovedAt != nil {
+				movedAt = e.MovedAt.Format(time.RFC3339)
+			}
+			reason := e.Error
+			if reason == "" {
+				reason = e.DecodeError
+			}
+			fmt.Printf("%s\t%s\t%s\t%d\t%s\t%d\t%s\n", e.ID, movedAt, e.ThreadID, e.Seq, e.EventID, e.Retries, reason)
+		}
+	case "show":
+		if len(args) != 1 {
+			fmt.Fprintln(os.Stderr, usage)
+			os.Exit(2)
+		}
+		e, err := dead.Get(ctx, args[0])
+		if err != nil {
+			log.Fatalf("show: %v", err)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(e)
+	case "replay":
+		fs := flag.NewFlagSet("replay", flag.ExitOnError)
+		all := fs.Bool("all", false, "replay every entry")
+		_ = fs.Parse(args)
+		if *all == (fs.NArg() > 0) {
+			fmt.Fprintln(os.Stderr, usage)
+			os.Exit(2)
+		}
+		if *all {
+			n, err := dead.ReplayAll(ctx)
+			if err != nil {
+				log.Fatalf("replay: %v (replayed %d)", err, n)
+			}
+			fmt.Printf("replayed %d\n", n)
+			return
+		}
+		for _, id := range fs.Args() {
+			streamID, err := dead.Replay(ctx, id)
+			if errors.Is(err, dlq.ErrNotFound) {
+				log.Printf("%s: not found", id)
+				continue
+			}
+			if err != nil {
+				log.Fatalf("replay %s: %v", id, err)
+			}
+			fmt.Printf("replayed %s as %s\n", id, streamID)
+		}
+	case "edit":
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, usage)
+			os.Exit(2)
+		}
+		b, err := os.ReadFile(args[1])
+		if err != nil {
+			log.Fatalf("read: %v", err)
+		}
+		e, err := eventide.DecodeEvent(b)
+		if err != nil {
+			log.Fatalf("decode %s: %v", args[1], err)
+		}
+		streamID, err := dead.ReplayEdited(ctx, args[0], e)
+		if err != nil {
+			log.Fatalf("edit: %v", err)
+		}
+		fmt.Printf("replayed %s as %s\n", args[0], streamID)
+	case "skip":
+		if len(args) == 0 {
+			fmt.Fprintln(os.Stderr, usage)
+			os.Exit(2)
+		}
+		n, err := dead.Skip(ctx, args...)
+		if err != nil {
+			log.Fatalf("skip: %v", err)
+		}
+		fmt.Printf("skipped %d\n", n)
+	case "purge":
+		fs := flag.NewFlagSet("purge", flag.ExitOnError)
+		beforeFlag := fs.String("before", "", "only purge entries moved before this time or this long ago")
+		_ = fs.Parse(args)
+		before, err := parseBefore(*beforeFlag)
+		if err != nil {
+			log.Fatalf("-before: %v", err)
+		}
+		n, err := dead.Purge(ctx, before)
+		if err != nil {
+			log.Fatalf("purge: %v", err)
+		}
+		fmt.Printf("purged %d\n", n)
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+func parseBefore(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
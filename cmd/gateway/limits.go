@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/warjiang/eventide/internal/redisstreams"
+	"github.com/warjiang/eventide/sdk/go/eventide"
+)
+
+// limiter applies per-tenant and per-thread token buckets and hard quotas to
+// writes. Buckets and counters live in Redis so that they hold across gateway
+// replicas.
+type limiter struct {
+	rdb             *redisstreams.Client
+	tenant          redisstreams.RateLimit
+	thread          redisstreams.RateLimit
+	tenantOverrides map[string]redisstreams.RateLimit
+	threadOverrides map[string]redisstreams.RateLimit
+
+	maxThreadEvents     int64
+	maxPayloadBytes     int64
+	maxTenantDailyBytes int64
+}
+
+type rateLimitOverride struct {
+	EventsPerSecond float64 `json:"events_per_second"`
+	Burst           int64   `json:"burst,omitempty"`
+}
+
+type rateLimitOverrides struct {
+	Tenants map[string]rateLimitOverride `json:"tenants"`
+	Threads map[string]rateLimitOverride `json:"threads"`
+}
+
+type limitResponse struct {
+	Error             string `json:"error"`
+	Reason            string `json:"reason"`
+	Index             *int   `json:"index,omitempty"`
+	RetryAfterSeconds int64  `json:"retry_after_seconds,omitempty"`
+}
+
+func newLimiterFromEnv(rdb *redisstreams.Client) (*limiter, error) {
+	l := &limiter{
+		rdb:                 rdb,
+		maxThreadEvents:     int64(getenvIntDefault("QUOTA_THREAD_MAX_EVENTS", 0)),
+		maxPayloadBytes:     int64(getenvIntDefault("QUOTA_EVENT_MAX_PAYLOAD_BYTES", 0)),
+		maxTenantDailyBytes: int64(getenvIntDefault("QUOTA_TENANT_DAILY_BYTES", 0)),
+	}
+	var err error
+	if l.tenant, err = rateLimitFromEnv("RATE_LIMIT_TENANT_EPS", "RATE_LIMIT_TENANT_BURST"); err != nil {
+		return nil, err
+	}
+	if l.thread, err = rateLimitFromEnv("RATE_LIMIT_THREAD_EPS", "RATE_LIMIT_THREAD_BURST"); err != nil {
+		return nil, err
+	}
+	if path := os.Getenv("RATE_LIMIT_OVERRIDES_FILE"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var o rateLimitOverrides
+		if err := json.Unmarshal(b, &o); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		l.tenantOverrides = overrideLimits(o.Tenants)
+		l.threadOverrides = overrideLimits(o.Threads)
+	}
+	return l, nil
+}
+
+func rateLimitFromEnv(rateKey, burstKey string) (redisstreams.RateLimit, error) {
+	var rl redisstreams.RateLimit
+	if v := os.Getenv(rateKey); v != "" {
+		rate, err := strconv.ParseFloat(v, 64)
+		if err != nil || rate < 0 {
+			return rl, fmt.Errorf("invalid %s %q", rateKey, v)
+		}
+		rl.Rate = rate
+	}
+	rl.Burst = int64(getenvIntDefault(burstKey, 0))
+	return withDefaultBurst(rl), nil
+}
+
+func overrideLimits(in map[string]rateLimitOverride) map[string]redisstreams.RateLimit {
+	out := make(map[string]redisstreams.RateLimit, len(in))
+	for k, v := range in {
+		out[k] = withDefaultBurst(redisstreams.RateLimit{Rate: v.EventsPerSecond, Burst: v.Burst})
+	}
+	return out
+}
+
+// withDefaultBurst lets one second's worth of events through at once when no
+// burst is configured.
+func withDefaultBurst(rl redisstreams.RateLimit) redisstreams.RateLimit {
+	if rl.Enabled() && rl.Burst <= 0 {
+		rl.Burst = int64(math.Max(1, math.Ceil(rl.Rate)))
+	}
+	return rl
+}
+
+func (l *limiter) tenantLimit(tenantID string) redisstreams.RateLimit {
+	if rl, ok := l.tenantOverrides[tenantID]; ok {
+		return rl
+	}
+	return l.tenant
+}
+
+func (l *limiter) threadLimit(threadID string) redisstreams.RateLimit {
+	if rl, ok := l.threadOverrides[threadID]; ok {
+		return rl
+	}
+	return l.thread
+}
+
+// charge is what admit consumed for a write, so that settle can give back
+// the share of events that were not written.
+type charge struct {
+	a       redisstreams.Admission
+	bytes   []int64
+	written []bool
+}
+
+// markWritten records that the event at index i was written. c may be nil.
+func (c *charge) markWritten(i int) {
+	if c != nil {
+		c.written[i] = true
+	}
+}
+
+// admit checks events (all of one thread) against the limits. It writes 413
+// or 429 and returns false when the write is refused. The returned charge,
+// nil when no limit applies, must be passed to settle once the write is
+// done. Empty thread IDs are left to event validation.
+func (l *limiter) admit(ctx context.Context, w http.ResponseWriter, tenantID, threadID string, events []eventide.Event) (*charge, bool) {
+	if strings.TrimSpace(threadID) == "" {
+		return nil, true
+	}
+	var bytes int64
+	sizes := make([]int64, len(events))
+	for i, e := range events {
+		n := int64(len(e.Payload))
+		sizes[i] = n
+		if l.maxPayloadBytes > 0 && n > l.maxPayloadBytes {
+			var index *int
+			if len(events) > 1 {
+				index = &i
+			}
+			writeLimitError(w, http.StatusRequestEntityTooLarge, limitResponse{
+				Error:  fmt.Sprintf("payload exceeds %d bytes", l.maxPayloadBytes),
+				Reason: "payload_bytes",
+				Index:  index,
+			}, 0)
+			return nil, false
+		}
+		bytes += n
+	}
+	a := redisstreams.Admission{
+		TenantID:            tenantID,
+		ThreadID:            threadID,
+		Events:              int64(len(events)),
+		Bytes:               bytes,
+		TenantLimit:         l.tenantLimit(tenantID),
+		ThreadLimit:         l.threadLimit(threadID),
+		MaxThreadEvents:     l.maxThreadEvents,
+		MaxTenantDailyBytes: l.maxTenantDailyBytes,
+	}
+	if !a.TenantLimit.Enabled() && !a.ThreadLimit.Enabled() && a.MaxThreadEvents == 0 && a.MaxTenantDailyBytes == 0 {
+		return nil, true
+	}
+	res, err := l.rdb.Admit(ctx, a)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	if res.Reason == "" {
+		return &charge{a: a, bytes: sizes, written: make([]bool, len(events))}, true
+	}
+	msg := "rate limit exceeded"
+	switch res.Reason {
+	case redisstreams.AdmitThreadEvents:
+		msg = fmt.Sprintf("thread event quota of %d exceeded", l.maxThreadEvents)
+	case redisstreams.AdmitTenantDailyBytes:
+		msg = fmt.Sprintf("tenant daily quota of %d bytes exceeded", l.maxTenantDailyBytes)
+	}
+	writeLimitError(w, http.StatusTooManyRequests, limitResponse{Error: msg, Reason: res.Reason}, res.RetryAfter)
+	return nil, false
+}
+
+// settle refunds what c consumed for events that were not marked written:
+// duplicates, and every event of a write that failed or was refused after
+// admit. Failures are only logged; they leave the caller limited slightly
+// early.
+func (l *limiter) settle(ctx context.Context, c *charge) {
+	if c == nil {
+		return
+	}
+	r := c.a
+	r.Events, r.Bytes = 0, 0
+	for i, ok := range c.written {
+		if !ok {
+			r.Events++
+			r.Bytes += c.bytes[i]
+		}
+	}
+	if r.Events == 0 {
+		return
+	}
+	if err := l.rdb.Refund(context.WithoutCancel(ctx), r); err != nil {
+		log.Printf("refund rate limit (tenant_id=%s thread_id=%s): %v", r.TenantID, r.ThreadID, err)
+	}
+}
+
+func writeLimitError(w http.ResponseWriter, status int, resp limitResponse, retryAfter time.Duration) {
+	if retryAfter > 0 {
+		secs := int64(math.Ceil(retryAfter.Seconds()))
+		resp.RetryAfterSeconds = secs
+		w.Header().Set("retry-after", strconv.FormatInt(secs, 10))
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
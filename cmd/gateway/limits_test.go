@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/warjiang/eventide/internal/redisstreams"
+	"github.com/warjiang/eventide/sdk/go/eventide"
+)
+
+func TestThreadEventQuota(t *testing.T) {
+	g, _, store := newTestGateway(t)
+	g.limits.maxThreadEvents = 3
+	// The quota counts the thread's seq counter, which is seeded from
+	// Postgres on the first append.
+	store.lastSeq["th1"] = 1
+
+	for _, id := range []string{"e2", "e3"} {
+		if rec := serve(t, g.append, appendRequest{Event: testEvent(id)}, nil); rec.Code != http.StatusOK {
+			t.Fatalf("append %s: %d %s", id, rec.Code, rec.Body)
+		}
+	}
+	rec := serve(t, g.append, appendRequest{Event: testEvent("e4")}, nil)
+	var resp limitResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("append over quota: %d %s", rec.Code, rec.Body)
+	}
+	if resp.Reason != redisstreams.AdmitThreadEvents || rec.Header().Get("retry-after") != "" {
+		t.Fatalf("refusal = %+v, retry-after %q", resp, rec.Header().Get("retry-after"))
+	}
+}
+
+func TestDuplicatesAreRefunded(t *testing.T) {
+	g, _, _ := newTestGateway(t)
+	g.limits.thread = redisstreams.RateLimit{Rate: 0.001, Burst: 2}
+
+	// The bucket holds two events. The duplicate of e1 is charged like any
+	// write but refunded once it turns out not to be written, so e2 still
+	// fits.
+	for _, id := range []string{"e1", "e1", "e2"} {
+		if rec := serve(t, g.append, appendRequest{Event: testEvent(id)}, nil); rec.Code != http.StatusOK {
+			t.Fatalf("append %s: %d %s", id, rec.Code, rec.Body)
+		}
+	}
+	if rec := serve(t, g.append, appendRequest{Event: testEvent("e3")}, nil); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("append past the burst: %d %s", rec.Code, rec.Body)
+	}
+
+	// Within a batch only the duplicates are refunded.
+	g, _, _ = newTestGateway(t)
+	g.limits.thread = redisstreams.RateLimit{Rate: 0.001, Burst: 3}
+	first := appendBatchRequest{Events: []eventide.Event{testEvent("e1")}}
+	retry := appendBatchRequest{Events: []eventide.Event{testEvent("e1"), testEvent("e2")}}
+	for _, in := range []appendBatchRequest{first, retry} {
+		if rec := serve(t, g.appendBatch, in, nil); rec.Code != http.StatusOK {
+			t.Fatalf("batch: %d %s", rec.Code, rec.Body)
+		}
+	}
+	if rec := serve(t, g.append, appendRequest{Event: testEvent("e3")}, nil); rec.Code != http.StatusOK {
+		t.Fatalf("append within the burst: %d %s", rec.Code, rec.Body)
+	}
+	if rec := serve(t, g.append, appendRequest{Event: testEvent("e4")}, nil); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("append past the burst: %d %s", rec.Code, rec.Body)
+	}
+}
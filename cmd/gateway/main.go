@@ -3,10 +3,13 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -14,10 +17,13 @@ import (
 	"github.com/go-chi/chi/v5"
 
 	_ "github.com/joho/godotenv/autoload"
+	"github.com/warjiang/eventide/internal/auth"
 	"github.com/warjiang/eventide/internal/config"
 	"github.com/warjiang/eventide/internal/httpx"
 	"github.com/warjiang/eventide/internal/id"
 	"github.com/warjiang/eventide/internal/logx"
+	"github.com/warjiang/eventide/internal/metrics"
+	"github.com/warjiang/eventide/internal/pgstore"
 	"github.com/warjiang/eventide/internal/redisstreams"
 	"github.com/warjiang/eventide/sdk/go/eventide"
 )
@@ -32,6 +38,9 @@ type ingestResponse struct {
 
 type appendRequest struct {
 	Event eventide.Event `json:"event"`
+	// ExpectedSeq, when set, makes the append conditional on the thread's
+	// current head seq. The If-Match header is accepted as an alternative.
+	ExpectedSeq *int64 `json:"expected_seq,omitempty"`
 }
 
 type appendResponse struct {
@@ -41,6 +50,40 @@ type appendResponse struct {
 	Duplicated bool   `json:"duplicated,omitempty"`
 }
 
+type appendBatchRequest struct {
+	Events      []eventide.Event `json:"events"`
+	ExpectedSeq *int64           `json:"expected_seq,omitempty"`
+}
+
+type appendBatchResponse struct {
+	Results []appendResponse `json:"results"`
+}
+
+type seqConflictResponse struct {
+	Error       string `json:"error"`
+	ExpectedSeq int64  `json:"expected_seq"`
+	CurrentSeq  int64  `json:"current_seq"`
+}
+
+// maxBatchEvents bounds a single /events:appendBatch request so one script
+// call cannot block Redis for too long.
+const maxBatchEvents = 1000
+
+// gateway serves the write API. Every check that can reject an event runs
+// before its seq is reserved, in the order validate, tenant, schema, turn,
+// limits.
+type gateway struct {
+	rdb        *redisstreams.Client
+	trimMaxLen int64
+	dedupe     redisstreams.DedupePolicy
+	validator  *payloadValidator
+	turns      *turnGuard
+	seqs       *seqAllocator
+	owners     *threadOwners
+	limits     *limiter
+	payloads   *payloadOffloader
+}
+
 func main() {
 	logx.Setup()
 	cfg, err := config.FromEnv()
@@ -51,118 +94,452 @@ func main() {
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
-	rdb := redisstreams.New(cfg.Redis.Addr, cfg.Redis.Username, cfg.Redis.Password, cfg.Redis.DB)
+	rdb := redisstreams.New(cfg.Redis)
+	rdb.SetGlobalShards(cfg.Streams.GlobalShards)
+	entryFormat, err := redisstreams.ParseEntryFormat(cfg.Streams.EntryFormat)
+	if err != nil {
+		log.Fatalf("STREAM_ENTRY_FORMAT: %v", err)
+	}
+	rdb.SetEntryFormat(entryFormat)
 	defer func() { _ = rdb.Close() }()
 	if err := rdb.Ping(ctx); err != nil {
 		log.Fatalf("redis ping: %v", err)
 	}
 
+	// Postgres is the source of truth for seq counters lost from Redis.
+	store, err := pgstore.New(ctx, cfg.Postgres.ConnString)
+	if err != nil {
+		log.Fatalf("pg: %v", err)
+	}
+	defer store.Close()
+	if err := store.Ping(ctx); err != nil {
+		log.Fatalf("pg ping: %v", err)
+	}
+
+	dedupe := redisstreams.DedupePolicy{TTL: cfg.Streams.DedupeTTL, Window: cfg.Streams.DedupeWindow}
+
+	validator, err := newPayloadValidator(getenvDefault("SCHEMA_VALIDATION", schemaModeOff), os.Getenv("SCHEMA_DIR"))
+	if err != nil {
+		log.Fatalf("schema: %v", err)
+	}
+
+	turns, err := newTurnGuard(getenvDefault("TURN_STATE_MODE", turnModeOff), rdb)
+	if err != nil {
+		log.Fatalf("turn state: %v", err)
+	}
+
+	seqs := &seqAllocator{rdb: rdb, store: store}
+	owners := &threadOwners{rdb: rdb, store: store}
+	limits, err := newLimiterFromEnv(rdb)
+	if err != nil {
+		log.Fatalf("rate limits: %v", err)
+	}
+	payloads, err := newPayloadOffloader(ctx, cfg.S3, getenvIntDefault("PAYLOAD_OFFLOAD_THRESHOLD_BYTES", 0))
+	if err != nil {
+		log.Fatalf("payload offload: %v", err)
+	}
+	if os.Getenv("SEQ_RECONCILE_ON_START") != "0" {
+		go func() {
+			res, err := seqs.reconcile(ctx)
+			if err != nil {
+				log.Printf("seq reconcile: %v", err)
+				return
+			}
+			log.Printf("seq reconcile done (checked=%d fixed=%d)", res.Checked, res.Fixed)
+		}()
+	}
+
+	authn, err := auth.New(cfg.Auth, store)
+	if err != nil {
+		log.Fatalf("auth: %v", err)
+	}
+
+	g := &gateway{
+		rdb:        rdb,
+		trimMaxLen: cfg.Streams.TrimMaxLen,
+		dedupe:     dedupe,
+		validator:  validator,
+		turns:      turns,
+		seqs:       seqs,
+		owners:     owners,
+		limits:     limits,
+		payloads:   payloads,
+	}
+
 	r := chi.NewRouter()
+	r.Use(metrics.Middleware("gateway"))
+	api := r.With(authn.Middleware)
+	admin := r.With(auth.RequireAdmin(cfg.Auth.AdminToken, cfg.Auth.Enabled))
 	r.Get("/healthz", func(w http.ResponseWriter, _ *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("ok"))
 	})
+	r.Handle("/metrics", metrics.Handler())
+
+	api.Post("/events:append", g.append)
+	api.Post("/events:appendBatch", g.appendBatch)
+	api.Post("/ingest", g.ingest)
+	admin.Post("/admin/seq:reconcile", g.reconcileSeqs)
+
+	addr := cfg.HTTP.Addr
+	if env := os.Getenv("EVENTIDE_GATEWAY_ADDR"); env != "" {
+		addr = env
+	}
+	srv := httpx.New(addr, r)
+	go func() {
+		<-ctx.Done()
+		_ = srv.Shutdown(context.Background())
+	}()
+	log.Printf("event-gateway listening on %s", addr)
+	if err := srv.ListenAndServe(); err != nil {
+		log.Fatalf("serve: %v", err)
+	}
+}
+
+func (g *gateway) append(w http.ResponseWriter, req *http.Request) {
+	var in appendRequest
+	dec := json.NewDecoder(req.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	expectedSeq, err := parseExpectedSeq(req, in.ExpectedSeq)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	r.Post("/events:append", func(w http.ResponseWriter, req *http.Request) {
-		var in appendRequest
-		dec := json.NewDecoder(req.Body)
-		dec.DisallowUnknownFields()
-		if err := dec.Decode(&in); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+	e := in.Event
+	e.TenantID = auth.FromContext(req.Context()).TenantID
+	applyTraceHeaders(req, &e)
+	if err := fillDefaults(&e); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if expectedSeq != nil && e.Seq != 0 && e.Seq != *expectedSeq+1 {
+		http.Error(w, "seq must be expected_seq+1", http.StatusBadRequest)
+		return
+	}
+	// Everything that can reject the event runs before a seq is reserved:
+	// a reservation cannot be undone, and a conditional append that moved
+	// the head without writing would make the producer's next
+	// expected_seq wrong. Validate accepts the zero seq a reservation
+	// fills in.
+	if err := e.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !checkTenant(req.Context(), w, g.owners, e.ThreadID, e.TenantID) {
+		return
+	}
+	if pve := g.validator.validate(e); pve != nil {
+		writeSchemaError(w, nil, e, pve)
+		return
+	}
+	if !checkTurn(req.Context(), w, g.turns, &e) {
+		return
+	}
+	// Admit last, and give back whatever was not written.
+	ch, ok := g.limits.admit(req.Context(), w, e.TenantID, e.ThreadID, []eventide.Event{e})
+	if !ok {
+		return
+	}
+	defer g.limits.settle(req.Context(), ch)
+	events := []eventide.Event{e}
+	retry, err := g.conditionalRetry(req.Context(), expectedSeq, e.ThreadID, events)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	e = events[0]
+	switch {
+	case retry:
+	case expectedSeq != nil:
+		start, head, ok, err := g.seqs.reserveIfMatch(req.Context(), e.ThreadID, 1, *expectedSeq)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-
-		e := in.Event
-		if e.SpecVersion == "" {
-			e.SpecVersion = eventide.SpecVersion
+		if !ok {
+			writeSeqConflict(w, *expectedSeq, head)
+			return
 		}
-		if e.EventID == "" {
-			idStr, err := id.NewULID()
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			e.EventID = idStr
+		e.Seq = start
+	case e.Seq == 0:
+		seq, err := g.seqs.reserve(req.Context(), e.ThreadID, 1)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		e.Seq = seq
+	}
+	if err := g.payloads.offload(req.Context(), &e); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	streamID, duplicated, err := ingestWithRetry(req.Context(), func() (string, bool, error) {
+		return ingestEvent(req.Context(), g.rdb, g.trimMaxLen, g.dedupe, g.turns, e)
+	})
+	if err != nil {
+		writeIngestError(w, false, []eventide.Event{e}, err)
+		return
+	}
+	if !duplicated {
+		ch.markWritten(0)
+	}
+	countAppended(duplicated)
+	w.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(w).Encode(appendResponse{EventID: e.EventID, Seq: e.Seq, StreamID: streamID, Duplicated: duplicated})
+}
+
+func (g *gateway) appendBatch(w http.ResponseWriter, req *http.Request) {
+	var in appendBatchRequest
+	dec := json.NewDecoder(req.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(in.Events) == 0 {
+		http.Error(w, "events is required", http.StatusBadRequest)
+		return
+	}
+	expectedSeq, err := parseExpectedSeq(req, in.ExpectedSeq)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(in.Events) > maxBatchEvents {
+		http.Error(w, fmt.Sprintf("too many events (max %d)", maxBatchEvents), http.StatusBadRequest)
+		return
+	}
+
+	events := in.Events
+	threadID := events[0].ThreadID
+	if strings.TrimSpace(threadID) == "" {
+		http.Error(w, "thread_id is required", http.StatusBadRequest)
+		return
+	}
+	tenantID := auth.FromContext(req.Context()).TenantID
+	var needSeq int64
+	for i := range events {
+		if events[i].ThreadID != threadID {
+			http.Error(w, fmt.Sprintf("events[%d]: all events must share thread_id", i), http.StatusBadRequest)
+			return
 		}
-		if e.TS.IsZero() {
-			e.TS = time.Now().UTC()
+		events[i].TenantID = tenantID
+		applyTraceHeaders(req, &events[i])
+		if err := fillDefaults(&events[i]); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
-		if e.Seq == 0 {
-			if strings.TrimSpace(e.ThreadID) == "" {
-				http.Error(w, "thread_id is required", http.StatusBadRequest)
-				return
-			}
-			seq, err := rdb.NextSeq(req.Context(), e.ThreadID)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			e.Seq = seq
+		if events[i].Seq == 0 {
+			needSeq++
+		} else if expectedSeq != nil {
+			http.Error(w, fmt.Sprintf("events[%d]: seq must be empty when expected_seq is set", i), http.StatusBadRequest)
+			return
 		}
+	}
+	// As for single appends, nothing may reject the batch once its seqs
+	// are reserved.
+	for i, e := range events {
 		if err := e.Validate(); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			http.Error(w, fmt.Sprintf("events[%d]: %v", i, err), http.StatusBadRequest)
 			return
 		}
-
-		streamID, duplicated, err := ingestWithRetry(req.Context(), func() (string, bool, error) {
-			return ingestEvent(req.Context(), rdb, cfg.Streams.TrimMaxLen, e)
-		})
+	}
+	if !checkTenant(req.Context(), w, g.owners, threadID, tenantID) {
+		return
+	}
+	for i, e := range events {
+		if pve := g.validator.validate(e); pve != nil {
+			writeSchemaError(w, &i, e, pve)
+			return
+		}
+	}
+	tv, err := g.turns.check(req.Context(), threadID, events)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if tv != nil {
+		writeTurnViolation(w, &tv.Index, events[tv.Index], tv.Violation)
+		return
+	}
+	ch, ok := g.limits.admit(req.Context(), w, tenantID, threadID, events)
+	if !ok {
+		return
+	}
+	defer g.limits.settle(req.Context(), ch)
+	retry, err := g.conditionalRetry(req.Context(), expectedSeq, threadID, events)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	switch {
+	case retry:
+	case expectedSeq != nil:
+		next, head, ok, err := g.seqs.reserveIfMatch(req.Context(), threadID, needSeq, *expectedSeq)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		w.Header().Set("content-type", "application/json")
-		_ = json.NewEncoder(w).Encode(appendResponse{EventID: e.EventID, Seq: e.Seq, StreamID: streamID, Duplicated: duplicated})
-	})
-
-	r.Post("/ingest", func(w http.ResponseWriter, req *http.Request) {
-		var in ingestRequest
-		dec := json.NewDecoder(req.Body)
-		dec.DisallowUnknownFields()
-		if err := dec.Decode(&in); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+		if !ok {
+			writeSeqConflict(w, *expectedSeq, head)
 			return
 		}
-		e := in.Event
-		if err := e.Validate(); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
+		for i := range events {
+			events[i].Seq = next
+			next++
 		}
-		streamID, _, err := ingestWithRetry(req.Context(), func() (string, bool, error) {
-			return ingestEvent(req.Context(), rdb, cfg.Streams.TrimMaxLen, e)
-		})
+	case needSeq > 0:
+		// Reserve one contiguous block so the batch keeps its order
+		// without a round trip per event.
+		next, err := g.seqs.reserve(req.Context(), threadID, needSeq)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		w.Header().Set("content-type", "application/json")
-		_ = json.NewEncoder(w).Encode(ingestResponse{StreamID: streamID})
+		for i := range events {
+			if events[i].Seq == 0 {
+				events[i].Seq = next
+				next++
+			}
+		}
+	}
+	for i := range events {
+		if err := g.payloads.offload(req.Context(), &events[i]); err != nil {
+			http.Error(w, fmt.Sprintf("events[%d]: %v", i, err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var results []redisstreams.XAddResult
+	err = withRetry(req.Context(), func() error {
+		var err error
+		results, err = ingestEvents(req.Context(), g.rdb, g.trimMaxLen, g.dedupe, g.turns, threadID, events)
+		return err
 	})
+	if err != nil {
+		writeIngestError(w, true, events, err)
+		return
+	}
+	resp := appendBatchResponse{Results: make([]appendResponse, 0, len(events))}
+	for i, e := range events {
+		if !results[i].Duplicated {
+			ch.markWritten(i)
+		}
+		countAppended(results[i].Duplicated)
+		resp.Results = append(resp.Results, appendResponse{
+			EventID:    e.EventID,
+			Seq:        e.Seq,
+			StreamID:   results[i].StreamID,
+			Duplicated: results[i].Duplicated,
+		})
+	}
+	w.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
 
-	addr := cfg.HTTP.Addr
-	if env := os.Getenv("EVENTIDE_GATEWAY_ADDR"); env != "" {
-		addr = env
+func (g *gateway) ingest(w http.ResponseWriter, req *http.Request) {
+	var in ingestRequest
+	dec := json.NewDecoder(req.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	srv := httpx.New(addr, r)
-	go func() {
-		<-ctx.Done()
-		_ = srv.Shutdown(context.Background())
-	}()
-	log.Printf("event-gateway listening on %s", addr)
-	if err := srv.ListenAndServe(); err != nil {
-		log.Fatalf("serve: %v", err)
+	e := in.Event
+	e.TenantID = auth.FromContext(req.Context()).TenantID
+	if err := e.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !checkTenant(req.Context(), w, g.owners, e.ThreadID, e.TenantID) {
+		return
+	}
+	if pve := g.validator.validate(e); pve != nil {
+		writeSchemaError(w, nil, e, pve)
+		return
+	}
+	if !checkTurn(req.Context(), w, g.turns, &e) {
+		return
+	}
+	// Payload quotas apply to the payload as sent, before offload.
+	ch, ok := g.limits.admit(req.Context(), w, e.TenantID, e.ThreadID, []eventide.Event{e})
+	if !ok {
+		return
+	}
+	defer g.limits.settle(req.Context(), ch)
+	if err := g.payloads.offload(req.Context(), &e); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	streamID, duplicated, err := ingestWithRetry(req.Context(), func() (string, bool, error) {
+		return ingestEvent(req.Context(), g.rdb, g.trimMaxLen, g.dedupe, g.turns, e)
+	})
+	if err != nil {
+		writeIngestError(w, false, []eventide.Event{e}, err)
+		return
+	}
+	if !duplicated {
+		ch.markWritten(0)
 	}
+	countAppended(duplicated)
+	w.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(w).Encode(ingestResponse{StreamID: streamID})
 }
 
-func ingestEvent(ctx context.Context, rdb *redisstreams.Client, trimMaxLen int64, e eventide.Event) (string, bool, error) {
+func (g *gateway) reconcileSeqs(w http.ResponseWriter, req *http.Request) {
+	res, err := g.seqs.reconcile(req.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// conditionalRetry reports whether a conditional append repeats one that was
+// already written. Its first attempt moved the head past expected_seq, so
+// the seq check would fail it; instead the events get back the seqs of that
+// write, and writing them again reports them as duplicated. Only retries
+// that dedupe still remembers in full are recognized.
+func (g *gateway) conditionalRetry(ctx context.Context, expectedSeq *int64, threadID string, events []eventide.Event) (bool, error) {
+	if expectedSeq == nil || g.dedupe.TTL <= 0 {
+		return false, nil
+	}
+	ids := make([]string, len(events))
+	for i, e := range events {
+		ids[i] = e.EventID
+	}
+	written, err := g.rdb.LookupWritten(ctx, threadID, ids)
+	if err != nil {
+		return false, err
+	}
+	for _, we := range written {
+		if we.StreamID == "" {
+			return false, nil
+		}
+	}
+	for i := range events {
+		events[i].Seq = written[i].Seq
+	}
+	return true, nil
+}
+
+func ingestEvent(ctx context.Context, rdb *redisstreams.Client, trimMaxLen int64, dedupe redisstreams.DedupePolicy, turns *turnGuard, e eventide.Event) (string, bool, error) {
 	payloadStr := string(e.Payload)
 	encoded, err := e.Encode()
 	if err != nil {
 		return "", false, err
 	}
-	dedupeTTL := 7 * 24 * time.Hour
 	return rdb.IdempotentXAddEvent(
 		ctx,
+		e.TenantID,
 		e.ThreadID,
 		e.EventID,
 		e.Seq,
@@ -172,28 +549,209 @@ func ingestEvent(ctx context.Context, rdb *redisstreams.Client, trimMaxLen int64
 		string(e.Level),
 		payloadStr,
 		string(encoded),
+		turns.kind(e.Type),
 		trimMaxLen,
-		dedupeTTL,
+		dedupe,
+		turns.policy(),
 	)
 }
 
+func ingestEvents(ctx context.Context, rdb *redisstreams.Client, trimMaxLen int64, dedupe redisstreams.DedupePolicy, turns *turnGuard, threadID string, events []eventide.Event) ([]redisstreams.XAddResult, error) {
+	entries := make([]redisstreams.EventEntry, 0, len(events))
+	for _, e := range events {
+		encoded, err := e.Encode()
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, redisstreams.EventEntry{
+			TenantID:      e.TenantID,
+			EventID:       e.EventID,
+			Seq:           e.Seq,
+			TurnID:        e.TurnID,
+			TSRFC3339Nano: e.TS.Format(time.RFC3339Nano),
+			Type:          e.Type,
+			Level:         string(e.Level),
+			Payload:       string(e.Payload),
+			EventJSON:     string(encoded),
+			TurnKind:      turns.kind(e.Type),
+		})
+	}
+	return rdb.IdempotentXAddEvents(ctx, threadID, entries, trimMaxLen, dedupe, turns.policy())
+}
+
+// parseExpectedSeq returns the expected head seq from the request body or the
+// If-Match header (a bare or quoted integer). When both are present they must
+// agree.
+func parseExpectedSeq(req *http.Request, fromBody *int64) (*int64, error) {
+	if fromBody != nil && *fromBody < 0 {
+		return nil, errors.New("invalid expected_seq")
+	}
+	v := strings.TrimSpace(req.Header.Get("If-Match"))
+	if v == "" {
+		return fromBody, nil
+	}
+	v = strings.Trim(strings.TrimPrefix(v, "W/"), `"`)
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return nil, errors.New("invalid If-Match")
+	}
+	if fromBody != nil && *fromBody != n {
+		return nil, errors.New("expected_seq and If-Match disagree")
+	}
+	return &n, nil
+}
+
+func writeSeqConflict(w http.ResponseWriter, expected, current int64) {
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	_ = json.NewEncoder(w).Encode(seqConflictResponse{
+		Error:       "seq conflict",
+		ExpectedSeq: expected,
+		CurrentSeq:  current,
+	})
+}
+
+// applyTraceHeaders fills e.Trace from the request's W3C trace context
+// (traceparent/tracestate) when the producer did not set one.
+func applyTraceHeaders(req *http.Request, e *eventide.Event) {
+	if len(e.Trace) > 0 {
+		return
+	}
+	if tc, ok := eventide.TraceContextFromHeaders(req.Header); ok {
+		e.Trace = tc.Map()
+	}
+}
+
+// fillDefaults sets the envelope fields the gateway is allowed to default.
+// Seq is left alone because single and batch appends allocate it differently.
+func fillDefaults(e *eventide.Event) error {
+	if e.SpecVersion == "" {
+		e.SpecVersion = eventide.SpecVersion
+	}
+	if e.EventID == "" {
+		idStr, err := id.NewULID()
+		if err != nil {
+			return err
+		}
+		e.EventID = idStr
+	}
+	if e.TS.IsZero() {
+		e.TS = time.Now().UTC()
+	}
+	return nil
+}
+
 func ingestWithRetry(ctx context.Context, op func() (string, bool, error)) (string, bool, error) {
+	var (
+		streamID   string
+		duplicated bool
+	)
+	err := withRetry(ctx, func() error {
+		var err error
+		streamID, duplicated, err = op()
+		return err
+	})
+	if err != nil {
+		return "", false, err
+	}
+	return streamID, duplicated, nil
+}
+
+func withRetry(ctx context.Context, op func() error) error {
 	delays := []time.Duration{10 * time.Millisecond, 100 * time.Millisecond, 500 * time.Millisecond, time.Second, 2 * time.Second}
 	for i := 0; i < len(delays)+1; i++ {
-		streamID, duplicated, err := op()
+		err := op()
 		if err == nil {
-			return streamID, duplicated, nil
+			return nil
 		}
-		if i == len(delays) {
-			return "", false, err
+		if i == len(delays) || isRefusal(err) {
+			return err
 		}
+		metrics.IngestRetries.Inc()
 		t := time.NewTimer(delays[i])
 		select {
 		case <-ctx.Done():
 			t.Stop()
-			return "", false, ctx.Err()
+			return ctx.Err()
 		case <-t.C:
 		}
 	}
-	return "", false, nil
+	return nil
+}
+
+// isRefusal reports whether err is the append script refusing a write,
+// which a retry would not change.
+func isRefusal(err error) bool {
+	var (
+		tv *redisstreams.TurnViolationError
+		oe *redisstreams.ThreadOwnerError
+	)
+	return errors.As(err, &tv) || errors.As(err, &oe)
+}
+
+// writeIngestError writes the response for an error from the append script.
+// Refusals get the same response as the checks that run before it: a strict
+// turn violation (the turn moved after check) is a 409, with the index when
+// batch is set, and a thread claimed by another tenant meanwhile is a 403.
+func writeIngestError(w http.ResponseWriter, batch bool, events []eventide.Event, err error) {
+	var (
+		tv *redisstreams.TurnViolationError
+		oe *redisstreams.ThreadOwnerError
+	)
+	switch {
+	case errors.As(err, &tv) && tv.Index < len(events):
+		var index *int
+		if batch {
+			index = &tv.Index
+		}
+		writeTurnViolation(w, index, events[tv.Index], tv.Violation)
+	case errors.As(err, &oe):
+		http.Error(w, "thread belongs to another tenant", http.StatusForbidden)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func countAppended(duplicated bool) {
+	if duplicated {
+		metrics.AppendedEvents.WithLabelValues("duplicated").Inc()
+		return
+	}
+	metrics.AppendedEvents.WithLabelValues("written").Inc()
+}
+
+// checkTurn runs a single event through the turn guard and writes the error
+// response when it must be rejected.
+func checkTurn(ctx context.Context, w http.ResponseWriter, turns *turnGuard, e *eventide.Event) bool {
+	events := []eventide.Event{*e}
+	tv, err := turns.check(ctx, e.ThreadID, events)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if tv != nil {
+		writeTurnViolation(w, nil, *e, tv.Violation)
+		return false
+	}
+	*e = events[0]
+	return true
+}
+
+func getenvDefault(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func getenvIntDefault(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return def
+	}
+	return n
 }
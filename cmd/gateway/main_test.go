@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/warjiang/eventide/internal/auth"
+	"github.com/warjiang/eventide/internal/config"
+	"github.com/warjiang/eventide/internal/pgstore"
+	"github.com/warjiang/eventide/internal/redisstreams"
+	"github.com/warjiang/eventide/sdk/go/eventide"
+)
+
+// fakeStore stands in for Postgres: the last persisted seq and the owning
+// tenant of each thread.
+type fakeStore struct {
+	lastSeq map[string]int64
+	owners  map[string]string
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{lastSeq: make(map[string]int64), owners: make(map[string]string)}
+}
+
+func (s *fakeStore) LastSeq(_ context.Context, threadID string) (int64, error) {
+	return s.lastSeq[threadID], nil
+}
+
+func (s *fakeStore) ListThreadSeqs(_ context.Context, after string, limit int64) ([]pgstore.ThreadSeq, error) {
+	ids := make([]string, 0, len(s.lastSeq))
+	for id := range s.lastSeq {
+		if id > after {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	if int64(len(ids)) > limit {
+		ids = ids[:limit]
+	}
+	out := make([]pgstore.ThreadSeq, 0, len(ids))
+	for _, id := range ids {
+		out = append(out, pgstore.ThreadSeq{ThreadID: id, LastSeq: s.lastSeq[id]})
+	}
+	return out, nil
+}
+
+func (s *fakeStore) GetThread(_ context.Context, threadID string) (pgstore.Thread, bool, error) {
+	tenantID, ok := s.owners[threadID]
+	return pgstore.Thread{ThreadID: threadID, TenantID: tenantID}, ok, nil
+}
+
+// newTestGateway returns a gateway on miniredis with every check off and
+// dedupe on.
+func newTestGateway(t *testing.T) (*gateway, *miniredis.Miniredis, *fakeStore) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb := redisstreams.New(config.RedisConfig{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = rdb.Close() })
+	validator, err := newPayloadValidator(schemaModeOff, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	turns, err := newTurnGuard(turnModeOff, rdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newFakeStore()
+	g := &gateway{
+		rdb:        rdb,
+		trimMaxLen: 1000,
+		dedupe:     redisstreams.DedupePolicy{TTL: time.Hour},
+		validator:  validator,
+		turns:      turns,
+		seqs:       &seqAllocator{rdb: rdb, store: store},
+		owners:     &threadOwners{rdb: rdb, store: store},
+		limits:     &limiter{rdb: rdb},
+		payloads:   &payloadOffloader{},
+	}
+	return g, mr, store
+}
+
+// serve runs h on a request with body as the tenant "acme".
+func serve(t *testing.T, h http.HandlerFunc, body any, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	b, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(b))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	p := auth.Principal{TenantID: "acme", Method: auth.MethodAnonymous}
+	req = req.WithContext(auth.WithPrincipal(req.Context(), p))
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	return rec
+}
+
+func testEvent(eventID string) eventide.Event {
+	return eventide.Event{
+		SpecVersion: eventide.SpecVersion,
+		EventID:     eventID,
+		ThreadID:    "th1",
+		TurnID:      "t1",
+		TS:          time.Now().UTC(),
+		Type:        eventide.TypeMessageDelta,
+		Level:       eventide.LevelInfo,
+		Payload:     json.RawMessage(`{"message_id":"m1","delta":"hi"}`),
+	}
+}
+
+func TestWriteCheckOrder(t *testing.T) {
+	// Each case fails the check it is named after and every check after
+	// it, so the status shows which check ran first.
+	otherTenant := func(s *fakeStore) { s.owners["th1"] = "other" }
+	badSchema := func(g *gateway, e *eventide.Event) {
+		g.validator.mode = schemaModeEnforce
+		e.Payload = json.RawMessage(`{"delta":1}`)
+	}
+	strictTurns := func(g *gateway) { g.turns.mode = turnModeStrict }
+	noTokens := func(g *gateway) { g.limits.tenant = redisstreams.RateLimit{Rate: 0.001, Burst: 1} }
+
+	cases := []struct {
+		name  string
+		setup func(g *gateway, s *fakeStore, e *eventide.Event)
+		want  int
+	}{
+		{"validate", func(g *gateway, s *fakeStore, e *eventide.Event) {
+			e.TurnID = ""
+			otherTenant(s)
+			badSchema(g, e)
+			strictTurns(g)
+			noTokens(g)
+		}, http.StatusBadRequest},
+		{"tenant", func(g *gateway, s *fakeStore, e *eventide.Event) {
+			otherTenant(s)
+			badSchema(g, e)
+			strictTurns(g)
+			noTokens(g)
+		}, http.StatusForbidden},
+		{"schema", func(g *gateway, s *fakeStore, e *eventide.Event) {
+			badSchema(g, e)
+			strictTurns(g)
+			noTokens(g)
+		}, http.StatusUnprocessableEntity},
+		{"turn", func(g *gateway, s *fakeStore, e *eventide.Event) {
+			strictTurns(g)
+			noTokens(g)
+		}, http.StatusConflict},
+		{"limits", func(g *gateway, s *fakeStore, e *eventide.Event) {
+			noTokens(g)
+		}, http.StatusTooManyRequests},
+		{"ok", func(g *gateway, s *fakeStore, e *eventide.Event) {}, http.StatusOK},
+	}
+	handlers := []struct {
+		name    string
+		handler func(g *gateway) http.HandlerFunc
+		body    func(e eventide.Event) any
+		reserve bool
+	}{
+		{"append", func(g *gateway) http.HandlerFunc { return g.append }, func(e eventide.Event) any { return appendRequest{Event: e} }, true},
+		{"appendBatch", func(g *gateway) http.HandlerFunc { return g.appendBatch }, func(e eventide.Event) any { return appendBatchRequest{Events: []eventide.Event{e}} }, true},
+		{"ingest", func(g *gateway) http.HandlerFunc { return g.ingest }, func(e eventide.Event) any { e.Seq = 1; return ingestRequest{Event: e} }, false},
+	}
+	for _, h := range handlers {
+		for _, tc := range cases {
+			t.Run(h.name+"/"+tc.name, func(t *testing.T) {
+				g, mr, store := newTestGateway(t)
+				e := testEvent("e1")
+				tc.setup(g, store, &e)
+				if g.limits.tenant.Enabled() {
+					// Use up the only token.
+					res, err := g.rdb.Admit(context.Background(), redisstreams.Admission{TenantID: "acme", ThreadID: "th0", Events: 1, TenantLimit: g.limits.tenant})
+					if err != nil || res.Reason != "" {
+						t.Fatalf("admit: %+v %v", res, err)
+					}
+				}
+
+				rec := serve(t, h.handler(g), h.body(e), nil)
+				if rec.Code != tc.want {
+					t.Fatalf("status = %d, want %d: %s", rec.Code, tc.want, rec.Body)
+				}
+				// Only a write that passed every check takes a seq.
+				reserved := mr.Exists(redisstreams.SeqKey("th1"))
+				if want := tc.want == http.StatusOK && h.reserve; reserved != want {
+					t.Fatalf("seq reserved = %v, want %v", reserved, want)
+				}
+				n, err := g.rdb.XLen(context.Background(), redisstreams.StreamKey("th1"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := tc.want == http.StatusOK; (n == 1) != want {
+					t.Fatalf("stream length = %d after status %d", n, rec.Code)
+				}
+			})
+		}
+	}
+}
+
+func TestConditionalAppendRetry(t *testing.T) {
+	g, _, _ := newTestGateway(t)
+	expect := int64(0)
+	first := serve(t, g.append, appendRequest{Event: testEvent("e1"), ExpectedSeq: &expect}, nil)
+	if first.Code != http.StatusOK {
+		t.Fatalf("first append: %d %s", first.Code, first.Body)
+	}
+	var want appendResponse
+	if err := json.Unmarshal(first.Body.Bytes(), &want); err != nil {
+		t.Fatal(err)
+	}
+
+	// The retry finds the head moved by its first attempt, and gets that
+	// attempt's result back instead of a conflict.
+	rec := serve(t, g.append, appendRequest{Event: testEvent("e1"), ExpectedSeq: &expect}, nil)
+	var got appendResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("retry: %d %s", rec.Code, rec.Body)
+	}
+	want.Duplicated = true
+	if got != want {
+		t.Fatalf("retry = %+v, want %+v", got, want)
+	}
+
+	// A new event with the stale head still conflicts.
+	if rec := serve(t, g.append, appendRequest{Event: testEvent("e2"), ExpectedSeq: &expect}, nil); rec.Code != http.StatusConflict {
+		t.Fatalf("stale append: %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestConditionalAppendBatchRetry(t *testing.T) {
+	g, _, _ := newTestGateway(t)
+	batch := func(ids ...string) appendBatchRequest {
+		expect := int64(0)
+		in := appendBatchRequest{ExpectedSeq: &expect}
+		for _, id := range ids {
+			in.Events = append(in.Events, testEvent(id))
+		}
+		return in
+	}
+	first := serve(t, g.appendBatch, batch("e1", "e2"), nil)
+	if first.Code != http.StatusOK {
+		t.Fatalf("first batch: %d %s", first.Code, first.Body)
+	}
+	var want appendBatchResponse
+	if err := json.Unmarshal(first.Body.Bytes(), &want); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := serve(t, g.appendBatch, batch("e1", "e2"), http.Header{"If-Match": {`"0"`}})
+	var got appendBatchResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("retry: %d %s", rec.Code, rec.Body)
+	}
+	for i := range want.Results {
+		want.Results[i].Duplicated = true
+		if got.Results[i] != want.Results[i] {
+			t.Fatalf("retry = %+v, want %+v", got.Results, want.Results)
+		}
+	}
+
+	// A batch that is only partly written is not a retry.
+	if rec := serve(t, g.appendBatch, batch("e2", "e3"), nil); rec.Code != http.StatusConflict {
+		t.Fatalf("partial retry: %d %s", rec.Code, rec.Body)
+	}
+}
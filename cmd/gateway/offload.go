@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/warjiang/eventide/internal/config"
+	"github.com/warjiang/eventide/internal/s3store"
+	"github.com/warjiang/eventide/sdk/go/eventide"
+)
+
+// payloadOffloader moves payloads larger than threshold bytes to S3 and
+// replaces them with a reference envelope (claim check), keeping large tool
+// results out of Redis and the events table.
+type payloadOffloader struct {
+	s3        *s3store.Client
+	threshold int
+}
+
+func newPayloadOffloader(ctx context.Context, cfg config.S3Config, threshold int) (*payloadOffloader, error) {
+	if threshold <= 0 {
+		return &payloadOffloader{}, nil
+	}
+	s3c, err := s3store.New(ctx, s3store.Config{
+		Endpoint:        cfg.Endpoint,
+		Region:          cfg.Region,
+		Bucket:          cfg.Bucket,
+		AccessKeyID:     cfg.AccessKeyID,
+		SecretAccessKey: cfg.SecretAccessKey,
+		Prefix:          cfg.Prefix,
+		UsePathStyle:    cfg.UsePathStyle,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := s3c.EnsureBucket(ctx); err != nil {
+		return nil, err
+	}
+	return &payloadOffloader{s3: s3c, threshold: threshold}, nil
+}
+
+// offload replaces e.Payload with a reference when it exceeds the threshold.
+// The object key is derived from the event ID, so retries overwrite the same
+// object.
+func (o *payloadOffloader) offload(ctx context.Context, e *eventide.Event) error {
+	if o.s3 == nil || len(e.Payload) <= o.threshold {
+		return nil
+	}
+	contentType := e.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	key := o.s3.Key(s3store.PayloadPath(e.ThreadID, e.EventID))
+	if err := o.s3.PutObject(ctx, key, e.Payload, contentType, ""); err != nil {
+		return fmt.Errorf("offload payload: %w", err)
+	}
+	ref, err := json.Marshal(eventide.NewPayloadRef(key, e.Payload, contentType))
+	if err != nil {
+		return err
+	}
+	e.Payload = ref
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/warjiang/eventide/sdk/go/eventide"
+)
+
+const (
+	schemaModeOff     = "off"
+	schemaModeWarn    = "warn"
+	schemaModeEnforce = "enforce"
+)
+
+// payloadValidator checks event payloads against the SDK schema registry.
+// In warn mode mismatches are only logged; in enforce mode they are rejected
+// with 422.
+type payloadValidator struct {
+	mode     string
+	registry *eventide.SchemaRegistry
+}
+
+type schemaErrorResponse struct {
+	Error   string                 `json:"error"`
+	Index   *int                   `json:"index,omitempty"`
+	EventID string                 `json:"event_id"`
+	Type    string                 `json:"type"`
+	Issues  []eventide.SchemaIssue `json:"issues"`
+}
+
+// newPayloadValidator builds a validator for mode. Custom schemas are loaded
+// from dir, one file per event type named "<type>.json".
+func newPayloadValidator(mode, dir string) (*payloadValidator, error) {
+	switch mode {
+	case schemaModeOff, schemaModeWarn, schemaModeEnforce:
+	default:
+		return nil, fmt.Errorf("invalid schema validation mode %q", mode)
+	}
+	v := &payloadValidator{mode: mode, registry: eventide.NewSchemaRegistry()}
+	if mode == schemaModeOff || dir == "" {
+		return v, nil
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		eventType := strings.TrimSuffix(filepath.Base(f), ".json")
+		if err := v.registry.Register(eventType, b); err != nil {
+			return nil, fmt.Errorf("schema %s: %w", f, err)
+		}
+		log.Printf("registered payload schema for %s", eventType)
+	}
+	return v, nil
+}
+
+// validate returns the validation error to reject e with, or nil when e is
+// accepted (including warn-mode mismatches).
+func (v *payloadValidator) validate(e eventide.Event) *eventide.PayloadValidationError {
+	if v.mode == schemaModeOff {
+		return nil
+	}
+	err := v.registry.Validate(e)
+	var pve *eventide.PayloadValidationError
+	if !errors.As(err, &pve) {
+		return nil
+	}
+	if v.mode == schemaModeWarn {
+		log.Printf("schema mismatch (event_id=%s thread_id=%s): %v", e.EventID, e.ThreadID, pve)
+		return nil
+	}
+	return pve
+}
+
+func writeSchemaError(w http.ResponseWriter, index *int, e eventide.Event, pve *eventide.PayloadValidationError) {
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	_ = json.NewEncoder(w).Encode(schemaErrorResponse{
+		Error:   "payload does not match schema",
+		Index:   index,
+		EventID: e.EventID,
+		Type:    e.Type,
+		Issues:  pve.Issues,
+	})
+}
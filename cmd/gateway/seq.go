@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/warjiang/eventide/internal/pgstore"
+	"github.com/warjiang/eventide/internal/redisstreams"
+)
+
+// seqAllocator hands out per-thread seqs from Redis. When a thread's counter
+// is missing (a new thread, or Redis lost its data) it is seeded from the
+// highest seq already persisted in Postgres or still present in the thread
+// stream, so seqs never restart below events that already exist.
+type seqAllocator struct {
+	rdb   *redisstreams.Client
+	store seqStore
+}
+
+// seqStore reads the seqs persisted in Postgres.
+type seqStore interface {
+	LastSeq(ctx context.Context, threadID string) (int64, error)
+	ListThreadSeqs(ctx context.Context, afterThreadID string, limit int64) ([]pgstore.ThreadSeq, error)
+}
+
+func (a *seqAllocator) reserve(ctx context.Context, threadID string, n int64) (int64, error) {
+	start, err := a.rdb.ReserveSeqRange(ctx, threadID, n)
+	if !errors.Is(err, redisstreams.ErrSeqNotInitialized) {
+		return start, err
+	}
+	if err := a.seed(ctx, threadID); err != nil {
+		return 0, err
+	}
+	return a.rdb.ReserveSeqRange(ctx, threadID, n)
+}
+
+func (a *seqAllocator) reserveIfMatch(ctx context.Context, threadID string, n, expected int64) (int64, int64, bool, error) {
+	start, head, ok, err := a.rdb.ReserveSeqRangeIfMatch(ctx, threadID, n, expected)
+	if !errors.Is(err, redisstreams.ErrSeqNotInitialized) {
+		return start, head, ok, err
+	}
+	if err := a.seed(ctx, threadID); err != nil {
+		return 0, 0, false, err
+	}
+	return a.rdb.ReserveSeqRangeIfMatch(ctx, threadID, n, expected)
+}
+
+func (a *seqAllocator) seed(ctx context.Context, threadID string) error {
+	floor, err := a.store.LastSeq(ctx, threadID)
+	if err != nil {
+		return err
+	}
+	streamSeq, err := a.rdb.LastStreamSeq(ctx, threadID)
+	if err != nil {
+		return err
+	}
+	if streamSeq > floor {
+		floor = streamSeq
+	}
+	if floor > 0 {
+		log.Printf("seeding seq counter for thread %s at %d", threadID, floor)
+	}
+	return a.rdb.SeedSeq(ctx, threadID, floor)
+}
+
+// reconcilePageSize is how many threads reconcile reads from Postgres at a
+// time.
+const reconcilePageSize = 500
+
+type reconcileResult struct {
+	Checked int64 `json:"checked"`
+	Fixed   int64 `json:"fixed"`
+}
+
+// reconcile raises every existing Redis seq counter that is behind the
+// thread's last_seq in Postgres. Missing counters are left to the lazy seed
+// in reserve.
+func (a *seqAllocator) reconcile(ctx context.Context) (reconcileResult, error) {
+	var (
+		res   reconcileResult
+		after string
+	)
+	for {
+		page, err := a.store.ListThreadSeqs(ctx, after, reconcilePageSize)
+		if err != nil {
+			return res, err
+		}
+		if len(page) == 0 {
+			return res, nil
+		}
+		for _, ts := range page {
+			raised, err := a.rdb.RaiseSeq(ctx, ts.ThreadID, ts.LastSeq)
+			if err != nil {
+				return res, err
+			}
+			res.Checked++
+			if raised {
+				res.Fixed++
+				log.Printf("seq counter for thread %s was behind postgres, raised to %d", ts.ThreadID, ts.LastSeq)
+			}
+		}
+		after = page[len(page)-1].ThreadID
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/warjiang/eventide/internal/redisstreams"
+)
+
+// addStreamSeq appends an entry with seq to the thread stream without
+// touching its seq counter, like events left behind when Redis lost the
+// counter.
+func addStreamSeq(t *testing.T, rdb *redisstreams.Client, threadID string, seq int64) {
+	t.Helper()
+	if _, err := rdb.XAddEvent(context.Background(), threadID, map[string]any{"seq": seq, "event": "{}"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSeqSeed(t *testing.T) {
+	cases := []struct {
+		name      string
+		pg        int64
+		stream    int64
+		wantStart int64
+	}{
+		{"new thread", 0, 0, 1},
+		{"postgres ahead", 10, 4, 11},
+		{"stream ahead", 3, 7, 8},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			g, _, store := newTestGateway(t)
+			ctx := context.Background()
+			store.lastSeq["th1"] = tc.pg
+			if tc.stream > 0 {
+				addStreamSeq(t, g.rdb, "th1", tc.stream)
+			}
+
+			start, err := g.seqs.reserve(ctx, "th1", 2)
+			if err != nil || start != tc.wantStart {
+				t.Fatalf("reserve = %d, %v, want %d", start, err, tc.wantStart)
+			}
+			// The counter exists now and is not seeded again.
+			store.lastSeq["th1"] = 100
+			if start, err := g.seqs.reserve(ctx, "th1", 1); err != nil || start != tc.wantStart+2 {
+				t.Fatalf("second reserve = %d, %v, want %d", start, err, tc.wantStart+2)
+			}
+		})
+	}
+}
+
+func TestSeqSeedIfMatch(t *testing.T) {
+	g, mr, store := newTestGateway(t)
+	ctx := context.Background()
+	store.lastSeq["th1"] = 5
+	addStreamSeq(t, g.rdb, "th1", 3)
+
+	// The head is the seeded seq, so a stale expectation conflicts.
+	_, head, ok, err := g.seqs.reserveIfMatch(ctx, "th1", 1, 4)
+	if err != nil || ok || head != 5 {
+		t.Fatalf("reserveIfMatch(4) = %d, %v, %v, want conflict at 5", head, ok, err)
+	}
+	mr.Del(redisstreams.SeqKey("th1"))
+	start, _, ok, err := g.seqs.reserveIfMatch(ctx, "th1", 2, 5)
+	if err != nil || !ok || start != 6 {
+		t.Fatalf("reserveIfMatch(5) = %d, %v, %v, want 6", start, ok, err)
+	}
+}
+
+func TestSeqReconcile(t *testing.T) {
+	g, mr, store := newTestGateway(t)
+	ctx := context.Background()
+	// More than two pages of threads in Postgres. Every counter that exists
+	// is behind, except the first thread's, which is ahead.
+	n := 2*reconcilePageSize + 1
+	for i := 0; i < n; i++ {
+		threadID := fmt.Sprintf("th%04d", i)
+		store.lastSeq[threadID] = 10
+		if i%2 == 0 {
+			mr.Set(redisstreams.SeqKey(threadID), "3")
+		}
+	}
+	mr.Set(redisstreams.SeqKey("th0000"), "20")
+
+	rec := serve(t, g.reconcileSeqs, nil, nil)
+	var res reconcileResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("reconcile: %d %s", rec.Code, rec.Body)
+	}
+	if want := (reconcileResult{Checked: int64(n), Fixed: int64(n / 2)}); res != want {
+		t.Fatalf("reconcile = %+v, want %+v", res, want)
+	}
+	for _, c := range []struct {
+		threadID string
+		want     string
+	}{
+		{"th0000", "20"},
+		{"th0002", "10"},
+		{fmt.Sprintf("th%04d", n-1), "10"},
+	} {
+		if got, _ := mr.Get(redisstreams.SeqKey(c.threadID)); got != c.want {
+			t.Fatalf("seq counter of %s = %q, want %s", c.threadID, got, c.want)
+		}
+	}
+	// Missing counters are left to the lazy seed.
+	if mr.Exists(redisstreams.SeqKey("th0001")) {
+		t.Fatal("reconcile created a missing counter")
+	}
+	if start, err := g.seqs.reserve(ctx, "th0001", 1); err != nil || start != 11 {
+		t.Fatalf("reserve after reconcile = %d, %v, want 11", start, err)
+	}
+}
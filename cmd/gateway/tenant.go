@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/warjiang/eventide/internal/pgstore"
+	"github.com/warjiang/eventide/internal/redisstreams"
+)
+
+// threadOwners pins every thread to the tenant of its first write. Postgres
+// is the source of truth; Redis caches the owner for the hot path. The append
+// script claims an unowned thread when it writes the thread's first event, so
+// a request that is rejected or fails claims nothing.
+type threadOwners struct {
+	rdb   *redisstreams.Client
+	store ownerStore
+}
+
+// ownerStore reads the owning tenant of threads from Postgres.
+type ownerStore interface {
+	GetThread(ctx context.Context, threadID string) (pgstore.Thread, bool, error)
+}
+
+// owner returns the tenant that owns threadID, or tenantID when the thread
+// has no owner yet.
+func (o *threadOwners) owner(ctx context.Context, threadID, tenantID string) (string, error) {
+	owner, ok, err := o.rdb.ThreadOwner(ctx, threadID)
+	if err != nil || ok {
+		return owner, err
+	}
+	th, ok, err := o.store.GetThread(ctx, threadID)
+	if err != nil {
+		return "", err
+	}
+	if !ok || th.TenantID == "" {
+		return tenantID, nil
+	}
+	if err := o.rdb.SetThreadOwner(ctx, threadID, th.TenantID); err != nil {
+		return "", err
+	}
+	return th.TenantID, nil
+}
+
+// checkTenant writes 403 and returns false when threadID belongs to a tenant
+// other than tenantID. Empty thread IDs are left to event validation.
+func checkTenant(ctx context.Context, w http.ResponseWriter, owners *threadOwners, threadID, tenantID string) bool {
+	if strings.TrimSpace(threadID) == "" {
+		return true
+	}
+	owner, err := owners.owner(ctx, threadID, tenantID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if owner != tenantID {
+		http.Error(w, "thread belongs to another tenant", http.StatusForbidden)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/warjiang/eventide/internal/redisstreams"
+	"github.com/warjiang/eventide/sdk/go/eventide"
+)
+
+const (
+	turnModeOff     = "off"
+	turnModeLenient = "lenient"
+	turnModeStrict  = "strict"
+)
+
+// turnStateTTL is how long a thread's turn state outlives its last change.
+const turnStateTTL = 7 * 24 * time.Hour
+
+// turnViolationTag is set on events accepted in lenient mode despite an
+// illegal turn transition.
+const turnViolationTag = "turn_violation"
+
+// turnGuard enforces the turn lifecycle per thread. In strict mode illegal
+// transitions are rejected; in lenient mode they are accepted but tagged.
+// check only reads turn state; the state moves in the script that writes
+// the events (see policy), so a rejected or failed write leaves it alone.
+type turnGuard struct {
+	mode string
+	rdb  *redisstreams.Client
+}
+
+type turnViolation struct {
+	Index     int
+	Violation string
+}
+
+type turnViolationResponse struct {
+	Error     string `json:"error"`
+	Index     *int   `json:"index,omitempty"`
+	EventID   string `json:"event_id"`
+	TurnID    string `json:"turn_id"`
+	Type      string `json:"type"`
+	Violation string `json:"violation"`
+}
+
+func newTurnGuard(mode string, rdb *redisstreams.Client) (*turnGuard, error) {
+	switch mode {
+	case turnModeOff, turnModeLenient, turnModeStrict:
+	default:
+		return nil, fmt.Errorf("invalid turn state mode %q", mode)
+	}
+	return &turnGuard{mode: mode, rdb: rdb}, nil
+}
+
+// check runs events (all of one thread, in order) through the turn state
+// machine without changing it. In strict mode it returns the first
+// violation. In lenient mode violating events are tagged in place.
+func (g *turnGuard) check(ctx context.Context, threadID string, events []eventide.Event) (*turnViolation, error) {
+	if g.mode == turnModeOff {
+		return nil, nil
+	}
+	items := make([]redisstreams.TurnTransition, 0, len(events))
+	idx := make([]int, 0, len(events))
+	for i, e := range events {
+		kind := turnKind(e.Type)
+		if kind == "" {
+			continue
+		}
+		items = append(items, redisstreams.TurnTransition{EventID: e.EventID, TurnID: e.TurnID, Kind: kind})
+		idx = append(idx, i)
+	}
+	violations, err := g.rdb.CheckTurnTransitions(ctx, threadID, items)
+	if err != nil {
+		return nil, err
+	}
+	for j, v := range violations {
+		if v == "" {
+			continue
+		}
+		i := idx[j]
+		if g.mode == turnModeStrict {
+			return &turnViolation{Index: i, Violation: v}, nil
+		}
+		e := &events[i]
+		log.Printf("turn violation %s (event_id=%s thread_id=%s turn_id=%s type=%s)", v, e.EventID, e.ThreadID, e.TurnID, e.Type)
+		tags := make(map[string]string, len(e.Tags)+1)
+		for k, tv := range e.Tags {
+			tags[k] = tv
+		}
+		tags[turnViolationTag] = v
+		e.Tags = tags
+	}
+	return nil, nil
+}
+
+// policy returns how the append script applies the transitions of the
+// events it writes. Strict mode re-checks them there, so a transition that
+// became illegal after check still refuses the write.
+func (g *turnGuard) policy() redisstreams.TurnPolicy {
+	return redisstreams.TurnPolicy{
+		Enabled: g.mode != turnModeOff,
+		Strict:  g.mode == turnModeStrict,
+		TTL:     turnStateTTL,
+	}
+}
+
+// kind returns the transition of an event of eventType, or "" when turns
+// are not enforced.
+func (g *turnGuard) kind(eventType string) string {
+	if g.mode == turnModeOff {
+		return ""
+	}
+	return turnKind(eventType)
+}
+
+func turnKind(eventType string) string {
+	switch eventType {
+	case eventide.TypeTurnStarted:
+		return redisstreams.TurnKindStart
+	case eventide.TypeTurnCompleted:
+		return redisstreams.TurnKindCompleted
+	case eventide.TypeTurnFailed:
+		return redisstreams.TurnKindFailed
+	case eventide.TypeTurnCancelled:
+		return redisstreams.TurnKindCancelled
+	case eventide.TypeThreadReady:
+		// Emitted by the infrastructure outside of any turn.
+		return ""
+	default:
+		return redisstreams.TurnKindEvent
+	}
+}
+
+func writeTurnViolation(w http.ResponseWriter, index *int, e eventide.Event, violation string) {
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	_ = json.NewEncoder(w).Encode(turnViolationResponse{
+		Error:     "illegal turn transition",
+		Index:     index,
+		EventID:   e.EventID,
+		TurnID:    e.TurnID,
+		Type:      e.Type,
+		Violation: violation,
+	})
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"log"
+	"os"
 	"path/filepath"
 	"sort"
 	"strings"
@@ -22,6 +23,11 @@ func main() {
 	}
 
 	ctx := context.Background()
+	if len(os.Args) > 1 && os.Args[1] == "redis-keys" {
+		migrateRedisKeys(ctx, cfg)
+		return
+	}
+
 	store, err := pgstore.New(ctx, cfg.Postgres.ConnString)
 	if err != nil {
 		log.Fatalf("pg: %v", err)
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/warjiang/eventide/internal/config"
+	"github.com/warjiang/eventide/internal/redisstreams"
+)
+
+// migrateRedisKeys moves per-thread Redis keys from the untagged names used
+// before cluster support to their hash-tagged names. Run it once every
+// gateway has been upgraded.
+func migrateRedisKeys(ctx context.Context, cfg config.Config) {
+	rdb := redisstreams.New(cfg.Redis)
+	defer func() { _ = rdb.Close() }()
+	if err := rdb.Ping(ctx); err != nil {
+		log.Fatalf("redis ping: %v", err)
+	}
+	stats, err := rdb.MigrateLegacyKeys(ctx, log.Printf)
+	if err != nil {
+		log.Fatalf("migrate redis keys: %v", err)
+	}
+	log.Printf("redis keys: moved=%d merged=%d skipped=%d", stats.Moved, stats.Merged, stats.Skipped)
+}
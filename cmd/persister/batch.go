@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/warjiang/eventide/internal/metrics"
+	"github.com/warjiang/eventide/internal/pgstore"
+	"github.com/warjiang/eventide/internal/redisstreams"
+)
+
+// readBatch reads up to p.batchSize new messages. After the first message
+// arrives it keeps reading for at most p.batchLatency to fill the batch.
+func (p *persister) readBatch(ctx context.Context) ([]redisstreams.GroupMessage, error) {
+	size := p.batchSize
+	msgs, err := p.rdb.XReadGroup(ctx, p.group, p.consumer, p.stream, ">", 5*time.Second, int64(size))
+	if err != nil || len(msgs) == 0 || p.batchLatency <= 0 {
+		return msgs, err
+	}
+	deadline := time.Now().Add(p.batchLatency)
+	for len(msgs) < size {
+		// XREADGROUP treats BLOCK 0 as "forever", so stop below a millisecond.
+		wait := time.Until(deadline)
+		if wait < time.Millisecond {
+			break
+		}
+		more, err := p.rdb.XReadGroup(ctx, p.group, p.consumer, p.stream, ">", wait, int64(size-len(msgs)))
+		if err != nil {
+			// What was read is pending on this consumer; persist it now.
+			log.Printf("xreadgroup %s: %v", p.stream, err)
+			break
+		}
+		msgs = append(msgs, more...)
+	}
+	return msgs, nil
+}
+
+// handleBatch persists msgs in one transaction and acknowledges them after it
+// commits. When the transaction fails as a whole, the messages are retried
+// one at a time so that a single bad event cannot hold back the rest.
+func (p *persister) handleBatch(ctx context.Context, msgs []redisstreams.GroupMessage) {
+	if len(msgs) == 0 {
+		return
+	}
+	if err := p.rdb.ResolveRefs(ctx, msgs); err != nil {
+		// The messages stay pending and are claimed again later.
+		log.Printf("resolve refs %s: %v", p.stream, err)
+		return
+	}
+	var (
+		ack      []string
+		items    []pgstore.BatchItem
+		itemMsgs []redisstreams.GroupMessage
+	)
+	for _, m := range msgs {
+		item, err := p.decode(m)
+		if errors.Is(err, redisstreams.ErrEntryMissing) {
+			// Retrying cannot bring the entry back; the message ends up in
+			// the dead-letter stream once its retries run out.
+			log.Printf("msg %s: %v", m.ID, err)
+			metrics.PersistedEvents.WithLabelValues("failed").Inc()
+			p.recordFailure(ctx, m.ID, err)
+			continue
+		}
+		if err != nil {
+			log.Printf("skip msg %s: %v", m.ID, err)
+			metrics.PersistedEvents.WithLabelValues("skipped").Inc()
+			ack = append(ack, m.ID)
+			continue
+		}
+		items = append(items, item)
+		itemMsgs = append(itemMsgs, m)
+	}
+	defer func() {
+		if len(ack) > 0 {
+			if _, err := p.rdb.XAck(ctx, p.stream, p.group, ack...); err != nil {
+				log.Printf("xack: %v", err)
+			}
+		}
+	}()
+	if len(items) == 0 {
+		return
+	}
+
+	start := time.Now()
+	results, err := p.store.PersistBatch(ctx, p.idleTimeoutSeconds, items)
+	metrics.PersistBatchDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		log.Printf("persist batch of %d: %v; retrying one by one", len(items), err)
+		for _, m := range itemMsgs {
+			persisted, acked := p.handleMessage(ctx, m)
+			if !persisted && !acked {
+				break
+			}
+		}
+		return
+	}
+	metrics.PersistBatchSize.Observe(float64(len(items)))
+
+	for i, err := range results {
+		m, e := itemMsgs[i], items[i].Event
+		var (
+			conflict *pgstore.SeqConflictError
+			mismatch *pgstore.TenantMismatchError
+		)
+		switch {
+		case err == nil:
+			metrics.PersistedEvents.WithLabelValues("persisted").Inc()
+			ack = append(ack, m.ID)
+		case errors.As(err, &conflict), errors.As(err, &mismatch):
+			log.Printf("quarantined msg %s: %v", m.ID, err)
+			metrics.PersistedEvents.WithLabelValues("quarantined").Inc()
+			ack = append(ack, m.ID)
+		default:
+			log.Printf("persist event %s/%d: %v", e.ThreadID, e.Seq, err)
+			metrics.PersistedEvents.WithLabelValues("failed").Inc()
+			p.recordFailure(ctx, m.ID, err)
+		}
+	}
+}
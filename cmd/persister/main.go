@@ -2,19 +2,22 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log"
 	"os"
 	"os/signal"
 	"strconv"
+	"sync"
 	"syscall"
 	"time"
 
 	_ "github.com/joho/godotenv/autoload"
 	"github.com/warjiang/eventide/internal/config"
+	"github.com/warjiang/eventide/internal/dlq"
 	"github.com/warjiang/eventide/internal/logx"
+	"github.com/warjiang/eventide/internal/metrics"
 	"github.com/warjiang/eventide/internal/pgstore"
 	"github.com/warjiang/eventide/internal/redisstreams"
-	"github.com/warjiang/eventide/sdk/go/eventide"
 )
 
 func main() {
@@ -24,7 +27,9 @@ func main() {
 		log.Fatalf("config: %v", err)
 	}
 
-	tenantID := getenvDefault("TENANT_ID", "default")
+	// defaultTenant applies to stream entries written before the gateway
+	// recorded a tenant per event.
+	defaultTenant := getenvDefault("TENANT_ID", "default")
 	idleTimeoutSeconds := getenvIntDefault("IDLE_TIMEOUT_SECONDS", 900)
 	group := getenvDefault("PERSISTER_GROUP", "persist")
 	consumer := getenvDefault("PERSISTER_CONSUMER", defaultConsumer())
@@ -32,7 +37,8 @@ func main() {
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
-	rdb := redisstreams.New(cfg.Redis.Addr, cfg.Redis.Username, cfg.Redis.Password, cfg.Redis.DB)
+	rdb := redisstreams.New(cfg.Redis)
+	rdb.SetGlobalShards(cfg.Streams.GlobalShards)
 	defer func() { _ = rdb.Close() }()
 	if err := rdb.Ping(ctx); err != nil {
 		log.Fatalf("redis ping: %v", err)
@@ -47,16 +53,123 @@ func main() {
 		log.Fatalf("pg ping: %v", err)
 	}
 
-	stream := redisstreams.GlobalStreamKey()
-	if err := rdb.EnsureConsumerGroupOnStream(ctx, stream, group); err != nil {
-		log.Fatalf("redis group: %v", err)
+	dlqStream := getenvDefault("PERSISTER_DLQ_STREAM", redisstreams.DLQStreamKey())
+	streams := rdb.GlobalStreams()
+	if rdb.Sharded() {
+		// Entries written before sharding was enabled stay on the unsharded
+		// key until they are drained.
+		streams = append(streams, redisstreams.GlobalStreamKey())
+	}
+	for _, s := range streams {
+		if err := rdb.EnsureConsumerGroupOnStream(ctx, s, group); err != nil {
+			log.Fatalf("redis group: %v", err)
+		}
+	}
+
+	if addr := getenvDefault("METRICS_ADDR", ":9102"); addr != "off" {
+		go serveMetrics(ctx, addr)
+		go collectStreamMetrics(ctx, rdb, streams, dlqStream, 15*time.Second)
+	}
+
+	if every := getenvDurationDefault("PERSISTER_TRIM_INTERVAL", 30*time.Second); every > 0 {
+		go trimLoop(ctx, rdb, streams, every, getenvDurationDefault("PERSISTER_TRIM_MARGIN", 5*time.Minute))
+	}
+
+	if every := getenvDurationDefault("PERSISTER_RECONCILE_INTERVAL", 15*time.Second); every > 0 && rdb.Cluster() {
+		go reconcileLoop(ctx, rdb, rdb.GlobalStreams(), every, getenvDurationDefault("PERSISTER_RECONCILE_AGE", 30*time.Second))
+	}
+
+	batchSize := getenvIntDefault("PERSISTER_BATCH_SIZE", 200)
+	if batchSize <= 0 {
+		batchSize = 200
+	}
+	p := &persister{
+		rdb:                rdb,
+		store:              store,
+		dlqStream:          dlqStream,
+		group:              group,
+		consumer:           consumer,
+		batchSize:          batchSize,
+		batchLatency:       getenvDurationDefault("PERSISTER_BATCH_MAX_LATENCY", 0),
+		maxRetries:         int64(getenvIntDefault("PERSISTER_MAX_RETRIES", 5)),
+		defaultTenant:      defaultTenant,
+		idleTimeoutSeconds: idleTimeoutSeconds,
 	}
 
-	log.Printf("persister started (stream=%s group=%s consumer=%s)", stream, group, consumer)
+	log.Printf("persister started (group=%s consumer=%s shards=%d batch=%d)", group, consumer, rdb.GlobalShards(), batchSize)
+	if !rdb.Sharded() {
+		p.forStream(redisstreams.GlobalStreamKey()).run(ctx)
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		p.forStream(redisstreams.GlobalStreamKey()).run(ctx)
+	}()
+	if v := os.Getenv("PERSISTER_SHARDS"); v != "" {
+		shards, err := parseShards(v, rdb.GlobalShards())
+		if err != nil {
+			log.Fatalf("PERSISTER_SHARDS: %v", err)
+		}
+		log.Printf("consuming shards %v", shards)
+		metrics.PersisterShards.Set(float64(len(shards)))
+		for _, shard := range shards {
+			wg.Add(1)
+			go func(stream string) {
+				defer wg.Done()
+				p.forStream(stream).run(ctx)
+			}(redisstreams.GlobalShardKey(shard))
+		}
+	} else {
+		ttl := getenvDurationDefault("PERSISTER_LEASE_TTL", 15*time.Second)
+		if ttl <= 0 {
+			ttl = 15 * time.Second
+		}
+		leases := &shardLeases{
+			rdb:     rdb,
+			p:       p,
+			shards:  rdb.GlobalShards(),
+			ttl:     ttl,
+			workers: make(map[int]*shardWorker),
+		}
+		leases.run(ctx)
+	}
+	wg.Wait()
+}
+
+// persister moves events from a global stream into Postgres.
+type persister struct {
+	rdb                *redisstreams.Client
+	store              *pgstore.Store
+	dead               *dlq.Queue
+	stream             string
+	dlqStream          string
+	group              string
+	consumer           string
+	batchSize          int
+	batchLatency       time.Duration
+	maxRetries         int64
+	defaultTenant      string
+	idleTimeoutSeconds int
+}
+
+// forStream returns a copy of p that consumes stream.
+func (p *persister) forStream(stream string) *persister {
+	cp := *p
+	cp.stream = stream
+	cp.dead = dlq.New(p.rdb, stream, p.dlqStream)
+	return &cp
+}
+
+// run consumes p.stream until ctx is cancelled. Work already read is
+// finished even after cancellation, so that a shard handed to another
+// replica is not left half persisted.
+func (p *persister) run(ctx context.Context) {
+	work := context.WithoutCancel(ctx)
 	minIdle := 30 * time.Second
 	start := "0-0"
-	dlqStream := getenvDefault("PERSISTER_DLQ_STREAM", "stream:global:dlq")
-	maxRetries := int64(getenvIntDefault("PERSISTER_MAX_RETRIES", 5))
 	for {
 		select {
 		case <-ctx.Done():
@@ -64,37 +177,36 @@ func main() {
 		default:
 		}
 
-		pending, err := rdb.XPendingExt(ctx, stream, group, "-", "+", 200)
+		pending, err := p.rdb.XPendingExt(work, p.stream, p.group, "-", "+", int64(p.batchSize))
 		if err != nil {
-			log.Printf("xpendingext: %v", err)
+			log.Printf("xpendingext %s: %v", p.stream, err)
 		} else {
-			for _, p := range pending {
-				if p.RetryCount < maxRetries {
+			for _, pe := range pending {
+				if pe.RetryCount < p.maxRetries {
 					continue
 				}
-				if err := moveToDLQ(ctx, rdb, stream, group, dlqStream, p.ID); err != nil {
-					log.Printf("dlq move failed (id=%s): %v", p.ID, err)
+				moved, err := p.dead.Move(work, p.group, pe.ID, pe.RetryCount)
+				if err != nil {
+					log.Printf("dlq move failed (stream=%s id=%s): %v", p.stream, pe.ID, err)
 					break
 				}
+				if moved {
+					metrics.DLQMoved.Inc()
+				}
 			}
 		}
 
-		claimed, err := rdb.XAutoClaim(ctx, stream, group, consumer, start, minIdle, 200)
+		claimed, err := p.rdb.XAutoClaim(work, p.stream, p.group, p.consumer, start, minIdle, int64(p.batchSize))
 		if err != nil {
-			log.Printf("xautoclaim: %v", err)
+			log.Printf("xautoclaim %s: %v", p.stream, err)
 		} else {
 			start = claimed.Start
-			for _, m := range claimed.Messages {
-				persisted, acked := handleMessage(ctx, rdb, store, stream, group, tenantID, idleTimeoutSeconds, m)
-				if !persisted && !acked {
-					break
-				}
-			}
+			p.handleBatch(work, claimed.Messages)
 		}
 
-		msgs, err := rdb.XReadGroup(ctx, group, consumer, stream, ">", 5*time.Second, 200)
+		msgs, err := p.readBatch(work)
 		if err != nil {
-			log.Printf("xreadgroup: %v", err)
+			log.Printf("xreadgroup %s: %v", p.stream, err)
 			t := time.NewTimer(250 * time.Millisecond)
 			select {
 			case <-ctx.Done():
@@ -102,71 +214,84 @@ func main() {
 				return
 			case <-t.C:
 			}
-			continue
-		}
-		if len(msgs) == 0 {
-			continue
-		}
-		for _, m := range msgs {
-			persisted, acked := handleMessage(ctx, rdb, store, stream, group, tenantID, idleTimeoutSeconds, m)
-			if !persisted && !acked {
-				break
-			}
 		}
+		p.handleBatch(work, msgs)
 	}
 }
 
-func handleMessage(
-	ctx context.Context,
-	rdb *redisstreams.Client,
-	store *pgstore.Store,
-	stream string,
-	group string,
-	tenantID string,
-	idleTimeoutSeconds int,
-	m redisstreams.GroupMessage,
-) (persisted bool, acked bool) {
-	evtStr, _ := m.Values["event"].(string)
-	if evtStr == "" {
-		log.Printf("skip msg %s: missing event field", m.ID)
-		_, _ = rdb.XAck(ctx, stream, group, m.ID)
-		return false, true
+// decode extracts the event and its tenant from a stream message. Pointers
+// to thread stream entries must have been resolved with ResolveRefs.
+func (p *persister) decode(m redisstreams.GroupMessage) (pgstore.BatchItem, error) {
+	e, err := redisstreams.DecodeEntry(m.Values)
+	if err != nil {
+		return pgstore.BatchItem{}, err
 	}
-	e, err := eventide.DecodeEvent([]byte(evtStr))
+	tenantID, _ := m.Values["tenant_id"].(string)
+	if tenantID == "" {
+		tenantID = e.TenantID
+	}
+	if tenantID == "" {
+		tenantID = p.defaultTenant
+	}
+	return pgstore.BatchItem{TenantID: tenantID, Event: e}, nil
+}
+
+// handleMessage persists a single message outside of a batch. It is the
+// fallback when a batch transaction fails as a whole.
+func (p *persister) handleMessage(ctx context.Context, m redisstreams.GroupMessage) (persisted bool, acked bool) {
+	item, err := p.decode(m)
 	if err != nil {
-		log.Printf("skip msg %s: decode event: %v", m.ID, err)
-		_, _ = rdb.XAck(ctx, stream, group, m.ID)
+		log.Printf("skip msg %s: %v", m.ID, err)
+		metrics.PersistedEvents.WithLabelValues("skipped").Inc()
+		_, _ = p.rdb.XAck(ctx, p.stream, p.group, m.ID)
 		return false, true
 	}
+	e := item.Event
 
-	if err := store.PersistEvent(ctx, tenantID, idleTimeoutSeconds, e); err != nil {
+	start := time.Now()
+	err = p.store.PersistEvent(ctx, item.TenantID, p.idleTimeoutSeconds, e)
+	metrics.PersistDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		var conflict *pgstore.SeqConflictError
+		if errors.As(err, &conflict) {
+			if err := p.store.QuarantineConflict(ctx, conflict, e); err != nil {
+				log.Printf("quarantine event %s/%d: %v", e.ThreadID, e.Seq, err)
+				p.recordFailure(ctx, m.ID, err)
+				return false, false
+			}
+			log.Printf("quarantined msg %s: %v", m.ID, conflict)
+			metrics.PersistedEvents.WithLabelValues("quarantined").Inc()
+			_, _ = p.rdb.XAck(ctx, p.stream, p.group, m.ID)
+			return false, true
+		}
+		var mismatch *pgstore.TenantMismatchError
+		if errors.As(err, &mismatch) {
+			if err := p.store.QuarantineTenantMismatch(ctx, mismatch, e); err != nil {
+				log.Printf("quarantine event %s/%d: %v", e.ThreadID, e.Seq, err)
+				p.recordFailure(ctx, m.ID, err)
+				return false, false
+			}
+			log.Printf("quarantined msg %s: %v", m.ID, mismatch)
+			metrics.PersistedEvents.WithLabelValues("quarantined").Inc()
+			_, _ = p.rdb.XAck(ctx, p.stream, p.group, m.ID)
+			return false, true
+		}
 		log.Printf("persist event %s/%d: %v", e.ThreadID, e.Seq, err)
+		metrics.PersistedEvents.WithLabelValues("failed").Inc()
+		p.recordFailure(ctx, m.ID, err)
 		return false, false
 	}
-	_, _ = rdb.XAck(ctx, stream, group, m.ID)
+	metrics.PersistedEvents.WithLabelValues("persisted").Inc()
+	_, _ = p.rdb.XAck(ctx, p.stream, p.group, m.ID)
 	return true, true
 }
 
-func moveToDLQ(ctx context.Context, rdb *redisstreams.Client, stream, group, dlqStream, id string) error {
-	msgs, err := rdb.XRange(ctx, stream, id, id, 1)
-	if err != nil {
-		return err
-	}
-	if len(msgs) == 0 {
-		_, _ = rdb.XAck(ctx, stream, group, id)
-		_, _ = rdb.XDel(ctx, stream, id)
-		return nil
-	}
-	values := msgs[0].Values
-	values["dlq_from_stream"] = stream
-	values["dlq_from_id"] = id
-	values["dlq_ts"] = time.Now().UTC().Format(time.RFC3339Nano)
-	if _, err := rdb.XAddToStream(ctx, dlqStream, values); err != nil {
-		return err
-	}
-	_, _ = rdb.XAck(ctx, stream, group, id)
-	_, _ = rdb.XDel(ctx, stream, id)
-	return nil
+// recordFailure keeps the reason a message could not be persisted so that it
+// shows up on the dead-letter entry if retries run out.
+func (p *persister) recordFailure(ctx context.Context, id string, cause error) {
+	if err := p.dead.RecordFailure(ctx, id, cause); err != nil {
+		log.Printf("record failure (id=%s): %v", id, err)
+	}
 }
 
 func defaultConsumer() string {
@@ -192,3 +317,15 @@ func getenvIntDefault(key string, def int) int {
 	}
 	return n
 }
+
+func getenvDurationDefault(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return def
+	}
+	return d
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/warjiang/eventide/internal/httpx"
+	"github.com/warjiang/eventide/internal/metrics"
+	"github.com/warjiang/eventide/internal/redisstreams"
+)
+
+// serveMetrics exposes /metrics on addr until ctx is cancelled. The persister
+// has no other HTTP surface, so a failure here is logged rather than fatal.
+func serveMetrics(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	srv := httpx.New(addr, mux)
+	go func() {
+		<-ctx.Done()
+		_ = srv.Shutdown(context.Background())
+	}()
+	log.Printf("persister metrics listening on %s", addr)
+	if err := srv.ListenAndServe(); err != nil {
+		log.Printf("metrics: %v", err)
+	}
+}
+
+// collectStreamMetrics samples the length of the global stream shards and
+// the dead-letter stream, and the pending count and lag of every consumer
+// group on each shard.
+func collectStreamMetrics(ctx context.Context, rdb *redisstreams.Client, streams []string, dlqStream string, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		for _, s := range append(streams[:len(streams):len(streams)], dlqStream) {
+			n, err := rdb.XLen(ctx, s)
+			if err != nil {
+				log.Printf("metrics xlen %s: %v", s, err)
+				continue
+			}
+			metrics.StreamLength.WithLabelValues(s).Set(float64(n))
+		}
+		for _, stream := range streams {
+			groups, err := rdb.XInfoGroups(ctx, stream)
+			if err != nil {
+				log.Printf("metrics xinfo groups %s: %v", stream, err)
+			}
+			for _, g := range groups {
+				metrics.StreamPending.WithLabelValues(stream, g.Name).Set(float64(g.Pending))
+				if g.Lag >= 0 {
+					metrics.StreamLag.WithLabelValues(stream, g.Name).Set(float64(g.Lag))
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
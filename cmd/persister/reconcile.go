@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/warjiang/eventide/internal/metrics"
+	"github.com/warjiang/eventide/internal/redisstreams"
+)
+
+// reconcileBatch bounds how many threads one pass looks at per stream.
+const reconcileBatch = 500
+
+// reconcileLoop periodically appends the global entries that gateways failed
+// to write after the thread script in cluster mode and that have been
+// pending for longer than age. Every persister replica runs it over every
+// shard; entries are claimed before they are written.
+func reconcileLoop(ctx context.Context, rdb *redisstreams.Client, streams []string, every, age time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		for _, stream := range streams {
+			res, err := rdb.ReconcileGlobal(ctx, stream, age, reconcileBatch)
+			metrics.GlobalReconciled.Add(float64(res.Appended))
+			metrics.GlobalReconcileMissing.Add(float64(res.Missing))
+			if err != nil {
+				log.Printf("reconcile %s: %v", stream, err)
+				continue
+			}
+			if res.Appended > 0 || res.Missing > 0 {
+				log.Printf("reconciled %s: appended %d global entries, %d thread entries already gone", stream, res.Appended, res.Missing)
+			}
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/warjiang/eventide/internal/metrics"
+	"github.com/warjiang/eventide/internal/redisstreams"
+)
+
+// parseShards parses a static shard assignment such as "0,2,4-7" or "all".
+func parseShards(v string, shards int) ([]int, error) {
+	if v == "all" {
+		out := make([]int, shards)
+		for i := range out {
+			out[i] = i
+		}
+		return out, nil
+	}
+	seen := make(map[int]bool)
+	var out []int
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimSpace(part)
+		lo, hi, isRange := strings.Cut(part, "-")
+		from, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, fmt.Errorf("invalid shard %q", part)
+		}
+		to := from
+		if isRange {
+			if to, err = strconv.Atoi(hi); err != nil || to < from {
+				return nil, fmt.Errorf("invalid shard range %q", part)
+			}
+		}
+		for i := from; i <= to; i++ {
+			if i < 0 || i >= shards {
+				return nil, fmt.Errorf("shard %d out of range [0,%d)", i, shards)
+			}
+			if !seen[i] {
+				seen[i] = true
+				out = append(out, i)
+			}
+		}
+	}
+	sort.Ints(out)
+	return out, nil
+}
+
+func shardLeaseKey(group string, shard int) string {
+	return fmt.Sprintf("persister:%s:shard:%d:lease", group, shard)
+}
+
+func shardMembersKey(group string) string {
+	return fmt.Sprintf("persister:%s:members", group)
+}
+
+// shardLeases splits the global stream shards between persister replicas.
+// Every replica heartbeats into a member set, holds leases on its fair share
+// of the shards and runs one consume loop per leased shard. Replicas above
+// their share release shards for newcomers; leases of a replica that dies
+// expire after ttl and are taken over by the others, which then claim its
+// pending messages once they have been idle long enough.
+type shardLeases struct {
+	rdb     *redisstreams.Client
+	p       *persister
+	shards  int
+	ttl     time.Duration
+	workers map[int]*shardWorker
+}
+
+type shardWorker struct {
+	cancel  context.CancelFunc
+	done    chan struct{}
+	renewed time.Time
+}
+
+func (l *shardLeases) run(ctx context.Context) {
+	defer l.releaseAll()
+	t := time.NewTicker(l.ttl / 3)
+	defer t.Stop()
+	for {
+		l.rebalance(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (l *shardLeases) rebalance(ctx context.Context) {
+	owner := l.p.consumer
+	now := time.Now()
+
+	// Renew held leases first, so that slow stops below cannot let them lapse.
+	var lost []int
+	for _, shard := range l.owned() {
+		ok, err := l.rdb.AcquireLease(ctx, shardLeaseKey(l.p.group, shard), owner, l.ttl)
+		if err != nil {
+			log.Printf("renew lease on shard %d: %v", shard, err)
+			if now.Sub(l.workers[shard].renewed) < l.ttl {
+				continue
+			}
+		}
+		if err != nil || !ok {
+			lost = append(lost, shard)
+			continue
+		}
+		l.workers[shard].renewed = now
+	}
+	if len(lost) > 0 {
+		log.Printf("lost leases on shards %v", lost)
+		l.stop(lost)
+	}
+
+	live, err := l.rdb.Heartbeat(ctx, shardMembersKey(l.p.group), owner, l.ttl)
+	if err != nil {
+		log.Printf("persister heartbeat: %v", err)
+		return
+	}
+	target := (l.shards + int(live) - 1) / int(live)
+
+	if owned := l.owned(); len(owned) > target {
+		extra := owned[target:]
+		l.stop(extra)
+		for _, shard := range extra {
+			if err := l.rdb.ReleaseLease(ctx, shardLeaseKey(l.p.group, shard), owner); err != nil {
+				log.Printf("release lease on shard %d: %v", shard, err)
+			}
+		}
+		log.Printf("released shards %v (%d replicas)", extra, live)
+	}
+
+	// Start probing at a per-replica offset so replicas rarely race for the
+	// same shard.
+	offset := redisstreams.GlobalShard(owner, l.shards)
+	for i := 0; i < l.shards && len(l.workers) < target; i++ {
+		shard := (offset + i) % l.shards
+		if l.workers[shard] != nil {
+			continue
+		}
+		ok, err := l.rdb.AcquireLease(ctx, shardLeaseKey(l.p.group, shard), owner, l.ttl)
+		if err != nil {
+			log.Printf("acquire lease on shard %d: %v", shard, err)
+			break
+		}
+		if ok {
+			log.Printf("acquired shard %d", shard)
+			l.start(ctx, shard, now)
+		}
+	}
+	metrics.PersisterShards.Set(float64(len(l.workers)))
+}
+
+// owned returns the leased shards in ascending order.
+func (l *shardLeases) owned() []int {
+	out := make([]int, 0, len(l.workers))
+	for shard := range l.workers {
+		out = append(out, shard)
+	}
+	sort.Ints(out)
+	return out
+}
+
+func (l *shardLeases) start(ctx context.Context, shard int, renewed time.Time) {
+	wctx, cancel := context.WithCancel(ctx)
+	w := &shardWorker{cancel: cancel, done: make(chan struct{}), renewed: renewed}
+	l.workers[shard] = w
+	go func() {
+		defer close(w.done)
+		l.p.forStream(redisstreams.GlobalShardKey(shard)).run(wctx)
+	}()
+}
+
+// stop cancels the workers of shards and waits for them to finish what they
+// already read.
+func (l *shardLeases) stop(shards []int) {
+	for _, shard := range shards {
+		l.workers[shard].cancel()
+	}
+	for _, shard := range shards {
+		<-l.workers[shard].done
+		delete(l.workers, shard)
+	}
+}
+
+// releaseAll stops every worker and hands its shard back on shutdown, so
+// that other replicas can take over without waiting for the leases to
+// expire.
+func (l *shardLeases) releaseAll() {
+	ctx := context.Background()
+	owned := l.owned()
+	l.stop(owned)
+	for _, shard := range owned {
+		_ = l.rdb.ReleaseLease(ctx, shardLeaseKey(l.p.group, shard), l.p.consumer)
+	}
+	_ = l.rdb.LeaveGroup(ctx, shardMembersKey(l.p.group), l.p.consumer)
+	metrics.PersisterShards.Set(0)
+}
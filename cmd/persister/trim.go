@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/warjiang/eventide/internal/metrics"
+	"github.com/warjiang/eventide/internal/redisstreams"
+)
+
+// trimLoop periodically drops entries of the global streams that every
+// consumer group has acknowledged and that are older than margin. Every
+// persister replica runs it over every shard; trimming is idempotent.
+func trimLoop(ctx context.Context, rdb *redisstreams.Client, streams []string, every, margin time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		for _, stream := range streams {
+			n, err := rdb.TrimAcknowledged(ctx, stream, margin)
+			if err != nil {
+				log.Printf("trim %s: %v", stream, err)
+				continue
+			}
+			if n > 0 {
+				metrics.StreamTrimmed.WithLabelValues(stream).Add(float64(n))
+				log.Printf("trimmed %d entries from %s", n, stream)
+			}
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+
+	"github.com/warjiang/eventide/internal/id"
+)
+
+const apiKeyPrefix = "ek_"
+
+// NewAPIKey generates a new API key. Only the returned hash is stored; the
+// key itself is shown to the operator once.
+func NewAPIKey() (keyID string, key string, hash string, err error) {
+	keyID, err = id.NewULID()
+	if err != nil {
+		return "", "", "", err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", "", err
+	}
+	key = apiKeyPrefix + strings.ToLower(keyID) + "_" + base64.RawURLEncoding.EncodeToString(secret)
+	return keyID, key, HashAPIKey(key), nil
+}
+
+func IsAPIKey(s string) bool {
+	return strings.HasPrefix(s, apiKeyPrefix)
+}
+
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,276 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/warjiang/eventide/internal/config"
+)
+
+const (
+	MethodAnonymous   = "anonymous"
+	MethodAPIKey      = "api_key"
+	MethodJWT         = "jwt"
+	MethodStreamToken = "stream_token"
+)
+
+var errUnauthenticated = errors.New("unauthenticated")
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	TenantID string
+	// Subject is the API key ID or the JWT subject.
+	Subject string
+	Method  string
+	// ThreadID restricts a stream-token principal to a single thread.
+	ThreadID string
+}
+
+// CanAccessTenant reports whether the principal may see data owned by
+// tenantID. Anonymous principals (auth disabled) can see every tenant.
+func (p Principal) CanAccessTenant(tenantID string) bool {
+	return p.Method == MethodAnonymous || p.TenantID == tenantID
+}
+
+// CanAccessThread reports whether the principal's credential is valid for
+// threadID. Only stream tokens are scoped to a thread.
+func (p Principal) CanAccessThread(threadID string) bool {
+	return p.ThreadID == "" || p.ThreadID == threadID
+}
+
+type principalKey struct{}
+
+func WithPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns the principal stored by Middleware.
+func FromContext(ctx context.Context) Principal {
+	p, _ := ctx.Value(principalKey{}).(Principal)
+	return p
+}
+
+// APIKeyStore looks up API keys by the SHA-256 hash of the full key.
+type APIKeyStore interface {
+	LookupAPIKey(ctx context.Context, keyHash string) (tenantID string, keyID string, ok bool, err error)
+	// LastAPIKeyRevocation returns when a key was last revoked, or the zero
+	// time when none was.
+	LastAPIKeyRevocation(ctx context.Context) (time.Time, error)
+}
+
+type Authenticator struct {
+	enabled       bool
+	defaultTenant string
+	keys          APIKeyStore
+	jwt           *jwtVerifier
+	streamTokens  *StreamTokens
+
+	mu    sync.Mutex
+	cache map[string]cachedKey
+	// lastRevocation is the newest revocation seen, checked at most every
+	// apiKeyRevocationCheck. cacheGen counts the times the cache was dropped,
+	// so that a lookup started before a drop does not refill it.
+	lastRevocation      time.Time
+	revocationCheckedAt time.Time
+	cacheGen            uint64
+}
+
+type cachedKey struct {
+	principal Principal
+	expires   time.Time
+}
+
+// Resolved API keys are cached for apiKeyCacheTTL, but the cache is dropped
+// as soon as a revocation is seen, so a revoked key keeps working for at
+// most apiKeyRevocationCheck.
+const (
+	apiKeyCacheTTL        = time.Minute
+	apiKeyRevocationCheck = 5 * time.Second
+)
+
+// New builds an Authenticator from cfg. keys may be nil when API keys are not
+// used by the service.
+func New(cfg config.AuthConfig, keys APIKeyStore) (*Authenticator, error) {
+	a := &Authenticator{
+		enabled:       cfg.Enabled,
+		defaultTenant: cfg.DefaultTenant,
+		keys:          keys,
+		cache:         make(map[string]cachedKey),
+	}
+	if !cfg.Enabled {
+		return a, nil
+	}
+	if cfg.JWKSFile != "" {
+		v, err := newJWTVerifier(cfg.JWKSFile, cfg.JWTIssuer, cfg.JWTAudience, cfg.JWTTenantClaim)
+		if err != nil {
+			return nil, fmt.Errorf("jwks: %w", err)
+		}
+		a.jwt = v
+	}
+	if cfg.StreamTokenSecret != "" {
+		a.streamTokens = NewStreamTokens([]byte(cfg.StreamTokenSecret))
+	}
+	return a, nil
+}
+
+func (a *Authenticator) Enabled() bool {
+	return a.enabled
+}
+
+// StreamTokens returns the signer for query-string stream tokens, or nil when
+// AUTH_STREAM_TOKEN_SECRET is not configured.
+func (a *Authenticator) StreamTokens() *StreamTokens {
+	return a.streamTokens
+}
+
+// Middleware authenticates every request and stores the Principal in the
+// request context. Credentials are read from "Authorization: Bearer" (API key
+// or JWT) or "X-API-Key".
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return a.middleware(next, false)
+}
+
+// StreamMiddleware is Middleware for streaming routes (SSE, WebSocket): GET
+// requests may also carry a stream token in the access_token query
+// parameter, for clients such as EventSource that cannot set headers. Stream
+// tokens are accepted nowhere else.
+func (a *Authenticator) StreamMiddleware(next http.Handler) http.Handler {
+	return a.middleware(next, true)
+}
+
+func (a *Authenticator) middleware(next http.Handler, streamTokens bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		p, err := a.authenticate(req, streamTokens)
+		if err != nil {
+			if !errors.Is(err, errUnauthenticated) {
+				log.Printf("auth: %v", err)
+			}
+			w.Header().Set("www-authenticate", `Bearer realm="eventide"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, req.WithContext(WithPrincipal(req.Context(), p)))
+	})
+}
+
+func (a *Authenticator) authenticate(req *http.Request, streamTokens bool) (Principal, error) {
+	if !a.enabled {
+		return Principal{TenantID: a.defaultTenant, Method: MethodAnonymous}, nil
+	}
+	if key := strings.TrimSpace(req.Header.Get("X-API-Key")); key != "" {
+		return a.authenticateAPIKey(req.Context(), key)
+	}
+	if h := req.Header.Get("Authorization"); h != "" {
+		token, ok := strings.CutPrefix(h, "Bearer ")
+		if !ok {
+			return Principal{}, errUnauthenticated
+		}
+		token = strings.TrimSpace(token)
+		if IsAPIKey(token) {
+			return a.authenticateAPIKey(req.Context(), token)
+		}
+		if a.jwt == nil {
+			return Principal{}, errUnauthenticated
+		}
+		p, err := a.jwt.verify(token)
+		if err != nil {
+			return Principal{}, fmt.Errorf("%w: %v", errUnauthenticated, err)
+		}
+		return p, nil
+	}
+	if token := req.URL.Query().Get("access_token"); token != "" && streamTokens && req.Method == http.MethodGet && a.streamTokens != nil {
+		p, err := a.streamTokens.Verify(token)
+		if err != nil {
+			return Principal{}, fmt.Errorf("%w: %v", errUnauthenticated, err)
+		}
+		return p, nil
+	}
+	return Principal{}, errUnauthenticated
+}
+
+func (a *Authenticator) authenticateAPIKey(ctx context.Context, key string) (Principal, error) {
+	if a.keys == nil {
+		return Principal{}, errUnauthenticated
+	}
+	hash := HashAPIKey(key)
+	now := time.Now()
+	a.checkRevocations(ctx, now)
+	a.mu.Lock()
+	c, ok := a.cache[hash]
+	gen := a.cacheGen
+	a.mu.Unlock()
+	if ok && now.Before(c.expires) {
+		return c.principal, nil
+	}
+	tenantID, keyID, found, err := a.keys.LookupAPIKey(ctx, hash)
+	if err != nil {
+		return Principal{}, err
+	}
+	if !found {
+		return Principal{}, errUnauthenticated
+	}
+	p := Principal{TenantID: tenantID, Subject: keyID, Method: MethodAPIKey}
+	a.mu.Lock()
+	if a.cacheGen == gen {
+		a.cache[hash] = cachedKey{principal: p, expires: now.Add(apiKeyCacheTTL)}
+	}
+	a.mu.Unlock()
+	return p, nil
+}
+
+// checkRevocations drops the key cache when a key was revoked since the last
+// check. Only one request at a time runs the check; the others use the cache
+// as it is meanwhile. When the check fails, cached keys stay valid until
+// they expire.
+func (a *Authenticator) checkRevocations(ctx context.Context, now time.Time) {
+	a.mu.Lock()
+	if now.Sub(a.revocationCheckedAt) < apiKeyRevocationCheck {
+		a.mu.Unlock()
+		return
+	}
+	a.revocationCheckedAt = now
+	a.mu.Unlock()
+
+	last, err := a.keys.LastAPIKeyRevocation(ctx)
+	if err != nil {
+		log.Printf("auth: check api key revocations: %v", err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if last.After(a.lastRevocation) {
+		a.lastRevocation = last
+		a.cache = make(map[string]cachedKey)
+		a.cacheGen++
+	}
+}
+
+// RequireAdmin protects operator routes with a static bearer token. Without a
+// token the routes stay open only while authentication is disabled.
+func RequireAdmin(token string, authEnabled bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if token == "" {
+				if authEnabled {
+					http.Error(w, "admin api disabled (ADMIN_TOKEN not set)", http.StatusForbidden)
+					return
+				}
+				next.ServeHTTP(w, req)
+				return
+			}
+			got, _ := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(strings.TrimSpace(got)), []byte(token)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
@@ -0,0 +1,245 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/warjiang/eventide/internal/config"
+)
+
+type fakeKeys map[string]string
+
+func (f fakeKeys) LookupAPIKey(_ context.Context, keyHash string) (string, string, bool, error) {
+	tenantID, ok := f[keyHash]
+	return tenantID, "key_" + tenantID, ok, nil
+}
+
+func (f fakeKeys) LastAPIKeyRevocation(context.Context) (time.Time, error) {
+	return time.Time{}, nil
+}
+
+// revocableKeys is fakeKeys whose keys can be revoked.
+type revocableKeys struct {
+	fakeKeys
+	lastRevocation time.Time
+}
+
+func (k *revocableKeys) revoke(hash string) {
+	delete(k.fakeKeys, hash)
+	k.lastRevocation = time.Now()
+}
+
+func (k *revocableKeys) LastAPIKeyRevocation(context.Context) (time.Time, error) {
+	return k.lastRevocation, nil
+}
+
+// serve runs req through mw and returns the status and the principal the
+// handler saw.
+func serve(mw func(http.Handler) http.Handler, req *http.Request) (int, Principal) {
+	var got Principal
+	h := mw(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = FromContext(req.Context())
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec.Code, got
+}
+
+func writeJWKS(t *testing.T, pub *rsa.PublicKey) string {
+	t.Helper()
+	set := jwks{Keys: []jwk{{
+		Kid: "k1",
+		Kty: "RSA",
+		Use: "sig",
+		N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+	}}}
+	b, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAuthenticate(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, key, hash, err := NewAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := New(config.AuthConfig{
+		Enabled:           true,
+		JWKSFile:          writeJWKS(t, &priv.PublicKey),
+		JWTIssuer:         "issuer",
+		JWTTenantClaim:    "tenant_id",
+		StreamTokenSecret: "secret",
+	}, fakeKeys{hash: "acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signJWT := func(claims jwt.MapClaims) string {
+		tok := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		tok.Header["kid"] = "k1"
+		s, err := tok.SignedString(priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	exp := time.Now().Add(time.Hour).Unix()
+	validJWT := signJWT(jwt.MapClaims{"iss": "issuer", "sub": "user1", "tenant_id": "globex", "exp": exp})
+	streamToken, _, err := a.StreamTokens().Issue(Principal{TenantID: "acme", Subject: "key_acme"}, "th1", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		stream bool
+		method string
+		target string
+		header map[string]string
+		status int
+		want   Principal
+	}{
+		{name: "api key header", header: map[string]string{"X-API-Key": key}, status: 200,
+			want: Principal{TenantID: "acme", Subject: "key_acme", Method: MethodAPIKey}},
+		{name: "api key bearer", header: map[string]string{"Authorization": "Bearer " + key}, status: 200,
+			want: Principal{TenantID: "acme", Subject: "key_acme", Method: MethodAPIKey}},
+		{name: "unknown api key", header: map[string]string{"X-API-Key": "ek_nope"}, status: 401},
+		{name: "jwt", header: map[string]string{"Authorization": "Bearer " + validJWT}, status: 200,
+			want: Principal{TenantID: "globex", Subject: "user1", Method: MethodJWT}},
+		{name: "jwt wrong issuer", status: 401, header: map[string]string{
+			"Authorization": "Bearer " + signJWT(jwt.MapClaims{"iss": "other", "tenant_id": "globex", "exp": exp})}},
+		{name: "jwt without tenant", status: 401, header: map[string]string{
+			"Authorization": "Bearer " + signJWT(jwt.MapClaims{"iss": "issuer", "exp": exp})}},
+		{name: "jwt expired", status: 401, header: map[string]string{
+			"Authorization": "Bearer " + signJWT(jwt.MapClaims{"iss": "issuer", "tenant_id": "globex", "exp": time.Now().Add(-time.Minute).Unix()})}},
+		{name: "no credentials", status: 401},
+		{name: "stream token on stream route", stream: true, target: "/?access_token=" + streamToken, status: 200,
+			want: Principal{TenantID: "acme", Subject: "key_acme", Method: MethodStreamToken, ThreadID: "th1"}},
+		{name: "stream token on other route", target: "/?access_token=" + streamToken, status: 401},
+		{name: "stream token on post", stream: true, method: http.MethodPost, target: "/?access_token=" + streamToken, status: 401},
+		{name: "tampered stream token", stream: true, target: "/?access_token=" + streamToken + "x", status: 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method, target := tt.method, tt.target
+			if method == "" {
+				method = http.MethodGet
+			}
+			if target == "" {
+				target = "/"
+			}
+			req := httptest.NewRequest(method, target, nil)
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			mw := a.Middleware
+			if tt.stream {
+				mw = a.StreamMiddleware
+			}
+			status, got := serve(mw, req)
+			if status != tt.status {
+				t.Fatalf("status %d, want %d", status, tt.status)
+			}
+			if status == http.StatusOK && got != tt.want {
+				t.Fatalf("principal %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAPIKeyRevocation(t *testing.T) {
+	_, key1, hash1, err := NewAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, key2, hash2, err := NewAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := &revocableKeys{fakeKeys: fakeKeys{hash1: "acme", hash2: "globex"}}
+	a, err := New(config.AuthConfig{Enabled: true}, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(key string, want int) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-API-Key", key)
+		if status, _ := serve(a.Middleware, req); status != want {
+			t.Fatalf("status %d, want %d", status, want)
+		}
+	}
+	check(key1, 200)
+	check(key2, 200)
+
+	// The cached key outlives its revocation until the next check.
+	keys.revoke(hash1)
+	check(key1, 200)
+	a.revocationCheckedAt = time.Time{}
+	check(key1, 401)
+	check(key2, 200)
+}
+
+func TestAuthenticateDisabled(t *testing.T) {
+	a, err := New(config.AuthConfig{DefaultTenant: "default"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, got := serve(a.Middleware, httptest.NewRequest(http.MethodGet, "/", nil))
+	if status != http.StatusOK || got != (Principal{TenantID: "default", Method: MethodAnonymous}) {
+		t.Fatalf("got %d %+v", status, got)
+	}
+	if !got.CanAccessTenant("other") {
+		t.Fatal("anonymous principal should access every tenant")
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	tests := []struct {
+		name        string
+		token       string
+		authEnabled bool
+		header      string
+		status      int
+	}{
+		{name: "open while auth disabled", status: 200},
+		{name: "disabled without token", authEnabled: true, status: 403},
+		{name: "valid token", token: "s3cret", authEnabled: true, header: "Bearer s3cret", status: 200},
+		{name: "wrong token", token: "s3cret", authEnabled: true, header: "Bearer nope", status: 401},
+		{name: "missing token", token: "s3cret", status: 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/admin", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			status, _ := serve(RequireAdmin(tt.token, tt.authEnabled), req)
+			if status != tt.status {
+				t.Fatalf("status %d, want %d", status, tt.status)
+			}
+		})
+	}
+}
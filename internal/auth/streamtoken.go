@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// MaxStreamTokenTTL bounds how long a query-string token stays valid. These
+// tokens end up in URLs and access logs, so they must be short-lived.
+const MaxStreamTokenTTL = 5 * time.Minute
+
+// StreamTokens signs and verifies short-lived tokens that grant read access
+// to a single thread (or, with an empty thread, to the tenant's threads).
+type StreamTokens struct {
+	secret []byte
+}
+
+type streamClaims struct {
+	TenantID string `json:"tid"`
+	ThreadID string `json:"thr,omitempty"`
+	Subject  string `json:"sub,omitempty"`
+	Expires  int64  `json:"exp"`
+}
+
+func NewStreamTokens(secret []byte) *StreamTokens {
+	return &StreamTokens{secret: secret}
+}
+
+// Issue returns a token for p scoped to threadID that expires after ttl.
+func (s *StreamTokens) Issue(p Principal, threadID string, ttl time.Duration) (string, time.Time, error) {
+	if ttl <= 0 || ttl > MaxStreamTokenTTL {
+		ttl = MaxStreamTokenTTL
+	}
+	exp := time.Now().Add(ttl).UTC()
+	b, err := json.Marshal(streamClaims{TenantID: p.TenantID, ThreadID: threadID, Subject: p.Subject, Expires: exp.Unix()})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	body := base64.RawURLEncoding.EncodeToString(b)
+	return body + "." + s.sign(body), exp, nil
+}
+
+func (s *StreamTokens) Verify(token string) (Principal, error) {
+	body, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return Principal{}, errors.New("malformed stream token")
+	}
+	if !hmac.Equal([]byte(sig), []byte(s.sign(body))) {
+		return Principal{}, errors.New("invalid stream token signature")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil {
+		return Principal{}, errors.New("malformed stream token")
+	}
+	var c streamClaims
+	if err := json.Unmarshal(b, &c); err != nil {
+		return Principal{}, errors.New("malformed stream token")
+	}
+	if time.Now().Unix() >= c.Expires {
+		return Principal{}, errors.New("stream token expired")
+	}
+	if c.TenantID == "" {
+		return Principal{}, errors.New("stream token has no tenant")
+	}
+	return Principal{TenantID: c.TenantID, Subject: c.Subject, Method: MethodStreamToken, ThreadID: c.ThreadID}, nil
+}
+
+func (s *StreamTokens) sign(body string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(body))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,402 @@
+// Package dlq manages the persister's dead-letter stream: moving poison
+// messages out of the global stream, recording why they failed, and
+// inspecting, replaying, editing, skipping and purging them afterwards.
+package dlq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/warjiang/eventide/internal/redisstreams"
+	"github.com/warjiang/eventide/sdk/go/eventide"
+)
+
+// Fields added to a message when it is moved to the dead-letter stream.
+const (
+	FieldFromStream = "dlq_from_stream"
+	FieldFromID     = "dlq_from_id"
+	FieldTS         = "dlq_ts"
+	FieldError      = "dlq_error"
+	FieldRetries    = "dlq_retries"
+)
+
+// failureTTL bounds how long the last error of a message is kept. Errors of
+// messages that later persist are never cleared and simply expire.
+const failureTTL = 7 * 24 * time.Hour
+
+// ErrNotFound is returned when a dead-letter entry does not exist.
+var ErrNotFound = errors.New("dlq entry not found")
+
+// InvalidEventError is returned by ReplayEdited when the edited event does
+// not validate.
+type InvalidEventError struct {
+	Err error
+}
+
+func (e *InvalidEventError) Error() string {
+	return "invalid event: " + e.Err.Error()
+}
+
+func (e *InvalidEventError) Unwrap() error {
+	return e.Err
+}
+
+// Queue moves messages from stream to dlqStream and back. Replayed messages
+// go to the global stream shard of their thread, which is stream unless the
+// global stream is sharded.
+type Queue struct {
+	rdb       *redisstreams.Client
+	stream    string
+	dlqStream string
+}
+
+func New(rdb *redisstreams.Client, stream, dlqStream string) *Queue {
+	return &Queue{rdb: rdb, stream: stream, dlqStream: dlqStream}
+}
+
+func (q *Queue) Stream() string {
+	return q.dlqStream
+}
+
+func (q *Queue) Len(ctx context.Context) (int64, error) {
+	return q.rdb.XLen(ctx, q.dlqStream)
+}
+
+// Entry is a dead-letter message with its event decoded.
+type Entry struct {
+	ID         string          `json:"id"`
+	FromStream string          `json:"from_stream,omitempty"`
+	FromID     string          `json:"from_id,omitempty"`
+	MovedAt    *time.Time      `json:"moved_at,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	Retries    int64           `json:"retries,omitempty"`
+	ThreadID   string          `json:"thread_id,omitempty"`
+	TenantID   string          `json:"tenant_id,omitempty"`
+	Seq        int64           `json:"seq,omitempty"`
+	EventID    string          `json:"event_id,omitempty"`
+	Event      json.RawMessage `json:"event,omitempty"`
+	// DecodeError is set when the event field is missing or not valid JSON,
+	// which is usually why the message ended up here.
+	DecodeError string `json:"decode_error,omitempty"`
+}
+
+// FailureKey holds the last persist error of a message of stream.
+func FailureKey(stream, id string) string {
+	return fmt.Sprintf("dlq:error:%s:%s", stream, id)
+}
+
+// RecordFailure remembers why message id could not be persisted, so that the
+// reason travels with it if it is moved to the dead-letter stream.
+func (q *Queue) RecordFailure(ctx context.Context, id string, cause error) error {
+	return q.rdb.Set(ctx, FailureKey(q.stream, id), cause.Error(), failureTTL)
+}
+
+// MovedKey marks message id of stream as being moved to the dead-letter
+// stream. It holds the time in milliseconds the first attempt started.
+func MovedKey(stream, id string) string {
+	return fmt.Sprintf("dlq:moved:%s:%s", stream, id)
+}
+
+// ReplayedKey holds the global stream ID entry id of dlqStream was replayed
+// as, until the entry is gone from the dead-letter stream.
+func ReplayedKey(dlqStream, id string) string {
+	return fmt.Sprintf("dlq:replayed:%s:%s", dlqStream, id)
+}
+
+// Move copies message id of group to the dead-letter stream together with its
+// last recorded error, then acknowledges and deletes it from the source
+// stream. A message that no longer exists is only acknowledged, and moved is
+// false.
+//
+// The source and dead-letter streams may live in different cluster slots, so
+// the copy and the delete cannot be one script. Instead the first attempt
+// leaves a marker, and a retry after a failed acknowledge or delete looks for
+// the copy it already made instead of adding a second one.
+func (q *Queue) Move(ctx context.Context, group, id string, retries int64) (moved bool, err error) {
+	msgs, err := q.rdb.XRange(ctx, q.stream, id, id, 1)
+	if err != nil {
+		return false, err
+	}
+	if len(msgs) == 0 {
+		if _, err := q.rdb.XAck(ctx, q.stream, group, id); err != nil {
+			return false, err
+		}
+		_, err := q.rdb.Del(ctx, MovedKey(q.stream, id))
+		return false, err
+	}
+	copied, err := q.copied(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	if !copied {
+		if err := q.copy(ctx, msgs[0], retries); err != nil {
+			return false, err
+		}
+	}
+	if _, err := q.rdb.XAck(ctx, q.stream, group, id); err != nil {
+		return false, err
+	}
+	if _, err := q.rdb.XDel(ctx, q.stream, id); err != nil {
+		return false, err
+	}
+	_, _ = q.rdb.Del(ctx, FailureKey(q.stream, id), MovedKey(q.stream, id))
+	return true, nil
+}
+
+// copied claims the move of message id, or reports whether an earlier attempt
+// already added it to the dead-letter stream. Only entries added since that
+// attempt started are searched.
+func (q *Queue) copied(ctx context.Context, id string) (bool, error) {
+	key := MovedKey(q.stream, id)
+	first, err := q.rdb.SetNX(ctx, key, strconv.FormatInt(time.Now().UnixMilli(), 10), failureTTL)
+	if err != nil || first {
+		return false, err
+	}
+	since, ok, err := q.rdb.Get(ctx, key)
+	if err != nil || !ok {
+		return false, err
+	}
+	after := ""
+	start := since + "-0"
+	for {
+		if after != "" {
+			start = "(" + after
+		}
+		msgs, err := q.rdb.XRange(ctx, q.dlqStream, start, "+", 100)
+		if err != nil {
+			return false, err
+		}
+		for _, m := range msgs {
+			if m.Values[FieldFromStream] == q.stream && m.Values[FieldFromID] == id {
+				return true, nil
+			}
+		}
+		if len(msgs) < 100 {
+			return false, nil
+		}
+		after = msgs[len(msgs)-1].ID
+	}
+}
+
+func (q *Queue) copy(ctx context.Context, m redisstreams.GroupMessage, retries int64) error {
+	cause, _, err := q.rdb.Get(ctx, FailureKey(q.stream, m.ID))
+	if err != nil {
+		return err
+	}
+	values := m.Values
+	if redisstreams.IsRef(values) {
+		// Store the event itself: the thread stream entry a pointer refers
+		// to is trimmed eventually. A pointer whose entry is already gone is
+		// kept as it is.
+		if err := q.rdb.ResolveRefs(ctx, []redisstreams.GroupMessage{m}); err != nil {
+			return err
+		}
+		_ = redisstreams.InlineEntry(values)
+	}
+	values[FieldFromStream] = q.stream
+	values[FieldFromID] = m.ID
+	values[FieldTS] = time.Now().UTC().Format(time.RFC3339Nano)
+	values[FieldRetries] = retries
+	if cause != "" {
+		values[FieldError] = cause
+	}
+	_, err = q.rdb.XAddToStream(ctx, q.dlqStream, values)
+	return err
+}
+
+// List returns up to limit entries with IDs greater than after, oldest
+// first. An empty after starts at the beginning of the stream.
+func (q *Queue) List(ctx context.Context, after string, limit int64) ([]Entry, error) {
+	msgs, err := q.rdb.XRange(ctx, q.dlqStream, rangeStart(after), "+", limit)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Entry, 0, len(msgs))
+	for _, m := range msgs {
+		out = append(out, decodeEntry(m))
+	}
+	return out, nil
+}
+
+func (q *Queue) Get(ctx context.Context, id string) (Entry, error) {
+	m, err := q.get(ctx, id)
+	if err != nil {
+		return Entry{}, err
+	}
+	return decodeEntry(m), nil
+}
+
+func (q *Queue) get(ctx context.Context, id string) (redisstreams.GroupMessage, error) {
+	msgs, err := q.rdb.XRange(ctx, q.dlqStream, id, id, 1)
+	if err != nil {
+		return redisstreams.GroupMessage{}, err
+	}
+	if len(msgs) == 0 {
+		return redisstreams.GroupMessage{}, ErrNotFound
+	}
+	return msgs[0], nil
+}
+
+// Replay appends entry id back to the global stream without its dead-letter
+// fields and removes it from the dead-letter stream. It returns the new
+// stream ID.
+func (q *Queue) Replay(ctx context.Context, id string) (string, error) {
+	m, err := q.get(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	return q.replay(ctx, m)
+}
+
+// ReplayEdited replaces the event of entry id with e before replaying it. The
+// thread, seq and event ID fields are rewritten from e; the tenant is kept,
+// since ownership of a thread cannot be changed by editing.
+func (q *Queue) ReplayEdited(ctx context.Context, id string, e eventide.Event) (string, error) {
+	m, err := q.get(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	tenantID, _ := m.Values["tenant_id"].(string)
+	e.TenantID = tenantID
+	b, err := e.Encode()
+	if err != nil {
+		return "", &InvalidEventError{Err: err}
+	}
+	m.Values["thread_id"] = e.ThreadID
+	m.Values["seq"] = e.Seq
+	m.Values["event_id"] = e.EventID
+	m.Values["event"] = string(b)
+	delete(m.Values, "ref")
+	delete(m.Values, "enc")
+	return q.replay(ctx, m)
+}
+
+// ReplayAll replays every entry present when it starts, oldest first, and
+// returns how many were replayed.
+func (q *Queue) ReplayAll(ctx context.Context) (int, error) {
+	n := 0
+	after := ""
+	for {
+		entries, err := q.rdb.XRange(ctx, q.dlqStream, rangeStart(after), "+", 100)
+		if err != nil {
+			return n, err
+		}
+		if len(entries) == 0 {
+			return n, nil
+		}
+		for _, m := range entries {
+			if _, err := q.replay(ctx, m); err != nil {
+				return n, err
+			}
+			n++
+			after = m.ID
+		}
+	}
+}
+
+// replay appends m to the global stream and then deletes it from the
+// dead-letter stream, remembering the new ID in between so that a retry after
+// a failed delete does not append it twice. A failure between the append and
+// the marker can still replay an entry twice; the persister ignores events it
+// already stored.
+func (q *Queue) replay(ctx context.Context, m redisstreams.GroupMessage) (string, error) {
+	key := ReplayedKey(q.dlqStream, m.ID)
+	newID, done, err := q.rdb.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	if !done {
+		values := make(map[string]any, len(m.Values))
+		for k, v := range m.Values {
+			if strings.HasPrefix(k, "dlq_") {
+				continue
+			}
+			values[k] = v
+		}
+		target := q.stream
+		if threadID, _ := values["thread_id"].(string); threadID != "" {
+			target = q.rdb.GlobalStreamFor(threadID)
+		}
+		if newID, err = q.rdb.XAddToStream(ctx, target, values); err != nil {
+			return "", err
+		}
+		if err := q.rdb.Set(ctx, key, newID, failureTTL); err != nil {
+			return newID, err
+		}
+	}
+	if _, err := q.rdb.XDel(ctx, q.dlqStream, m.ID); err != nil {
+		return newID, err
+	}
+	_, _ = q.rdb.Del(ctx, key)
+	return newID, nil
+}
+
+// Skip drops entries without replaying them and returns how many existed.
+func (q *Queue) Skip(ctx context.Context, ids ...string) (int64, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	return q.rdb.XDel(ctx, q.dlqStream, ids...)
+}
+
+// Purge drops every entry moved before the given time, or all entries when
+// before is zero, and returns how many were removed.
+func (q *Queue) Purge(ctx context.Context, before time.Time) (int64, error) {
+	if before.IsZero() {
+		n, err := q.rdb.XLen(ctx, q.dlqStream)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := q.rdb.Del(ctx, q.dlqStream); err != nil {
+			return 0, err
+		}
+		return n, nil
+	}
+	return q.rdb.XTrimMinID(ctx, q.dlqStream, strconv.FormatInt(before.UnixMilli(), 10))
+}
+
+func rangeStart(after string) string {
+	if after == "" {
+		return "-"
+	}
+	return "(" + after
+}
+
+func decodeEntry(m redisstreams.GroupMessage) Entry {
+	e := Entry{ID: m.ID}
+	e.FromStream, _ = m.Values[FieldFromStream].(string)
+	e.FromID, _ = m.Values[FieldFromID].(string)
+	e.Error, _ = m.Values[FieldError].(string)
+	e.ThreadID, _ = m.Values["thread_id"].(string)
+	e.TenantID, _ = m.Values["tenant_id"].(string)
+	e.EventID, _ = m.Values["event_id"].(string)
+	if v, ok := m.Values[FieldTS].(string); ok {
+		if ts, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			e.MovedAt = &ts
+		}
+	}
+	if v, ok := m.Values[FieldRetries].(string); ok {
+		e.Retries, _ = strconv.ParseInt(v, 10, 64)
+	}
+	if v, ok := m.Values["seq"].(string); ok {
+		e.Seq, _ = strconv.ParseInt(v, 10, 64)
+	}
+	raw, _ := m.Values["event"].(string)
+	switch {
+	case raw == "" && redisstreams.IsRef(m.Values):
+		e.DecodeError = redisstreams.ErrEntryMissing.Error()
+	case raw == "":
+		e.DecodeError = "missing event field"
+	case !json.Valid([]byte(raw)):
+		e.DecodeError = "event is not valid JSON"
+		e.Event, _ = json.Marshal(raw)
+	default:
+		e.Event = json.RawMessage(raw)
+	}
+	return e
+}
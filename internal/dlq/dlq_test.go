@@ -0,0 +1,219 @@
+package dlq
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/warjiang/eventide/internal/config"
+	"github.com/warjiang/eventide/internal/redisstreams"
+)
+
+const (
+	testStream = "stream:global:events"
+	testGroup  = "persister"
+)
+
+func newTestQueue(t *testing.T) (*Queue, *redisstreams.Client, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb := redisstreams.New(config.RedisConfig{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = rdb.Close() })
+	if err := rdb.EnsureConsumerGroupOnStream(context.Background(), testStream, testGroup); err != nil {
+		t.Fatal(err)
+	}
+	return New(rdb, testStream, redisstreams.DLQStreamKey()), rdb, mr
+}
+
+// deliver adds a message to the source stream and reads it through the
+// group, leaving it pending like a message the persister failed on.
+func deliver(t *testing.T, rdb *redisstreams.Client) string {
+	t.Helper()
+	ctx := context.Background()
+	id, err := rdb.XAddToStream(ctx, testStream, map[string]any{
+		"thread_id": "th1",
+		"tenant_id": "acme",
+		"seq":       1,
+		"event_id":  "ev1",
+		"event":     `{"event_id":"ev1"}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rdb.XReadGroup(ctx, testGroup, "c1", testStream, ">", 0, 10); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func streamLen(t *testing.T, rdb *redisstreams.Client, stream string) int64 {
+	t.Helper()
+	n, err := rdb.XLen(context.Background(), stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestMove(t *testing.T) {
+	ctx := context.Background()
+	q, rdb, _ := newTestQueue(t)
+	id := deliver(t, rdb)
+	if err := q.RecordFailure(ctx, id, errors.New("boom")); err != nil {
+		t.Fatal(err)
+	}
+
+	moved, err := q.Move(ctx, testGroup, id, 3)
+	if err != nil || !moved {
+		t.Fatalf("Move = %v, %v", moved, err)
+	}
+	if n := streamLen(t, rdb, testStream); n != 0 {
+		t.Fatalf("source stream has %d entries", n)
+	}
+	pending, err := rdb.XPendingExt(ctx, testStream, testGroup, "-", "+", 10)
+	if err != nil || len(pending) != 0 {
+		t.Fatalf("pending = %v, %v", pending, err)
+	}
+	entries, err := q.List(ctx, "", 10)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("List = %v, %v", entries, err)
+	}
+	e := entries[0]
+	if e.FromStream != testStream || e.FromID != id || e.Error != "boom" || e.Retries != 3 || e.EventID != "ev1" {
+		t.Fatalf("entry %+v", e)
+	}
+	if _, ok, _ := rdb.Get(ctx, FailureKey(testStream, id)); ok {
+		t.Fatal("failure key left behind")
+	}
+
+	// The message is gone, so moving it again only acknowledges it.
+	moved, err = q.Move(ctx, testGroup, id, 3)
+	if err != nil || moved {
+		t.Fatalf("second Move = %v, %v", moved, err)
+	}
+	if n := streamLen(t, rdb, q.Stream()); n != 1 {
+		t.Fatalf("dlq has %d entries, want 1", n)
+	}
+}
+
+func TestMoveRetryAfterCopy(t *testing.T) {
+	ctx := context.Background()
+	q, rdb, _ := newTestQueue(t)
+	id := deliver(t, rdb)
+
+	// An earlier attempt copied the message but failed to delete it.
+	msgs, err := rdb.XRange(ctx, testStream, id, id, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := rdb.SetNX(ctx, MovedKey(testStream, id), "0", time.Minute); err != nil || !ok {
+		t.Fatalf("SetNX = %v, %v", ok, err)
+	}
+	if err := q.copy(ctx, msgs[0], 1); err != nil {
+		t.Fatal(err)
+	}
+
+	moved, err := q.Move(ctx, testGroup, id, 2)
+	if err != nil || !moved {
+		t.Fatalf("Move = %v, %v", moved, err)
+	}
+	if n := streamLen(t, rdb, q.Stream()); n != 1 {
+		t.Fatalf("dlq has %d entries, want 1", n)
+	}
+	if n := streamLen(t, rdb, testStream); n != 0 {
+		t.Fatalf("source stream has %d entries", n)
+	}
+	if _, ok, _ := rdb.Get(ctx, MovedKey(testStream, id)); ok {
+		t.Fatal("moved marker left behind")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	ctx := context.Background()
+	q, rdb, _ := newTestQueue(t)
+	id := deliver(t, rdb)
+	if _, err := q.Move(ctx, testGroup, id, 1); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := q.List(ctx, "", 10)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("List = %v, %v", entries, err)
+	}
+
+	newID, err := q.Replay(ctx, entries[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := rdb.XRange(ctx, testStream, newID, newID, 1)
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("XRange = %v, %v", msgs, err)
+	}
+	for k := range msgs[0].Values {
+		if k == FieldFromStream || k == FieldFromID || k == FieldTS || k == FieldError || k == FieldRetries {
+			t.Fatalf("replayed entry kept %s", k)
+		}
+	}
+	if msgs[0].Values["event_id"] != "ev1" {
+		t.Fatalf("replayed entry %v", msgs[0].Values)
+	}
+	if n := streamLen(t, rdb, q.Stream()); n != 0 {
+		t.Fatalf("dlq has %d entries", n)
+	}
+	if _, err := q.Replay(ctx, entries[0].ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("second Replay err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestReplayRetryAfterAppend(t *testing.T) {
+	ctx := context.Background()
+	q, rdb, _ := newTestQueue(t)
+	id := deliver(t, rdb)
+	if _, err := q.Move(ctx, testGroup, id, 1); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := q.List(ctx, "", 10)
+
+	// An earlier attempt appended the entry but failed to delete it.
+	if err := rdb.Set(ctx, ReplayedKey(q.Stream(), entries[0].ID), "1-1", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	newID, err := q.Replay(ctx, entries[0].ID)
+	if err != nil || newID != "1-1" {
+		t.Fatalf("Replay = %q, %v", newID, err)
+	}
+	if n := streamLen(t, rdb, testStream); n != 0 {
+		t.Fatalf("source stream has %d entries, want 0", n)
+	}
+	if n := streamLen(t, rdb, q.Stream()); n != 0 {
+		t.Fatalf("dlq has %d entries", n)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	ctx := context.Background()
+	q, _, mr := newTestQueue(t)
+	for _, id := range []string{"1000-0", "2000-0", "3000-0"} {
+		if _, err := mr.XAdd(q.Stream(), id, []string{"event_id", id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := q.Purge(ctx, time.UnixMilli(2500))
+	if err != nil || n != 2 {
+		t.Fatalf("Purge(before) = %d, %v", n, err)
+	}
+	entries, _ := q.List(ctx, "", 10)
+	if len(entries) != 1 || entries[0].ID != "3000-0" {
+		t.Fatalf("entries left %+v", entries)
+	}
+
+	n, err = q.Purge(ctx, time.Time{})
+	if err != nil || n != 1 {
+		t.Fatalf("Purge(all) = %d, %v", n, err)
+	}
+	if l, _ := q.Len(ctx); l != 0 {
+		t.Fatalf("dlq has %d entries", l)
+	}
+}
@@ -0,0 +1,777 @@
+package eventfilter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/warjiang/eventide/sdk/go/eventide"
+)
+
+// Limits on expressions, which come from untrusted query parameters.
+const (
+	maxExprLen   = 1024
+	maxExprDepth = 32
+)
+
+// Variables an expression can refer to.
+var exprVars = map[string]bool{
+	"thread_id": true,
+	"turn_id":   true,
+	"seq":       true,
+	"ts":        true,
+	"type":      true,
+	"level":     true,
+	"payload":   true,
+	"tags":      true,
+	"source":    true,
+	"trace":     true,
+}
+
+// Expr is a compiled filter expression.
+type Expr struct {
+	src  string
+	root node
+}
+
+// Compile parses a boolean expression in a small subset of CEL:
+//
+//	payload.role == "assistant" && size(payload.text) > 0
+//	type.startsWith("tool.") || tags.env in ["prod", "staging"]
+//	has(payload.error) && !(level in ["debug", "info"])
+//
+// Operands are the event fields thread_id, turn_id, seq, ts (an RFC 3339
+// string), type, level, payload, tags, source and trace, with fields selected
+// by "." or "[...]", and string, number, bool, null and list literals. The
+// operators are ||, &&, !, ==, !=, <, <=, >, >= and in; the functions are
+// has(x.f), size(x) and the string methods startsWith, endsWith and contains.
+func Compile(src string) (*Expr, error) {
+	if len(src) > maxExprLen {
+		return nil, fmt.Errorf("longer than %d bytes", maxExprLen)
+	}
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	root, err := p.parseOr(0)
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %s at %d", t, t.pos)
+	}
+	return &Expr{src: src, root: root}, nil
+}
+
+func (x *Expr) String() string {
+	return x.src
+}
+
+// Match evaluates x for e. Errors, such as a missing payload field or
+// comparing a string with a number, count as no match.
+func (x *Expr) Match(e eventide.Event) bool {
+	v, err := x.root.eval(newEnv(e))
+	b, ok := v.(bool)
+	return err == nil && ok && b
+}
+
+// env exposes an event to expressions. The payload is decoded on first use.
+type env struct {
+	e       eventide.Event
+	payload any
+	decoded bool
+	err     error
+}
+
+func newEnv(e eventide.Event) *env {
+	return &env{e: e}
+}
+
+func (v *env) lookup(name string) (any, error) {
+	e := v.e
+	switch name {
+	case "thread_id":
+		return e.ThreadID, nil
+	case "turn_id":
+		return e.TurnID, nil
+	case "seq":
+		return float64(e.Seq), nil
+	case "ts":
+		return e.TS.UTC().Format(time.RFC3339Nano), nil
+	case "type":
+		return e.Type, nil
+	case "level":
+		return string(e.Level), nil
+	case "tags":
+		m := make(map[string]any, len(e.Tags))
+		for k, t := range e.Tags {
+			m[k] = t
+		}
+		return m, nil
+	case "source":
+		return jsonValue(e.Source)
+	case "trace":
+		return jsonValue(e.Trace)
+	case "payload":
+		if !v.decoded {
+			v.decoded = true
+			if len(e.Payload) > 0 {
+				v.err = json.Unmarshal(e.Payload, &v.payload)
+			}
+		}
+		return v.payload, v.err
+	}
+	return nil, fmt.Errorf("unknown variable %s", name)
+}
+
+// jsonValue converts m to the types json.Unmarshal produces, which is all
+// the evaluator deals with.
+func jsonValue(m map[string]any) (any, error) {
+	if m == nil {
+		return map[string]any{}, nil
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	var out any
+	err = json.Unmarshal(b, &out)
+	return out, err
+}
+
+// ── Evaluation ──────────────────────────────────────────────────────────
+
+var errNoField = errors.New("no such field")
+
+type node interface {
+	eval(v *env) (any, error)
+}
+
+type literal struct{ val any }
+
+func (n literal) eval(*env) (any, error) { return n.val, nil }
+
+type variable struct{ name string }
+
+func (n variable) eval(v *env) (any, error) { return v.lookup(n.name) }
+
+type listNode struct{ items []node }
+
+func (n listNode) eval(v *env) (any, error) {
+	out := make([]any, 0, len(n.items))
+	for _, item := range n.items {
+		x, err := item.eval(v)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, x)
+	}
+	return out, nil
+}
+
+// selectNode is x.field or x["field"].
+type selectNode struct {
+	x     node
+	field string
+}
+
+func (n selectNode) eval(v *env) (any, error) {
+	x, err := n.x.eval(v)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := x.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("select %s: not an object", n.field)
+	}
+	f, ok := m[n.field]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", errNoField, n.field)
+	}
+	return f, nil
+}
+
+// indexNode is x[i] with a computed index.
+type indexNode struct {
+	x, index node
+}
+
+func (n indexNode) eval(v *env) (any, error) {
+	x, err := n.x.eval(v)
+	if err != nil {
+		return nil, err
+	}
+	i, err := n.index.eval(v)
+	if err != nil {
+		return nil, err
+	}
+	switch c := x.(type) {
+	case []any:
+		f, ok := i.(float64)
+		if !ok || f != float64(int(f)) || f < 0 || int(f) >= len(c) {
+			return nil, errors.New("index out of range")
+		}
+		return c[int(f)], nil
+	case map[string]any:
+		k, ok := i.(string)
+		if !ok {
+			return nil, errors.New("map key is not a string")
+		}
+		f, ok := c[k]
+		if !ok {
+			return nil, fmt.Errorf("%w %s", errNoField, k)
+		}
+		return f, nil
+	}
+	return nil, errors.New("index of a scalar")
+}
+
+// hasNode is has(x.field): whether x has the field, without failing when it
+// does not.
+type hasNode struct{ sel selectNode }
+
+func (n hasNode) eval(v *env) (any, error) {
+	x, err := n.sel.x.eval(v)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := x.(map[string]any)
+	if !ok {
+		return false, nil
+	}
+	_, ok = m[n.sel.field]
+	return ok, nil
+}
+
+type notNode struct{ x node }
+
+func (n notNode) eval(v *env) (any, error) {
+	x, err := n.x.eval(v)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := x.(bool)
+	if !ok {
+		return nil, errors.New("! of a non-bool")
+	}
+	return !b, nil
+}
+
+// logicNode is && or ||. As in CEL, an error on one side is absorbed when the
+// other side decides the result.
+type logicNode struct {
+	and  bool
+	l, r node
+}
+
+func (n logicNode) eval(v *env) (any, error) {
+	l, lerr := evalBool(n.l, v)
+	if lerr == nil && l != n.and {
+		return l, nil
+	}
+	r, rerr := evalBool(n.r, v)
+	if rerr == nil && r != n.and {
+		return r, nil
+	}
+	if lerr != nil {
+		return nil, lerr
+	}
+	if rerr != nil {
+		return nil, rerr
+	}
+	return n.and, nil
+}
+
+func evalBool(n node, v *env) (bool, error) {
+	x, err := n.eval(v)
+	if err != nil {
+		return false, err
+	}
+	b, ok := x.(bool)
+	if !ok {
+		return false, errors.New("operand is not a bool")
+	}
+	return b, nil
+}
+
+type compareNode struct {
+	op   string
+	l, r node
+}
+
+func (n compareNode) eval(v *env) (any, error) {
+	l, err := n.l.eval(v)
+	if err != nil {
+		return nil, err
+	}
+	r, err := n.r.eval(v)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return equal(l, r), nil
+	case "!=":
+		return !equal(l, r), nil
+	case "in":
+		switch c := r.(type) {
+		case []any:
+			for _, item := range c {
+				if equal(l, item) {
+					return true, nil
+				}
+			}
+			return false, nil
+		case map[string]any:
+			k, ok := l.(string)
+			if !ok {
+				return nil, errors.New("map key is not a string")
+			}
+			_, ok = c[k]
+			return ok, nil
+		}
+		return nil, errors.New("in needs a list or a map")
+	}
+	c, err := order(l, r)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "<":
+		return c < 0, nil
+	case "<=":
+		return c <= 0, nil
+	case ">":
+		return c > 0, nil
+	default:
+		return c >= 0, nil
+	}
+}
+
+func equal(l, r any) bool {
+	switch l.(type) {
+	case []any, map[string]any:
+		return reflect.DeepEqual(l, r)
+	}
+	return l == r
+}
+
+func order(l, r any) (int, error) {
+	switch a := l.(type) {
+	case float64:
+		if b, ok := r.(float64); ok {
+			switch {
+			case a < b:
+				return -1, nil
+			case a > b:
+				return 1, nil
+			}
+			return 0, nil
+		}
+	case string:
+		if b, ok := r.(string); ok {
+			return strings.Compare(a, b), nil
+		}
+	}
+	return 0, fmt.Errorf("cannot order %T and %T", l, r)
+}
+
+// callNode is size(x) or a string method called on target.
+type callNode struct {
+	fn     string
+	target node
+	args   []node
+}
+
+func (n callNode) eval(v *env) (any, error) {
+	x, err := n.target.eval(v)
+	if err != nil {
+		return nil, err
+	}
+	if n.fn == "size" {
+		switch c := x.(type) {
+		case string:
+			return float64(utf8.RuneCountInString(c)), nil
+		case []any:
+			return float64(len(c)), nil
+		case map[string]any:
+			return float64(len(c)), nil
+		}
+		return nil, errors.New("size of a scalar")
+	}
+	s, ok := x.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s on a non-string", n.fn)
+	}
+	a, err := n.args[0].eval(v)
+	if err != nil {
+		return nil, err
+	}
+	arg, ok := a.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s needs a string", n.fn)
+	}
+	switch n.fn {
+	case "startsWith":
+		return strings.HasPrefix(s, arg), nil
+	case "endsWith":
+		return strings.HasSuffix(s, arg), nil
+	default:
+		return strings.Contains(s, arg), nil
+	}
+}
+
+// ── Parsing ─────────────────────────────────────────────────────────────
+
+type tokKind int
+
+const (
+	tokEOF tokKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokOp
+)
+
+type token struct {
+	kind tokKind
+	text string
+	val  any
+	pos  int
+}
+
+func (t token) String() string {
+	if t.kind == tokEOF {
+		return "end of expression"
+	}
+	return strconv.Quote(t.text)
+}
+
+// ops lists the operators, longest first so that "<=" wins over "<".
+var ops = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")", "[", "]", ".", ",", "-"}
+
+func lex(src string) ([]token, error) {
+	var toks []token
+	i := 0
+next:
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case isIdentStart(c):
+			start := i
+			for i < len(src) && (isIdentStart(src[i]) || src[i] >= '0' && src[i] <= '9') {
+				i++
+			}
+			toks = append(toks, token{kind: tokIdent, text: src[start:i], pos: start})
+		case c >= '0' && c <= '9':
+			start := i
+			for i < len(src) && (src[i] >= '0' && src[i] <= '9' || src[i] == '.' || src[i] == 'e' || src[i] == 'E' ||
+				(src[i] == '+' || src[i] == '-') && (src[i-1] == 'e' || src[i-1] == 'E')) {
+				i++
+			}
+			f, err := strconv.ParseFloat(src[start:i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q at %d", src[start:i], start)
+			}
+			toks = append(toks, token{kind: tokNumber, text: src[start:i], val: f, pos: start})
+		case c == '"' || c == '\'':
+			start := i
+			var b strings.Builder
+			i++
+			for {
+				if i >= len(src) {
+					return nil, fmt.Errorf("unterminated string at %d", start)
+				}
+				ch := src[i]
+				if ch == c {
+					i++
+					break
+				}
+				if ch == '\\' && i+1 < len(src) {
+					i++
+					switch src[i] {
+					case 'n':
+						b.WriteByte('\n')
+					case 't':
+						b.WriteByte('\t')
+					case '\\', '"', '\'':
+						b.WriteByte(src[i])
+					default:
+						return nil, fmt.Errorf("invalid escape at %d", i-1)
+					}
+					i++
+					continue
+				}
+				b.WriteByte(ch)
+				i++
+			}
+			toks = append(toks, token{kind: tokString, text: src[start:i], val: b.String(), pos: start})
+		default:
+			for _, op := range ops {
+				if strings.HasPrefix(src[i:], op) {
+					toks = append(toks, token{kind: tokOp, text: op, pos: i})
+					i += len(op)
+					continue next
+				}
+			}
+			return nil, fmt.Errorf("unexpected %q at %d", c, i)
+		}
+	}
+	return append(toks, token{kind: tokEOF, pos: len(src)}), nil
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+type parser struct {
+	toks []token
+	i    int
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.i]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *parser) accept(op string) bool {
+	if t := p.peek(); t.kind == tokOp && t.text == op {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(op string) error {
+	if !p.accept(op) {
+		t := p.peek()
+		return fmt.Errorf("expected %q, got %s at %d", op, t, t.pos)
+	}
+	return nil
+}
+
+func (p *parser) parseOr(depth int) (node, error) {
+	l, err := p.parseAnd(depth)
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		r, err := p.parseAnd(depth)
+		if err != nil {
+			return nil, err
+		}
+		l = logicNode{and: false, l: l, r: r}
+	}
+	return l, nil
+}
+
+func (p *parser) parseAnd(depth int) (node, error) {
+	l, err := p.parseRelation(depth)
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		r, err := p.parseRelation(depth)
+		if err != nil {
+			return nil, err
+		}
+		l = logicNode{and: true, l: l, r: r}
+	}
+	return l, nil
+}
+
+func (p *parser) parseRelation(depth int) (node, error) {
+	l, err := p.parseUnary(depth)
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	switch {
+	case t.kind == tokOp && (t.text == "==" || t.text == "!=" || t.text == "<" || t.text == "<=" || t.text == ">" || t.text == ">="),
+		t.kind == tokIdent && t.text == "in":
+		p.next()
+		r, err := p.parseUnary(depth)
+		if err != nil {
+			return nil, err
+		}
+		return compareNode{op: t.text, l: l, r: r}, nil
+	}
+	return l, nil
+}
+
+func (p *parser) parseUnary(depth int) (node, error) {
+	if depth > maxExprDepth {
+		return nil, errors.New("nested too deeply")
+	}
+	if p.accept("!") {
+		x, err := p.parseUnary(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return notNode{x: x}, nil
+	}
+	if p.accept("-") {
+		t := p.next()
+		if t.kind != tokNumber {
+			return nil, fmt.Errorf("expected a number after -, got %s at %d", t, t.pos)
+		}
+		return literal{val: -t.val.(float64)}, nil
+	}
+	return p.parsePostfix(depth)
+}
+
+func (p *parser) parsePostfix(depth int) (node, error) {
+	x, err := p.parsePrimary(depth)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept("."):
+			t := p.next()
+			if t.kind != tokIdent {
+				return nil, fmt.Errorf("expected a field name, got %s at %d", t, t.pos)
+			}
+			if !p.accept("(") {
+				x = selectNode{x: x, field: t.text}
+				continue
+			}
+			switch t.text {
+			case "startsWith", "endsWith", "contains":
+			default:
+				return nil, fmt.Errorf("unknown method %s at %d", t.text, t.pos)
+			}
+			args, err := p.parseArgs(depth)
+			if err != nil {
+				return nil, err
+			}
+			if len(args) != 1 {
+				return nil, fmt.Errorf("%s takes one argument", t.text)
+			}
+			x = callNode{fn: t.text, target: x, args: args}
+		case p.accept("["):
+			index, err := p.parseOr(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			if lit, ok := index.(literal); ok {
+				if s, ok := lit.val.(string); ok {
+					x = selectNode{x: x, field: s}
+					continue
+				}
+			}
+			x = indexNode{x: x, index: index}
+		default:
+			return x, nil
+		}
+	}
+}
+
+func (p *parser) parseArgs(depth int) ([]node, error) {
+	var args []node
+	if p.accept(")") {
+		return args, nil
+	}
+	for {
+		a, err := p.parseOr(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, a)
+		if p.accept(")") {
+			return args, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *parser) parsePrimary(depth int) (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNumber, tokString:
+		return literal{val: t.val}, nil
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return literal{val: true}, nil
+		case "false":
+			return literal{val: false}, nil
+		case "null":
+			return literal{val: nil}, nil
+		case "has", "size":
+			if !p.accept("(") {
+				break
+			}
+			args, err := p.parseArgs(depth)
+			if err != nil {
+				return nil, err
+			}
+			if len(args) != 1 {
+				return nil, fmt.Errorf("%s takes one argument", t.text)
+			}
+			if t.text == "size" {
+				return callNode{fn: "size", target: args[0]}, nil
+			}
+			sel, ok := args[0].(selectNode)
+			if !ok {
+				return nil, fmt.Errorf("has needs a field selection such as has(payload.x), at %d", t.pos)
+			}
+			return hasNode{sel: sel}, nil
+		}
+		if !exprVars[t.text] {
+			return nil, fmt.Errorf("unknown variable %s at %d", t.text, t.pos)
+		}
+		return variable{name: t.text}, nil
+	case tokOp:
+		switch t.text {
+		case "(":
+			x, err := p.parseOr(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return x, nil
+		case "[":
+			var items []node
+			if p.accept("]") {
+				return listNode{}, nil
+			}
+			for {
+				item, err := p.parseOr(depth + 1)
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, item)
+				if p.accept("]") {
+					return listNode{items: items}, nil
+				}
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("unexpected %s at %d", t, t.pos)
+}
@@ -0,0 +1,143 @@
+package eventfilter
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/warjiang/eventide/sdk/go/eventide"
+)
+
+func testEvent() eventide.Event {
+	return eventide.Event{
+		ThreadID: "th1",
+		TurnID:   "t1",
+		Seq:      5,
+		TS:       time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+		Type:     "tool.call.started",
+		Level:    eventide.LevelWarn,
+		Tags:     map[string]string{"env": "prod"},
+		Source:   map[string]any{"agent": "planner"},
+		Payload:  json.RawMessage(`{"role":"assistant","text":"héllo","n":3,"items":[1,{"a":"b"}],"err":null}`),
+	}
+}
+
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		src     string
+		wantErr string
+	}{
+		{src: `payload.role == "assistant" && size(payload.text) > 0`},
+		{src: `type.startsWith("tool.") || tags.env in ["prod", "staging"]`},
+		{src: `has(payload.error) && !(level in ["debug", "info"])`},
+		{src: `payload.items[1]["a"] == 'b'`},
+		{src: `seq >= -1 && null == payload.err && true != false`},
+		{src: `foo == 1`, wantErr: "unknown variable foo"},
+		{src: `payload.x ==`, wantErr: "unexpected"},
+		{src: `has(payload)`, wantErr: "has needs a field selection"},
+		{src: `"abc`, wantErr: "unterminated string"},
+		{src: `"a\qb"`, wantErr: "invalid escape"},
+		{src: `payload.x.nope(1)`, wantErr: "unknown method nope"},
+		{src: `size(payload.a, payload.b)`, wantErr: "takes one argument"},
+		{src: `payload.x == 1 1`, wantErr: "unexpected"},
+		{src: `payload.x # 1`, wantErr: "unexpected"},
+		{src: strings.Repeat("(", 40) + "1" + strings.Repeat(")", 40), wantErr: "nested too deeply"},
+		{src: strings.Repeat("a", maxExprLen+1), wantErr: "longer than"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			x, err := Compile(tt.src)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if x.String() != tt.src {
+					t.Fatalf("String() = %q", x.String())
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExprMatch(t *testing.T) {
+	e := testEvent()
+	tests := []struct {
+		src  string
+		want bool
+	}{
+		{`payload.role == "assistant" && size(payload.text) == 5`, true},
+		{`type.startsWith("tool.") || tags.env in ["dev"]`, true},
+		{`type.endsWith(".started") && type.contains("call")`, true},
+		{`has(payload.missing)`, false},
+		{`!has(payload.missing) && has(payload.err)`, true},
+		// Errors count as no match, even when negated...
+		{`payload.missing == 1`, false},
+		{`!(payload.missing == 1)`, false},
+		{`payload.role > 1`, false},
+		// ...unless the other side of || or && decides the result.
+		{`payload.missing == 1 || seq >= 5`, true},
+		{`seq < 5 && payload.missing == 1`, false},
+		{`payload.n > 2.5 && payload.n < 3.5`, true},
+		{`payload.items[1].a == 'b' && payload["role"] != "user"`, true},
+		{`payload.items[2] == 1`, false},
+		{`size(payload.items) == 2 && size(tags) == 1`, true},
+		{`"env" in tags && level in ["warn", "error"] && payload.err == null`, true},
+		{`ts.startsWith("2026-01-01T") && thread_id == "th1" && turn_id == "t1"`, true},
+		{`source.agent == "planner" && !has(trace.trace_id)`, true},
+		{`seq`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			x, err := Compile(tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := x.Match(e); got != tt.want {
+				t.Fatalf("Match = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExprMatchInvalidPayload(t *testing.T) {
+	e := testEvent()
+	e.Payload = json.RawMessage(`{not json`)
+	x, err := Compile(`has(payload.a) || type == "tool.call.started"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !x.Match(e) {
+		t.Fatal("a decidable || should match despite the payload error")
+	}
+}
+
+func FuzzCompile(f *testing.F) {
+	for _, src := range []string{
+		`payload.role == "assistant" && size(payload.text) > 0`,
+		`type.startsWith("tool.") || tags.env in ["prod", "staging"]`,
+		`has(payload.error) && !(level in ["debug", "info"])`,
+		`payload.items[1]["a"] == 'b\n'`,
+		`seq >= -1.5e3 && null != payload.err`,
+		`((((1))))`,
+	} {
+		f.Add(src)
+	}
+	e := testEvent()
+	f.Fuzz(func(t *testing.T, src string) {
+		x, err := Compile(src)
+		if err != nil {
+			return
+		}
+		if x.String() != src {
+			t.Fatalf("String() = %q, want %q", x.String(), src)
+		}
+		// Evaluation must not panic, whatever the expression.
+		x.Match(e)
+		x.Match(eventide.Event{})
+	})
+}
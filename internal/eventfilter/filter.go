@@ -0,0 +1,261 @@
+// Package eventfilter selects the events a reader asks for: by type, minimum
+// level, tags, seq and ts ranges, and an optional expression over the event's
+// fields and payload. Filters are parsed from query parameters, pushed down
+// into Postgres queries where possible and otherwise applied to each event
+// before it is serialized.
+package eventfilter
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/warjiang/eventide/internal/pgstore"
+	"github.com/warjiang/eventide/sdk/go/eventide"
+)
+
+// levels lists the event levels from lowest to highest.
+var levels = []eventide.Level{eventide.LevelDebug, eventide.LevelInfo, eventide.LevelWarn, eventide.LevelError}
+
+// Filter selects events. The zero Filter selects every event.
+type Filter struct {
+	// Types are matched exactly, or by prefix when they end in "*", as in
+	// "tool.call.*".
+	Types []string
+	// MinLevel drops events below it.
+	MinLevel eventide.Level
+	// Tags must all be present with the given values.
+	Tags map[string]string
+	// MinSeq and MaxSeq are inclusive; zero does not filter.
+	MinSeq int64
+	MaxSeq int64
+	// Since is inclusive and Until exclusive; zero does not filter.
+	Since time.Time
+	Until time.Time
+	// Expr is evaluated last; an event it errors on does not match.
+	Expr *Expr
+}
+
+// Spec is the wire form of a Filter, as sent in WebSocket subscriptions.
+// Times are RFC 3339 strings.
+type Spec struct {
+	Types    []string          `json:"types,omitempty"`
+	MinLevel string            `json:"min_level,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+	MinSeq   int64             `json:"min_seq,omitempty"`
+	MaxSeq   int64             `json:"max_seq,omitempty"`
+	Since    string            `json:"since,omitempty"`
+	Until    string            `json:"until,omitempty"`
+	Expr     string            `json:"expr,omitempty"`
+}
+
+// Parse reads a filter from query parameters:
+//
+//	types      comma-separated types, with prefix globs such as "message.*"
+//	min_level  debug, info, warn or error
+//	tag        key:value, repeatable
+//	min_seq    lowest seq, inclusive
+//	max_seq    highest seq, inclusive
+//	since      RFC 3339 time, inclusive
+//	until      RFC 3339 time, exclusive
+//	expr       an expression, see Compile
+func Parse(q url.Values) (Filter, error) {
+	var s Spec
+	for _, v := range q["types"] {
+		s.Types = append(s.Types, strings.Split(v, ",")...)
+	}
+	s.MinLevel = q.Get("min_level")
+	for _, v := range q["tag"] {
+		key, value, ok := strings.Cut(v, ":")
+		if !ok || key == "" {
+			return Filter{}, fmt.Errorf("invalid tag: %q: want key:value", v)
+		}
+		if s.Tags == nil {
+			s.Tags = make(map[string]string)
+		}
+		s.Tags[key] = value
+	}
+	var err error
+	if s.MinSeq, err = parseSeq(q, "min_seq"); err != nil {
+		return Filter{}, err
+	}
+	if s.MaxSeq, err = parseSeq(q, "max_seq"); err != nil {
+		return Filter{}, err
+	}
+	s.Since = q.Get("since")
+	s.Until = q.Get("until")
+	s.Expr = q.Get("expr")
+	return s.Filter()
+}
+
+// Filter validates s and compiles it.
+func (s Spec) Filter() (Filter, error) {
+	var f Filter
+	anyType := false
+	for _, t := range s.Types {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		if i := strings.IndexByte(t, '*'); i >= 0 && i != len(t)-1 {
+			return Filter{}, fmt.Errorf("invalid types: %q: * is only allowed at the end", t)
+		}
+		anyType = anyType || t == "*"
+		f.Types = append(f.Types, t)
+	}
+	if anyType {
+		f.Types = nil
+	}
+	if s.MinLevel != "" {
+		if levelRank(eventide.Level(s.MinLevel)) < 0 {
+			return Filter{}, errors.New("invalid min_level")
+		}
+		f.MinLevel = eventide.Level(s.MinLevel)
+	}
+	for k, v := range s.Tags {
+		if k == "" {
+			return Filter{}, errors.New("invalid tag: empty key")
+		}
+		if f.Tags == nil {
+			f.Tags = make(map[string]string, len(s.Tags))
+		}
+		f.Tags[k] = v
+	}
+	if s.MinSeq < 0 {
+		return Filter{}, errors.New("invalid min_seq")
+	}
+	if s.MaxSeq < 0 {
+		return Filter{}, errors.New("invalid max_seq")
+	}
+	f.MinSeq, f.MaxSeq = s.MinSeq, s.MaxSeq
+	var err error
+	if f.Since, err = parseTime(s.Since, "since"); err != nil {
+		return Filter{}, err
+	}
+	if f.Until, err = parseTime(s.Until, "until"); err != nil {
+		return Filter{}, err
+	}
+	if s.Expr != "" {
+		if f.Expr, err = Compile(s.Expr); err != nil {
+			return Filter{}, fmt.Errorf("invalid expr: %w", err)
+		}
+	}
+	return f, nil
+}
+
+func parseSeq(q url.Values, name string) (int64, error) {
+	v := q.Get(name)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s", name)
+	}
+	return n, nil
+}
+
+func parseTime(v, name string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid %s", name)
+	}
+	return t, nil
+}
+
+// Match reports whether e passes the filter.
+func (f Filter) Match(e eventide.Event) bool {
+	if len(f.Types) > 0 && !matchType(f.Types, e.Type) {
+		return false
+	}
+	if f.MinLevel != "" && levelRank(e.Level) < levelRank(f.MinLevel) {
+		return false
+	}
+	for k, v := range f.Tags {
+		if got, ok := e.Tags[k]; !ok || got != v {
+			return false
+		}
+	}
+	if f.MinSeq > 0 && e.Seq < f.MinSeq {
+		return false
+	}
+	if f.MaxSeq > 0 && e.Seq > f.MaxSeq {
+		return false
+	}
+	if !f.Since.IsZero() && e.TS.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !e.TS.Before(f.Until) {
+		return false
+	}
+	if f.Expr != nil && !f.Expr.Match(e) {
+		return false
+	}
+	return true
+}
+
+// NeedsPostFilter reports whether events returned by a query that f was
+// pushed down into still have to be passed through Match.
+func (f Filter) NeedsPostFilter() bool {
+	return f.Expr != nil
+}
+
+// Pushdown adds the parts of f that Postgres can evaluate to q. Everything
+// but Expr is pushed down.
+func (f Filter) Pushdown(q *pgstore.EventQuery) {
+	q.Types = append(q.Types, f.Types...)
+	if f.MinLevel != "" {
+		for _, l := range levels[levelRank(f.MinLevel):] {
+			q.Levels = append(q.Levels, string(l))
+		}
+	}
+	if len(f.Tags) > 0 {
+		if q.Tags == nil {
+			q.Tags = make(map[string]string, len(f.Tags))
+		}
+		for k, v := range f.Tags {
+			q.Tags[k] = v
+		}
+	}
+	if f.MinSeq > 0 && f.MinSeq-1 > q.FromSeq {
+		q.FromSeq = f.MinSeq - 1
+	}
+	if f.MaxSeq > 0 && (q.MaxSeq == 0 || f.MaxSeq < q.MaxSeq) {
+		q.MaxSeq = f.MaxSeq
+	}
+	if !f.Since.IsZero() && f.Since.After(q.Since) {
+		q.Since = f.Since
+	}
+	if !f.Until.IsZero() && (q.Until.IsZero() || f.Until.Before(q.Until)) {
+		q.Until = f.Until
+	}
+}
+
+func matchType(patterns []string, typ string) bool {
+	for _, p := range patterns {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if strings.HasPrefix(typ, prefix) {
+				return true
+			}
+		} else if typ == p {
+			return true
+		}
+	}
+	return false
+}
+
+// levelRank returns the position of l in levels, or -1 for unknown levels.
+func levelRank(l eventide.Level) int {
+	for i, v := range levels {
+		if v == l {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,261 @@
+package eventfilter
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/warjiang/eventide/internal/pgstore"
+	"github.com/warjiang/eventide/sdk/go/eventide"
+)
+
+var t0 = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    Filter
+		wantErr string
+	}{
+		{query: "", want: Filter{}},
+		{query: "types=message.*,+tool.call+&types=run.started", want: Filter{Types: []string{"message.*", "tool.call", "run.started"}}},
+		{query: "types=message.*,*", want: Filter{}},
+		{query: "types=,", want: Filter{}},
+		{query: "min_level=warn", want: Filter{MinLevel: eventide.LevelWarn}},
+		{query: "tag=env:prod&tag=team:a:b", want: Filter{Tags: map[string]string{"env": "prod", "team": "a:b"}}},
+		{query: "tag=env:", want: Filter{Tags: map[string]string{"env": ""}}},
+		{query: "min_seq=3&max_seq=7", want: Filter{MinSeq: 3, MaxSeq: 7}},
+		{
+			query: "since=2026-01-01T00:00:00Z&until=2026-01-01T01:00:00.5%2B01:00",
+			want:  Filter{Since: t0, Until: time.Date(2026, 1, 1, 1, 0, 0, 5e8, time.FixedZone("", 3600))},
+		},
+		{query: "types=mess*age", wantErr: "* is only allowed at the end"},
+		{query: "min_level=fatal", wantErr: "invalid min_level"},
+		{query: "tag=env", wantErr: "invalid tag"},
+		{query: "tag=:prod", wantErr: "invalid tag"},
+		{query: "min_seq=-1", wantErr: "invalid min_seq"},
+		{query: "max_seq=x", wantErr: "invalid max_seq"},
+		{query: "since=yesterday", wantErr: "invalid since"},
+		{query: "until=2026-01-01", wantErr: "invalid until"},
+		{query: "expr=payload.x+%3D%3D", wantErr: "invalid expr"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			q, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := Parse(q)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !f.Since.Equal(tt.want.Since) || !f.Until.Equal(tt.want.Until) {
+				t.Fatalf("since, until = %v, %v", f.Since, f.Until)
+			}
+			f.Since, f.Until = tt.want.Since, tt.want.Until
+			if !reflect.DeepEqual(f, tt.want) {
+				t.Fatalf("Parse = %+v, want %+v", f, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseExpr(t *testing.T) {
+	f, err := Parse(url.Values{"expr": {`payload.role == "user"`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Expr == nil || f.Expr.String() != `payload.role == "user"` || !f.NeedsPostFilter() {
+		t.Fatalf("Expr = %v", f.Expr)
+	}
+	if f, _ := Parse(url.Values{"types": {"a"}}); f.NeedsPostFilter() {
+		t.Fatal("a filter without expr needs no post-filter")
+	}
+}
+
+func TestMatch(t *testing.T) {
+	e := eventide.Event{
+		Seq:     5,
+		TS:      t0,
+		Type:    "tool.call.started",
+		Level:   eventide.LevelInfo,
+		Tags:    map[string]string{"env": "prod", "team": "a"},
+		Payload: []byte(`{"role":"assistant"}`),
+	}
+	tests := []struct {
+		name string
+		f    Filter
+		want bool
+	}{
+		{"zero", Filter{}, true},
+		{"exact type", Filter{Types: []string{"tool.call.started"}}, true},
+		{"other type", Filter{Types: []string{"tool.call"}}, false},
+		{"glob", Filter{Types: []string{"message.*", "tool.*"}}, true},
+		{"glob without dot", Filter{Types: []string{"tool.call.start*"}}, true},
+		{"other glob", Filter{Types: []string{"tool.result.*"}}, false},
+		{"min level equal", Filter{MinLevel: eventide.LevelInfo}, true},
+		{"min level below", Filter{MinLevel: eventide.LevelDebug}, true},
+		{"min level above", Filter{MinLevel: eventide.LevelWarn}, false},
+		{"tags", Filter{Tags: map[string]string{"env": "prod"}}, true},
+		{"all tags", Filter{Tags: map[string]string{"env": "prod", "team": "b"}}, false},
+		{"missing tag", Filter{Tags: map[string]string{"region": ""}}, false},
+		{"seq range", Filter{MinSeq: 5, MaxSeq: 5}, true},
+		{"seq below", Filter{MinSeq: 6}, false},
+		{"seq above", Filter{MaxSeq: 4}, false},
+		{"since inclusive", Filter{Since: t0}, true},
+		{"since after", Filter{Since: t0.Add(time.Nanosecond)}, false},
+		{"until exclusive", Filter{Until: t0}, false},
+		{"until after", Filter{Until: t0.Add(time.Second)}, true},
+		{"expr", Filter{Expr: mustCompile(t, `payload.role == "assistant"`)}, true},
+		{"expr mismatch", Filter{Expr: mustCompile(t, `payload.role == "user"`)}, false},
+		{"expr error", Filter{Expr: mustCompile(t, `payload.missing > 1`)}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.f.Match(e); got != tt.want {
+				t.Fatalf("Match = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func mustCompile(t *testing.T, src string) *Expr {
+	t.Helper()
+	x, err := Compile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return x
+}
+
+// TestPushdownMatchesMatch checks that a query with a filter pushed down
+// selects exactly the events Match selects, evaluating the query the way
+// QueryEvents' SQL does.
+func TestPushdownMatchesMatch(t *testing.T) {
+	var events []eventide.Event
+	types := []string{"message.delta", "message_delta", "messageXdelta", "tool.call", "tool.call.started", "tool%call", "tool_call", `tool\call`, "run"}
+	tagSets := []map[string]string{nil, {"env": "prod"}, {"env": "dev"}, {"env": "prod", "team": "a"}}
+	for i, typ := range types {
+		for j, l := range levels {
+			events = append(events, eventide.Event{
+				Seq:   int64(i*len(levels) + j + 1),
+				TS:    t0.Add(time.Duration(i+j) * time.Minute),
+				Type:  typ,
+				Level: l,
+				Tags:  tagSets[(i+j)%len(tagSets)],
+			})
+		}
+	}
+
+	filters := []Filter{
+		{},
+		{Types: []string{"message.*"}},
+		{Types: []string{"message_*"}},
+		{Types: []string{"tool%*", "run"}},
+		{Types: []string{`tool\*`}},
+		{Types: []string{"tool.call"}},
+		{Types: []string{"tool.call*"}},
+		{Types: []string{"tool_call", "message.delta"}},
+		{MinLevel: eventide.LevelDebug},
+		{MinLevel: eventide.LevelWarn},
+		{MinLevel: eventide.LevelError, Types: []string{"tool.*"}},
+		{Tags: map[string]string{"env": "prod"}},
+		{Tags: map[string]string{"env": "prod", "team": "a"}},
+		{Tags: map[string]string{"team": ""}},
+		{MinSeq: 3, MaxSeq: 20},
+		{MinSeq: 1},
+		{Since: t0.Add(2 * time.Minute), Until: t0.Add(5 * time.Minute)},
+		{Types: []string{"message.*"}, MinLevel: eventide.LevelInfo, Tags: map[string]string{"env": "prod"}, MaxSeq: 30},
+	}
+	for _, f := range filters {
+		t.Run(fmt.Sprintf("%+v", f), func(t *testing.T) {
+			q := pgstore.EventQuery{ThreadID: "th"}
+			f.Pushdown(&q)
+			for _, e := range events {
+				if got, want := selects(q, e), f.Match(e); got != want {
+					t.Errorf("event %s/%s/%v seq %d: query selects %v, Match %v", e.Type, e.Level, e.Tags, e.Seq, got, want)
+				}
+			}
+		})
+	}
+}
+
+// selects evaluates the WHERE clause QueryEvents builds for q against e.
+func selects(q pgstore.EventQuery, e eventide.Event) bool {
+	if e.Seq <= q.FromSeq || (q.MaxSeq > 0 && e.Seq > q.MaxSeq) {
+		return false
+	}
+	if len(q.Types) > 0 {
+		ok := false
+		for _, t := range q.Types {
+			if prefix, glob := strings.CutSuffix(t, "*"); glob {
+				ok = ok || like(escapeLike(prefix)+"%", e.Type)
+			} else {
+				ok = ok || e.Type == t
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(q.Levels) > 0 {
+		ok := false
+		for _, l := range q.Levels {
+			ok = ok || string(e.Level) == l
+		}
+		if !ok {
+			return false
+		}
+	}
+	for k, v := range q.Tags {
+		if got, ok := e.Tags[k]; !ok || got != v {
+			return false
+		}
+	}
+	if !q.Since.IsZero() && e.TS.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !e.TS.Before(q.Until) {
+		return false
+	}
+	return true
+}
+
+// escapeLike mirrors pgstore's escaping of prefix patterns.
+var escapeLike = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace
+
+// like implements Postgres' LIKE with the default backslash escape.
+func like(pattern, s string) bool {
+	if pattern == "" {
+		return s == ""
+	}
+	switch c := pattern[0]; c {
+	case '%':
+		for i := 0; i <= len(s); i++ {
+			if like(pattern[1:], s[i:]) {
+				return true
+			}
+		}
+		return false
+	case '_':
+		return s != "" && like(pattern[1:], s[1:])
+	case '\\':
+		pattern = pattern[1:]
+		if pattern == "" {
+			return false
+		}
+		c = pattern[0]
+		fallthrough
+	default:
+		return s != "" && s[0] == c && like(pattern[1:], s[1:])
+	}
+}
@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisHook times every Redis command. Pipelines are recorded as one
+// "pipeline" observation.
+type RedisHook struct{}
+
+func (RedisHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return next(ctx, network, addr)
+	}
+}
+
+func (RedisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		RedisDuration.WithLabelValues(cmd.Name(), redisStatus(err)).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+func (RedisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		RedisDuration.WithLabelValues("pipeline", redisStatus(err)).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+// redisStatus treats redis.Nil (a missing key) as success.
+func redisStatus(err error) string {
+	if errors.Is(err, redis.Nil) {
+		return "ok"
+	}
+	return Status(err)
+}
+
+// PostgresTracer times every query run through a pgx connection, labelled by
+// the leading SQL keyword.
+type PostgresTracer struct{}
+
+type pgTraceKey struct{}
+
+type pgTrace struct {
+	start     time.Time
+	operation string
+}
+
+func (PostgresTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	return context.WithValue(ctx, pgTraceKey{}, pgTrace{start: time.Now(), operation: sqlOperation(data.SQL)})
+}
+
+func (PostgresTracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	t, ok := ctx.Value(pgTraceKey{}).(pgTrace)
+	if !ok {
+		return
+	}
+	err := data.Err
+	if errors.Is(err, pgx.ErrNoRows) {
+		err = nil
+	}
+	PostgresDuration.WithLabelValues(t.operation, Status(err)).Observe(time.Since(t.start).Seconds())
+}
+
+func sqlOperation(sql string) string {
+	fields := strings.Fields(sql)
+	if len(fields) == 0 {
+		return "unknown"
+	}
+	switch op := strings.ToLower(fields[0]); op {
+	case "select", "insert", "update", "delete", "with", "begin", "commit", "rollback", "create", "alter":
+		return op
+	default:
+		return "other"
+	}
+}
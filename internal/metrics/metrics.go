@@ -0,0 +1,269 @@
+// Package metrics defines the Prometheus metrics shared by the eventide
+// services, so that every binary reports under the same names.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "eventide"
+
+var (
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by service, route and status code.",
+	}, []string{"service", "route", "code"})
+
+	HTTPDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by service and route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"service", "route"})
+
+	// Gateway.
+
+	AppendedEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "gateway",
+		Name:      "events_total",
+		Help:      "Events accepted by the gateway, by result (written or duplicated).",
+	}, []string{"result"})
+
+	IngestRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "gateway",
+		Name:      "ingest_retries_total",
+		Help:      "Redis writes retried after a transient failure.",
+	})
+
+	// Beacon.
+
+	SSEConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "beacon",
+		Name:      "sse_connections",
+		Help:      "Open SSE connections.",
+	})
+
+	SSEBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "beacon",
+		Name:      "sse_bytes_sent_total",
+		Help:      "Bytes written to SSE connections.",
+	})
+
+	SSEEvents = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "beacon",
+		Name:      "sse_events_sent_total",
+		Help:      "Events written to SSE connections.",
+	})
+
+	SSEReplayedEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "beacon",
+		Name:      "sse_replayed_events_total",
+		Help:      "Events replayed to SSE and WebSocket subscribers from behind the Redis stream, by source (postgres, archive).",
+	}, []string{"source"})
+
+	WSConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "beacon",
+		Name:      "ws_connections",
+		Help:      "Open WebSocket connections.",
+	})
+
+	WSSubscriptions = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "beacon",
+		Name:      "ws_subscriptions",
+		Help:      "Active thread subscriptions on WebSocket connections.",
+	})
+
+	WSEvents = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "beacon",
+		Name:      "ws_events_sent_total",
+		Help:      "Events sent to WebSocket connections.",
+	})
+
+	// Persister.
+
+	PersistedEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "persister",
+		Name:      "events_total",
+		Help:      "Stream messages handled by the persister, by result.",
+	}, []string{"result"})
+
+	PersistDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "persister",
+		Name:      "persist_duration_seconds",
+		Help:      "Time to persist one event to Postgres outside of a batch.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	PersistBatchDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "persister",
+		Name:      "batch_duration_seconds",
+		Help:      "Time to persist one batch of events in a single transaction.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	PersistBatchSize = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "persister",
+		Name:      "batch_size",
+		Help:      "Events per committed batch.",
+		Buckets:   []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000},
+	})
+
+	PersisterShards = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "persister",
+		Name:      "owned_shards",
+		Help:      "Global stream shards this persister replica consumes.",
+	})
+
+	DLQMoved = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "persister",
+		Name:      "dlq_moved_total",
+		Help:      "Messages moved to the dead-letter stream.",
+	})
+
+	GlobalReconciled = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "persister",
+		Name:      "global_reconciled_total",
+		Help:      "Global stream entries appended for thread stream entries whose global write never completed (cluster mode).",
+	})
+
+	GlobalReconcileMissing = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "persister",
+		Name:      "global_reconcile_missing_total",
+		Help:      "Unconfirmed thread stream entries that were gone before their global entry could be appended (cluster mode).",
+	})
+
+	StreamLength = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "stream_length",
+		Help:      "Entries in a Redis stream.",
+	}, []string{"stream"})
+
+	StreamPending = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "stream_pending_messages",
+		Help:      "Messages delivered to a consumer group but not yet acknowledged.",
+	}, []string{"stream", "group"})
+
+	StreamLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "stream_consumer_lag",
+		Help:      "Entries in a stream not yet delivered to a consumer group.",
+	}, []string{"stream", "group"})
+
+	StreamTrimmed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "stream_trimmed_entries_total",
+		Help:      "Acknowledged entries trimmed from a Redis stream.",
+	}, []string{"stream"})
+
+	// Archiver.
+
+	ArchivedEvents = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "archiver",
+		Name:      "events_total",
+		Help:      "Events written to archives.",
+	})
+
+	ArchivedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "archiver",
+		Name:      "bytes_total",
+		Help:      "Compressed archive bytes uploaded.",
+	})
+
+	ArchiveLastSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "archiver",
+		Name:      "last_success_timestamp_seconds",
+		Help:      "Unix time of the last successful archive run.",
+	})
+
+	// Backends.
+
+	RedisDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "redis_command_duration_seconds",
+		Help:      "Redis command latency by command and status.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 5},
+	}, []string{"command", "status"})
+
+	PostgresDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "postgres_query_duration_seconds",
+		Help:      "Postgres query latency by operation and status.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 5},
+	}, []string{"operation", "status"})
+
+	S3Duration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "s3_operation_duration_seconds",
+		Help:      "S3 operation latency by operation and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation", "status"})
+)
+
+// Handler serves the default registry.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Status is the status label for an operation that returned err.
+func Status(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// ObserveS3 records the latency of an S3 operation started at start.
+func ObserveS3(op string, start time.Time, err error) {
+	S3Duration.WithLabelValues(op, Status(err)).Observe(time.Since(start).Seconds())
+}
+
+// Middleware records request counts and latencies per chi route pattern.
+func Middleware(service string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			start := time.Now()
+			ww := middleware.NewWrapResponseWriter(w, req.ProtoMajor)
+			next.ServeHTTP(ww, req)
+			route := "unmatched"
+			if rc := chi.RouteContext(req.Context()); rc != nil && rc.RoutePattern() != "" {
+				route = rc.RoutePattern()
+			}
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			HTTPRequests.WithLabelValues(service, route, strconv.Itoa(status)).Inc()
+			HTTPDuration.WithLabelValues(service, route).Observe(time.Since(start).Seconds())
+		})
+	}
+}
@@ -0,0 +1,473 @@
+package pgstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/warjiang/eventide/sdk/go/eventide"
+)
+
+// BatchItem is one event of a PersistBatch call together with the tenant it
+// was written by.
+type BatchItem struct {
+	TenantID string
+	Event    eventide.Event
+}
+
+type seqKey struct {
+	threadID string
+	seq      int64
+}
+
+type turnKey struct {
+	threadID string
+	turnID   string
+}
+
+// PersistBatch writes items and their folded thread and turn projections in
+// a single transaction. It returns one error per item:
+//   - nil when the event is stored, including when it was stored before;
+//   - a *SeqConflictError or *TenantMismatchError when the event was
+//     quarantined in the same transaction;
+//   - any other error when the item is invalid and nothing was written for it.
+//
+// When the second return value is non-nil the transaction was rolled back and
+// nothing was written.
+func (s *Store) PersistBatch(ctx context.Context, idleTimeoutSeconds int, items []BatchItem) ([]error, error) {
+	if idleTimeoutSeconds <= 0 {
+		idleTimeoutSeconds = 900
+	}
+	results := make([]error, len(items))
+	var valid []int
+	for i, it := range items {
+		if strings.TrimSpace(it.TenantID) == "" {
+			results[i] = errors.New("tenantID is required")
+			continue
+		}
+		if err := it.Event.Validate(); err != nil {
+			results[i] = fmt.Errorf("event invalid: %w", err)
+			continue
+		}
+		valid = append(valid, i)
+	}
+	if len(valid) == 0 {
+		return results, nil
+	}
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = tx.Rollback(context.Background())
+	}()
+
+	owners, err := threadOwners(ctx, tx, items, valid, idleTimeoutSeconds)
+	if err != nil {
+		return nil, err
+	}
+	var owned []int
+	for _, i := range valid {
+		it := items[i]
+		owner := owners[it.Event.ThreadID]
+		if owner != it.TenantID {
+			mismatch := &TenantMismatchError{ThreadID: it.Event.ThreadID, Seq: it.Event.Seq, EventID: it.Event.EventID, OwnerTenantID: owner, TenantID: it.TenantID}
+			if err := insertConflict(ctx, tx, "tenant_mismatch", mismatch.ThreadID, mismatch.Seq, "", it.Event); err != nil {
+				return nil, err
+			}
+			results[i] = mismatch
+			continue
+		}
+		owned = append(owned, i)
+	}
+
+	stored, err := insertEvents(ctx, tx, items, owned, results)
+	if err != nil {
+		return nil, err
+	}
+	if err := upsertThreads(ctx, tx, items, stored, idleTimeoutSeconds); err != nil {
+		return nil, err
+	}
+	if err := upsertTurns(ctx, tx, items, stored); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// threadOwners returns the tenant of every thread of idx, locking the thread
+// rows until the transaction ends. Threads without a row get one owned by the
+// tenant of their first event in the batch: the first event of a new thread
+// fixes its tenant. Inserting before reading means that of two replicas
+// persisting the first events of a thread concurrently, the second waits for
+// the first and then sees its owner, instead of both claiming the thread.
+func threadOwners(ctx context.Context, tx pgx.Tx, items []BatchItem, idx []int, idleTimeoutSeconds int) (map[string]string, error) {
+	first := make(map[string]string)
+	var ids []string
+	for _, i := range idx {
+		id := items[i].Event.ThreadID
+		if _, ok := first[id]; !ok {
+			first[id] = items[i].TenantID
+			ids = append(ids, id)
+		}
+	}
+	// Rows are locked in thread_id order so that concurrent batches cannot
+	// deadlock on them.
+	sort.Strings(ids)
+	tenants := make([]string, len(ids))
+	for n, id := range ids {
+		tenants[n] = first[id]
+	}
+	now := time.Now().UTC()
+	if _, err := tx.Exec(ctx, `INSERT INTO threads(
+  thread_id, tenant_id, status, created_at, last_active_at, idle_timeout_seconds, last_seq
+)
+SELECT t.thread_id, t.tenant_id, 'active', $3::timestamptz, $3::timestamptz, $4::int, 0
+FROM unnest($1::text[], $2::text[]) WITH ORDINALITY AS t(thread_id, tenant_id, n)
+ORDER BY t.n
+ON CONFLICT (thread_id) DO NOTHING`, ids, tenants, now, idleTimeoutSeconds); err != nil {
+		return nil, err
+	}
+	rows, err := tx.Query(ctx, `SELECT thread_id, tenant_id FROM threads WHERE thread_id = ANY($1) ORDER BY thread_id FOR UPDATE`, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	owners := make(map[string]string, len(ids))
+	for rows.Next() {
+		var threadID, tenantID string
+		if err := rows.Scan(&threadID, &tenantID); err != nil {
+			return nil, err
+		}
+		owners[threadID] = tenantID
+	}
+	return owners, rows.Err()
+}
+
+// insertEvents writes the events of idx with multi-row inserts and returns
+// the items that are stored afterwards, in batch order. Items that lost their
+// seq to a different event are quarantined and recorded in results.
+func insertEvents(ctx context.Context, tx pgx.Tx, items []BatchItem, idx []int, results []error) ([]int, error) {
+	if len(idx) == 0 {
+		return nil, nil
+	}
+	// Rows go in in (thread_id, seq) order so that concurrent batches take
+	// index locks in the same order.
+	ordered := append([]int(nil), idx...)
+	sort.SliceStable(ordered, func(a, b int) bool {
+		ea, eb := items[ordered[a]].Event, items[ordered[b]].Event
+		if ea.ThreadID != eb.ThreadID {
+			return ea.ThreadID < eb.ThreadID
+		}
+		return ea.Seq < eb.Seq
+	})
+
+	const cols = 12
+	inserted := make(map[string]bool)
+	for _, chunk := range chunks(ordered, cols) {
+		var sql strings.Builder
+		sql.WriteString(`INSERT INTO agent_events(
+  thread_id, seq, event_id, turn_id, ts, type, level, payload, source, trace, tags, tenant_id
+) VALUES `)
+		args := make([]any, 0, len(chunk)*cols)
+		for n, i := range chunk {
+			if n > 0 {
+				sql.WriteString(",")
+			}
+			sql.WriteString(placeholders(n*cols, cols))
+			e := items[i].Event
+			args = append(args, e.ThreadID, e.Seq, e.EventID, e.TurnID, e.TS, e.Type, string(e.Level), e.Payload, e.Source, e.Trace, e.Tags, items[i].TenantID)
+		}
+		sql.WriteString("\nON CONFLICT DO NOTHING\nRETURNING event_id")
+
+		rows, err := tx.Query(ctx, sql.String(), args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var eventID string
+			if err := rows.Scan(&eventID); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			inserted[eventID] = true
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Anything not inserted is either a redelivery of a stored event or a
+	// different event that was handed a seq that is already taken.
+	var lookup []int
+	for _, i := range ordered {
+		id := items[i].Event.EventID
+		if inserted[id] {
+			delete(inserted, id) // a later copy in the same batch was skipped
+			continue
+		}
+		lookup = append(lookup, i)
+	}
+	existing, err := existingEventIDs(ctx, tx, items, lookup)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range lookup {
+		e := items[i].Event
+		existingID, ok := existing[seqKey{e.ThreadID, e.Seq}]
+		if !ok || existingID == e.EventID {
+			continue
+		}
+		conflict := &SeqConflictError{ThreadID: e.ThreadID, Seq: e.Seq, ExistingEventID: existingID, EventID: e.EventID}
+		if err := insertConflict(ctx, tx, "seq_conflict", e.ThreadID, e.Seq, existingID, e); err != nil {
+			return nil, err
+		}
+		results[i] = conflict
+	}
+
+	var stored []int
+	for _, i := range idx {
+		if results[i] == nil {
+			stored = append(stored, i)
+		}
+	}
+	return stored, nil
+}
+
+func existingEventIDs(ctx context.Context, tx pgx.Tx, items []BatchItem, idx []int) (map[seqKey]string, error) {
+	out := make(map[seqKey]string)
+	if len(idx) == 0 {
+		return out, nil
+	}
+	threadIDs := make([]string, 0, len(idx))
+	seqs := make([]int64, 0, len(idx))
+	for _, i := range idx {
+		threadIDs = append(threadIDs, items[i].Event.ThreadID)
+		seqs = append(seqs, items[i].Event.Seq)
+	}
+	rows, err := tx.Query(ctx, `SELECT e.thread_id, e.seq, e.event_id
+FROM agent_events e
+JOIN unnest($1::text[], $2::bigint[]) AS k(thread_id, seq) ON e.thread_id = k.thread_id AND e.seq = k.seq`, threadIDs, seqs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			k       seqKey
+			eventID string
+		)
+		if err := rows.Scan(&k.threadID, &k.seq, &eventID); err != nil {
+			return nil, err
+		}
+		out[k] = eventID
+	}
+	return out, rows.Err()
+}
+
+// upsertThreads folds the stored events into one row per thread: the status
+// of its last event and its highest seq.
+func upsertThreads(ctx context.Context, tx pgx.Tx, items []BatchItem, stored []int, idleTimeoutSeconds int) error {
+	type threadRow struct {
+		tenantID string
+		status   string
+		lastSeq  int64
+	}
+	byThread := make(map[string]*threadRow)
+	for _, i := range stored {
+		e := items[i].Event
+		row, ok := byThread[e.ThreadID]
+		if !ok {
+			row = &threadRow{tenantID: items[i].TenantID}
+			byThread[e.ThreadID] = row
+		}
+		row.status = "active"
+		if e.Type == eventide.TypeTurnCompleted || e.Type == eventide.TypeTurnFailed || e.Type == eventide.TypeTurnCancelled {
+			row.status = "idle"
+		}
+		if e.Seq > row.lastSeq {
+			row.lastSeq = e.Seq
+		}
+	}
+	if len(byThread) == 0 {
+		return nil
+	}
+	ids := make([]string, 0, len(byThread))
+	for id := range byThread {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	const cols = 7
+	now := time.Now().UTC()
+	for _, chunk := range chunks(ids, cols) {
+		var sql strings.Builder
+		sql.WriteString(`INSERT INTO threads(
+  thread_id, tenant_id, status, created_at, last_active_at, idle_timeout_seconds, last_seq
+) VALUES `)
+		args := make([]any, 0, len(chunk)*cols)
+		for n, id := range chunk {
+			if n > 0 {
+				sql.WriteString(",")
+			}
+			sql.WriteString(placeholders(n*cols, cols))
+			row := byThread[id]
+			args = append(args, id, row.tenantID, row.status, now, now, idleTimeoutSeconds, row.lastSeq)
+		}
+		sql.WriteString(`
+ON CONFLICT (thread_id) DO UPDATE SET
+  status = EXCLUDED.status,
+  last_active_at = EXCLUDED.last_active_at,
+  idle_timeout_seconds = EXCLUDED.idle_timeout_seconds,
+  last_seq = GREATEST(threads.last_seq, EXCLUDED.last_seq)`)
+		if _, err := tx.Exec(ctx, sql.String(), args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// upsertTurns folds the stored events into one row per turn, applying the
+// same transitions PersistEvent applies one event at a time. The input of a
+// turn is set by its started event, so it is written separately for the
+// turns that saw one in this batch.
+func upsertTurns(ctx context.Context, tx pgx.Tx, items []BatchItem, stored []int) error {
+	type turnRow struct {
+		status      string
+		createdAt   time.Time
+		completedAt any
+		input       json.RawMessage
+	}
+	byTurn := make(map[turnKey]*turnRow)
+	for _, i := range stored {
+		e := items[i].Event
+		k := turnKey{e.ThreadID, e.TurnID}
+		status := turnStatus(e)
+		row, ok := byTurn[k]
+		if !ok {
+			row = &turnRow{status: status, createdAt: e.TS}
+			byTurn[k] = row
+		} else {
+			row.status = foldTurnStatus(row.status, status)
+		}
+		if row.completedAt == nil {
+			row.completedAt = turnCompletedAt(e)
+		}
+		if e.Type == eventide.TypeTurnStarted {
+			row.input = e.Payload
+		}
+	}
+	if len(byTurn) == 0 {
+		return nil
+	}
+	keys := make([]turnKey, 0, len(byTurn))
+	for k := range byTurn {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(a, b int) bool {
+		if keys[a].threadID != keys[b].threadID {
+			return keys[a].threadID < keys[b].threadID
+		}
+		return keys[a].turnID < keys[b].turnID
+	})
+
+	const cols = 6
+	var (
+		inputThreads []string
+		inputTurns   []string
+		inputs       []string
+	)
+	for _, chunk := range chunks(keys, cols) {
+		var sql strings.Builder
+		sql.WriteString(`INSERT INTO turns(
+  thread_id, turn_id, status, input, created_at, completed_at
+) VALUES `)
+		args := make([]any, 0, len(chunk)*cols)
+		for n, k := range chunk {
+			if n > 0 {
+				sql.WriteString(",")
+			}
+			sql.WriteString(placeholders(n*cols, cols))
+			row := byTurn[k]
+			input := row.input
+			if input == nil {
+				input = json.RawMessage("{}")
+			} else {
+				inputThreads = append(inputThreads, k.threadID)
+				inputTurns = append(inputTurns, k.turnID)
+				inputs = append(inputs, string(row.input))
+			}
+			args = append(args, k.threadID, k.turnID, row.status, input, row.createdAt, row.completedAt)
+		}
+		sql.WriteString(`
+ON CONFLICT (thread_id, turn_id) DO UPDATE SET
+  status = CASE
+    WHEN turns.status IN ('completed', 'failed', 'cancelled') THEN turns.status
+    WHEN turns.status = 'running' AND EXCLUDED.status = 'started' THEN turns.status
+    ELSE EXCLUDED.status
+  END,
+  completed_at = COALESCE(turns.completed_at, EXCLUDED.completed_at)`)
+		if _, err := tx.Exec(ctx, sql.String(), args...); err != nil {
+			return err
+		}
+	}
+	if len(inputs) == 0 {
+		return nil
+	}
+	_, err := tx.Exec(ctx, `UPDATE turns t SET input = v.input::jsonb
+FROM unnest($1::text[], $2::text[], $3::text[]) AS v(thread_id, turn_id, input)
+WHERE t.thread_id = v.thread_id AND t.turn_id = v.turn_id`, inputThreads, inputTurns, inputs)
+	return err
+}
+
+// foldTurnStatus applies the turn upsert's status transition in Go:
+// terminal statuses stick, and a running turn is not moved back to started.
+func foldTurnStatus(current, next string) string {
+	switch {
+	case current == "completed" || current == "failed" || current == "cancelled":
+		return current
+	case current == "running" && next == "started":
+		return current
+	default:
+		return next
+	}
+}
+
+// maxParams is the number of bind parameters Postgres accepts in one
+// statement.
+const maxParams = 65535
+
+// chunks splits rows into runs that fit into one multi-row statement of cols
+// parameters per row.
+func chunks[T any](rows []T, cols int) [][]T {
+	size := maxParams / cols
+	out := make([][]T, 0, (len(rows)+size-1)/size)
+	for len(rows) > size {
+		out = append(out, rows[:size])
+		rows = rows[size:]
+	}
+	return append(out, rows)
+}
+
+// placeholders returns "($from+1,...,$from+n)".
+func placeholders(from, n int) string {
+	var b strings.Builder
+	b.WriteString("(")
+	for i := 1; i <= n; i++ {
+		if i > 1 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, "$%d", from+i)
+	}
+	b.WriteString(")")
+	return b.String()
+}
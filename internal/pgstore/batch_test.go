@@ -0,0 +1,224 @@
+package pgstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/warjiang/eventide/migrations"
+	"github.com/warjiang/eventide/sdk/go/eventide"
+)
+
+// The PersistBatch tests need a real Postgres. Point EVENTIDE_TEST_PG_CONN at
+// a scratch database; every test runs in a schema of its own:
+//
+//	EVENTIDE_TEST_PG_CONN=postgres://postgres@127.0.0.1:5432/postgres go test ./internal/pgstore
+
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	conn := os.Getenv("EVENTIDE_TEST_PG_CONN")
+	if conn == "" {
+		t.Skip("EVENTIDE_TEST_PG_CONN not set")
+	}
+	ctx := context.Background()
+	admin, err := New(ctx, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(admin.Close)
+	schema := fmt.Sprintf("test_%d", time.Now().UnixNano())
+	if err := admin.Exec(ctx, "CREATE SCHEMA "+schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = admin.Exec(context.Background(), "DROP SCHEMA "+schema+" CASCADE") })
+
+	sep := "?"
+	if strings.Contains(conn, "?") {
+		sep = "&"
+	}
+	s, err := New(ctx, conn+sep+"search_path="+schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	if err := s.EnsureMigrationsTable(ctx); err != nil {
+		t.Fatal(err)
+	}
+	files, err := fs.Glob(migrations.FS, "*.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	for _, f := range files {
+		b, err := migrations.FS.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.ApplyMigration(ctx, strings.TrimSuffix(f, ".sql"), string(b)); err != nil {
+			t.Fatalf("apply %s: %v", f, err)
+		}
+	}
+	return s
+}
+
+func testEvent(threadID, eventID string, seq int64, typ string) eventide.Event {
+	return eventide.Event{
+		SpecVersion: eventide.SpecVersion,
+		EventID:     eventID,
+		ThreadID:    threadID,
+		TurnID:      "turn1",
+		Seq:         seq,
+		TS:          time.Now().UTC(),
+		Type:        typ,
+		Level:       eventide.LevelInfo,
+		Payload:     []byte(`{"n":1}`),
+	}
+}
+
+func TestPersistBatch(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+
+	items := []BatchItem{
+		{TenantID: "acme", Event: testEvent("th1", "e1", 1, eventide.TypeTurnStarted)},
+		{TenantID: "acme", Event: testEvent("th1", "e2", 2, eventide.TypeMessageDelta)},
+		{TenantID: "acme", Event: testEvent("th1", "e2", 2, eventide.TypeMessageDelta)},
+		{TenantID: "globex", Event: testEvent("th1", "e3", 3, eventide.TypeMessageDelta)},
+		{TenantID: "acme", Event: testEvent("th1", "e4", 2, eventide.TypeMessageDelta)},
+		{TenantID: "acme", Event: testEvent("th1", "e5", 3, eventide.TypeTurnCompleted)},
+		{TenantID: "", Event: testEvent("th1", "e6", 4, eventide.TypeMessageDelta)},
+	}
+	results, err := s.PersistBatch(ctx, 60, items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int{0, 1, 2, 5} {
+		if results[i] != nil {
+			t.Fatalf("results[%d] = %v", i, results[i])
+		}
+	}
+	var mismatch *TenantMismatchError
+	if !errors.As(results[3], &mismatch) || mismatch.OwnerTenantID != "acme" {
+		t.Fatalf("results[3] = %v, want tenant mismatch", results[3])
+	}
+	var conflict *SeqConflictError
+	if !errors.As(results[4], &conflict) || conflict.ExistingEventID != "e2" {
+		t.Fatalf("results[4] = %v, want seq conflict", results[4])
+	}
+	if results[6] == nil {
+		t.Fatal("results[6]: item without tenant was accepted")
+	}
+
+	th, ok, err := s.GetThread(ctx, "th1")
+	if err != nil || !ok {
+		t.Fatalf("GetThread = %v, %v", ok, err)
+	}
+	if th.TenantID != "acme" || th.LastSeq != 3 || th.Status != "idle" || th.IdleTimeoutSeconds != 60 {
+		t.Fatalf("thread %+v", th)
+	}
+	var status string
+	if err := s.pool.QueryRow(ctx, `SELECT status FROM turns WHERE thread_id='th1' AND turn_id='turn1'`).Scan(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status != "completed" {
+		t.Fatalf("turn status %q", status)
+	}
+	if n, err := s.CountConflicts(ctx, "th1"); err != nil || n != 2 {
+		t.Fatalf("CountConflicts = %d, %v", n, err)
+	}
+
+	// A redelivery of stored events is not an error.
+	results, err = s.PersistBatch(ctx, 60, items[:2])
+	if err != nil || results[0] != nil || results[1] != nil {
+		t.Fatalf("redelivery = %v, %v", results, err)
+	}
+}
+
+func TestPersistBatchLarge(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+
+	// More rows than fit into one statement's bind parameters.
+	n := 2*maxParams/12 + 10
+	items := make([]BatchItem, n)
+	for i := range items {
+		items[i] = BatchItem{TenantID: "acme", Event: testEvent(fmt.Sprintf("th%d", i%3000), fmt.Sprintf("e%d", i), int64(i/3000+1), eventide.TypeMessageDelta)}
+	}
+	results, err := s.PersistBatch(ctx, 0, items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range results {
+		if r != nil {
+			t.Fatalf("results[%d] = %v", i, r)
+		}
+	}
+	var stored int
+	if err := s.pool.QueryRow(ctx, `SELECT COUNT(*) FROM agent_events`).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored != n {
+		t.Fatalf("stored %d events, want %d", stored, n)
+	}
+}
+
+func TestPersistBatchConcurrentOwners(t *testing.T) {
+	ctx := context.Background()
+	s := newTestStore(t)
+
+	// Two replicas persist the first event of the same thread for different
+	// tenants; exactly one of them may own it.
+	tenants := []string{"acme", "globex"}
+	results := make([][]error, len(tenants))
+	errs := make([]error, len(tenants))
+	var wg sync.WaitGroup
+	for n, tenant := range tenants {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e := testEvent("shared", "e-"+tenant, int64(n+1), eventide.TypeMessageDelta)
+			results[n], errs[n] = s.PersistBatch(ctx, 0, []BatchItem{{TenantID: tenant, Event: e}})
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	th, _, err := s.GetThread(ctx, "shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mismatches int
+	for n, tenant := range tenants {
+		var mismatch *TenantMismatchError
+		switch {
+		case results[n][0] == nil && tenant != th.TenantID:
+			t.Fatalf("%s stored an event on a thread owned by %s", tenant, th.TenantID)
+		case errors.As(results[n][0], &mismatch):
+			mismatches++
+		}
+	}
+	if mismatches != 1 {
+		t.Fatalf("%d tenant mismatches, want 1", mismatches)
+	}
+}
+
+func TestChunks(t *testing.T) {
+	rows := make([]int, maxParams/12*2+1)
+	got := chunks(rows, 12)
+	if len(got) != 3 || len(got[0]) != maxParams/12 || len(got[2]) != 1 {
+		t.Fatalf("chunk sizes %d", len(got))
+	}
+	if got := chunks(rows[:5], 12); len(got) != 1 || len(got[0]) != 5 {
+		t.Fatalf("small input split into %d chunks", len(got))
+	}
+}
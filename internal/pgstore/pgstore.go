@@ -5,13 +5,16 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/jackc/pgx/v5"
 
+	"github.com/warjiang/eventide/internal/metrics"
 	"github.com/warjiang/eventide/sdk/go/eventide"
 
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -47,6 +50,7 @@ func New(ctx context.Context, connString string) (*Store, error) {
 	cfg.MaxConnLifetime = 30 * time.Minute
 	cfg.MaxConnIdleTime = 5 * time.Minute
 	cfg.HealthCheckPeriod = 30 * time.Second
+	cfg.ConnConfig.Tracer = metrics.PostgresTracer{}
 	pool, err := pgxpool.NewWithConfig(ctx, cfg)
 	if err != nil {
 		return nil, err
@@ -124,9 +128,30 @@ func (s *Store) PersistEvent(ctx context.Context, tenantID string, idleTimeoutSe
 		return fmt.Errorf("event invalid: %w", err)
 	}
 
-	_, err := s.pool.Exec(ctx, `INSERT INTO agent_events(
-  thread_id, seq, event_id, turn_id, ts, type, level, payload, source, trace, tags
-) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11)
+	// The event and its thread and turn projections are written together, so
+	// that a crash cannot leave them out of step.
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback(context.Background())
+	}()
+
+	// A thread's tenant is fixed by its first event. The gateway already
+	// rejects cross-tenant writes; this catches anything that slipped past it.
+	var owner string
+	err = tx.QueryRow(ctx, `SELECT tenant_id FROM threads WHERE thread_id=$1`, e.ThreadID).Scan(&owner)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+	if err == nil && owner != tenantID {
+		return &TenantMismatchError{ThreadID: e.ThreadID, Seq: e.Seq, EventID: e.EventID, OwnerTenantID: owner, TenantID: tenantID}
+	}
+
+	tag, err := tx.Exec(ctx, `INSERT INTO agent_events(
+  thread_id, seq, event_id, turn_id, ts, type, level, payload, source, trace, tags, tenant_id
+) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12)
 ON CONFLICT DO NOTHING`,
 		e.ThreadID,
 		e.Seq,
@@ -139,21 +164,33 @@ ON CONFLICT DO NOTHING`,
 		e.Source,
 		e.Trace,
 		e.Tags,
+		tenantID,
 	)
 	if err != nil {
 		return err
 	}
+	if tag.RowsAffected() == 0 {
+		// Either a redelivery of this very event, or a different event that
+		// was handed the same seq. Only the latter is a conflict.
+		var existingEventID string
+		err := tx.QueryRow(ctx, `SELECT event_id FROM agent_events WHERE thread_id=$1 AND seq=$2`, e.ThreadID, e.Seq).Scan(&existingEventID)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return err
+		}
+		if err == nil && existingEventID != e.EventID {
+			return &SeqConflictError{ThreadID: e.ThreadID, Seq: e.Seq, ExistingEventID: existingEventID, EventID: e.EventID}
+		}
+	}
 
 	status := "active"
 	if e.Type == eventide.TypeTurnCompleted || e.Type == eventide.TypeTurnFailed || e.Type == eventide.TypeTurnCancelled {
 		status = "idle"
 	}
 
-	_, err = s.pool.Exec(ctx, `INSERT INTO threads(
+	_, err = tx.Exec(ctx, `INSERT INTO threads(
   thread_id, tenant_id, status, created_at, last_active_at, idle_timeout_seconds, last_seq
 ) VALUES ($1,$2,$3,$4,$5,$6,$7)
 ON CONFLICT (thread_id) DO UPDATE SET
-  tenant_id = EXCLUDED.tenant_id,
   status = EXCLUDED.status,
   last_active_at = EXCLUDED.last_active_at,
   idle_timeout_seconds = EXCLUDED.idle_timeout_seconds,
@@ -170,11 +207,16 @@ ON CONFLICT (thread_id) DO UPDATE SET
 		return err
 	}
 
-	_, err = s.pool.Exec(ctx, `INSERT INTO turns(
+	_, err = tx.Exec(ctx, `INSERT INTO turns(
   thread_id, turn_id, status, input, created_at, completed_at
 ) VALUES ($1,$2,$3,$4,$5,$6)
 ON CONFLICT (thread_id, turn_id) DO UPDATE SET
-  status = EXCLUDED.status,
+  status = CASE
+    WHEN turns.status IN ('completed', 'failed', 'cancelled') THEN turns.status
+    WHEN turns.status = 'running' AND EXCLUDED.status = 'started' THEN turns.status
+    ELSE EXCLUDED.status
+  END,
+  input = CASE WHEN EXCLUDED.status = 'started' THEN EXCLUDED.input ELSE turns.input END,
   completed_at = COALESCE(turns.completed_at, EXCLUDED.completed_at)`,
 		e.ThreadID,
 		e.TurnID,
@@ -187,7 +229,125 @@ ON CONFLICT (thread_id, turn_id) DO UPDATE SET
 		return err
 	}
 
-	return nil
+	return tx.Commit(ctx)
+}
+
+// SeqConflictError is returned by PersistEvent when (thread_id, seq) is
+// already taken by a different event. Nothing is written in that case.
+type SeqConflictError struct {
+	ThreadID        string
+	Seq             int64
+	ExistingEventID string
+	EventID         string
+}
+
+func (e *SeqConflictError) Error() string {
+	return fmt.Sprintf("seq conflict on %s/%d: event %s already stored, got %s", e.ThreadID, e.Seq, e.ExistingEventID, e.EventID)
+}
+
+type EventConflict struct {
+	ConflictID      int64
+	ThreadID        string
+	Seq             int64
+	Reason          string
+	ExistingEventID string
+	EventID         string
+	Event           json.RawMessage
+	DetectedAt      time.Time
+}
+
+// TenantMismatchError is returned by PersistEvent when the event's tenant
+// differs from the tenant that owns the thread. Nothing is written in that
+// case.
+type TenantMismatchError struct {
+	ThreadID      string
+	Seq           int64
+	EventID       string
+	OwnerTenantID string
+	TenantID      string
+}
+
+func (e *TenantMismatchError) Error() string {
+	return fmt.Sprintf("tenant mismatch on %s: thread owned by %q, event %s from %q", e.ThreadID, e.OwnerTenantID, e.EventID, e.TenantID)
+}
+
+// QuarantineConflict records an event that lost a seq conflict, together with
+// the event that holds the seq, so it can be inspected and resolved later.
+func (s *Store) QuarantineConflict(ctx context.Context, c *SeqConflictError, e eventide.Event) error {
+	return s.quarantine(ctx, "seq_conflict", c.ThreadID, c.Seq, c.ExistingEventID, e)
+}
+
+// QuarantineTenantMismatch records an event that was written to a thread owned
+// by another tenant.
+func (s *Store) QuarantineTenantMismatch(ctx context.Context, c *TenantMismatchError, e eventide.Event) error {
+	return s.quarantine(ctx, "tenant_mismatch", c.ThreadID, c.Seq, "", e)
+}
+
+func (s *Store) quarantine(ctx context.Context, reason, threadID string, seq int64, existingEventID string, e eventide.Event) error {
+	return insertConflict(ctx, s.pool, reason, threadID, seq, existingEventID, e)
+}
+
+// execer is satisfied by both the pool and a transaction.
+type execer interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+}
+
+func insertConflict(ctx context.Context, db execer, reason, threadID string, seq int64, existingEventID string, e eventide.Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	var existing any
+	if existingEventID != "" {
+		existing = existingEventID
+	}
+	_, err = db.Exec(ctx, `INSERT INTO event_conflicts(
+  thread_id, seq, reason, existing_event_id, event_id, event, detected_at
+) VALUES ($1,$2,$3,$4,$5,$6,$7)
+ON CONFLICT (event_id) DO NOTHING`,
+		threadID, seq, reason, existing, e.EventID, b, time.Now().UTC(),
+	)
+	return err
+}
+
+func (s *Store) ListConflicts(ctx context.Context, threadID string, limit int64) ([]EventConflict, error) {
+	threadID = strings.TrimSpace(threadID)
+	if threadID == "" {
+		return nil, errors.New("threadID is required")
+	}
+	if limit <= 0 {
+		limit = 100
+	}
+	if limit > 1000 {
+		limit = 1000
+	}
+	rows, err := s.pool.Query(ctx, `SELECT conflict_id, thread_id, seq, reason, COALESCE(existing_event_id, ''), event_id, event, detected_at
+FROM event_conflicts
+WHERE thread_id=$1
+ORDER BY seq ASC, conflict_id ASC
+LIMIT $2`, threadID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []EventConflict
+	for rows.Next() {
+		var c EventConflict
+		if err := rows.Scan(&c.ConflictID, &c.ThreadID, &c.Seq, &c.Reason, &c.ExistingEventID, &c.EventID, &c.Event, &c.DetectedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (s *Store) CountConflicts(ctx context.Context, threadID string) (int64, error) {
+	var n int64
+	err := s.pool.QueryRow(ctx, `SELECT COUNT(*) FROM event_conflicts WHERE thread_id=$1`, threadID).Scan(&n)
+	return n, err
 }
 
 func (s *Store) GetThread(ctx context.Context, threadID string) (Thread, bool, error) {
@@ -212,9 +372,45 @@ func (s *Store) ListEvents(ctx context.Context, threadID string, fromSeq int64,
 	if threadID == "" {
 		return nil, errors.New("threadID is required")
 	}
+	return s.QueryEvents(ctx, EventQuery{ThreadID: threadID, FromSeq: fromSeq, Limit: limit})
+}
+
+// likeEscaper escapes the wildcards of a LIKE pattern.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// EventQuery selects events for QueryEvents. Empty fields do not filter.
+// Either ThreadID or TraceID must be set.
+type EventQuery struct {
+	ThreadID string
+	TenantID string
+	TraceID  string
+	// FromSeq is exclusive and only applies together with ThreadID.
+	FromSeq int64
+	// MaxSeq is inclusive.
+	MaxSeq int64
+	// Types are matched exactly, or by prefix when they end in "*".
+	Types  []string
+	Levels []string
+	// Tags must all be present with the given values.
+	Tags map[string]string
+	// Since is inclusive and Until exclusive.
+	Since time.Time
+	Until time.Time
+	Limit int64
+}
+
+// QueryEvents returns the events of a thread ordered by seq, or, without a
+// ThreadID, events ordered by ts.
+func (s *Store) QueryEvents(ctx context.Context, q EventQuery) ([]json.RawMessage, error) {
+	q.ThreadID = strings.TrimSpace(q.ThreadID)
+	if q.ThreadID == "" && q.TraceID == "" {
+		return nil, errors.New("threadID or traceID is required")
+	}
+	fromSeq := q.FromSeq
 	if fromSeq < 0 {
 		fromSeq = 0
 	}
+	limit := q.Limit
 	if limit <= 0 {
 		limit = 500
 	}
@@ -222,11 +418,66 @@ func (s *Store) ListEvents(ctx context.Context, threadID string, fromSeq int64,
 		limit = 5000
 	}
 
-	rows, err := s.pool.Query(ctx, `SELECT thread_id, seq, event_id, turn_id, ts, type, level, payload, source, trace, tags
+	var where []string
+	var args []any
+	if q.ThreadID != "" {
+		args = append(args, q.ThreadID, fromSeq)
+		where = append(where, fmt.Sprintf("thread_id=$%d AND seq > $%d", len(args)-1, len(args)))
+	}
+	if q.TenantID != "" {
+		args = append(args, q.TenantID)
+		where = append(where, fmt.Sprintf("tenant_id=$%d", len(args)))
+	}
+	if q.TraceID != "" {
+		args = append(args, q.TraceID)
+		where = append(where, fmt.Sprintf("trace->>'trace_id'=$%d", len(args)))
+	}
+	if q.MaxSeq > 0 {
+		args = append(args, q.MaxSeq)
+		where = append(where, fmt.Sprintf("seq <= $%d", len(args)))
+	}
+	if len(q.Types) > 0 {
+		var exact, prefixes []string
+		for _, t := range q.Types {
+			if prefix, ok := strings.CutSuffix(t, "*"); ok {
+				prefixes = append(prefixes, likeEscaper.Replace(prefix)+"%")
+			} else {
+				exact = append(exact, t)
+			}
+		}
+		args = append(args, exact, prefixes)
+		where = append(where, fmt.Sprintf("(type = ANY($%d) OR type LIKE ANY($%d))", len(args)-1, len(args)))
+	}
+	if len(q.Levels) > 0 {
+		args = append(args, q.Levels)
+		where = append(where, fmt.Sprintf("level = ANY($%d)", len(args)))
+	}
+	if len(q.Tags) > 0 {
+		b, err := json.Marshal(q.Tags)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, string(b))
+		where = append(where, fmt.Sprintf("tags @> $%d::jsonb", len(args)))
+	}
+	if !q.Since.IsZero() {
+		args = append(args, q.Since)
+		where = append(where, fmt.Sprintf("ts >= $%d", len(args)))
+	}
+	if !q.Until.IsZero() {
+		args = append(args, q.Until)
+		where = append(where, fmt.Sprintf("ts < $%d", len(args)))
+	}
+	order := "seq ASC"
+	if q.ThreadID == "" {
+		order = "ts ASC, thread_id ASC, seq ASC"
+	}
+	args = append(args, limit)
+	rows, err := s.pool.Query(ctx, `SELECT thread_id, seq, event_id, turn_id, ts, type, level, payload, source, trace, tags, COALESCE(tenant_id, '')
 FROM agent_events
-WHERE thread_id=$1 AND seq > $2
-ORDER BY seq ASC
-LIMIT $3`, threadID, fromSeq, limit)
+WHERE `+strings.Join(where, " AND ")+`
+ORDER BY `+order+`
+LIMIT $`+strconv.Itoa(len(args)), args...)
 	if err != nil {
 		return nil, err
 	}
@@ -246,12 +497,13 @@ LIMIT $3`, threadID, fromSeq, limit)
 			source  json.RawMessage
 			trace   json.RawMessage
 			tags    json.RawMessage
+			tenant  string
 		)
 		var sourceAny map[string]any
 		var traceAny map[string]any
 		var tagsAny map[string]string
 
-		if err := rows.Scan(&thID, &seq, &eventID, &turnID, &ts, &typeStr, &level, &payload, &source, &trace, &tags); err != nil {
+		if err := rows.Scan(&thID, &seq, &eventID, &turnID, &ts, &typeStr, &level, &payload, &source, &trace, &tags, &tenant); err != nil {
 			return nil, err
 		}
 		if len(source) > 0 {
@@ -276,6 +528,7 @@ LIMIT $3`, threadID, fromSeq, limit)
 			Source:      sourceAny,
 			Trace:       traceAny,
 			Tags:        tagsAny,
+			TenantID:    tenant,
 		}
 		b, err := e.Encode()
 		if err != nil {
@@ -310,7 +563,7 @@ func (s *Store) ListEventsForArchive(ctx context.Context, threadID string, fromS
 	if limit <= 0 {
 		limit = 5000
 	}
-	rows, err := s.pool.Query(ctx, `SELECT thread_id, seq, event_id, turn_id, ts, type, level, payload, source, trace, tags
+	rows, err := s.pool.Query(ctx, `SELECT thread_id, seq, event_id, turn_id, ts, type, level, payload, source, trace, tags, COALESCE(tenant_id, '')
 FROM agent_events
 WHERE thread_id=$1 AND seq >= $2 AND seq <= $3
 ORDER BY seq ASC
@@ -334,11 +587,12 @@ LIMIT $4`, threadID, fromSeqInclusive, toSeqInclusive, limit)
 			source  json.RawMessage
 			trace   json.RawMessage
 			tags    json.RawMessage
+			tenant  string
 		)
 		var sourceAny map[string]any
 		var traceAny map[string]any
 		var tagsAny map[string]string
-		if err := rows.Scan(&thID, &seq, &eventID, &turnID, &ts, &typeStr, &level, &payload, &source, &trace, &tags); err != nil {
+		if err := rows.Scan(&thID, &seq, &eventID, &turnID, &ts, &typeStr, &level, &payload, &source, &trace, &tags, &tenant); err != nil {
 			return ArchiveQueryResult{}, err
 		}
 		if first {
@@ -368,6 +622,7 @@ LIMIT $4`, threadID, fromSeqInclusive, toSeqInclusive, limit)
 			Source:      sourceAny,
 			Trace:       traceAny,
 			Tags:        tagsAny,
+			TenantID:    tenant,
 		}
 		b, err := e.Encode()
 		if err != nil {
@@ -488,3 +743,124 @@ func turnInputPayload(e eventide.Event) any {
 	}
 	return e.Payload
 }
+
+// LastSeq returns the highest seq Postgres knows for the thread, or 0 when
+// the thread has no persisted events.
+func (s *Store) LastSeq(ctx context.Context, threadID string) (int64, error) {
+	threadID = strings.TrimSpace(threadID)
+	if threadID == "" {
+		return 0, errors.New("threadID is required")
+	}
+	var seq int64
+	err := s.pool.QueryRow(ctx, `SELECT GREATEST(
+  COALESCE((SELECT last_seq FROM threads WHERE thread_id=$1), 0),
+  COALESCE((SELECT MAX(seq) FROM agent_events WHERE thread_id=$1), 0)
+)`, threadID).Scan(&seq)
+	return seq, err
+}
+
+type ThreadSeq struct {
+	ThreadID string
+	LastSeq  int64
+}
+
+// ListThreadSeqs pages through threads ordered by thread_id, starting after
+// afterThreadID.
+func (s *Store) ListThreadSeqs(ctx context.Context, afterThreadID string, limit int64) ([]ThreadSeq, error) {
+	if limit <= 0 {
+		limit = 500
+	}
+	rows, err := s.pool.Query(ctx, `SELECT thread_id, last_seq
+FROM threads
+WHERE thread_id > $1
+ORDER BY thread_id ASC
+LIMIT $2`, afterThreadID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []ThreadSeq
+	for rows.Next() {
+		var ts ThreadSeq
+		if err := rows.Scan(&ts.ThreadID, &ts.LastSeq); err != nil {
+			return nil, err
+		}
+		out = append(out, ts)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+type APIKey struct {
+	KeyID     string
+	TenantID  string
+	Name      string
+	CreatedAt time.Time
+	RevokedAt *time.Time
+}
+
+func (s *Store) InsertAPIKey(ctx context.Context, keyID, tenantID, name, keyHash string) error {
+	_, err := s.pool.Exec(ctx, `INSERT INTO api_keys (key_id, tenant_id, name, key_hash) VALUES ($1, $2, $3, $4)`,
+		keyID, tenantID, name, keyHash)
+	return err
+}
+
+// LookupAPIKey resolves an unrevoked key by the SHA-256 hash of the key.
+func (s *Store) LookupAPIKey(ctx context.Context, keyHash string) (string, string, bool, error) {
+	var tenantID, keyID string
+	err := s.pool.QueryRow(ctx, `SELECT tenant_id, key_id FROM api_keys WHERE key_hash=$1 AND revoked_at IS NULL`, keyHash).
+		Scan(&tenantID, &keyID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", "", false, nil
+		}
+		return "", "", false, err
+	}
+	return tenantID, keyID, true, nil
+}
+
+func (s *Store) RevokeAPIKey(ctx context.Context, keyID string) (bool, error) {
+	tag, err := s.pool.Exec(ctx, `UPDATE api_keys SET revoked_at=now() WHERE key_id=$1 AND revoked_at IS NULL`, keyID)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// LastAPIKeyRevocation returns when an API key was last revoked, or the zero
+// time when none was.
+func (s *Store) LastAPIKeyRevocation(ctx context.Context) (time.Time, error) {
+	var t *time.Time
+	if err := s.pool.QueryRow(ctx, `SELECT max(revoked_at) FROM api_keys`).Scan(&t); err != nil {
+		return time.Time{}, err
+	}
+	if t == nil {
+		return time.Time{}, nil
+	}
+	return *t, nil
+}
+
+func (s *Store) ListAPIKeys(ctx context.Context, tenantID string) ([]APIKey, error) {
+	rows, err := s.pool.Query(ctx, `SELECT key_id, tenant_id, name, created_at, revoked_at
+FROM api_keys
+WHERE $1 = '' OR tenant_id = $1
+ORDER BY created_at ASC`, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []APIKey
+	for rows.Next() {
+		var k APIKey
+		if err := rows.Scan(&k.KeyID, &k.TenantID, &k.Name, &k.CreatedAt, &k.RevokedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, k)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
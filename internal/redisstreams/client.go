@@ -2,72 +2,365 @@ package redisstreams
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/redis/go-redis/v9"
+	"github.com/warjiang/eventide/internal/config"
+	"github.com/warjiang/eventide/internal/metrics"
 )
 
 type Client struct {
-	rdb               *redis.Client
-	idempotentXAddLua *redis.Script
+	rdb                    redis.UniversalClient
+	cluster                bool
+	idempotentXAddBatchLua *redis.Script
+	reserveSeqLua          *redis.Script
+	seedSeqLua             *redis.Script
+	turnTransitionLua      *redis.Script
+	admitLua               *redis.Script
+	refundLua              *redis.Script
+	acquireLeaseLua        *redis.Script
+	releaseLeaseLua        *redis.Script
+	heartbeatLua           *redis.Script
+	confirmGlobalLua       *redis.Script
+	claimPendingLua        *redis.Script
+	unindexPendingLua      *redis.Script
+	seekSeqLua             *redis.Script
+	lookupWrittenLua       *redis.Script
+	globalShards           int
+	entryFormat            EntryFormat
+	refTrimMargin          time.Duration
+	refFloorsMu            sync.Mutex
+	refFloors              map[string]refFloor
 }
 
-func New(addr, username, password string, db int) *Client {
+// ErrSeqNotInitialized is returned by the seq reservation methods when the
+// thread's counter does not exist in Redis, either because the thread is new
+// or because Redis lost it. Callers seed the counter with SeedSeq and retry.
+var ErrSeqNotInitialized = errors.New("seq counter not initialized")
+
+// New connects to a standalone server, a cluster or a sentinel-managed
+// master depending on cfg.Mode.
+func New(cfg config.RedisConfig) *Client {
+	opts := &redis.UniversalOptions{
+		Addrs:            cfg.Nodes(),
+		Username:         cfg.Username,
+		Password:         cfg.Password,
+		DB:               cfg.DB,
+		SentinelUsername: cfg.SentinelUsername,
+		SentinelPassword: cfg.SentinelPassword,
+	}
+	switch cfg.Mode {
+	case config.RedisCluster:
+		opts.IsClusterMode = true
+	case config.RedisSentinel:
+		opts.MasterName = cfg.MasterName
+	default:
+		opts.Addrs = opts.Addrs[:1]
+	}
+	rdb := redis.NewUniversalClient(opts)
+	rdb.AddHook(metrics.RedisHook{})
 	return &Client{
-		rdb: redis.NewClient(&redis.Options{Addr: addr, Username: username, Password: password, DB: db}),
-		idempotentXAddLua: redis.NewScript(`
-local dedupeKey = KEYS[1]
-local threadStream = KEYS[2]
-local globalStream = KEYS[3]
+		rdb:     rdb,
+		cluster: cfg.Mode == config.RedisCluster,
+		idempotentXAddBatchLua: redis.NewScript(turnStepLua + `
+local threadStream = KEYS[1]
+local dedupeHash = KEYS[2]
+local dedupeSeqs = KEYS[3]
+local turnsKey = KEYS[4]
+local ownerKey = KEYS[5]
+-- Entries whose global entry the caller still has to write; cluster mode only.
+local pendingHash = KEYS[6]
+-- Absent in cluster mode, where the caller writes the global stream itself.
+local globalStream = KEYS[7]
 
 local ttlSeconds = tonumber(ARGV[1])
 local trimMaxLen = tonumber(ARGV[2])
+local threadID = ARGV[3]
+local window = tonumber(ARGV[4])
+-- Compact entries keep only seq and the encoded event in the thread stream,
+-- and a pointer to it in the global stream.
+local compact = ARGV[5] == '1'
+-- '' leaves turn state alone; 'lenient' applies the legal transitions of
+-- written events; 'strict' also refuses the whole call on an illegal one.
+local turnMode = ARGV[6]
+local turnTTL = tonumber(ARGV[7])
+-- The tenant writing, which must own the thread. The first write claims it.
+local tenant = ARGV[8]
+local ownerTTL = tonumber(ARGV[9])
+-- Compact entries at or above this ID may still be referenced by global
+-- entries no consumer group has acknowledged; '' when nothing is known.
+local trimFloor = ARGV[10]
+local first = 10
+local fieldsPerEvent = 11
+local dedupe = ttlSeconds and ttlSeconds > 0
+
+local owner = nil
+if tenant ~= '' then
+  owner = redis.call('GET', ownerKey)
+  if owner and owner ~= tenant then
+    return {4, owner}
+  end
+end
 
-local eventID = ARGV[3]
-local threadID = ARGV[4]
-local seq = ARGV[5]
-local turnID = ARGV[6]
-local ts = ARGV[7]
-local typeStr = ARGV[8]
-local level = ARGV[9]
-local payload = ARGV[10]
-local eventJSON = ARGV[11]
-
-local existing = redis.call('GET', dedupeKey)
-if existing then
-  return {1, existing}
+local states = {}
+local function turnState(turnID)
+  local cur = states[turnID]
+  if cur == nil then
+    cur = redis.call('HGET', turnsKey, turnID) or ''
+    states[turnID] = cur
+  end
+  return cur
 end
 
-local streamID = redis.call('XADD', threadStream, '*',
-  'seq', seq,
-  'event_id', eventID,
-  'turn_id', turnID,
-  'ts', ts,
-  'type', typeStr,
-  'level', level,
-  'payload', payload,
-  'event', eventJSON
-)
+if turnMode == 'strict' then
+  -- Check every transition before writing anything. Duplicates are retries
+  -- of written events, not transitions.
+  local seen = {}
+  local sim = {}
+  for base = first, #ARGV - 1, fieldsPerEvent do
+    local eventID = ARGV[base + 1]
+    local turnID = ARGV[base + 3]
+    local kind = ARGV[base + 11]
+    local dup = dedupe and (seen[eventID] or redis.call('HEXISTS', dedupeHash, eventID) == 1)
+    seen[eventID] = true
+    if kind ~= '' and not dup then
+      local cur = sim[turnID]
+      if cur == nil then
+        cur = turnState(turnID)
+      end
+      local nextState, violation = turnStep(cur, kind)
+      if violation ~= '' then
+        return {3, (base - first) / fieldsPerEvent, violation}
+      end
+      sim[turnID] = nextState
+    end
+  end
+end
 
-redis.call('XADD', globalStream, '*',
-  'thread_id', threadID,
-  'seq', seq,
-  'event_id', eventID,
-  'event', eventJSON
-)
+local out = {}
+local maxSeq = nil
+local changed = {}
+local written = false
+for base = first, #ARGV - 1, fieldsPerEvent do
+  local eventID = ARGV[base + 1]
+  local seq = ARGV[base + 2]
+  local turnID = ARGV[base + 3]
+  local ts = ARGV[base + 4]
+  local typeStr = ARGV[base + 5]
+  local level = ARGV[base + 6]
+  local payload = ARGV[base + 7]
+  local event = ARGV[base + 8]
+  local tenantID = ARGV[base + 9]
+  local enc = ARGV[base + 10]
+  local kind = ARGV[base + 11]
+
+  local existing = redis.call('HGET', dedupeHash, eventID)
+  -- A 'p:' prefix marks a write whose global entry is not confirmed yet.
+  if existing and string.sub(existing, 1, 2) == 'p:' then
+    table.insert(out, 2)
+    table.insert(out, string.sub(existing, 3))
+  elseif existing then
+    table.insert(out, 1)
+    table.insert(out, existing)
+  else
+    local streamID
+    if compact then
+      streamID = redis.call('XADD', threadStream, '*',
+        'seq', seq,
+        'enc', enc,
+        'event', event
+      )
+    else
+      streamID = redis.call('XADD', threadStream, '*',
+        'seq', seq,
+        'event_id', eventID,
+        'turn_id', turnID,
+        'ts', ts,
+        'type', typeStr,
+        'level', level,
+        'payload', payload,
+        'tenant_id', tenantID,
+        'event', event
+      )
+    end
+
+    local marker = streamID
+    if globalStream and compact then
+      redis.call('XADD', globalStream, '*',
+        'thread_id', threadID,
+        'tenant_id', tenantID,
+        'seq', seq,
+        'ref', streamID
+      )
+    elseif globalStream then
+      redis.call('XADD', globalStream, '*',
+        'thread_id', threadID,
+        'tenant_id', tenantID,
+        'seq', seq,
+        'event_id', eventID,
+        'event', event
+      )
+    else
+      -- Recorded whether or not dedupe is on, so that ReconcileGlobal can
+      -- finish the write if the caller never does.
+      marker = 'p:' .. streamID
+      redis.call('HSET', pendingHash, streamID, cjson.encode({event_id = eventID, tenant_id = tenantID}))
+    end
+
+    if dedupe then
+      redis.call('HSET', dedupeHash, eventID, marker)
+      redis.call('ZADD', dedupeSeqs, seq, eventID)
+      local n = tonumber(seq)
+      if not maxSeq or n > maxSeq then
+        maxSeq = n
+      end
+    end
+
+    if turnMode ~= '' and kind ~= '' then
+      local cur = turnState(turnID)
+      local nextState = turnStep(cur, kind)
+      if nextState and nextState ~= cur then
+        states[turnID] = nextState
+        changed[turnID] = true
+      end
+    end
+
+    written = true
+    table.insert(out, 0)
+    table.insert(out, streamID)
+  end
+end
+
+if written and tenant ~= '' then
+  if owner then
+    redis.call('EXPIRE', ownerKey, ownerTTL)
+  else
+    redis.call('SET', ownerKey, tenant, 'EX', ownerTTL)
+  end
+end
+
+if next(changed) ~= nil then
+  for turnID, _ in pairs(changed) do
+    redis.call('HSET', turnsKey, turnID, states[turnID])
+  end
+  if turnTTL and turnTTL > 0 then
+    redis.call('EXPIRE', turnsKey, turnTTL)
+  end
+end
+
+if maxSeq then
+  -- Forget events that fell out of the seq window. Evictions are capped per
+  -- call so that shrinking the window cannot stall Redis; the rest follow
+  -- on later writes.
+  if window and window > 0 then
+    local old = redis.call('ZRANGEBYSCORE', dedupeSeqs, '-inf', maxSeq - window, 'LIMIT', 0, 1000)
+    if #old > 0 then
+      redis.call('HDEL', dedupeHash, unpack(old))
+      redis.call('ZREM', dedupeSeqs, unpack(old))
+    end
+  end
+  redis.call('EXPIRE', dedupeHash, ttlSeconds)
+  redis.call('EXPIRE', dedupeSeqs, ttlSeconds)
+end
 
 if trimMaxLen and trimMaxLen > 0 then
-  redis.call('XTRIM', threadStream, 'MAXLEN', '~', trimMaxLen)
+  if compact and trimFloor ~= '' then
+    -- Drop at most what MAXLEN would, and only entries below the floor: the
+    -- stream grows past trimMaxLen while a consumer lags behind.
+    local excess = redis.call('XLEN', threadStream) - trimMaxLen
+    if excess > 0 then
+      redis.call('XTRIM', threadStream, 'MINID', '~', trimFloor, 'LIMIT', excess)
+    end
+  else
+    redis.call('XTRIM', threadStream, 'MAXLEN', '~', trimMaxLen)
+  end
 end
 
-if ttlSeconds and ttlSeconds > 0 then
-  redis.call('SET', dedupeKey, streamID, 'EX', ttlSeconds)
+return out
+`),
+		reserveSeqLua: redis.NewScript(`
+local seqKey = KEYS[1]
+local n = tonumber(ARGV[1])
+local expected = tonumber(ARGV[2])
+
+local raw = redis.call('GET', seqKey)
+if not raw then
+  return {-1, 0}
+end
+local current = tonumber(raw)
+if expected and current ~= expected then
+  return {0, current}
+end
+return {1, redis.call('INCRBY', seqKey, n)}
+`),
+		seedSeqLua: redis.NewScript(`
+local seqKey = KEYS[1]
+local floor = tonumber(ARGV[1])
+local createIfMissing = ARGV[2] == '1'
+
+local raw = redis.call('GET', seqKey)
+if not raw then
+  if not createIfMissing then
+    return {0, -1}
+  end
+  redis.call('SET', seqKey, floor)
+  return {1, floor}
+end
+local current = tonumber(raw)
+if current < floor then
+  redis.call('SET', seqKey, floor)
+  return {1, floor}
+end
+return {0, current}
+`),
+		turnTransitionLua: redis.NewScript(turnStepLua + `
+local turnsKey = KEYS[1]
+local dedupeHash = KEYS[2]
+
+local states = {}
+local out = {}
+
+for base = 0, #ARGV - 1, 3 do
+  local eventID = ARGV[base + 1]
+  local turnID = ARGV[base + 2]
+  local kind = ARGV[base + 3]
+  local violation = ''
+
+  -- Retries of an already written event are not transitions.
+  if redis.call('HEXISTS', dedupeHash, eventID) == 0 then
+    local cur = states[turnID]
+    if cur == nil then
+      cur = redis.call('HGET', turnsKey, turnID) or ''
+    end
+    local nextState
+    nextState, violation = turnStep(cur, kind)
+    if nextState then
+      states[turnID] = nextState
+    else
+      states[turnID] = cur
+    end
+  end
+  table.insert(out, violation)
 end
 
-return {0, streamID}
+return out
 `),
+		admitLua:          redis.NewScript(admitScript),
+		refundLua:         redis.NewScript(refundScript),
+		acquireLeaseLua:   redis.NewScript(acquireLeaseScript),
+		releaseLeaseLua:   redis.NewScript(releaseLeaseScript),
+		heartbeatLua:      redis.NewScript(heartbeatScript),
+		confirmGlobalLua:  redis.NewScript(confirmGlobalScript),
+		claimPendingLua:   redis.NewScript(claimPendingScript),
+		unindexPendingLua: redis.NewScript(unindexPendingScript),
+		seekSeqLua:        redis.NewScript(seekSeqScript),
+		lookupWrittenLua:  redis.NewScript(lookupWrittenScript),
+		refTrimMargin:     RefTrimMargin,
 	}
 }
 
@@ -79,43 +372,169 @@ func (c *Client) Close() error {
 	return c.rdb.Close()
 }
 
+// Per-thread keys wrap the thread ID in braces, making it the Redis Cluster
+// hash tag: every key of a thread lives in the same slot, so scripts can
+// touch them together.
+
 func StreamKey(threadID string) string {
-	return fmt.Sprintf("stream:thread:%s", threadID)
+	return fmt.Sprintf("stream:thread:{%s}", threadID)
 }
 
+// GlobalStreamKey is the unsharded global stream. When the global stream is
+// sharded it only holds entries written before sharding was enabled.
 func GlobalStreamKey() string {
 	return "stream:global:events"
 }
 
+// DLQStreamKey is the default dead-letter stream for messages the persister
+// gave up on.
+func DLQStreamKey() string {
+	return "stream:global:dlq"
+}
+
 func SeqKey(threadID string) string {
-	return fmt.Sprintf("seq:thread:%s", threadID)
+	return fmt.Sprintf("seq:thread:{%s}", threadID)
+}
+
+func TurnsKey(threadID string) string {
+	return fmt.Sprintf("turns:thread:{%s}", threadID)
+}
+
+// ThreadTenantKey caches the tenant that owns a thread. It is set by the
+// first write, expires ThreadOwnerTTL after the last one and never changes
+// while it exists.
+func ThreadTenantKey(threadID string) string {
+	return fmt.Sprintf("tenant:thread:{%s}", threadID)
 }
 
 func (c *Client) NextSeq(ctx context.Context, threadID string) (int64, error) {
-	return c.rdb.Incr(ctx, SeqKey(threadID)).Result()
+	return c.ReserveSeqRange(ctx, threadID, 1)
 }
 
 func (c *Client) ReserveSeqRange(ctx context.Context, threadID string, n int64) (int64, error) {
 	if n <= 0 {
 		return 0, fmt.Errorf("n must be > 0")
 	}
-	end, err := c.rdb.IncrBy(ctx, SeqKey(threadID), n).Result()
+	start, _, _, err := c.reserveSeq(ctx, threadID, n, "")
+	return start, err
+}
+
+// ReserveSeqRangeIfMatch reserves n seqs like ReserveSeqRange, but only when
+// the thread's current head seq equals expected. On mismatch ok is false and
+// head holds the current head seq; nothing is reserved.
+func (c *Client) ReserveSeqRangeIfMatch(ctx context.Context, threadID string, n, expected int64) (start int64, head int64, ok bool, err error) {
+	if n <= 0 {
+		return 0, 0, false, fmt.Errorf("n must be > 0")
+	}
+	return c.reserveSeq(ctx, threadID, n, strconv.FormatInt(expected, 10))
+}
+
+func (c *Client) reserveSeq(ctx context.Context, threadID string, n int64, expected string) (int64, int64, bool, error) {
+	res, err := c.reserveSeqLua.Run(ctx, c.rdb, []string{SeqKey(threadID)}, n, expected).Result()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	status, val, err := luaPair(res)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	switch status {
+	case -1:
+		return 0, 0, false, ErrSeqNotInitialized
+	case 0:
+		return 0, val, false, nil
+	default:
+		return val - n + 1, val, true, nil
+	}
+}
+
+// SeedSeq initializes the thread's seq counter to floor if it is missing, or
+// raises it to floor if it is behind. It never lowers a counter.
+func (c *Client) SeedSeq(ctx context.Context, threadID string, floor int64) error {
+	_, err := c.seedSeqLua.Run(ctx, c.rdb, []string{SeqKey(threadID)}, floor, "1").Result()
+	return err
+}
+
+// RaiseSeq raises an existing seq counter to floor if it is behind. Missing
+// counters are left alone; they are seeded lazily on the next append.
+func (c *Client) RaiseSeq(ctx context.Context, threadID string, floor int64) (bool, error) {
+	res, err := c.seedSeqLua.Run(ctx, c.rdb, []string{SeqKey(threadID)}, floor, "0").Result()
+	if err != nil {
+		return false, err
+	}
+	raised, _, err := luaPair(res)
+	if err != nil {
+		return false, err
+	}
+	return raised == 1, nil
+}
+
+// LastStreamSeq returns the seq of the newest entry in the thread stream, or
+// 0 when the stream is empty or missing.
+func (c *Client) LastStreamSeq(ctx context.Context, threadID string) (int64, error) {
+	res, err := c.rdb.XRevRangeN(ctx, StreamKey(threadID), "+", "-", 1).Result()
 	if err != nil {
+		if err == redis.Nil {
+			return 0, nil
+		}
 		return 0, err
 	}
-	return end - n + 1, nil
+	if len(res) == 0 {
+		return 0, nil
+	}
+	seqStr, _ := res[0].Values["seq"].(string)
+	if seqStr == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(seqStr, 10, 64)
+}
+
+// OldestStreamSeq returns the seq of the oldest entry still in the thread
+// stream, or 0 when the stream is empty or missing.
+func (c *Client) OldestStreamSeq(ctx context.Context, threadID string) (int64, error) {
+	res, err := c.rdb.XRangeN(ctx, StreamKey(threadID), "-", "+", 1).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return 0, nil
+		}
+		return 0, err
+	}
+	if len(res) == 0 {
+		return 0, nil
+	}
+	seqStr, _ := res[0].Values["seq"].(string)
+	if seqStr == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(seqStr, 10, 64)
+}
+
+func luaPair(res any) (int64, int64, error) {
+	arr, ok := res.([]any)
+	if !ok || len(arr) != 2 {
+		return 0, 0, fmt.Errorf("unexpected lua result")
+	}
+	a, ok1 := arr[0].(int64)
+	b, ok2 := arr[1].(int64)
+	if !ok1 || !ok2 {
+		return 0, 0, fmt.Errorf("unexpected lua result")
+	}
+	return a, b, nil
 }
 
 func (c *Client) XAddEvent(ctx context.Context, threadID string, values map[string]any) (string, error) {
 	return c.rdb.XAdd(ctx, &redis.XAddArgs{Stream: StreamKey(threadID), Values: values}).Result()
 }
 
-func (c *Client) XAddGlobalEvent(ctx context.Context, values map[string]any) (string, error) {
-	return c.rdb.XAdd(ctx, &redis.XAddArgs{Stream: GlobalStreamKey(), Values: values}).Result()
+func (c *Client) XAddGlobalEvent(ctx context.Context, threadID string, values map[string]any) (string, error) {
+	return c.rdb.XAdd(ctx, &redis.XAddArgs{Stream: c.GlobalStreamFor(threadID), Values: values}).Result()
 }
 
+// IdempotentXAddEvent appends one event like IdempotentXAddEvents and
+// reports whether its event_id was already written.
 func (c *Client) IdempotentXAddEvent(
 	ctx context.Context,
+	tenantID string,
 	threadID string,
 	eventID string,
 	seq int64,
@@ -125,41 +544,218 @@ func (c *Client) IdempotentXAddEvent(
 	level string,
 	payload string,
 	eventJSON string,
+	turnKind string,
 	trimMaxLen int64,
-	dedupeTTL time.Duration,
+	dedupe DedupePolicy,
+	turns TurnPolicy,
 ) (string, bool, error) {
-	dedupeKey := fmt.Sprintf("dedupe:event:%s", eventID)
-	keys := []string{dedupeKey, StreamKey(threadID), GlobalStreamKey()}
-	args := []any{
-		int64(dedupeTTL.Seconds()),
-		trimMaxLen,
-		eventID,
-		threadID,
-		seq,
-		turnID,
-		tsRFC3339Nano,
-		typeStr,
-		level,
-		payload,
-		eventJSON,
-	}
-	res, err := c.idempotentXAddLua.Run(ctx, c.rdb, keys, args...).Result()
+	res, err := c.IdempotentXAddEvents(ctx, threadID, []EventEntry{{
+		TenantID:      tenantID,
+		EventID:       eventID,
+		Seq:           seq,
+		TurnID:        turnID,
+		TSRFC3339Nano: tsRFC3339Nano,
+		Type:          typeStr,
+		Level:         level,
+		Payload:       payload,
+		EventJSON:     eventJSON,
+		TurnKind:      turnKind,
+	}}, trimMaxLen, dedupe, turns)
 	if err != nil {
 		return "", false, err
 	}
+	return res[0].StreamID, res[0].Duplicated, nil
+}
+
+// EventEntry is one event written by IdempotentXAddEvents. All entries of a
+// call belong to the same thread.
+type EventEntry struct {
+	TenantID      string
+	EventID       string
+	Seq           int64
+	TurnID        string
+	TSRFC3339Nano string
+	Type          string
+	Level         string
+	Payload       string
+	EventJSON     string
+	// TurnKind is the entry's turn transition, one of the TurnKind
+	// constants, or "" for none.
+	TurnKind string
+}
+
+type XAddResult struct {
+	StreamID   string
+	Duplicated bool
+}
+
+// IdempotentXAddEvents appends entries to the thread stream and the global
+// stream in a single script call, in order. Results are returned in the same
+// order as entries; entries whose event_id was already written are reported
+// as duplicated with the stream ID of the original write, as long as dedupe
+// still remembers them. Entries are laid out in the format set with
+// SetEntryFormat; in the compact layouts the thread stream is not trimmed
+// below entries that global pointers a consumer group still needs refer to,
+// see RefTrimMargin. Turn transitions of written entries are applied according
+// to turns; a strict policy that finds an illegal one writes nothing and
+// returns a *TurnViolationError. In cluster mode the global stream lives in
+// another slot and is written after the script; see writeGlobal and
+// ReconcileGlobal.
+func (c *Client) IdempotentXAddEvents(
+	ctx context.Context,
+	threadID string,
+	entries []EventEntry,
+	trimMaxLen int64,
+	dedupe DedupePolicy,
+	turns TurnPolicy,
+) ([]XAddResult, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	keys := []string{StreamKey(threadID), dedupeKey(threadID), dedupeSeqKey(threadID), TurnsKey(threadID), ThreadTenantKey(threadID), GlobalPendingKey(threadID)}
+	compact := c.entryFormat != EntryLegacy
+	trimFloor := ""
+	if compact && trimMaxLen > 0 {
+		trimFloor = c.refTrimFloor(ctx, threadID)
+	}
+	args := make([]any, 0, 10+len(entries)*11)
+	args = append(args, int64(dedupe.TTL.Seconds()), trimMaxLen, threadID, dedupe.Window, compact, turns.mode(), int64(turns.TTL.Seconds()),
+		entries[0].TenantID, int64(ThreadOwnerTTL.Seconds()), trimFloor)
+	for _, e := range entries {
+		if compact {
+			event, enc := c.encodeEvent(e.EventJSON)
+			args = append(args, e.EventID, e.Seq, e.TurnID, "", "", "", "", event, e.TenantID, enc, e.TurnKind)
+		} else {
+			args = append(args, e.EventID, e.Seq, e.TurnID, e.TSRFC3339Nano, e.Type, e.Level, e.Payload, e.EventJSON, e.TenantID, "", e.TurnKind)
+		}
+	}
+	if !c.cluster {
+		keys = append(keys, c.GlobalStreamFor(threadID))
+	} else if err := c.indexPending(ctx, threadID); err != nil {
+		return nil, err
+	}
+	res, err := c.idempotentXAddBatchLua.Run(ctx, c.rdb, keys, args...).Result()
+	if err != nil {
+		return nil, err
+	}
 	arr, ok := res.([]any)
-	if !ok || len(arr) != 2 {
-		return "", false, fmt.Errorf("unexpected lua result")
+	if ok && len(arr) == 2 && arr[0] == int64(xaddOwnedByOther) {
+		owner, _ := arr[1].(string)
+		return nil, &ThreadOwnerError{ThreadID: threadID, Owner: owner}
+	}
+	if ok && len(arr) == 3 && arr[0] == int64(xaddTurnViolation) {
+		index, _ := arr[1].(int64)
+		violation, _ := arr[2].(string)
+		return nil, &TurnViolationError{Index: int(index), Violation: violation}
 	}
-	dupInt, ok := arr[0].(int64)
-	if !ok {
-		return "", false, fmt.Errorf("unexpected lua result[0]")
+	if !ok || len(arr) != len(entries)*2 {
+		return nil, fmt.Errorf("unexpected lua result")
 	}
-	streamID, ok := arr[1].(string)
-	if !ok {
-		return "", false, fmt.Errorf("unexpected lua result[1]")
+	out := make([]XAddResult, 0, len(entries))
+	var global []globalWrite
+	for i := 0; i < len(arr); i += 2 {
+		status, ok := arr[i].(int64)
+		if !ok {
+			return nil, fmt.Errorf("unexpected lua result[%d]", i)
+		}
+		streamID, ok := arr[i+1].(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected lua result[%d]", i+1)
+		}
+		out = append(out, XAddResult{StreamID: streamID, Duplicated: status != xaddWritten})
+		if c.needsGlobalWrite(status) {
+			e := entries[i/2]
+			global = append(global, globalWrite{
+				eventID:  e.EventID,
+				streamID: streamID,
+				values:   c.globalValues(threadID, e, streamID),
+			})
+		}
+	}
+	if err := c.writeGlobal(ctx, threadID, global); err != nil {
+		return nil, err
 	}
-	return streamID, dupInt != 0, nil
+	return out, nil
+}
+
+// Turn transition kinds accepted by CheckTurnTransitions.
+const (
+	TurnKindStart     = "start"
+	TurnKindEvent     = "event"
+	TurnKindCompleted = "completed"
+	TurnKindFailed    = "failed"
+	TurnKindCancelled = "cancelled"
+)
+
+// Violations reported by CheckTurnTransitions.
+const (
+	TurnViolationAlreadyStarted = "turn_already_started"
+	TurnViolationNotStarted     = "turn_not_started"
+	TurnViolationAlreadyEnded   = "turn_already_ended"
+)
+
+type TurnTransition struct {
+	EventID string
+	TurnID  string
+	Kind    string
+}
+
+// CheckTurnTransitions runs transitions, in order, through the per-thread
+// turn state machine (started -> running -> completed/failed/cancelled) and
+// returns one violation per transition, "" when it is legal. It changes no
+// state: transitions are applied by IdempotentXAddEvents when their events
+// are written. Transitions whose event was already written are treated as
+// retries and always pass.
+func (c *Client) CheckTurnTransitions(ctx context.Context, threadID string, items []TurnTransition) ([]string, error) {
+	if len(items) == 0 {
+		return nil, nil
+	}
+	keys := []string{TurnsKey(threadID), dedupeKey(threadID)}
+	args := make([]any, 0, len(items)*3)
+	for _, it := range items {
+		args = append(args, it.EventID, it.TurnID, it.Kind)
+	}
+	res, err := c.turnTransitionLua.Run(ctx, c.rdb, keys, args...).Result()
+	if err != nil {
+		return nil, err
+	}
+	arr, ok := res.([]any)
+	if !ok || len(arr) != len(items) {
+		return nil, fmt.Errorf("unexpected lua result")
+	}
+	out := make([]string, len(arr))
+	for i, v := range arr {
+		out[i], _ = v.(string)
+	}
+	return out, nil
+}
+
+// ThreadOwnerTTL is how long the cached owner of a thread outlives the
+// thread's last write. Postgres stays the source of truth once it expires.
+const ThreadOwnerTTL = 7 * 24 * time.Hour
+
+// ThreadOwnerError is returned by IdempotentXAddEvents when the thread is
+// owned by a tenant other than the one writing. Nothing is written.
+type ThreadOwnerError struct {
+	ThreadID string
+	Owner    string
+}
+
+func (e *ThreadOwnerError) Error() string {
+	return fmt.Sprintf("thread %s belongs to another tenant", e.ThreadID)
+}
+
+// ThreadOwner returns the cached owner of threadID, or ok=false when none is
+// cached. Owners are claimed by IdempotentXAddEvents when a thread's first
+// event is written.
+func (c *Client) ThreadOwner(ctx context.Context, threadID string) (string, bool, error) {
+	return c.Get(ctx, ThreadTenantKey(threadID))
+}
+
+// SetThreadOwner caches tenantID as the owner of threadID, as recorded in
+// Postgres.
+func (c *Client) SetThreadOwner(ctx context.Context, threadID, tenantID string) error {
+	return c.rdb.Set(ctx, ThreadTenantKey(threadID), tenantID, ThreadOwnerTTL).Err()
 }
 
 func (c *Client) TrimMaxLenApprox(ctx context.Context, threadID string, maxLen int64) error {
@@ -277,6 +873,63 @@ func (c *Client) XPendingExt(ctx context.Context, stream, group, start, end stri
 	return out, nil
 }
 
+// GroupInfo describes a consumer group as reported by XINFO GROUPS. Lag is -1
+// when Redis cannot determine it.
+type GroupInfo struct {
+	Name            string
+	Consumers       int64
+	Pending         int64
+	LastDeliveredID string
+	Lag             int64
+}
+
+func (c *Client) XInfoGroups(ctx context.Context, stream string) ([]GroupInfo, error) {
+	res, err := c.rdb.XInfoGroups(ctx, stream).Result()
+	if err != nil {
+		if err == redis.Nil || strings.HasPrefix(err.Error(), "ERR no such key") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	out := make([]GroupInfo, 0, len(res))
+	for _, g := range res {
+		out = append(out, GroupInfo{
+			Name:            g.Name,
+			Consumers:       g.Consumers,
+			Pending:         g.Pending,
+			LastDeliveredID: g.LastDeliveredID,
+			Lag:             g.Lag,
+		})
+	}
+	return out, nil
+}
+
+// ConsumerInfo describes one consumer of a group as reported by XINFO
+// CONSUMERS. Idle is the time since the consumer last attempted an
+// interaction; Inactive is the time since its last successful one.
+type ConsumerInfo struct {
+	Name     string
+	Pending  int64
+	Idle     time.Duration
+	Inactive time.Duration
+}
+
+func (c *Client) XInfoConsumers(ctx context.Context, stream, group string) ([]ConsumerInfo, error) {
+	res, err := c.rdb.XInfoConsumers(ctx, stream, group).Result()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]ConsumerInfo, 0, len(res))
+	for _, cons := range res {
+		out = append(out, ConsumerInfo{Name: cons.Name, Pending: cons.Pending, Idle: cons.Idle, Inactive: cons.Inactive})
+	}
+	return out, nil
+}
+
+func (c *Client) XLen(ctx context.Context, stream string) (int64, error) {
+	return c.rdb.XLen(ctx, stream).Result()
+}
+
 type AutoClaimResult struct {
 	Start    string
 	Messages []GroupMessage
@@ -308,6 +961,37 @@ func (c *Client) Incr(ctx context.Context, key string) (int64, error) {
 	return c.rdb.Incr(ctx, key).Result()
 }
 
+// Get returns the string at key, or ok=false when it does not exist.
+func (c *Client) Get(ctx context.Context, key string) (string, bool, error) {
+	v, err := c.rdb.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return v, true, nil
+}
+
+func (c *Client) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	return c.rdb.Set(ctx, key, value, ttl).Err()
+}
+
+// SetNX sets key only when it does not exist and reports whether it did.
+func (c *Client) SetNX(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+	return c.rdb.SetNX(ctx, key, value, ttl).Result()
+}
+
+func (c *Client) Del(ctx context.Context, keys ...string) (int64, error) {
+	return c.rdb.Del(ctx, keys...).Result()
+}
+
+// XTrimMinID removes entries with IDs lower than minID and returns how many
+// were removed.
+func (c *Client) XTrimMinID(ctx context.Context, stream, minID string) (int64, error) {
+	return c.rdb.XTrimMinID(ctx, stream, minID).Result()
+}
+
 func isBusyGroup(err error) bool {
 	if err == nil {
 		return false
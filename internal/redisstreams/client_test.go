@@ -0,0 +1,37 @@
+package redisstreams
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestXAddClaimsThreadOwner(t *testing.T) {
+	c, mr := newTestClient(t)
+	ctx := context.Background()
+
+	if _, ok, err := c.ThreadOwner(ctx, "th"); err != nil || ok {
+		t.Fatalf("owner of a new thread: %v %v", ok, err)
+	}
+	acme := []EventEntry{{TenantID: "acme", EventID: "e1", Seq: 1, EventJSON: "{}"}}
+	if _, err := c.IdempotentXAddEvents(ctx, "th", acme, 0, DedupePolicy{}, TurnPolicy{}); err != nil {
+		t.Fatal(err)
+	}
+	owner, ok, err := c.ThreadOwner(ctx, "th")
+	if err != nil || !ok || owner != "acme" {
+		t.Fatalf("owner %q %v %v, want acme", owner, ok, err)
+	}
+	if ttl := mr.TTL(ThreadTenantKey("th")); ttl != ThreadOwnerTTL {
+		t.Fatalf("owner ttl %v, want %v", ttl, ThreadOwnerTTL)
+	}
+
+	globex := []EventEntry{{TenantID: "globex", EventID: "e2", Seq: 2, EventJSON: "{}"}}
+	_, err = c.IdempotentXAddEvents(ctx, "th", globex, 0, DedupePolicy{}, TurnPolicy{})
+	var oe *ThreadOwnerError
+	if !errors.As(err, &oe) || oe.Owner != "acme" {
+		t.Fatalf("expected ThreadOwnerError, got %v", err)
+	}
+	if n, _ := c.XLen(ctx, StreamKey("th")); n != 1 {
+		t.Fatalf("stream has %d entries, want 1", n)
+	}
+}
@@ -0,0 +1,103 @@
+package redisstreams
+
+import (
+	"context"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Statuses returned per event by the idempotent XADD scripts.
+const (
+	xaddWritten    = 0
+	xaddDuplicated = 1
+	// xaddPending is a duplicate whose global stream entry was never
+	// confirmed, because the write that created it failed halfway.
+	xaddPending = 2
+)
+
+// Statuses returned instead of per-event statuses when the script refused
+// the whole call.
+const (
+	// xaddTurnViolation: a strict TurnPolicy found an illegal transition.
+	xaddTurnViolation = 3
+	// xaddOwnedByOther: the thread belongs to another tenant.
+	xaddOwnedByOther = 4
+)
+
+// Cluster reports whether the client talks to a Redis Cluster.
+func (c *Client) Cluster() bool {
+	return c.cluster
+}
+
+// needsGlobalWrite reports whether an event with the given script status
+// still has to be appended to the global stream by the caller.
+func (c *Client) needsGlobalWrite(status int64) bool {
+	return status == xaddPending || (status == xaddWritten && c.cluster)
+}
+
+// globalWrite is the second phase of an append in cluster mode.
+type globalWrite struct {
+	eventID  string
+	streamID string
+	values   map[string]any
+}
+
+// globalValues returns the global stream entry for e, written to the thread
+// stream as streamID, in the client's entry format.
+func (c *Client) globalValues(threadID string, e EventEntry, streamID string) map[string]any {
+	if c.entryFormat != EntryLegacy {
+		return map[string]any{
+			"thread_id": threadID,
+			"tenant_id": e.TenantID,
+			"seq":       e.Seq,
+			"ref":       streamID,
+		}
+	}
+	return map[string]any{
+		"thread_id": threadID,
+		"tenant_id": e.TenantID,
+		"seq":       e.Seq,
+		"event_id":  e.EventID,
+		"event":     e.EventJSON,
+	}
+}
+
+// writeGlobal appends events to the global stream after the thread script
+// has run, then confirms them by dropping their pending entries and the
+// pending marker from their dedupe entries. The thread's keys and the global
+// stream live in different cluster slots, so the two phases cannot share a
+// script. When this fails the pending entries stay behind: a retry of the
+// same events redoes the global write while dedupe remembers them, and
+// ReconcileGlobal redoes it otherwise. The persister tolerates the duplicate
+// entries either can produce.
+func (c *Client) writeGlobal(ctx context.Context, threadID string, writes []globalWrite) error {
+	if len(writes) == 0 {
+		return nil
+	}
+	stream := c.GlobalStreamFor(threadID)
+	pipe := c.rdb.Pipeline()
+	for _, w := range writes {
+		pipe.XAdd(ctx, &redis.XAddArgs{Stream: stream, Values: w.values})
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	args := make([]any, 0, len(writes)*2)
+	for _, w := range writes {
+		args = append(args, w.eventID, w.streamID)
+	}
+	return c.confirmGlobalLua.Run(ctx, c.rdb, []string{dedupeKey(threadID), GlobalPendingKey(threadID)}, args...).Err()
+}
+
+// confirmGlobalScript drops the pending entries of written global entries and
+// replaces their pending dedupe markers with the stream ID they stand for.
+// Dedupe entries that were evicted or rewritten meanwhile are left alone.
+const confirmGlobalScript = `
+for i = 1, #ARGV, 2 do
+  redis.call('HDEL', KEYS[2], ARGV[i + 1])
+  if redis.call('HGET', KEYS[1], ARGV[i]) == 'p:' .. ARGV[i + 1] then
+    redis.call('HSET', KEYS[1], ARGV[i], ARGV[i + 1])
+  end
+end
+return 0
+`
@@ -0,0 +1,93 @@
+package redisstreams
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// DedupePolicy bounds how long the event IDs written to a thread are
+// remembered for duplicate detection. Each thread keeps one hash of event ID
+// to stream ID and one sorted set of event IDs by seq, instead of one key per
+// event.
+type DedupePolicy struct {
+	// TTL is how long a thread's dedupe state lives after its last write.
+	// Zero disables dedupe.
+	TTL time.Duration
+	// Window is how many seqs behind the thread's newest event an event ID
+	// is still remembered. Zero keeps every event ID until TTL expires.
+	Window int64
+}
+
+// dedupeKey maps event IDs written to the thread to their thread stream ID.
+func dedupeKey(threadID string) string {
+	return fmt.Sprintf("dedupe:thread:{%s}", threadID)
+}
+
+// dedupeSeqKey orders the event IDs of dedupeKey by seq for window eviction.
+func dedupeSeqKey(threadID string) string {
+	return fmt.Sprintf("dedupe:seq:thread:{%s}", threadID)
+}
+
+// WrittenEvent is what dedupe remembers of an event written to a thread.
+type WrittenEvent struct {
+	StreamID string
+	Seq      int64
+}
+
+// LookupWritten returns, in order, the earlier write of each of eventIDs to
+// the thread, or the zero WrittenEvent for event IDs that dedupe does not
+// remember. Writes whose global entry is still pending are reported too.
+func (c *Client) LookupWritten(ctx context.Context, threadID string, eventIDs []string) ([]WrittenEvent, error) {
+	if len(eventIDs) == 0 {
+		return nil, nil
+	}
+	args := make([]any, len(eventIDs))
+	for i, id := range eventIDs {
+		args[i] = id
+	}
+	res, err := c.lookupWrittenLua.Run(ctx, c.rdb, []string{dedupeKey(threadID), dedupeSeqKey(threadID)}, args...).Result()
+	if err != nil {
+		return nil, err
+	}
+	arr, ok := res.([]any)
+	if !ok || len(arr) != len(eventIDs)*2 {
+		return nil, fmt.Errorf("unexpected lua result")
+	}
+	out := make([]WrittenEvent, len(eventIDs))
+	for i := range out {
+		streamID, _ := arr[2*i].(string)
+		if streamID == "" {
+			continue
+		}
+		raw, _ := arr[2*i+1].(string)
+		seq, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("dedupe seq of %s: %w", eventIDs[i], err)
+		}
+		out[i] = WrittenEvent{StreamID: streamID, Seq: seq}
+	}
+	return out, nil
+}
+
+// lookupWrittenScript reads the stream ID and seq of each event ID from the
+// two dedupe keys at once, so that window eviction cannot split them.
+const lookupWrittenScript = `
+local out = {}
+for _, eventID in ipairs(ARGV) do
+  local streamID = redis.call('HGET', KEYS[1], eventID)
+  local seq = redis.call('ZSCORE', KEYS[2], eventID)
+  if streamID and seq then
+    if string.sub(streamID, 1, 2) == 'p:' then
+      streamID = string.sub(streamID, 3)
+    end
+    table.insert(out, streamID)
+    table.insert(out, seq)
+  else
+    table.insert(out, '')
+    table.insert(out, '')
+  end
+end
+return out
+`
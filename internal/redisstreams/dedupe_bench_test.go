@@ -0,0 +1,211 @@
+package redisstreams
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/warjiang/eventide/internal/config"
+)
+
+// The benchmarks in this file measure Redis memory with MEMORY USAGE and need
+// a real Redis. Point EVENTIDE_BENCH_REDIS_ADDR at a scratch instance:
+//
+//	EVENTIDE_BENCH_REDIS_ADDR=127.0.0.1:6379 go test ./internal/redisstreams -run '^$' -bench Dedupe
+//
+// Only B/event is meaningful when comparing the two designs; ns/op of the
+// per-thread runs includes the stream writes.
+
+const benchDedupeTTL = 7 * 24 * time.Hour
+
+func benchClient(b *testing.B) *Client {
+	addr := os.Getenv("EVENTIDE_BENCH_REDIS_ADDR")
+	if addr == "" {
+		b.Skip("EVENTIDE_BENCH_REDIS_ADDR not set")
+	}
+	c := New(config.RedisConfig{Addr: addr})
+	if err := c.Ping(context.Background()); err != nil {
+		b.Skipf("redis ping: %v", err)
+	}
+	b.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+// BenchmarkDedupeMemory compares the memory spent remembering b.N event IDs
+// spread over a number of threads: one key per event, as the gateway used to
+// write, against the per-thread hash and sorted set.
+func BenchmarkDedupeMemory(b *testing.B) {
+	for _, threads := range []int{1, 100, 1000} {
+		b.Run(fmt.Sprintf("per-event/threads=%d", threads), func(b *testing.B) {
+			benchPerEventDedupe(b, threads)
+		})
+		b.Run(fmt.Sprintf("per-thread/threads=%d", threads), func(b *testing.B) {
+			benchPerThreadDedupe(b, threads)
+		})
+	}
+}
+
+func benchPerEventDedupe(b *testing.B, threads int) {
+	c := benchClient(b)
+	ctx := context.Background()
+	prefix := benchPrefix()
+	keys := make([]string, 0, b.N)
+
+	b.ResetTimer()
+	pipe := c.rdb.Pipeline()
+	for i := 0; i < b.N; i++ {
+		threadID := fmt.Sprintf("%s-%d", prefix, i%threads)
+		key := fmt.Sprintf("dedupe:{%s}:event:%s", threadID, benchEventID(i))
+		keys = append(keys, key)
+		pipe.Set(ctx, key, benchStreamID(i), benchDedupeTTL)
+		if pipe.Len() == 1000 {
+			if _, err := pipe.Exec(ctx); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		b.Fatal(err)
+	}
+	b.StopTimer()
+	b.Cleanup(func() { benchDel(c, keys) })
+
+	b.ReportMetric(float64(benchMemory(b, c, keys))/float64(b.N), "B/event")
+}
+
+func benchPerThreadDedupe(b *testing.B, threads int) {
+	c := benchClient(b)
+	ctx := context.Background()
+	prefix := benchPrefix()
+	policy := DedupePolicy{TTL: benchDedupeTTL, Window: 10000}
+	floors := benchGlobalTails(b, c)
+
+	var keys []string
+	for t := 0; t < threads; t++ {
+		threadID := fmt.Sprintf("%s-%d", prefix, t)
+		keys = append(keys, dedupeKey(threadID), dedupeSeqKey(threadID), StreamKey(threadID))
+	}
+	b.Cleanup(func() {
+		benchDel(c, keys)
+		benchDropGlobal(c, floors, prefix+"-")
+	})
+
+	const batch = 50
+	seqs := make([]int64, threads)
+	b.ResetTimer()
+	for i := 0; i < b.N; i += batch {
+		t := (i / batch) % threads
+		threadID := fmt.Sprintf("%s-%d", prefix, t)
+		n := min(batch, b.N-i)
+		entries := make([]EventEntry, n)
+		for j := range entries {
+			seqs[t]++
+			entries[j] = EventEntry{
+				TenantID:  "bench",
+				EventID:   benchEventID(i + j),
+				Seq:       seqs[t],
+				EventJSON: "{}",
+			}
+		}
+		if _, err := c.IdempotentXAddEvents(ctx, threadID, entries, 1, policy, TurnPolicy{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+
+	var dedupeKeys []string
+	for t := 0; t < threads; t++ {
+		threadID := fmt.Sprintf("%s-%d", prefix, t)
+		dedupeKeys = append(dedupeKeys, dedupeKey(threadID), dedupeSeqKey(threadID))
+	}
+	b.ReportMetric(float64(benchMemory(b, c, dedupeKeys))/float64(b.N), "B/event")
+}
+
+func benchPrefix() string {
+	return fmt.Sprintf("bench-dedupe-%d", time.Now().UnixNano())
+}
+
+// benchEventID returns an ID shaped like the ULIDs SDKs generate.
+func benchEventID(i int) string {
+	return fmt.Sprintf("01J%023d", i)
+}
+
+func benchStreamID(i int) string {
+	return fmt.Sprintf("%d-%d", time.Now().UnixMilli(), i)
+}
+
+// benchMemory sums MEMORY USAGE over keys; missing keys count as zero.
+func benchMemory(b *testing.B, c *Client, keys []string) int64 {
+	ctx := context.Background()
+	var total int64
+	for start := 0; start < len(keys); start += 1000 {
+		pipe := c.rdb.Pipeline()
+		var cmds []*redis.IntCmd
+		for _, k := range keys[start:min(start+1000, len(keys))] {
+			cmds = append(cmds, pipe.MemoryUsage(ctx, k, 0))
+		}
+		_, _ = pipe.Exec(ctx)
+		for _, cmd := range cmds {
+			n, err := cmd.Result()
+			if err != nil && err != redis.Nil {
+				b.Fatal(err)
+			}
+			total += n
+		}
+	}
+	return total
+}
+
+func benchDel(c *Client, keys []string) {
+	ctx := context.Background()
+	for start := 0; start < len(keys); start += 1000 {
+		_ = c.rdb.Unlink(ctx, keys[start:min(start+1000, len(keys))]...).Err()
+	}
+}
+
+// benchGlobalTails returns the newest entry ID of every global stream, so
+// that entries written by the benchmark can be told apart afterwards.
+func benchGlobalTails(b *testing.B, c *Client) map[string]string {
+	ctx := context.Background()
+	tails := make(map[string]string)
+	for _, stream := range c.GlobalStreams() {
+		msgs, err := c.rdb.XRevRangeN(ctx, stream, "+", "-", 1).Result()
+		if err != nil {
+			b.Fatal(err)
+		}
+		tails[stream] = "0-0"
+		if len(msgs) > 0 {
+			tails[stream] = msgs[0].ID
+		}
+	}
+	return tails
+}
+
+// benchDropGlobal deletes global stream entries after tails whose thread ID
+// starts with prefix.
+func benchDropGlobal(c *Client, tails map[string]string, prefix string) {
+	ctx := context.Background()
+	for stream, tail := range tails {
+		start := nextStreamID(tail)
+		for {
+			msgs, err := c.rdb.XRangeN(ctx, stream, start, "+", 1000).Result()
+			if err != nil || len(msgs) == 0 {
+				break
+			}
+			var ids []string
+			for _, m := range msgs {
+				if threadID, _ := m.Values["thread_id"].(string); strings.HasPrefix(threadID, prefix) {
+					ids = append(ids, m.ID)
+				}
+			}
+			if len(ids) > 0 {
+				_ = c.rdb.XDel(ctx, stream, ids...).Err()
+			}
+			start = nextStreamID(msgs[len(msgs)-1].ID)
+		}
+	}
+}
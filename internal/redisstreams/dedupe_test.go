@@ -0,0 +1,60 @@
+package redisstreams
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLookupWritten(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	dedupe := DedupePolicy{TTL: time.Hour, Window: 2}
+	entries := []EventEntry{
+		{TenantID: "acme", EventID: "e1", Seq: 1, EventJSON: "{}"},
+		{TenantID: "acme", EventID: "e5", Seq: 5, EventJSON: "{}"},
+		{TenantID: "acme", EventID: "e6", Seq: 6, EventJSON: "{}"},
+	}
+	res, err := c.IdempotentXAddEvents(ctx, "th", entries, 0, dedupe, TurnPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// e1 fell out of the window; unknown is never written.
+	got, err := c.LookupWritten(ctx, "th", []string{"e6", "unknown", "e1", "e5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []WrittenEvent{{StreamID: res[2].StreamID, Seq: 6}, {}, {}, {StreamID: res[1].StreamID, Seq: 5}}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("LookupWritten = %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestLookupWrittenPending(t *testing.T) {
+	c, _ := newTestClient(t)
+	c.cluster = true
+	ctx := context.Background()
+
+	restore := failGlobalWrites(t, c, "th")
+	entries := []EventEntry{{TenantID: "acme", EventID: "e1", Seq: 3, EventJSON: "{}"}}
+	if _, err := c.IdempotentXAddEvents(ctx, "th", entries, 0, DedupePolicy{TTL: time.Hour}, TurnPolicy{}); err == nil {
+		t.Fatal("expected the global write to fail")
+	}
+	restore()
+
+	// The thread entry was written; its global entry is still pending.
+	got, err := c.LookupWritten(ctx, "th", []string{"e1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := c.XRange(ctx, StreamKey("th"), "-", "+", 10)
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("thread stream: %v %v", msgs, err)
+	}
+	if got[0] != (WrittenEvent{StreamID: msgs[0].ID, Seq: 3}) {
+		t.Fatalf("LookupWritten = %+v, want %s at 3", got, msgs[0].ID)
+	}
+}
@@ -0,0 +1,225 @@
+package redisstreams
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/redis/go-redis/v9"
+	"github.com/warjiang/eventide/sdk/go/eventide"
+)
+
+// EntryFormat is the layout IdempotentXAddEvents writes stream entries in.
+// Readers decode every format with DecodeEntry, so the format can be
+// switched once all of them understand it.
+type EntryFormat int
+
+const (
+	// EntryLegacy stores every event field next to the full event JSON in
+	// the thread stream, and the event JSON again in the global stream.
+	EntryLegacy EntryFormat = iota
+	// EntryCompact stores only seq and the encoded event in the thread
+	// stream. The global stream holds a pointer to the thread entry.
+	EntryCompact
+	// EntryCompactZstd is EntryCompact with events zstd-compressed when that
+	// makes them smaller.
+	EntryCompactZstd
+)
+
+// ParseEntryFormat parses "legacy", "compact" or "zstd".
+func ParseEntryFormat(s string) (EntryFormat, error) {
+	switch s {
+	case "", "legacy":
+		return EntryLegacy, nil
+	case "compact":
+		return EntryCompact, nil
+	case "zstd":
+		return EntryCompactZstd, nil
+	}
+	return 0, fmt.Errorf("unknown stream entry format %q", s)
+}
+
+// SetEntryFormat sets the layout of entries written from now on. Call it
+// once, before the client is used.
+func (c *Client) SetEntryFormat(f EntryFormat) {
+	c.entryFormat = f
+}
+
+// Encodings of the event field of compact entries.
+const (
+	encJSON = "json"
+	encZstd = "zstd"
+)
+
+// ErrEntryMissing is returned by DecodeEntry for a global stream pointer
+// whose thread stream entry no longer exists, usually because the thread
+// stream was trimmed before the pointer was consumed.
+var ErrEntryMissing = errors.New("referenced thread stream entry no longer exists")
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// encodeEvent returns the event field of a compact entry and its encoding.
+func (c *Client) encodeEvent(eventJSON string) (string, string) {
+	if c.entryFormat == EntryCompactZstd {
+		if b := zstdEncoder.EncodeAll([]byte(eventJSON), nil); len(b) < len(eventJSON) {
+			return string(b), encZstd
+		}
+	}
+	return eventJSON, encJSON
+}
+
+// IsRef reports whether values is a compact global stream entry, which
+// points at the thread stream entry holding the event.
+func IsRef(values map[string]any) bool {
+	_, ok := values["ref"].(string)
+	return ok
+}
+
+// ResolveRefs loads the thread stream entries that the global stream
+// pointers among msgs refer to, and merges their fields into the pointers so
+// that DecodeEntry can read them. Pointers whose entry is gone are left as
+// they are.
+func (c *Client) ResolveRefs(ctx context.Context, msgs []GroupMessage) error {
+	type lookup struct {
+		values map[string]any
+		cmd    *redis.XMessageSliceCmd
+	}
+	var lookups []lookup
+	pipe := c.rdb.Pipeline()
+	for _, m := range msgs {
+		ref, ok := m.Values["ref"].(string)
+		if !ok {
+			continue
+		}
+		if _, done := m.Values["event"]; done {
+			continue
+		}
+		threadID, _ := m.Values["thread_id"].(string)
+		lookups = append(lookups, lookup{
+			values: m.Values,
+			cmd:    pipe.XRangeN(ctx, StreamKey(threadID), ref, ref, 1),
+		})
+	}
+	if len(lookups) == 0 {
+		return nil
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return err
+	}
+	for _, l := range lookups {
+		res, err := l.cmd.Result()
+		if err != nil || len(res) == 0 {
+			continue
+		}
+		for _, k := range []string{"enc", "event"} {
+			if v, ok := res[0].Values[k]; ok {
+				l.values[k] = v
+			}
+		}
+	}
+	return nil
+}
+
+// EntryEventJSON returns the event JSON of a stream entry of any format,
+// decompressing it when needed. Global stream pointers must be resolved
+// with ResolveRefs first.
+func EntryEventJSON(values map[string]any) ([]byte, error) {
+	raw, ok := values["event"].(string)
+	if !ok || raw == "" {
+		if IsRef(values) {
+			return nil, ErrEntryMissing
+		}
+		return nil, errors.New("missing event field")
+	}
+	switch enc, _ := values["enc"].(string); enc {
+	case "", encJSON:
+		return []byte(raw), nil
+	case encZstd:
+		b, err := zstdDecoder.DecodeAll([]byte(raw), nil)
+		if err != nil {
+			return nil, fmt.Errorf("decompress event: %w", err)
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("unknown event encoding %q", enc)
+	}
+}
+
+// DecodeEntry returns the event stored in a thread or global stream entry of
+// any format. Global stream pointers must be resolved with ResolveRefs
+// first. The oldest thread stream entries, which predate the event field,
+// are rebuilt from their individual fields.
+func DecodeEntry(values map[string]any) (eventide.Event, error) {
+	if _, ok := values["event"]; !ok && !IsRef(values) {
+		if e, ok := eventFromFields(values); ok {
+			return e, nil
+		}
+	}
+	b, err := EntryEventJSON(values)
+	if err != nil {
+		return eventide.Event{}, err
+	}
+	e, err := eventide.DecodeEvent(b)
+	if err != nil {
+		return eventide.Event{}, fmt.Errorf("decode event: %w", err)
+	}
+	return e, nil
+}
+
+// InlineEntry rewrites a resolved compact entry in the legacy global stream
+// layout, with the event as plain JSON, so that it stays readable after the
+// thread entry it points at is trimmed.
+func InlineEntry(values map[string]any) error {
+	b, err := EntryEventJSON(values)
+	if err != nil {
+		return err
+	}
+	e, err := eventide.DecodeEvent(b)
+	if err != nil {
+		return fmt.Errorf("decode event: %w", err)
+	}
+	delete(values, "ref")
+	delete(values, "enc")
+	values["event_id"] = e.EventID
+	values["event"] = string(b)
+	return nil
+}
+
+// eventFromFields rebuilds an event from the individual fields of a legacy
+// thread stream entry.
+func eventFromFields(values map[string]any) (eventide.Event, bool) {
+	seqStr, _ := values["seq"].(string)
+	seq, err := strconv.ParseInt(seqStr, 10, 64)
+	if err != nil {
+		return eventide.Event{}, false
+	}
+	eventID, _ := values["event_id"].(string)
+	turnID, _ := values["turn_id"].(string)
+	tsStr, _ := values["ts"].(string)
+	typeStr, _ := values["type"].(string)
+	levelStr, _ := values["level"].(string)
+	payloadStr, _ := values["payload"].(string)
+	if eventID == "" || turnID == "" || tsStr == "" || typeStr == "" || levelStr == "" || payloadStr == "" {
+		return eventide.Event{}, false
+	}
+	ts, err := time.Parse(time.RFC3339Nano, tsStr)
+	if err != nil {
+		return eventide.Event{}, false
+	}
+	return eventide.Event{
+		SpecVersion: eventide.SpecVersion,
+		EventID:     eventID,
+		TurnID:      turnID,
+		Seq:         seq,
+		TS:          ts,
+		Type:        typeStr,
+		Level:       eventide.Level(levelStr),
+		Payload:     []byte(payloadStr),
+	}, true
+}
@@ -0,0 +1,64 @@
+package redisstreams
+
+import (
+	"context"
+	"time"
+)
+
+// acquireLeaseScript takes or renews a lease. It succeeds when the key is
+// free or already held by the same owner.
+const acquireLeaseScript = `
+local owner = redis.call('GET', KEYS[1])
+if owner == ARGV[1] then
+  redis.call('PEXPIRE', KEYS[1], ARGV[2])
+  return 1
+end
+if owner then
+  return 0
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+return 1
+`
+
+const releaseLeaseScript = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+  return redis.call('DEL', KEYS[1])
+end
+return 0
+`
+
+// heartbeatScript records a member in a sorted set scored by when its
+// heartbeat expires, drops expired members and returns the live count.
+const heartbeatScript = `
+local now = tonumber(ARGV[2])
+redis.call('ZADD', KEYS[1], now + tonumber(ARGV[3]), ARGV[1])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now)
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+return redis.call('ZCARD', KEYS[1])
+`
+
+// AcquireLease takes the lease at key for owner, or extends it when owner
+// already holds it. It returns false when another owner holds the lease.
+func (c *Client) AcquireLease(ctx context.Context, key, owner string, ttl time.Duration) (bool, error) {
+	n, err := c.acquireLeaseLua.Run(ctx, c.rdb, []string{key}, owner, ttl.Milliseconds()).Int64()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// ReleaseLease gives up the lease at key if owner still holds it.
+func (c *Client) ReleaseLease(ctx context.Context, key, owner string) error {
+	return c.releaseLeaseLua.Run(ctx, c.rdb, []string{key}, owner).Err()
+}
+
+// Heartbeat marks member alive in the group at key for ttl and returns how
+// many members are alive, including member.
+func (c *Client) Heartbeat(ctx context.Context, key, member string, ttl time.Duration) (int64, error) {
+	return c.heartbeatLua.Run(ctx, c.rdb, []string{key}, member, time.Now().UnixMilli(), ttl.Milliseconds()).Int64()
+}
+
+// LeaveGroup removes member from the group at key.
+func (c *Client) LeaveGroup(ctx context.Context, key, member string) error {
+	return c.rdb.ZRem(ctx, key, member).Err()
+}
@@ -0,0 +1,274 @@
+package redisstreams
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Reasons reported by Admit when a request is refused.
+const (
+	AdmitTenantRate       = "tenant_rate"
+	AdmitThreadRate       = "thread_rate"
+	AdmitThreadEvents     = "thread_events"
+	AdmitTenantDailyBytes = "tenant_daily_bytes"
+)
+
+// RateLimit is a token bucket refilled at Rate events per second and holding
+// at most Burst events. A zero Rate disables the limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int64
+}
+
+func (l RateLimit) Enabled() bool {
+	return l.Rate > 0
+}
+
+// Admission describes a write of Events events totalling Bytes payload bytes
+// to one thread, and the limits it is checked against. Zero limits are off.
+type Admission struct {
+	TenantID            string
+	ThreadID            string
+	Events              int64
+	Bytes               int64
+	TenantLimit         RateLimit
+	ThreadLimit         RateLimit
+	MaxThreadEvents     int64
+	MaxTenantDailyBytes int64
+}
+
+type AdmitResult struct {
+	// Reason is empty when the write is admitted.
+	Reason string
+	// RetryAfter is how long until the write could be admitted, or 0 when
+	// retrying will not help.
+	RetryAfter time.Duration
+}
+
+// Tenant keys use the tenant ID as hash tag, thread keys the thread ID, like
+// the other per-thread keys.
+
+func RateLimitTenantKey(tenantID string) string {
+	return fmt.Sprintf("ratelimit:tenant:{%s}", tenantID)
+}
+
+func RateLimitThreadKey(threadID string) string {
+	return fmt.Sprintf("ratelimit:thread:{%s}", threadID)
+}
+
+func QuotaTenantBytesKey(tenantID string, day time.Time) string {
+	return fmt.Sprintf("quota:bytes:tenant:{%s}:%s", tenantID, day.UTC().Format("20060102"))
+}
+
+// Admit checks a write against the rate limits and quotas in a single script
+// call and, if every check passes, consumes tokens and daily bytes for it.
+// Nothing is consumed when any check fails. The thread event quota is checked
+// against the thread's seq counter.
+//
+// In cluster mode the tenant and thread keys live in different slots, so the
+// thread checks run first in one call and the tenant checks in a second.
+// Thread tokens taken by the first call are given back when the second
+// refuses or fails.
+func (c *Client) Admit(ctx context.Context, a Admission) (AdmitResult, error) {
+	now := time.Now().UTC()
+	tenantRate := RateLimitTenantKey(a.TenantID)
+	threadRate := RateLimitThreadKey(a.ThreadID)
+	seq := SeqKey(a.ThreadID)
+	quota := QuotaTenantBytesKey(a.TenantID, now)
+	if !c.cluster {
+		return c.admit(ctx, now, []string{tenantRate, threadRate, seq, quota}, a)
+	}
+
+	// Keys of checks that are switched off are never read, so their slots
+	// are filled with a key of the same slot.
+	thread := a
+	thread.TenantLimit = RateLimit{}
+	thread.MaxTenantDailyBytes = 0
+	res, err := c.admit(ctx, now, []string{threadRate, threadRate, seq, seq}, thread)
+	if err != nil || res.Reason != "" {
+		return res, err
+	}
+	tenant := a
+	tenant.ThreadLimit = RateLimit{}
+	tenant.MaxThreadEvents = 0
+	res, err = c.admit(ctx, now, []string{tenantRate, tenantRate, quota, quota}, tenant)
+	if err == nil && res.Reason == "" {
+		return res, nil
+	}
+	// Callers settle only admitted writes, so the thread share of a refused
+	// or failed one is given back here.
+	if rerr := c.refund(ctx, []string{threadRate, threadRate, threadRate}, thread); rerr != nil && err == nil {
+		err = rerr
+	}
+	return res, err
+}
+
+func (c *Client) admit(ctx context.Context, now time.Time, keys []string, a Admission) (AdmitResult, error) {
+	args := []any{
+		now.UnixMilli(),
+		a.Events,
+		a.Bytes,
+		a.TenantLimit.Rate, a.TenantLimit.Burst,
+		a.ThreadLimit.Rate, a.ThreadLimit.Burst,
+		a.MaxThreadEvents,
+		a.MaxTenantDailyBytes,
+		int64((48 * time.Hour).Seconds()),
+	}
+	res, err := c.admitLua.Run(ctx, c.rdb, keys, args...).Result()
+	if err != nil {
+		return AdmitResult{}, err
+	}
+	arr, ok := res.([]any)
+	if !ok || len(arr) != 2 {
+		return AdmitResult{}, fmt.Errorf("unexpected lua result")
+	}
+	reason, _ := arr[0].(string)
+	waitMs, _ := arr[1].(int64)
+	out := AdmitResult{Reason: reason, RetryAfter: time.Duration(waitMs) * time.Millisecond}
+	if reason == AdmitTenantDailyBytes {
+		out.RetryAfter = now.Truncate(24 * time.Hour).Add(24 * time.Hour).Sub(now)
+	}
+	return out, nil
+}
+
+// Refund gives back the tokens and daily bytes Admit consumed for a write
+// that turned out not to need them: events that were duplicates or were not
+// written at all. a describes the refunded part of the write. Buckets are
+// never filled past their burst.
+func (c *Client) Refund(ctx context.Context, a Admission) error {
+	tenantRate := RateLimitTenantKey(a.TenantID)
+	threadRate := RateLimitThreadKey(a.ThreadID)
+	quota := QuotaTenantBytesKey(a.TenantID, time.Now())
+	if !c.cluster {
+		return c.refund(ctx, []string{tenantRate, threadRate, quota}, a)
+	}
+	thread := a
+	thread.TenantLimit = RateLimit{}
+	thread.MaxTenantDailyBytes = 0
+	if err := c.refund(ctx, []string{threadRate, threadRate, threadRate}, thread); err != nil {
+		return err
+	}
+	tenant := a
+	tenant.ThreadLimit = RateLimit{}
+	return c.refund(ctx, []string{tenantRate, tenantRate, quota}, tenant)
+}
+
+func (c *Client) refund(ctx context.Context, keys []string, a Admission) error {
+	var tenantBurst, threadBurst, bytes int64
+	if a.TenantLimit.Enabled() {
+		tenantBurst = a.TenantLimit.Burst
+	}
+	if a.ThreadLimit.Enabled() {
+		threadBurst = a.ThreadLimit.Burst
+	}
+	if a.MaxTenantDailyBytes > 0 {
+		bytes = a.Bytes
+	}
+	if tenantBurst == 0 && threadBurst == 0 && bytes == 0 {
+		return nil
+	}
+	return c.refundLua.Run(ctx, c.rdb, keys, a.Events, bytes, tenantBurst, threadBurst).Err()
+}
+
+const refundScript = `
+local n = tonumber(ARGV[1])
+local bytes = tonumber(ARGV[2])
+local tenantBurst = tonumber(ARGV[3])
+local threadBurst = tonumber(ARGV[4])
+
+-- Buckets that expired are full already.
+local function give(key, burst)
+  if burst <= 0 then
+    return
+  end
+  local tokens = tonumber(redis.call('HGET', key, 'tokens'))
+  if tokens then
+    redis.call('HSET', key, 'tokens', tostring(math.min(burst, tokens + n)))
+  end
+end
+
+give(KEYS[1], tenantBurst)
+give(KEYS[2], threadBurst)
+if bytes > 0 then
+  local used = tonumber(redis.call('GET', KEYS[3]) or '0')
+  if used > 0 then
+    redis.call('DECRBY', KEYS[3], math.min(used, bytes))
+  end
+end
+return 0
+`
+
+const admitScript = `
+local now = tonumber(ARGV[1])
+local n = tonumber(ARGV[2])
+local bytes = tonumber(ARGV[3])
+local tenantRate = tonumber(ARGV[4])
+local tenantBurst = tonumber(ARGV[5])
+local threadRate = tonumber(ARGV[6])
+local threadBurst = tonumber(ARGV[7])
+local maxEvents = tonumber(ARGV[8])
+local maxBytes = tonumber(ARGV[9])
+local bytesTTL = tonumber(ARGV[10])
+
+if maxEvents > 0 then
+  local current = tonumber(redis.call('GET', KEYS[3]) or '0')
+  if current + n > maxEvents then
+    return {'thread_events', 0}
+  end
+end
+if maxBytes > 0 then
+  local used = tonumber(redis.call('GET', KEYS[4]) or '0')
+  if used + bytes > maxBytes then
+    return {'tenant_daily_bytes', 0}
+  end
+end
+
+-- Returns the tokens left after taking n, or nil and the wait in ms.
+-- Requests larger than the burst are admitted once the bucket is full but
+-- still cost n: the bucket goes into debt, and later requests wait until the
+-- refill has paid it back, so the rate holds however writes are batched.
+local function take(key, rate, burst)
+  local need = math.min(n, burst)
+  local state = redis.call('HMGET', key, 'tokens', 'ts')
+  local tokens = tonumber(state[1]) or burst
+  local ts = tonumber(state[2]) or now
+  if now > ts then
+    tokens = math.min(burst, tokens + (now - ts) * rate / 1000)
+  end
+  if tokens < need then
+    return nil, math.ceil((need - tokens) * 1000 / rate)
+  end
+  return tokens - n, 0
+end
+
+local tenantLeft, threadLeft
+if tenantRate > 0 then
+  local wait
+  tenantLeft, wait = take(KEYS[1], tenantRate, tenantBurst)
+  if not tenantLeft then
+    return {'tenant_rate', wait}
+  end
+end
+if threadRate > 0 then
+  local wait
+  threadLeft, wait = take(KEYS[2], threadRate, threadBurst)
+  if not threadLeft then
+    return {'thread_rate', wait}
+  end
+end
+
+if tenantLeft then
+  redis.call('HSET', KEYS[1], 'tokens', tostring(tenantLeft), 'ts', now)
+  redis.call('PEXPIRE', KEYS[1], math.ceil((tenantBurst - tenantLeft) / tenantRate * 1000) + 1000)
+end
+if threadLeft then
+  redis.call('HSET', KEYS[2], 'tokens', tostring(threadLeft), 'ts', now)
+  redis.call('PEXPIRE', KEYS[2], math.ceil((threadBurst - threadLeft) / threadRate * 1000) + 1000)
+end
+if maxBytes > 0 then
+  redis.call('INCRBY', KEYS[4], bytes)
+  redis.call('EXPIRE', KEYS[4], bytesTTL)
+end
+return {'', 0}
+`
@@ -0,0 +1,123 @@
+package redisstreams
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAdmitChargesWholeBatch(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	limit := RateLimit{Rate: 1, Burst: 10}
+	a := Admission{TenantID: "acme", ThreadID: "th", Events: 100, ThreadLimit: limit}
+
+	// A batch larger than the burst passes on a full bucket...
+	res, err := c.Admit(ctx, a)
+	if err != nil || res.Reason != "" {
+		t.Fatalf("first batch refused: %+v %v", res, err)
+	}
+	// ...but leaves the bucket 90 events in debt.
+	a.Events = 1
+	res, err = c.Admit(ctx, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Reason != AdmitThreadRate || res.RetryAfter.Seconds() < 90 {
+		t.Fatalf("expected thread_rate with ~91s wait, got %+v", res)
+	}
+}
+
+func TestRefund(t *testing.T) {
+	c, mr := newTestClient(t)
+	ctx := context.Background()
+	a := Admission{
+		TenantID:            "acme",
+		ThreadID:            "th",
+		Events:              5,
+		Bytes:               500,
+		TenantLimit:         RateLimit{Rate: 0.001, Burst: 5},
+		ThreadLimit:         RateLimit{Rate: 0.001, Burst: 5},
+		MaxTenantDailyBytes: 1000,
+	}
+	if res, err := c.Admit(ctx, a); err != nil || res.Reason != "" {
+		t.Fatalf("admit: %+v %v", res, err)
+	}
+	if res, err := c.Admit(ctx, a); err != nil || res.Reason == "" {
+		t.Fatalf("expected the empty bucket to refuse: %+v %v", res, err)
+	}
+
+	// Giving back a duplicate batch restores tokens and bytes.
+	if err := c.Refund(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := c.Admit(ctx, a); err != nil || res.Reason != "" {
+		t.Fatalf("admit after refund: %+v %v", res, err)
+	}
+
+	// Refunds never fill a bucket past its burst, nor bytes below zero.
+	for i := 0; i < 3; i++ {
+		if err := c.Refund(ctx, a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.Events = 6
+	if res, err := c.Admit(ctx, a); err != nil || res.Reason != "" {
+		t.Fatalf("admit on a full bucket: %+v %v", res, err)
+	}
+	a.Events = 1
+	if res, err := c.Admit(ctx, a); err != nil || res.Reason != AdmitTenantRate {
+		t.Fatalf("expected the bucket to be in debt: %+v %v", res, err)
+	}
+	if got, _ := mr.Get(QuotaTenantBytesKey("acme", time.Now())); got != "500" {
+		t.Fatalf("daily bytes %q, want 500", got)
+	}
+}
+
+func TestAdmitClusterRefundsThreadShare(t *testing.T) {
+	c, _ := newTestClient(t)
+	c.cluster = true
+	ctx := context.Background()
+	limit := RateLimit{Rate: 0.001, Burst: 1}
+
+	// Use up the tenant's only token on another thread.
+	other := Admission{TenantID: "acme", ThreadID: "th0", Events: 1, TenantLimit: limit}
+	if res, err := c.Admit(ctx, other); err != nil || res.Reason != "" {
+		t.Fatalf("admit: %+v %v", res, err)
+	}
+
+	// The thread check passes and takes the thread's token, then the tenant
+	// check refuses.
+	a := Admission{TenantID: "acme", ThreadID: "th", Events: 1, TenantLimit: limit, ThreadLimit: limit}
+	if res, err := c.Admit(ctx, a); err != nil || res.Reason != AdmitTenantRate {
+		t.Fatalf("expected tenant_rate, got %+v %v", res, err)
+	}
+	// The thread's token was given back.
+	a.TenantLimit = RateLimit{}
+	if res, err := c.Admit(ctx, a); err != nil || res.Reason != "" {
+		t.Fatalf("thread token not refunded: %+v %v", res, err)
+	}
+}
+
+func TestAdmitThreadEventsUsesSeqCounter(t *testing.T) {
+	for _, cluster := range []bool{false, true} {
+		c, mr := newTestClient(t)
+		c.cluster = cluster
+		ctx := context.Background()
+		a := Admission{TenantID: "acme", ThreadID: "th", Events: 2, MaxThreadEvents: 10}
+
+		// Without a seq counter the thread counts as empty.
+		if res, err := c.Admit(ctx, a); err != nil || res.Reason != "" {
+			t.Fatalf("cluster=%v: admit on a new thread: %+v %v", cluster, res, err)
+		}
+		mr.Set(SeqKey("th"), "8")
+		if res, err := c.Admit(ctx, a); err != nil || res.Reason != "" {
+			t.Fatalf("cluster=%v: admit up to the quota: %+v %v", cluster, res, err)
+		}
+		mr.Set(SeqKey("th"), "9")
+		res, err := c.Admit(ctx, a)
+		if err != nil || res.Reason != AdmitThreadEvents || res.RetryAfter != 0 {
+			t.Fatalf("cluster=%v: expected thread_events, got %+v %v", cluster, res, err)
+		}
+	}
+}
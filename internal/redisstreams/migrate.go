@@ -0,0 +1,137 @@
+package redisstreams
+
+import (
+	"context"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// legacyThreadKeys are the per-thread keys that were written without a hash
+// tag before cluster support, by prefix, with the key they move to.
+var legacyThreadKeys = []struct {
+	prefix string
+	key    func(threadID string) string
+}{
+	{"stream:thread:", StreamKey},
+	{"seq:thread:", SeqKey},
+	{"turns:thread:", TurnsKey},
+	{"tenant:thread:", ThreadTenantKey},
+}
+
+// MigrateStats counts what MigrateLegacyKeys did.
+type MigrateStats struct {
+	// Moved keys did not exist under the new name yet.
+	Moved int64
+	// Merged keys already existed under the new name and were combined with
+	// it: seq counters keep the higher value, turn states fill in missing
+	// turns, and owners keep the new value.
+	Merged int64
+	// Skipped keys are thread streams that already exist under the new name.
+	// They are left in place; their entries have already been delivered to
+	// the global stream.
+	Skipped int64
+}
+
+// MigrateLegacyKeys moves per-thread keys written under the old untagged
+// names to their hash-tagged names. Dedupe and rate limit keys are not
+// moved; they expire on their own. It is safe to run repeatedly and while
+// the gateway is writing, as long as no gateway still uses the old names.
+func (c *Client) MigrateLegacyKeys(ctx context.Context, logf func(format string, args ...any)) (MigrateStats, error) {
+	var stats MigrateStats
+	err := c.forEachNode(ctx, func(ctx context.Context, node redis.Cmdable) error {
+		for _, lk := range legacyThreadKeys {
+			iter := node.Scan(ctx, 0, lk.prefix+"*", 500).Iterator()
+			for iter.Next(ctx) {
+				key := iter.Val()
+				threadID := strings.TrimPrefix(key, lk.prefix)
+				if strings.HasPrefix(threadID, "{") && strings.HasSuffix(threadID, "}") {
+					continue // already migrated
+				}
+				if err := c.migrateKey(ctx, key, lk.key(threadID), &stats, logf); err != nil {
+					return err
+				}
+			}
+			if err := iter.Err(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return stats, err
+}
+
+func (c *Client) migrateKey(ctx context.Context, from, to string, stats *MigrateStats, logf func(string, ...any)) error {
+	dump, err := c.rdb.Dump(ctx, from).Result()
+	if err == redis.Nil {
+		return nil // expired meanwhile
+	}
+	if err != nil {
+		return err
+	}
+	ttl, err := c.rdb.PTTL(ctx, from).Result()
+	if err != nil {
+		return err
+	}
+	if ttl < 0 {
+		ttl = 0
+	}
+	err = c.rdb.Restore(ctx, to, ttl, dump).Err()
+	switch {
+	case err == nil:
+		stats.Moved++
+	case strings.HasPrefix(err.Error(), "BUSYKEY"):
+		merged, err := c.mergeKey(ctx, from, to)
+		if err != nil {
+			return err
+		}
+		if !merged {
+			stats.Skipped++
+			logf("skip %s: %s already exists", from, to)
+			return nil
+		}
+		stats.Merged++
+	default:
+		return err
+	}
+	return c.rdb.Del(ctx, from).Err()
+}
+
+// mergeKey combines the legacy key from into the existing key to. It returns
+// false for key types that cannot be merged.
+func (c *Client) mergeKey(ctx context.Context, from, to string) (bool, error) {
+	switch {
+	case strings.HasPrefix(from, "seq:thread:"):
+		floor, err := c.rdb.Get(ctx, from).Int64()
+		if err != nil {
+			return false, err
+		}
+		return true, c.seedSeqLua.Run(ctx, c.rdb, []string{to}, floor, "1").Err()
+	case strings.HasPrefix(from, "turns:thread:"):
+		turns, err := c.rdb.HGetAll(ctx, from).Result()
+		if err != nil {
+			return false, err
+		}
+		for turnID, state := range turns {
+			if err := c.rdb.HSetNX(ctx, to, turnID, state).Err(); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	case strings.HasPrefix(from, "tenant:thread:"):
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// forEachNode runs fn against every master of a cluster, or against the
+// single server otherwise.
+func (c *Client) forEachNode(ctx context.Context, fn func(context.Context, redis.Cmdable) error) error {
+	if cc, ok := c.rdb.(*redis.ClusterClient); ok {
+		return cc.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+			return fn(ctx, node)
+		})
+	}
+	return fn(ctx, c.rdb)
+}
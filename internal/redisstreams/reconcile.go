@@ -0,0 +1,207 @@
+package redisstreams
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// In cluster mode an append writes the thread stream in one script and the
+// global stream in a second step. Every thread stream entry whose global
+// entry is not written yet is kept in the thread's pending hash until the
+// second step confirms it. Before the script runs, the thread is added to
+// the pending index of its global stream, so that ReconcileGlobal can find
+// the entries a failed or crashed second step left behind.
+
+// GlobalPendingKey holds the unconfirmed entries of threadID, keyed by thread
+// stream ID. It shares the thread's hash tag.
+func GlobalPendingKey(threadID string) string {
+	return fmt.Sprintf("global:pending:thread:{%s}", threadID)
+}
+
+// GlobalPendingIndexKey lists the threads that may have unconfirmed entries
+// bound for stream, scored by when the oldest of them may have been written.
+// It shares the hash tag of a global stream shard.
+func GlobalPendingIndexKey(stream string) string {
+	return "global:pending:" + stream
+}
+
+// pendingEntry is a value of the pending hash.
+type pendingEntry struct {
+	EventID  string `json:"event_id"`
+	TenantID string `json:"tenant_id"`
+	// ClaimedAt is when a reconciler last took the entry over, in
+	// milliseconds.
+	ClaimedAt int64 `json:"claimed_at,omitempty"`
+}
+
+// indexPending adds threadID to the pending index ahead of a write. A thread
+// already listed keeps its older score.
+func (c *Client) indexPending(ctx context.Context, threadID string) error {
+	return c.rdb.ZAddNX(ctx, GlobalPendingIndexKey(c.GlobalStreamFor(threadID)), redis.Z{
+		Score:  float64(time.Now().UnixMilli()),
+		Member: threadID,
+	}).Err()
+}
+
+// ReconcileResult counts what a ReconcileGlobal call did.
+type ReconcileResult struct {
+	// Appended is the number of global entries written.
+	Appended int
+	// Missing is the number of pending entries dropped because their thread
+	// stream entry no longer exists.
+	Missing int
+}
+
+// ReconcileGlobal writes the global entries of thread stream entries bound
+// for stream that have been pending for longer than age, for up to limit
+// threads. It only does work in cluster mode. Entries are claimed before they
+// are written, so concurrent reconcilers do not write the same entry at
+// once; a gateway that is merely slow can still race it, which leaves a
+// duplicate global entry for the persister to ignore.
+func (c *Client) ReconcileGlobal(ctx context.Context, stream string, age time.Duration, limit int64) (ReconcileResult, error) {
+	var res ReconcileResult
+	if !c.cluster {
+		return res, nil
+	}
+	index := GlobalPendingIndexKey(stream)
+	now := time.Now()
+	cutoff := now.Add(-age).UnixMilli()
+	threads, err := c.rdb.ZRangeByScoreWithScores(ctx, index, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(cutoff, 10),
+		Count: limit,
+	}).Result()
+	if err != nil {
+		return res, err
+	}
+	for _, z := range threads {
+		threadID, _ := z.Member.(string)
+		appended, missing, err := c.reconcileThread(ctx, threadID, cutoff, now.UnixMilli())
+		res.Appended += appended
+		res.Missing += missing
+		if err != nil {
+			return res, err
+		}
+		if err := c.reindexPending(ctx, index, threadID, z.Score); err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+func (c *Client) reconcileThread(ctx context.Context, threadID string, cutoff, now int64) (appended, missing int, err error) {
+	pendingKey := GlobalPendingKey(threadID)
+	raw, err := c.claimPendingLua.Run(ctx, c.rdb, []string{pendingKey}, cutoff, now).StringSlice()
+	if err != nil {
+		return 0, 0, err
+	}
+	var writes []globalWrite
+	for i := 0; i+1 < len(raw); i += 2 {
+		streamID := raw[i]
+		var p pendingEntry
+		if err := json.Unmarshal([]byte(raw[i+1]), &p); err != nil {
+			return appended, missing, fmt.Errorf("pending entry %s of %s: %w", streamID, threadID, err)
+		}
+		msgs, err := c.XRange(ctx, StreamKey(threadID), streamID, streamID, 1)
+		if err != nil {
+			return appended, missing, err
+		}
+		if len(msgs) == 0 {
+			if err := c.rdb.HDel(ctx, pendingKey, streamID).Err(); err != nil {
+				return appended, missing, err
+			}
+			missing++
+			continue
+		}
+		writes = append(writes, globalWrite{
+			eventID:  p.EventID,
+			streamID: streamID,
+			values:   pendingValues(threadID, p, msgs[0]),
+		})
+	}
+	if err := c.writeGlobal(ctx, threadID, writes); err != nil {
+		return appended, missing, err
+	}
+	return len(writes), missing, nil
+}
+
+// pendingValues rebuilds the global entry of thread stream entry m in the
+// layout m was written in.
+func pendingValues(threadID string, p pendingEntry, m GroupMessage) map[string]any {
+	if _, compact := m.Values["enc"]; compact {
+		return map[string]any{
+			"thread_id": threadID,
+			"tenant_id": p.TenantID,
+			"seq":       m.Values["seq"],
+			"ref":       m.ID,
+		}
+	}
+	return map[string]any{
+		"thread_id": threadID,
+		"tenant_id": p.TenantID,
+		"seq":       m.Values["seq"],
+		"event_id":  p.EventID,
+		"event":     m.Values["event"],
+	}
+}
+
+// reindexPending drops threadID from the pending index once it has no pending
+// entries left, or pushes its score to now so that the entries that are left
+// are looked at again after age. The index and the pending hash live in
+// different slots; the hash is checked again after the removal so that an
+// entry written in between is not left unlisted.
+func (c *Client) reindexPending(ctx context.Context, index, threadID string, score float64) error {
+	n, err := c.rdb.HLen(ctx, GlobalPendingKey(threadID)).Result()
+	if err != nil {
+		return err
+	}
+	now := redis.Z{Score: float64(time.Now().UnixMilli()), Member: threadID}
+	if n > 0 {
+		return c.rdb.ZAddXX(ctx, index, now).Err()
+	}
+	if err := c.unindexPendingLua.Run(ctx, c.rdb, []string{index}, threadID, strconv.FormatFloat(score, 'f', -1, 64)).Err(); err != nil {
+		return err
+	}
+	if n, err = c.rdb.HLen(ctx, GlobalPendingKey(threadID)).Result(); err != nil || n == 0 {
+		return err
+	}
+	return c.rdb.ZAddNX(ctx, index, now).Err()
+}
+
+// claimPendingScript returns the pending entries written or last claimed at
+// or before ARGV[1] as stream ID, value pairs, and marks them claimed at
+// ARGV[2].
+const claimPendingScript = `
+local cutoff = tonumber(ARGV[1])
+local now = tonumber(ARGV[2])
+local out = {}
+local all = redis.call('HGETALL', KEYS[1])
+for i = 1, #all, 2 do
+  local id = all[i]
+  local entry = cjson.decode(all[i + 1])
+  local at = tonumber(entry.claimed_at) or tonumber(string.match(id, '^(%d+)'))
+  if at <= cutoff then
+    entry.claimed_at = now
+    local value = cjson.encode(entry)
+    redis.call('HSET', KEYS[1], id, value)
+    table.insert(out, id)
+    table.insert(out, value)
+  end
+end
+return out
+`
+
+// unindexPendingScript removes ARGV[1] from the index unless its score
+// changed since it was read as ARGV[2].
+const unindexPendingScript = `
+local score = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if score and tonumber(score) == tonumber(ARGV[2]) then
+  redis.call('ZREM', KEYS[1], ARGV[1])
+end
+return 0
+`
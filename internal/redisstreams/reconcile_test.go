@@ -0,0 +1,143 @@
+package redisstreams
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// failGlobalWrites makes XADD to the global stream fail until the returned
+// function is called, like a gateway losing the global slot after the thread
+// script ran.
+func failGlobalWrites(t *testing.T, c *Client, threadID string) func() {
+	t.Helper()
+	ctx := context.Background()
+	stream := c.GlobalStreamFor(threadID)
+	if err := c.Set(ctx, stream, "not a stream", 0); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		if _, err := c.Del(ctx, stream); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReconcileGlobal(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		format EntryFormat
+		dedupe DedupePolicy
+	}{
+		{name: "legacy without dedupe", format: EntryLegacy},
+		{name: "compact with dedupe", format: EntryCompact, dedupe: DedupePolicy{TTL: time.Hour}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newTestClient(t)
+			c.cluster = true
+			c.SetEntryFormat(tt.format)
+			ctx := context.Background()
+			stream := c.GlobalStreamFor("th")
+			index := GlobalPendingIndexKey(stream)
+
+			restore := failGlobalWrites(t, c, "th")
+			entries := []EventEntry{
+				{TenantID: "acme", EventID: "e1", Seq: 1, EventJSON: `{"event_id":"e1"}`},
+				{TenantID: "acme", EventID: "e2", Seq: 2, EventJSON: `{"event_id":"e2"}`},
+			}
+			if _, err := c.IdempotentXAddEvents(ctx, "th", entries, 0, tt.dedupe, TurnPolicy{}); err == nil {
+				t.Fatal("expected the global write to fail")
+			}
+			restore()
+
+			// Entries younger than age are left to the gateway.
+			res, err := c.ReconcileGlobal(ctx, stream, time.Hour, 100)
+			if err != nil || res.Appended != 0 {
+				t.Fatalf("early ReconcileGlobal = %+v, %v", res, err)
+			}
+
+			res, err = c.ReconcileGlobal(ctx, stream, 0, 100)
+			if err != nil || res != (ReconcileResult{Appended: 2}) {
+				t.Fatalf("ReconcileGlobal = %+v, %v", res, err)
+			}
+			msgs, err := c.XRange(ctx, stream, "-", "+", 10)
+			if err != nil || len(msgs) != 2 {
+				t.Fatalf("global stream = %v, %v", msgs, err)
+			}
+			if err := c.ResolveRefs(ctx, msgs); err != nil {
+				t.Fatal(err)
+			}
+			for i, m := range msgs {
+				if m.Values["event"] != entries[i].EventJSON || m.Values["tenant_id"] != "acme" || m.Values["thread_id"] != "th" {
+					t.Fatalf("entry %d = %v", i, m.Values)
+				}
+			}
+			if n, _ := c.rdb.HLen(ctx, GlobalPendingKey("th")).Result(); n != 0 {
+				t.Fatalf("%d pending entries left", n)
+			}
+			if n, _ := c.rdb.ZCard(ctx, index).Result(); n != 0 {
+				t.Fatalf("pending index has %d threads", n)
+			}
+			if tt.dedupe.TTL > 0 {
+				// Confirmed entries are plain duplicates again.
+				res, err := c.IdempotentXAddEvents(ctx, "th", entries[:1], 0, tt.dedupe, TurnPolicy{})
+				if err != nil || !res[0].Duplicated {
+					t.Fatalf("retry = %+v, %v", res, err)
+				}
+				if n, _ := c.XLen(ctx, stream); n != 2 {
+					t.Fatalf("retry wrote the global entry again: %d entries", n)
+				}
+			}
+		})
+	}
+}
+
+func TestReconcileGlobalConfirmedWrites(t *testing.T) {
+	c, _ := newTestClient(t)
+	c.cluster = true
+	ctx := context.Background()
+	stream := c.GlobalStreamFor("th")
+
+	entries := []EventEntry{{TenantID: "acme", EventID: "e1", Seq: 1, EventJSON: "{}"}}
+	if _, err := c.IdempotentXAddEvents(ctx, "th", entries, 0, DedupePolicy{}, TurnPolicy{}); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := c.rdb.HLen(ctx, GlobalPendingKey("th")).Result(); n != 0 {
+		t.Fatalf("%d pending entries after a confirmed write", n)
+	}
+	res, err := c.ReconcileGlobal(ctx, stream, 0, 100)
+	if err != nil || res != (ReconcileResult{}) {
+		t.Fatalf("ReconcileGlobal = %+v, %v", res, err)
+	}
+	if n, _ := c.XLen(ctx, stream); n != 1 {
+		t.Fatalf("global stream has %d entries, want 1", n)
+	}
+	if n, _ := c.rdb.ZCard(ctx, GlobalPendingIndexKey(stream)).Result(); n != 0 {
+		t.Fatalf("pending index has %d threads", n)
+	}
+}
+
+func TestReconcileGlobalMissingEntry(t *testing.T) {
+	c, _ := newTestClient(t)
+	c.cluster = true
+	ctx := context.Background()
+	stream := c.GlobalStreamFor("th")
+
+	restore := failGlobalWrites(t, c, "th")
+	entries := []EventEntry{{TenantID: "acme", EventID: "e1", Seq: 1, EventJSON: "{}"}}
+	if _, err := c.IdempotentXAddEvents(ctx, "th", entries, 0, DedupePolicy{}, TurnPolicy{}); err == nil {
+		t.Fatal("expected the global write to fail")
+	}
+	restore()
+	if _, err := c.Del(ctx, StreamKey("th")); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := c.ReconcileGlobal(ctx, stream, 0, 100)
+	if err != nil || res != (ReconcileResult{Missing: 1}) {
+		t.Fatalf("ReconcileGlobal = %+v, %v", res, err)
+	}
+	if n, _ := c.XLen(ctx, stream); n != 0 {
+		t.Fatalf("global stream has %d entries", n)
+	}
+}
@@ -0,0 +1,18 @@
+package redisstreams
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/warjiang/eventide/internal/config"
+)
+
+// newTestClient returns a client backed by an in-process Redis that is torn
+// down with the test.
+func newTestClient(t *testing.T) (*Client, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	c := New(config.RedisConfig{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = c.Close() })
+	return c, mr
+}
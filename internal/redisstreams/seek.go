@@ -0,0 +1,78 @@
+package redisstreams
+
+import (
+	"context"
+	"fmt"
+)
+
+// seekMargin is how many entries SeekStreamSeq starts before the entry it
+// finds. Concurrent appends can land in the stream slightly out of seq order,
+// so an entry with a higher seq may precede one with a lower seq.
+const seekMargin = 100
+
+// SeekStreamSeq returns an XREAD cursor into the thread stream after which
+// every entry with a seq greater than seq is found, so that a resuming reader
+// does not rescan the stream from the start. It returns "0" when the stream
+// is empty or starts above seq. Readers still skip entries with seq <= seq,
+// since about seekMargin of them follow the cursor.
+func (c *Client) SeekStreamSeq(ctx context.Context, threadID string, seq int64) (string, error) {
+	res, err := c.seekSeqLua.Run(ctx, c.rdb, []string{StreamKey(threadID)}, seq, seekMargin).Result()
+	if err != nil {
+		return "", err
+	}
+	id, ok := res.(string)
+	if !ok {
+		return "", fmt.Errorf("unexpected lua result")
+	}
+	return id, nil
+}
+
+// seekSeqScript binary searches the millisecond part of entry IDs for the
+// first entry at or after which seqs exceed the target, then steps back
+// seekMargin entries.
+const seekSeqScript = `
+local stream = KEYS[1]
+local target = tonumber(ARGV[1])
+local margin = tonumber(ARGV[2])
+
+local function seqOf(entry)
+  local fields = entry[2]
+  for i = 1, #fields, 2 do
+    if fields[i] == 'seq' then
+      return tonumber(fields[i + 1]) or 0
+    end
+  end
+  return 0
+end
+
+local function msOf(id)
+  return tonumber(string.match(id, '^(%d+)'))
+end
+
+local first = redis.call('XRANGE', stream, '-', '+', 'COUNT', 1)[1]
+if not first or seqOf(first) > target then
+  return '0'
+end
+local last = redis.call('XREVRANGE', stream, '+', '-', 'COUNT', 1)[1]
+
+-- Entries from lo onwards start with a seq <= target; entries from hi
+-- onwards, if any, start with a seq > target.
+local lo = msOf(first[1])
+local hi = msOf(last[1]) + 1
+while hi - lo > 1 do
+  local mid = math.floor((lo + hi) / 2)
+  local entry = redis.call('XRANGE', stream, mid, '+', 'COUNT', 1)[1]
+  if seqOf(entry) <= target then
+    lo = mid
+  else
+    hi = mid
+  end
+end
+
+local pivot = redis.call('XRANGE', stream, lo, '+', 'COUNT', 1)[1]
+local before = redis.call('XREVRANGE', stream, pivot[1], '-', 'COUNT', margin + 1)
+if #before <= margin then
+  return '0'
+end
+return before[#before][1]
+`
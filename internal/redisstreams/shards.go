@@ -0,0 +1,66 @@
+package redisstreams
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+// GlobalShardKey is the key of one shard of the global stream. The braces
+// make the shard number the Redis Cluster hash tag, so shards spread across
+// slots.
+func GlobalShardKey(shard int) string {
+	return fmt.Sprintf("stream:global:events:{%d}", shard)
+}
+
+// GlobalShard maps threadID to one of shards global stream shards. All
+// events of a thread land on the same shard, which keeps them in order.
+func GlobalShard(threadID string, shards int) int {
+	if shards <= 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(threadID))
+	return int(h.Sum32() % uint32(shards))
+}
+
+// SetGlobalShards sets how many shards the global stream is split into.
+// With one shard or fewer the unsharded GlobalStreamKey is used. Every
+// service that reads or writes the global stream must agree on the count;
+// call it once, before the client is used.
+func (c *Client) SetGlobalShards(n int) {
+	c.globalShards = n
+}
+
+func (c *Client) GlobalShards() int {
+	if c.globalShards <= 1 {
+		return 1
+	}
+	return c.globalShards
+}
+
+// Sharded reports whether the global stream is split into shards.
+func (c *Client) Sharded() bool {
+	return c.globalShards > 1
+}
+
+// GlobalStreamFor returns the global stream key that events of threadID are
+// appended to.
+func (c *Client) GlobalStreamFor(threadID string) string {
+	if !c.Sharded() {
+		return GlobalStreamKey()
+	}
+	return GlobalShardKey(GlobalShard(threadID, c.globalShards))
+}
+
+// GlobalStreams returns the keys of every global stream shard, in shard
+// order.
+func (c *Client) GlobalStreams() []string {
+	if !c.Sharded() {
+		return []string{GlobalStreamKey()}
+	}
+	out := make([]string, c.globalShards)
+	for i := range out {
+		out[i] = GlobalShardKey(i)
+	}
+	return out
+}
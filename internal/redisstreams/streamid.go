@@ -0,0 +1,62 @@
+package redisstreams
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseStreamID splits a stream entry ID ("<ms>-<seq>") into its parts.
+func ParseStreamID(id string) (ms int64, seq int64, ok bool) {
+	msPart, seqPart, found := strings.Cut(id, "-")
+	ms, err := strconv.ParseInt(msPart, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	if !found {
+		return ms, 0, true
+	}
+	seq, err = strconv.ParseInt(seqPart, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return ms, seq, true
+}
+
+// StreamIDTime returns the time at which Redis assigned an auto-generated
+// stream ID.
+func StreamIDTime(id string) (time.Time, bool) {
+	ms, _, ok := ParseStreamID(id)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(ms).UTC(), true
+}
+
+// CompareStreamIDs orders two stream IDs like Redis does. Unparseable IDs
+// sort first.
+func CompareStreamIDs(a, b string) int {
+	ams, aseq, aok := ParseStreamID(a)
+	bms, bseq, bok := ParseStreamID(b)
+	switch {
+	case !aok || !bok:
+		if aok == bok {
+			return 0
+		}
+		if !aok {
+			return -1
+		}
+		return 1
+	case ams != bms:
+		if ams < bms {
+			return -1
+		}
+		return 1
+	case aseq != bseq:
+		if aseq < bseq {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
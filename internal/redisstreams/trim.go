@@ -0,0 +1,115 @@
+package redisstreams
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// TrimFloor returns the lowest entry ID of stream that some consumer group
+// still needs: the oldest pending entry of a group, or the entry after the
+// last one it was delivered. Everything below the floor has been
+// acknowledged by every group. ok is false when the stream has no groups, in
+// which case nothing is known to be safe to trim.
+func (c *Client) TrimFloor(ctx context.Context, stream string) (floor string, ok bool, err error) {
+	groups, err := c.XInfoGroups(ctx, stream)
+	if err != nil || len(groups) == 0 {
+		return "", false, err
+	}
+	for _, g := range groups {
+		candidate := nextStreamID(g.LastDeliveredID)
+		if g.Pending > 0 {
+			pending, err := c.XPendingExt(ctx, stream, g.Name, "-", "+", 1)
+			if err != nil {
+				return "", false, err
+			}
+			if len(pending) > 0 && CompareStreamIDs(pending[0].ID, candidate) < 0 {
+				candidate = pending[0].ID
+			}
+		}
+		if floor == "" || CompareStreamIDs(candidate, floor) < 0 {
+			floor = candidate
+		}
+	}
+	return floor, true, nil
+}
+
+// TrimAcknowledged removes entries of stream that every consumer group has
+// acknowledged and that are older than margin, and returns how many were
+// removed. Trimming is approximate: Redis only drops whole internal nodes, so
+// a few acknowledged entries may remain until the next call.
+func (c *Client) TrimAcknowledged(ctx context.Context, stream string, margin time.Duration) (int64, error) {
+	floor, ok, err := c.TrimFloor(ctx, stream)
+	if err != nil || !ok {
+		return 0, err
+	}
+	if margin > 0 {
+		cutoff := strconv.FormatInt(time.Now().Add(-margin).UnixMilli(), 10) + "-0"
+		if CompareStreamIDs(cutoff, floor) < 0 {
+			floor = cutoff
+		}
+	}
+	return c.rdb.XTrimMinIDApprox(ctx, stream, floor, 0).Result()
+}
+
+// RefTrimMargin is how much older than the oldest global entry some consumer
+// group still needs a compact thread stream entry must be before
+// IdempotentXAddEvents trims it. The pointer to a thread entry is written in
+// the same script as the entry, or in cluster mode up to a reconcile cycle
+// later; the margin covers that delay.
+const RefTrimMargin = 5 * time.Minute
+
+// refFloorTTL is how long a global stream's trim floor is reused before it is
+// read again. A stale floor is lower than the current one, so it only keeps
+// more entries.
+const refFloorTTL = 5 * time.Second
+
+type refFloor struct {
+	id string
+	at time.Time
+}
+
+// refTrimFloor returns the thread stream ID below which compact entries of
+// threadID are no longer referenced by global entries that a consumer group
+// still needs. It is "" when the global stream has no consumer groups, and
+// "0-0", which trims nothing, when the floor could not be read.
+func (c *Client) refTrimFloor(ctx context.Context, threadID string) string {
+	stream := c.GlobalStreamFor(threadID)
+	now := time.Now()
+	c.refFloorsMu.Lock()
+	f, ok := c.refFloors[stream]
+	c.refFloorsMu.Unlock()
+	if ok && now.Sub(f.at) < refFloorTTL {
+		return f.id
+	}
+
+	floor, ok, err := c.TrimFloor(ctx, stream)
+	if err != nil {
+		return "0-0"
+	}
+	f = refFloor{at: now}
+	if ok {
+		ms, _, _ := ParseStreamID(floor)
+		ms -= c.refTrimMargin.Milliseconds()
+		if ms < 0 {
+			ms = 0
+		}
+		f.id = strconv.FormatInt(ms, 10) + "-0"
+	}
+	c.refFloorsMu.Lock()
+	if c.refFloors == nil {
+		c.refFloors = make(map[string]refFloor)
+	}
+	c.refFloors[stream] = f
+	c.refFloorsMu.Unlock()
+	return f.id
+}
+
+// nextStreamID returns the smallest ID greater than id.
+func nextStreamID(id string) string {
+	ms, seq, ok := ParseStreamID(id)
+	if !ok {
+		return "0-0"
+	}
+	return strconv.FormatInt(ms, 10) + "-" + strconv.FormatInt(seq+1, 10)
+}
@@ -0,0 +1,77 @@
+package redisstreams
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCompactTrimKeepsReferencedEntries(t *testing.T) {
+	c, _ := newTestClient(t)
+	c.SetEntryFormat(EntryCompact)
+	c.refTrimMargin = 0
+	ctx := context.Background()
+	stream := c.GlobalStreamFor("th")
+	if err := c.EnsureConsumerGroupOnStream(ctx, stream, "persist"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The trim floor is rounded down to a millisecond, so entries only get
+	// below it when they are written in different milliseconds.
+	write := func(from, to int) {
+		t.Helper()
+		for i := from; i <= to; i++ {
+			time.Sleep(2 * time.Millisecond)
+			e := []EventEntry{{TenantID: "acme", EventID: fmt.Sprintf("e%d", i), Seq: int64(i), EventJSON: fmt.Sprintf(`{"seq":%d}`, i)}}
+			if _, err := c.IdempotentXAddEvents(ctx, "th", e, 2, DedupePolicy{}, TurnPolicy{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// The persister has not read anything yet, so every entry is still
+	// referenced and the thread stream grows past its MAXLEN of 2.
+	write(1, 5)
+	if n, _ := c.XLen(ctx, StreamKey("th")); n != 5 {
+		t.Fatalf("thread stream has %d entries, want 5", n)
+	}
+	msgs, err := c.XReadGroup(ctx, "persist", "c1", stream, ">", 0, 100)
+	if err != nil || len(msgs) != 5 {
+		t.Fatalf("XReadGroup = %d, %v", len(msgs), err)
+	}
+	if err := c.ResolveRefs(ctx, msgs); err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range msgs {
+		if m.Values["event"] != fmt.Sprintf(`{"seq":%d}`, i+1) {
+			t.Fatalf("entry %d not resolved: %v", i, m.Values)
+		}
+	}
+
+	// Once acknowledged, the entries are trimmed down to MAXLEN again.
+	ids := make([]string, len(msgs))
+	for i, m := range msgs {
+		ids[i] = m.ID
+	}
+	if _, err := c.XAck(ctx, stream, "persist", ids...); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	c.refFloors = nil
+	write(6, 6)
+	if n, _ := c.XLen(ctx, StreamKey("th")); n > 3 {
+		t.Fatalf("thread stream has %d entries after the persister caught up", n)
+	}
+	msgs, err = c.XReadGroup(ctx, "persist", "c1", stream, ">", 0, 100)
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("XReadGroup = %d, %v", len(msgs), err)
+	}
+	if err := c.ResolveRefs(ctx, msgs); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecodeEntry(msgs[0].Values); errors.Is(err, ErrEntryMissing) {
+		t.Fatal("newest entry was trimmed")
+	}
+}
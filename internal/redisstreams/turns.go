@@ -0,0 +1,67 @@
+package redisstreams
+
+import (
+	"fmt"
+	"time"
+)
+
+// TurnPolicy controls how IdempotentXAddEvents applies the turn transitions
+// of the entries it writes, in the same script as the writes: turn state
+// never moves for an event that was not written. The zero TurnPolicy leaves
+// turn state alone.
+type TurnPolicy struct {
+	// Enabled applies the legal transitions of written entries; illegal
+	// ones are skipped.
+	Enabled bool
+	// Strict refuses the whole call, writing nothing, when a transition is
+	// illegal. It implies Enabled.
+	Strict bool
+	// TTL is how long a thread's turn state lives after its last change.
+	TTL time.Duration
+}
+
+func (p TurnPolicy) mode() string {
+	switch {
+	case p.Strict:
+		return "strict"
+	case p.Enabled:
+		return "lenient"
+	default:
+		return ""
+	}
+}
+
+// TurnViolationError is returned by IdempotentXAddEvents when a strict
+// TurnPolicy refused the call. Index is the position of the offending entry.
+type TurnViolationError struct {
+	Index     int
+	Violation string
+}
+
+func (e *TurnViolationError) Error() string {
+	return fmt.Sprintf("entries[%d]: %s", e.Index, e.Violation)
+}
+
+// turnStepLua defines turnStep(cur, kind) for the scripts that run the turn
+// state machine (started -> running -> completed/failed/cancelled). It
+// returns the next state and an empty violation, or nil and the violation.
+const turnStepLua = `
+local function turnStep(cur, kind)
+  local open = cur == 'started' or cur == 'running'
+  local ended = cur == 'completed' or cur == 'failed' or cur == 'cancelled'
+  if kind == 'start' then
+    if cur == '' then
+      return 'started', ''
+    end
+    return nil, 'turn_already_started'
+  elseif open then
+    if kind == 'event' then
+      return 'running', ''
+    end
+    return kind, ''
+  elseif ended then
+    return nil, 'turn_already_ended'
+  end
+  return nil, 'turn_not_started'
+end
+`
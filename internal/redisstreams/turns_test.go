@@ -0,0 +1,93 @@
+package redisstreams
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func turnEntry(eventID string, seq int64, kind string) EventEntry {
+	return EventEntry{TenantID: "acme", EventID: eventID, Seq: seq, TurnID: "tu", EventJSON: "{}", TurnKind: kind}
+}
+
+func TestXAddAppliesTurnTransitions(t *testing.T) {
+	c, mr := newTestClient(t)
+	ctx := context.Background()
+	strict := TurnPolicy{Enabled: true, Strict: true, TTL: time.Hour}
+
+	// A check does not move the turn, so checking twice stays legal.
+	for i := 0; i < 2; i++ {
+		v, err := c.CheckTurnTransitions(ctx, "th", []TurnTransition{{EventID: "e1", TurnID: "tu", Kind: TurnKindStart}})
+		if err != nil || v[0] != "" {
+			t.Fatalf("check %d: %q %v", i, v, err)
+		}
+	}
+	if mr.Exists(TurnsKey("th")) {
+		t.Fatal("check changed turn state")
+	}
+
+	if _, err := c.IdempotentXAddEvents(ctx, "th", []EventEntry{turnEntry("e1", 1, TurnKindStart)}, 0, DedupePolicy{}, strict); err != nil {
+		t.Fatal(err)
+	}
+	if got := mr.HGet(TurnsKey("th"), "tu"); got != "started" {
+		t.Fatalf("turn state %q, want started", got)
+	}
+
+	// A strict batch with an illegal transition writes nothing, including
+	// the legal entries before it.
+	_, err := c.IdempotentXAddEvents(ctx, "th", []EventEntry{
+		turnEntry("e2", 2, TurnKindEvent),
+		turnEntry("e3", 3, TurnKindCompleted),
+		turnEntry("e4", 4, TurnKindStart),
+	}, 0, DedupePolicy{}, strict)
+	var tv *TurnViolationError
+	if !errors.As(err, &tv) || tv.Index != 2 || tv.Violation != TurnViolationAlreadyStarted {
+		t.Fatalf("expected violation at 2, got %v", err)
+	}
+	if n, _ := c.XLen(ctx, StreamKey("th")); n != 1 {
+		t.Fatalf("stream has %d entries, want 1", n)
+	}
+	if got := mr.HGet(TurnsKey("th"), "tu"); got != "started" {
+		t.Fatalf("turn state %q after refused batch, want started", got)
+	}
+
+	// Without dedupe, the retry of a completion whose write was refused
+	// still passes.
+	if _, err := c.IdempotentXAddEvents(ctx, "th", []EventEntry{turnEntry("e3", 3, TurnKindCompleted)}, 0, DedupePolicy{}, strict); err != nil {
+		t.Fatal(err)
+	}
+	if got := mr.HGet(TurnsKey("th"), "tu"); got != "completed" {
+		t.Fatalf("turn state %q, want completed", got)
+	}
+
+	// Lenient writes skip the illegal transition but keep the event.
+	if _, err := c.IdempotentXAddEvents(ctx, "th", []EventEntry{turnEntry("e5", 5, TurnKindEvent)}, 0, DedupePolicy{}, TurnPolicy{Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := c.XLen(ctx, StreamKey("th")); n != 3 {
+		t.Fatalf("stream has %d entries, want 3", n)
+	}
+	if got := mr.HGet(TurnsKey("th"), "tu"); got != "completed" {
+		t.Fatalf("turn state %q, want completed", got)
+	}
+}
+
+func TestXAddTurnRetryWithDedupe(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx := context.Background()
+	strict := TurnPolicy{Enabled: true, Strict: true, TTL: time.Hour}
+	dedupe := DedupePolicy{TTL: time.Hour}
+
+	start := []EventEntry{turnEntry("e1", 1, TurnKindStart)}
+	if _, err := c.IdempotentXAddEvents(ctx, "th", start, 0, dedupe, strict); err != nil {
+		t.Fatal(err)
+	}
+	res, err := c.IdempotentXAddEvents(ctx, "th", start, 0, dedupe, strict)
+	if err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if !res[0].Duplicated {
+		t.Fatal("retry not reported as duplicated")
+	}
+}
@@ -8,12 +8,14 @@ import (
 	"io"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/warjiang/eventide/internal/metrics"
 )
 
 type Config struct {
@@ -71,6 +73,12 @@ func (c *Client) Key(path string) string {
 	return c.prefix + "/" + path
 }
 
+// PayloadPath is where the gateway stores an offloaded event payload, relative
+// to the prefix.
+func PayloadPath(threadID, eventID string) string {
+	return "threads/" + threadID + "/payloads/" + eventID + ".json"
+}
+
 func (c *Client) PutObject(ctx context.Context, key string, body []byte, contentType string, contentEncoding string) error {
 	if strings.TrimSpace(key) == "" {
 		return errors.New("key is required")
@@ -86,7 +94,9 @@ func (c *Client) PutObject(ctx context.Context, key string, body []byte, content
 	if strings.TrimSpace(contentEncoding) != "" {
 		input.ContentEncoding = aws.String(contentEncoding)
 	}
+	start := time.Now()
 	_, err := c.s3.PutObject(ctx, input)
+	metrics.ObserveS3("put_object", start, err)
 	return err
 }
 
@@ -94,11 +104,15 @@ func (c *Client) EnsureBucket(ctx context.Context) error {
 	if strings.TrimSpace(c.bucket) == "" {
 		return errors.New("bucket is required")
 	}
+	start := time.Now()
 	_, err := c.s3.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(c.bucket)})
+	metrics.ObserveS3("head_bucket", start, err)
 	if err == nil {
 		return nil
 	}
+	start = time.Now()
 	_, err = c.s3.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String(c.bucket)})
+	metrics.ObserveS3("create_bucket", start, err)
 	if err == nil {
 		return nil
 	}
@@ -113,7 +127,9 @@ func (c *Client) GetObject(ctx context.Context, key string) (io.ReadCloser, stri
 	if strings.TrimSpace(key) == "" {
 		return nil, "", "", errors.New("key is required")
 	}
+	start := time.Now()
 	out, err := c.s3.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(c.bucket), Key: aws.String(key)})
+	metrics.ObserveS3("get_object", start, err)
 	if err != nil {
 		return nil, "", "", err
 	}
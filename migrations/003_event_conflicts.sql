@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS event_conflicts (
+  conflict_id BIGSERIAL PRIMARY KEY,
+  thread_id TEXT NOT NULL,
+  seq BIGINT NOT NULL,
+  reason TEXT NOT NULL,
+  existing_event_id TEXT,
+  event_id TEXT NOT NULL,
+  event JSONB NOT NULL,
+  detected_at TIMESTAMPTZ NOT NULL,
+  UNIQUE (event_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_event_conflicts_thread_seq ON event_conflicts(thread_id, seq);
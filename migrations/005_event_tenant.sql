@@ -0,0 +1 @@
+ALTER TABLE agent_events ADD COLUMN IF NOT EXISTS tenant_id TEXT;
@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS idx_agent_events_trace_id ON agent_events ((trace->>'trace_id')) WHERE trace IS NOT NULL;
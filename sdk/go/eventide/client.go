@@ -4,9 +4,11 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -23,13 +25,20 @@ type AppendResult struct {
 type Client struct {
 	baseURL string
 	hc      *http.Client
+
+	rateLimitRetries int
+	maxRetryAfter    time.Duration
+	injectTrace      TraceInjector
 }
 
 // NewClient creates a new Eventide gateway client.
 func NewClient(baseURL string) *Client {
 	return &Client{
-		baseURL: strings.TrimRight(baseURL, "/"),
-		hc:      &http.Client{Timeout: 10 * time.Second},
+		baseURL:          strings.TrimRight(baseURL, "/"),
+		hc:               &http.Client{Timeout: 10 * time.Second},
+		rateLimitRetries: 3,
+		maxRetryAfter:    30 * time.Second,
+		injectTrace:      injectContextTrace,
 	}
 }
 
@@ -39,25 +48,136 @@ func (c *Client) WithHTTPClient(hc *http.Client) *Client {
 	return c
 }
 
+// WithTraceInjector replaces how trace headers are added to requests. By
+// default the trace context set with WithTraceContext is sent; pass the
+// injector of your tracing library (for example an OpenTelemetry propagator)
+// to forward its spans instead, or nil to send no trace headers.
+func (c *Client) WithTraceInjector(inject TraceInjector) *Client {
+	c.injectTrace = inject
+	return c
+}
+
+// WithRateLimitRetries configures how rate-limited (429) requests are retried.
+// The client waits for the Retry-After the gateway sends and retries up to
+// retries times, but gives up at once when the gateway asks it to wait longer
+// than maxWait. Use 0 retries to disable. The default is 3 retries of at most
+// 30s each.
+func (c *Client) WithRateLimitRetries(retries int, maxWait time.Duration) *Client {
+	c.rateLimitRetries = retries
+	c.maxRetryAfter = maxWait
+	return c
+}
+
+// AppendOption customizes a single Append or AppendBatch call.
+type AppendOption func(*appendOptions)
+
+type appendOptions struct {
+	expectedSeq *int64
+}
+
+// ExpectSeq makes the append conditional: the gateway only accepts it when
+// the thread's current head seq equals seq. Otherwise the call fails with a
+// *GatewayError that matches ErrSeqConflict and carries the current head.
+// Use 0 to require an empty thread. Retrying an append that was already
+// written, with the same event IDs and seq, reports the events as duplicated
+// with their original seqs instead of failing, as long as the gateway's
+// dedupe still remembers them.
+func ExpectSeq(seq int64) AppendOption {
+	return func(o *appendOptions) {
+		o.expectedSeq = &seq
+	}
+}
+
+func buildAppendOptions(opts []AppendOption) appendOptions {
+	var o appendOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
 // Append sends a single event to the gateway.
-func (c *Client) Append(ctx context.Context, e Event) (*AppendResult, error) {
+func (c *Client) Append(ctx context.Context, e Event, opts ...AppendOption) (*AppendResult, error) {
 	if e.SpecVersion == "" {
 		e.SpecVersion = SpecVersion
 	}
-	body, err := json.Marshal(map[string]any{"event": e})
+	o := buildAppendOptions(opts)
+	body := map[string]any{"event": e}
+	if o.expectedSeq != nil {
+		body["expected_seq"] = *o.expectedSeq
+	}
+	var res AppendResult
+	if err := c.post(ctx, "/events:append", body, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// AppendBatch sends an ordered batch of events for a single thread in one
+// request. Events without a seq are assigned a contiguous block by the
+// gateway. Results are returned in the same order as events; duplicated
+// events are reported with Duplicated set.
+func (c *Client) AppendBatch(ctx context.Context, events []Event, opts ...AppendOption) ([]AppendResult, error) {
+	if len(events) == 0 {
+		return nil, nil
+	}
+	batch := make([]Event, len(events))
+	for i, e := range events {
+		if e.SpecVersion == "" {
+			e.SpecVersion = SpecVersion
+		}
+		batch[i] = e
+	}
+	o := buildAppendOptions(opts)
+	body := map[string]any{"events": batch}
+	if o.expectedSeq != nil {
+		body["expected_seq"] = *o.expectedSeq
+	}
+	var res struct {
+		Results []AppendResult `json:"results"`
+	}
+	if err := c.post(ctx, "/events:appendBatch", body, &res); err != nil {
+		return nil, err
+	}
+	return res.Results, nil
+}
+
+func (c *Client) post(ctx context.Context, path string, in any, out any) error {
+	body, err := json.Marshal(in)
 	if err != nil {
-		return nil, fmt.Errorf("encode event: %w", err)
+		return fmt.Errorf("encode event: %w", err)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/events:append", bytes.NewReader(body))
+	for attempt := 0; ; attempt++ {
+		err := c.postOnce(ctx, path, body, out)
+		var ge *GatewayError
+		if !errors.As(err, &ge) || ge.Status != http.StatusTooManyRequests ||
+			ge.RetryAfter <= 0 || ge.RetryAfter > c.maxRetryAfter || attempt >= c.rateLimitRetries {
+			return err
+		}
+		t := time.NewTimer(ge.RetryAfter)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+	}
+}
+
+func (c *Client) postOnce(ctx context.Context, path string, body []byte, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, bytes.NewReader(body))
 	if err != nil {
-		return nil, fmt.Errorf("new request: %w", err)
+		return fmt.Errorf("new request: %w", err)
 	}
 	req.Header.Set("content-type", "application/json")
+	if c.injectTrace != nil {
+		c.injectTrace(ctx, req.Header)
+	}
 
 	resp, err := c.hc.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("do request: %w", err)
+		return fmt.Errorf("do request: %w", err)
 	}
 	defer func() {
 		_ = resp.Body.Close()
@@ -65,20 +185,74 @@ func (c *Client) Append(ctx context.Context, e Event) (*AppendResult, error) {
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		b, _ := io.ReadAll(io.LimitReader(resp.Body, 8192))
-		return nil, &GatewayError{Status: resp.StatusCode, Body: string(b)}
+		ge := newGatewayError(resp.StatusCode, b)
+		ge.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		return ge
 	}
 
-	var res AppendResult
-	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
-		return nil, fmt.Errorf("decode response: %w", err)
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decode response: %w", err)
 	}
-	return &res, nil
+	return nil
 }
 
+// parseRetryAfter reads a Retry-After header given either as delay seconds
+// or as an HTTP date. It returns 0 when the header is missing or invalid.
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// ErrSeqConflict is matched (via errors.Is) by a *GatewayError returned when
+// a conditional append lost the race against another writer.
+var ErrSeqConflict = errors.New("eventide: seq conflict")
+
 // GatewayError represents a non-2xx HTTP response from the gateway.
 type GatewayError struct {
 	Status int
 	Body   string
+	// SeqConflict is set when the gateway rejected a conditional append
+	// because the thread's head moved. Other 409s, such as illegal turn
+	// transitions, leave it false.
+	SeqConflict bool
+	// CurrentSeq is the thread's head seq reported with a seq conflict (409).
+	CurrentSeq int64
+	// RetryAfter is the delay requested by the gateway's Retry-After header,
+	// sent with rate limit and quota errors (429).
+	RetryAfter time.Duration
+}
+
+func newGatewayError(status int, body []byte) *GatewayError {
+	ge := &GatewayError{Status: status, Body: string(body)}
+	if status == http.StatusConflict {
+		var conflict struct {
+			Error      string `json:"error"`
+			CurrentSeq *int64 `json:"current_seq"`
+		}
+		if err := json.Unmarshal(body, &conflict); err == nil && conflict.Error == "seq conflict" && conflict.CurrentSeq != nil {
+			ge.SeqConflict = true
+			ge.CurrentSeq = *conflict.CurrentSeq
+		}
+	}
+	return ge
+}
+
+// Is reports whether the error is a seq conflict, so callers can use
+// errors.Is(err, ErrSeqConflict).
+func (e *GatewayError) Is(target error) bool {
+	return target == ErrSeqConflict && e.SeqConflict
 }
 
 func (e *GatewayError) Error() string {
@@ -0,0 +1,87 @@
+package eventide
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAppendExpectSeqConflict(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			ExpectedSeq *int64 `json:"expected_seq"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if body.ExpectedSeq == nil || *body.ExpectedSeq != 3 {
+			t.Fatalf("expected_seq not sent: %v", body.ExpectedSeq)
+		}
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write([]byte(`{"error":"seq conflict","expected_seq":3,"current_seq":7}`))
+	}))
+	defer srv.Close()
+
+	_, err := NewClient(srv.URL).Append(context.Background(), Event{ThreadID: "th", TurnID: "tu"}, ExpectSeq(3))
+	if !errors.Is(err, ErrSeqConflict) {
+		t.Fatalf("expected ErrSeqConflict, got %v", err)
+	}
+	var ge *GatewayError
+	if !errors.As(err, &ge) || ge.CurrentSeq != 7 {
+		t.Fatalf("expected current seq 7, got %+v", ge)
+	}
+}
+
+func TestTurnViolationIsNotSeqConflict(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write([]byte(`{"error":"illegal turn transition","event_id":"e1","turn_id":"tu","type":"turn.started","violation":"turn_already_started"}`))
+	}))
+	defer srv.Close()
+
+	_, err := NewClient(srv.URL).Append(context.Background(), Event{ThreadID: "th", TurnID: "tu"}, ExpectSeq(3))
+	var ge *GatewayError
+	if !errors.As(err, &ge) || ge.Status != http.StatusConflict {
+		t.Fatalf("expected 409, got %v", err)
+	}
+	if errors.Is(err, ErrSeqConflict) || ge.SeqConflict {
+		t.Fatalf("turn violation matched ErrSeqConflict: %+v", ge)
+	}
+}
+
+func TestAppendRetriesAfterRateLimit(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("content-type", "application/json")
+		if calls == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte(`{"error":"rate limit exceeded","reason":"thread_rate"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"event_id":"e1","seq":1}`))
+	}))
+	defer srv.Close()
+
+	res, err := NewClient(srv.URL).Append(context.Background(), Event{ThreadID: "th", TurnID: "tu"})
+	if err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	if calls != 2 || res.Seq != 1 {
+		t.Fatalf("expected a retry, got calls=%d res=%+v", calls, res)
+	}
+
+	calls = 0
+	_, err = NewClient(srv.URL).WithRateLimitRetries(0, 0).Append(context.Background(), Event{ThreadID: "th", TurnID: "tu"})
+	var ge *GatewayError
+	if !errors.As(err, &ge) || ge.Status != http.StatusTooManyRequests || ge.RetryAfter != time.Second {
+		t.Fatalf("expected 429 with RetryAfter, got %v", err)
+	}
+}
@@ -29,6 +29,9 @@ type Event struct {
 	Level       Level           `json:"level"`
 	Payload     json.RawMessage `json:"payload"`
 
+	// TenantID is set by the gateway from the authenticated caller; values
+	// supplied by producers are overwritten.
+	TenantID    string            `json:"tenant_id,omitempty"`
 	ContentType string            `json:"content_type,omitempty"`
 	Source      map[string]any    `json:"source,omitempty"`
 	Trace       map[string]any    `json:"trace,omitempty"`
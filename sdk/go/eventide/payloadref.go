@@ -0,0 +1,57 @@
+package eventide
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// PayloadRef is the envelope that replaces a payload the gateway offloaded to
+// object storage because it exceeded the configured size threshold. Readers
+// can ask beacon to resolve it (inline=1) or fetch the object themselves.
+type PayloadRef struct {
+	Ref         bool   `json:"__ref__"`
+	ObjectKey   string `json:"object_key"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// NewPayloadRef builds the reference envelope for payload stored at objectKey.
+func NewPayloadRef(objectKey string, payload []byte, contentType string) PayloadRef {
+	sum := sha256.Sum256(payload)
+	return PayloadRef{
+		Ref:         true,
+		ObjectKey:   objectKey,
+		Size:        int64(len(payload)),
+		SHA256:      hex.EncodeToString(sum[:]),
+		ContentType: contentType,
+	}
+}
+
+// ParsePayloadRef reports whether payload is a reference envelope and, if so,
+// returns it.
+func ParsePayloadRef(payload json.RawMessage) (PayloadRef, bool) {
+	if !bytes.Contains(payload, []byte(`"__ref__"`)) {
+		return PayloadRef{}, false
+	}
+	var ref PayloadRef
+	if err := json.Unmarshal(payload, &ref); err != nil || !ref.Ref || ref.ObjectKey == "" {
+		return PayloadRef{}, false
+	}
+	return ref, true
+}
+
+// Verify checks that b is the payload the reference was built from.
+func (r PayloadRef) Verify(b []byte) error {
+	if int64(len(b)) != r.Size {
+		return fmt.Errorf("payload ref %s: size %d, want %d", r.ObjectKey, len(b), r.Size)
+	}
+	sum := sha256.Sum256(b)
+	if hex.EncodeToString(sum[:]) != r.SHA256 {
+		return fmt.Errorf("payload ref %s: sha256 mismatch", r.ObjectKey)
+	}
+	return nil
+}
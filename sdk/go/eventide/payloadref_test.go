@@ -0,0 +1,30 @@
+package eventide
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestPayloadRefRoundTrip(t *testing.T) {
+	payload := []byte(`{"result":"a very large tool result"}`)
+	b, err := json.Marshal(NewPayloadRef("threads/th/payloads/ev.json", payload, "application/json"))
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	ref, ok := ParsePayloadRef(b)
+	if !ok {
+		t.Fatalf("expected a ref, got %s", b)
+	}
+	if err := ref.Verify(payload); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if err := ref.Verify([]byte(`{"result":"tampered tool result!!!!"}`)); err == nil {
+		t.Fatalf("expected tampered payload to fail verification")
+	}
+	if _, ok := ParsePayloadRef([]byte(`{"__ref__":false,"object_key":"x"}`)); ok {
+		t.Fatalf("__ref__ false must not be a ref")
+	}
+	if _, ok := ParsePayloadRef([]byte(`{"delta":"hi"}`)); ok {
+		t.Fatalf("plain payload must not be a ref")
+	}
+}
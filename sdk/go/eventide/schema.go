@@ -0,0 +1,259 @@
+package eventide
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// builtinSchemas holds the payload schemas for the event types defined in
+// types.go. They only pin down the fields consumers rely on; extra fields are
+// always allowed.
+var builtinSchemas = map[string]string{
+	TypeTurnStarted:   `{"type":"object","properties":{"input":{}}}`,
+	TypeTurnCompleted: `{"type":"object"}`,
+	TypeTurnFailed:    `{"type":"object","required":["error"],"properties":{"error":{"type":["string","object"]}}}`,
+	TypeTurnCancelled: `{"type":"object","properties":{"reason":{"type":"string"}}}`,
+
+	TypeMessageDelta:     `{"type":"object","required":["message_id","delta"],"properties":{"message_id":{"type":"string","minLength":1},"delta":{"type":"string"}}}`,
+	TypeMessageCompleted: `{"type":"object","required":["message_id"],"properties":{"message_id":{"type":"string","minLength":1}}}`,
+
+	TypeToolCallStarted:   `{"type":"object","required":["tool"],"properties":{"tool":{"type":"string","minLength":1},"tool_call_id":{"type":"string"},"arguments":{}}}`,
+	TypeToolCallArgsDelta: `{"type":"object","required":["delta"],"properties":{"tool":{"type":"string"},"tool_call_id":{"type":"string"},"delta":{"type":"string"}}}`,
+	TypeToolCallCompleted: `{"type":"object","required":["tool"],"properties":{"tool":{"type":"string","minLength":1},"tool_call_id":{"type":"string"},"result":{}}}`,
+	TypeToolCallError:     `{"type":"object","required":["tool","error"],"properties":{"tool":{"type":"string","minLength":1},"tool_call_id":{"type":"string"},"error":{"type":["string","object"]}}}`,
+
+	TypeStateSnapshot: `{"type":"object"}`,
+	TypeStateDelta:    `{"type":["array","object"]}`,
+
+	TypeCustom:          `{}`,
+	TypeCustomComponent: `{"type":"object","required":["__jr__","component"],"properties":{"__jr__":{"enum":[true]},"component":{"type":"string","minLength":1},"props":{"type":"object"}}}`,
+
+	TypeThreadReady: `{"type":"object"}`,
+}
+
+// SchemaIssue describes one way a payload does not match its schema. Path is
+// a JSON Pointer into the payload ("" for the payload itself).
+type SchemaIssue struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// PayloadValidationError is returned by SchemaRegistry.Validate when an
+// event's payload does not match the schema registered for its type.
+type PayloadValidationError struct {
+	Type   string
+	Issues []SchemaIssue
+}
+
+func (e *PayloadValidationError) Error() string {
+	parts := make([]string, 0, len(e.Issues))
+	for _, is := range e.Issues {
+		p := is.Path
+		if p == "" {
+			p = "/"
+		}
+		parts = append(parts, p+": "+is.Message)
+	}
+	return fmt.Sprintf("payload of %s does not match schema: %s", e.Type, strings.Join(parts, "; "))
+}
+
+// SchemaRegistry maps event types to payload JSON Schemas. It understands
+// the subset of JSON Schema needed for event payloads: type, properties,
+// required, items, enum, minLength and additionalProperties. Other keywords
+// are ignored. Types without a registered schema are not validated.
+type SchemaRegistry struct {
+	mu      sync.RWMutex
+	schemas map[string]*jsonSchema
+}
+
+// NewSchemaRegistry returns a registry preloaded with the built-in schemas.
+func NewSchemaRegistry() *SchemaRegistry {
+	r := &SchemaRegistry{schemas: make(map[string]*jsonSchema, len(builtinSchemas))}
+	for t, raw := range builtinSchemas {
+		if err := r.Register(t, []byte(raw)); err != nil {
+			panic(fmt.Sprintf("eventide: builtin schema %s: %v", t, err))
+		}
+	}
+	return r
+}
+
+// DefaultSchemas is the registry used by RegisterSchema and ValidatePayload.
+var DefaultSchemas = NewSchemaRegistry()
+
+// RegisterSchema registers schema for eventType on DefaultSchemas.
+func RegisterSchema(eventType string, schema []byte) error {
+	return DefaultSchemas.Register(eventType, schema)
+}
+
+// ValidatePayload validates e's payload against DefaultSchemas.
+func ValidatePayload(e Event) error {
+	return DefaultSchemas.Validate(e)
+}
+
+// Register adds or replaces the schema for eventType.
+func (r *SchemaRegistry) Register(eventType string, schema []byte) error {
+	if strings.TrimSpace(eventType) == "" {
+		return errors.New("event type is required")
+	}
+	var s jsonSchema
+	if err := json.Unmarshal(schema, &s); err != nil {
+		return fmt.Errorf("parse schema: %w", err)
+	}
+	r.mu.Lock()
+	r.schemas[eventType] = &s
+	r.mu.Unlock()
+	return nil
+}
+
+// Has reports whether a schema is registered for eventType.
+func (r *SchemaRegistry) Has(eventType string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.schemas[eventType]
+	return ok
+}
+
+// Validate checks e.Payload against the schema registered for e.Type and
+// returns a *PayloadValidationError listing every mismatch.
+func (r *SchemaRegistry) Validate(e Event) error {
+	r.mu.RLock()
+	s, ok := r.schemas[e.Type]
+	r.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+	var v any
+	if err := json.Unmarshal(e.Payload, &v); err != nil {
+		return &PayloadValidationError{Type: e.Type, Issues: []SchemaIssue{{Path: "", Message: "invalid JSON: " + err.Error()}}}
+	}
+	var issues []SchemaIssue
+	s.validate(v, "", &issues)
+	if len(issues) > 0 {
+		return &PayloadValidationError{Type: e.Type, Issues: issues}
+	}
+	return nil
+}
+
+type jsonSchema struct {
+	Type                 schemaTypes            `json:"type,omitempty"`
+	Properties           map[string]*jsonSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	Items                *jsonSchema            `json:"items,omitempty"`
+	Enum                 []any                  `json:"enum,omitempty"`
+	MinLength            *int                   `json:"minLength,omitempty"`
+	AdditionalProperties *bool                  `json:"additionalProperties,omitempty"`
+}
+
+// schemaTypes accepts both "type": "string" and "type": ["string", "null"].
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*t = schemaTypes{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return errors.New("type must be a string or an array of strings")
+	}
+	*t = many
+	return nil
+}
+
+func (s *jsonSchema) validate(v any, path string, issues *[]SchemaIssue) {
+	if len(s.Type) > 0 && !s.matchesType(v) {
+		*issues = append(*issues, SchemaIssue{Path: path, Message: fmt.Sprintf("expected %s, got %s", strings.Join(s.Type, " or "), jsonTypeOf(v))})
+		return
+	}
+	if len(s.Enum) > 0 {
+		found := false
+		for _, want := range s.Enum {
+			if reflect.DeepEqual(want, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			*issues = append(*issues, SchemaIssue{Path: path, Message: "value is not one of the allowed values"})
+		}
+	}
+	switch t := v.(type) {
+	case string:
+		if s.MinLength != nil && len([]rune(t)) < *s.MinLength {
+			*issues = append(*issues, SchemaIssue{Path: path, Message: fmt.Sprintf("must be at least %d characters", *s.MinLength)})
+		}
+	case []any:
+		if s.Items != nil {
+			for i, item := range t {
+				s.Items.validate(item, fmt.Sprintf("%s/%d", path, i), issues)
+			}
+		}
+	case map[string]any:
+		for _, name := range s.Required {
+			if _, ok := t[name]; !ok {
+				*issues = append(*issues, SchemaIssue{Path: path + "/" + escapePointer(name), Message: "is required"})
+			}
+		}
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			prop, ok := s.Properties[k]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					*issues = append(*issues, SchemaIssue{Path: path + "/" + escapePointer(k), Message: "is not allowed"})
+				}
+				continue
+			}
+			prop.validate(t[k], path+"/"+escapePointer(k), issues)
+		}
+	}
+}
+
+func (s *jsonSchema) matchesType(v any) bool {
+	actual := jsonTypeOf(v)
+	for _, want := range s.Type {
+		if want == actual {
+			return true
+		}
+		if want == "number" && actual == "integer" {
+			return true
+		}
+	}
+	return false
+}
+
+func jsonTypeOf(v any) string {
+	switch t := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if t == math.Trunc(t) && !math.IsInf(t, 0) {
+			return "integer"
+		}
+		return "number"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	default:
+		return "unknown"
+	}
+}
+
+func escapePointer(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "~", "~0"), "/", "~1")
+}
@@ -0,0 +1,65 @@
+package eventide
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSchemaBuiltinsCoverAllTypes(t *testing.T) {
+	types := []string{
+		TypeTurnStarted, TypeTurnCompleted, TypeTurnFailed, TypeTurnCancelled,
+		TypeMessageDelta, TypeMessageCompleted,
+		TypeToolCallStarted, TypeToolCallArgsDelta, TypeToolCallCompleted, TypeToolCallError,
+		TypeStateSnapshot, TypeStateDelta,
+		TypeCustom, TypeCustomComponent,
+		TypeThreadReady,
+	}
+	r := NewSchemaRegistry()
+	for _, typ := range types {
+		if !r.Has(typ) {
+			t.Errorf("no builtin schema for %s", typ)
+		}
+	}
+}
+
+func TestSchemaValidate(t *testing.T) {
+	r := NewSchemaRegistry()
+
+	ok := Event{Type: TypeMessageDelta, Payload: []byte(`{"message_id":"m1","delta":"hi"}`)}
+	if err := r.Validate(ok); err != nil {
+		t.Fatalf("expected ok, got %v", err)
+	}
+
+	bad := Event{Type: TypeMessageDelta, Payload: []byte(`{"delta":1}`)}
+	err := r.Validate(bad)
+	var pve *PayloadValidationError
+	if !errors.As(err, &pve) {
+		t.Fatalf("expected PayloadValidationError, got %v", err)
+	}
+	if len(pve.Issues) != 2 || pve.Issues[0].Path != "/message_id" || pve.Issues[1].Path != "/delta" {
+		t.Fatalf("unexpected issues: %+v", pve.Issues)
+	}
+
+	if err := r.Validate(Event{Type: TypeToolCallCompleted, Payload: []byte(`{"result":"x"}`)}); err == nil {
+		t.Fatalf("expected tool.call.completed without tool to fail")
+	}
+	if err := r.Validate(Event{Type: "unknown.type", Payload: []byte(`"anything"`)}); err != nil {
+		t.Fatalf("unknown types should pass, got %v", err)
+	}
+}
+
+func TestSchemaRegisterCustom(t *testing.T) {
+	r := NewSchemaRegistry()
+	if err := r.Register("app.rating", []byte(`{"type":"object","required":["score"],"additionalProperties":false,"properties":{"score":{"type":"integer"}}}`)); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if err := r.Validate(Event{Type: "app.rating", Payload: []byte(`{"score":5}`)}); err != nil {
+		t.Fatalf("expected ok, got %v", err)
+	}
+	if err := r.Validate(Event{Type: "app.rating", Payload: []byte(`{"score":4.5,"extra":true}`)}); err == nil {
+		t.Fatalf("expected error")
+	}
+	if err := r.Register("app.bad", []byte(`{"type":1}`)); err == nil {
+		t.Fatalf("expected invalid schema to be rejected")
+	}
+}
@@ -0,0 +1,123 @@
+package eventide
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// Keys of Event.Trace filled from W3C trace context.
+const (
+	TraceKeyTraceID    = "trace_id"
+	TraceKeySpanID     = "span_id"
+	TraceKeyTraceFlags = "trace_flags"
+	TraceKeyTraceState = "tracestate"
+)
+
+// TraceContext is a W3C trace context (traceparent and tracestate headers).
+type TraceContext struct {
+	TraceID    string
+	SpanID     string
+	TraceFlags string
+	TraceState string
+}
+
+// ParseTraceparent parses a version 00 traceparent header value.
+func ParseTraceparent(v string) (TraceContext, bool) {
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return TraceContext{}, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return TraceContext{}, false
+	}
+	tc := TraceContext{TraceID: parts[1], SpanID: parts[2], TraceFlags: parts[3]}
+	if !isLowerHex(tc.TraceID, 32) || !isLowerHex(tc.SpanID, 16) || !isLowerHex(tc.TraceFlags, 2) {
+		return TraceContext{}, false
+	}
+	if strings.Trim(tc.TraceID, "0") == "" || strings.Trim(tc.SpanID, "0") == "" {
+		return TraceContext{}, false
+	}
+	return tc, true
+}
+
+// TraceContextFromHeaders reads traceparent and tracestate from h.
+func TraceContextFromHeaders(h http.Header) (TraceContext, bool) {
+	tc, ok := ParseTraceparent(h.Get("traceparent"))
+	if !ok {
+		return TraceContext{}, false
+	}
+	tc.TraceState = strings.TrimSpace(h.Get("tracestate"))
+	return tc, true
+}
+
+// IsValidTraceID reports whether id is a non-zero 32 character lowercase hex
+// trace ID.
+func IsValidTraceID(id string) bool {
+	return isLowerHex(id, 32) && strings.Trim(id, "0") != ""
+}
+
+func (tc TraceContext) Traceparent() string {
+	flags := tc.TraceFlags
+	if flags == "" {
+		flags = "01"
+	}
+	return "00-" + tc.TraceID + "-" + tc.SpanID + "-" + flags
+}
+
+// Inject writes tc as traceparent and tracestate headers.
+func (tc TraceContext) Inject(h http.Header) {
+	h.Set("traceparent", tc.Traceparent())
+	if tc.TraceState != "" {
+		h.Set("tracestate", tc.TraceState)
+	}
+}
+
+// Map returns tc in the shape stored in Event.Trace.
+func (tc TraceContext) Map() map[string]any {
+	m := map[string]any{TraceKeyTraceID: tc.TraceID, TraceKeySpanID: tc.SpanID}
+	if tc.TraceFlags != "" {
+		m[TraceKeyTraceFlags] = tc.TraceFlags
+	}
+	if tc.TraceState != "" {
+		m[TraceKeyTraceState] = tc.TraceState
+	}
+	return m
+}
+
+type traceContextKey struct{}
+
+// WithTraceContext returns a context carrying tc. Client requests made with
+// it send tc as W3C trace headers.
+func WithTraceContext(ctx context.Context, tc TraceContext) context.Context {
+	return context.WithValue(ctx, traceContextKey{}, tc)
+}
+
+// TraceContextFromContext returns the trace context set by WithTraceContext.
+func TraceContextFromContext(ctx context.Context) (TraceContext, bool) {
+	tc, ok := ctx.Value(traceContextKey{}).(TraceContext)
+	return tc, ok && tc.TraceID != ""
+}
+
+// TraceInjector writes the trace context of ctx into outgoing request
+// headers. Use it to plug in a tracing library's propagator.
+type TraceInjector func(ctx context.Context, h http.Header)
+
+func injectContextTrace(ctx context.Context, h http.Header) {
+	if tc, ok := TraceContextFromContext(ctx); ok {
+		tc.Inject(h)
+	}
+}
+
+func isLowerHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,46 @@
+package eventide
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tc, ok := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if !ok || tc.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || tc.SpanID != "00f067aa0ba902b7" || tc.TraceFlags != "01" {
+		t.Fatalf("unexpected parse: %+v ok=%v", tc, ok)
+	}
+	for _, bad := range []string{
+		"",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		if _, ok := ParseTraceparent(bad); ok {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestAppendInjectsTraceContext(t *testing.T) {
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("traceparent")
+		w.Header().Set("content-type", "application/json")
+		_, _ = w.Write([]byte(`{"event_id":"e1","seq":1}`))
+	}))
+	defer srv.Close()
+
+	tc := TraceContext{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7", TraceFlags: "01"}
+	ctx := WithTraceContext(context.Background(), tc)
+	if _, err := NewClient(srv.URL).Append(ctx, Event{ThreadID: "th", TurnID: "tu"}); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	if got != tc.Traceparent() {
+		t.Fatalf("traceparent = %q, want %q", got, tc.Traceparent())
+	}
+}